@@ -30,7 +30,18 @@ func NewCmdStart() *cobra.Command {
 
 			printConfig()
 
-			if cfg.ClientID == "" || cfg.ClientSecret == "" || cfg.TenantID == "" || cfg.SubscriptionID == "" {
+			// Azure credentials are only needed to manage Service Bus or Azure Batch resources
+			usesAzure := (cfg.AMQP == nil && cfg.NATS == nil && cfg.Redis == nil) || cfg.AzureBatch != nil
+			if usesAzure && (cfg.ClientID == "" || cfg.ClientSecret == "" || cfg.TenantID == "" || cfg.SubscriptionID == "") {
+				return errConfigurationMissing
+			}
+			if cfg.AMQP != nil && cfg.AMQP.ConnectionString == "" {
+				return errConfigurationMissing
+			}
+			if cfg.NATS != nil && cfg.NATS.URL == "" {
+				return errConfigurationMissing
+			}
+			if cfg.Redis != nil && cfg.Redis.URL == "" {
 				return errConfigurationMissing
 			}
 			if cfg.Job == nil {
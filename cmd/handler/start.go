@@ -29,6 +29,19 @@ func NewStartCommand() *cobra.Command {
 				handlerConfig.AzureBlobStorageProvider.BlobAccountName = handlerCmdConfig.GetString("azureblobprovider.blobaccountname")
 				handlerConfig.AzureBlobStorageProvider.BlobAccountKey = handlerCmdConfig.GetString("azureblobprovider.blobaccountkey")
 				handlerConfig.AzureBlobStorageProvider.ContainerName = handlerCmdConfig.GetString("azureblobprovider.containername")
+				handlerConfig.AzureBlobStorageProvider.BlobEndpoint = handlerCmdConfig.GetString("azureblobprovider.blobendpoint")
+			}
+
+			handlerConfig.S3BlobStorageProvider.Enabled = handlerCmdConfig.GetBool("s3provider.enabled")
+			if handlerConfig.S3BlobStorageProvider.Enabled {
+				handlerConfig.S3BlobStorageProvider.Endpoint = handlerCmdConfig.GetString("s3provider.endpoint")
+				handlerConfig.S3BlobStorageProvider.Region = handlerCmdConfig.GetString("s3provider.region")
+				handlerConfig.S3BlobStorageProvider.Bucket = handlerCmdConfig.GetString("s3provider.bucket")
+				handlerConfig.S3BlobStorageProvider.AccessKeyID = handlerCmdConfig.GetString("s3provider.accesskeyid")
+				handlerConfig.S3BlobStorageProvider.SecretAccessKey = handlerCmdConfig.GetString("s3provider.secretaccesskey")
+				handlerConfig.S3BlobStorageProvider.UsePathStyle = handlerCmdConfig.GetBool("s3provider.usepathstyle")
+				handlerConfig.S3BlobStorageProvider.Parallelism = handlerCmdConfig.GetInt("s3provider.parallelism")
+				handlerConfig.S3BlobStorageProvider.PresignExpiryMins = handlerCmdConfig.GetInt("s3provider.presignexpirymins")
 			}
 
 			handlerConfig.MongoDBDocumentStorageProvider.Enabled = handlerCmdConfig.GetBool("mongodbdocprovider.enabled")
@@ -47,6 +60,22 @@ func NewStartCommand() *cobra.Command {
 				handlerConfig.ServiceBusEventProvider.AuthorizationRuleName = handlerCmdConfig.GetString("servicebuseventprovider.authorizationrulename")
 			}
 
+			handlerConfig.AMQPEventProvider.Enabled = handlerCmdConfig.GetBool("amqpeventprovider.enabled")
+			if handlerConfig.AMQPEventProvider.Enabled {
+				handlerConfig.AMQPEventProvider.ConnectionString = handlerCmdConfig.GetString("amqpeventprovider.connectionstring")
+				handlerConfig.AMQPEventProvider.TopicAddress = handlerCmdConfig.GetString("amqpeventprovider.topicaddress")
+			}
+
+			handlerConfig.NATSEventProvider.Enabled = handlerCmdConfig.GetBool("natseventprovider.enabled")
+			if handlerConfig.NATSEventProvider.Enabled {
+				handlerConfig.NATSEventProvider.URL = handlerCmdConfig.GetString("natseventprovider.url")
+			}
+
+			handlerConfig.RedisEventProvider.Enabled = handlerCmdConfig.GetBool("rediseventprovider.enabled")
+			if handlerConfig.RedisEventProvider.Enabled {
+				handlerConfig.RedisEventProvider.URL = handlerCmdConfig.GetString("rediseventprovider.url")
+			}
+
 			handlerConfig.Context.Name = handlerCmdConfig.GetString("context.name")
 			handlerConfig.Context.EventID = handlerCmdConfig.GetString("context.eventid")
 			handlerConfig.Context.CorrelationID = handlerCmdConfig.GetString("context.correlationid")
@@ -99,19 +128,49 @@ func NewStartCommand() *cobra.Command {
 	flags.String("azureblobprovider.blobaccountname", "", "Azure Blob Storage account name")
 	handlerCmdConfig.BindPFlag("azureblobprovider.blobaccountname", flags.Lookup("azureblobprovider.blobaccountname"))
 
-	flags.String("azureblobprovider.blobaccountkey", "", "Azure Blob Storage account key")
+	flags.String("azureblobprovider.blobaccountkey", "", "Azure Blob Storage account key, prefer setting AZUREBLOBPROVIDER_BLOBACCOUNTKEY in the environment")
 	handlerCmdConfig.BindPFlag("azureblobprovider.blobaccountkey", flags.Lookup("azureblobprovider.blobaccountkey"))
 
 	flags.String("azureblobprovider.containername", "", "Azure Blob Storage container name")
 	handlerCmdConfig.BindPFlag("azureblobprovider.containername", flags.Lookup("azureblobprovider.containername"))
 
+	flags.String("azureblobprovider.blobendpoint", "", "Azure Blob Storage endpoint for sovereign clouds or the Azurite emulator, defaults to https://<account>.blob.core.windows.net")
+	handlerCmdConfig.BindPFlag("azureblobprovider.blobendpoint", flags.Lookup("azureblobprovider.blobendpoint"))
+
+	flags.Bool("s3provider.enabled", false, "Enable S3 compatible blob storage provider")
+	handlerCmdConfig.BindPFlag("s3provider.enabled", flags.Lookup("s3provider.enabled"))
+
+	flags.String("s3provider.endpoint", "", "S3 endpoint url, e.g. https://s3.eu-west-1.amazonaws.com or http://localhost:9000 for MinIO")
+	handlerCmdConfig.BindPFlag("s3provider.endpoint", flags.Lookup("s3provider.endpoint"))
+
+	flags.String("s3provider.region", "us-east-1", "S3 region used to sign requests")
+	handlerCmdConfig.BindPFlag("s3provider.region", flags.Lookup("s3provider.region"))
+
+	flags.String("s3provider.bucket", "", "S3 bucket name")
+	handlerCmdConfig.BindPFlag("s3provider.bucket", flags.Lookup("s3provider.bucket"))
+
+	flags.String("s3provider.accesskeyid", "", "S3 access key ID")
+	handlerCmdConfig.BindPFlag("s3provider.accesskeyid", flags.Lookup("s3provider.accesskeyid"))
+
+	flags.String("s3provider.secretaccesskey", "", "S3 secret access key, prefer setting S3PROVIDER_SECRETACCESSKEY in the environment")
+	handlerCmdConfig.BindPFlag("s3provider.secretaccesskey", flags.Lookup("s3provider.secretaccesskey"))
+
+	flags.Bool("s3provider.usepathstyle", false, "Address the bucket in the url's path rather than its host, as MinIO and Ceph expect")
+	handlerCmdConfig.BindPFlag("s3provider.usepathstyle", flags.Lookup("s3provider.usepathstyle"))
+
+	flags.Int("s3provider.parallelism", 0, "Number of parts of a multipart upload sent at once, defaults to the number of CPUs")
+	handlerCmdConfig.BindPFlag("s3provider.parallelism", flags.Lookup("s3provider.parallelism"))
+
+	flags.Int("s3provider.presignexpirymins", 1440, "Minutes the presigned urls in event metadata are valid for, at most 10080")
+	handlerCmdConfig.BindPFlag("s3provider.presignexpirymins", flags.Lookup("s3provider.presignexpirymins"))
+
 	flags.Bool("mongodbdocprovider.enabled", false, "Enable MongoDB Metadata provider")
 	handlerCmdConfig.BindPFlag("mongodbdocprovider.enabled", flags.Lookup("mongodbdocprovider.enabled"))
 
 	flags.String("mongodbdocprovider.name", "", "MongoDB database name")
 	handlerCmdConfig.BindPFlag("mongodbdocprovider.name", flags.Lookup("mongodbdocprovider.name"))
 
-	flags.String("mongodbdocprovider.password", "", "MongoDB database password")
+	flags.String("mongodbdocprovider.password", "", "MongoDB database password, prefer setting MONGODBDOCPROVIDER_PASSWORD in the environment")
 	handlerCmdConfig.BindPFlag("mongodbdocprovider.password", flags.Lookup("mongodbdocprovider.password"))
 
 	flags.String("mongodbdocprovider.collection", "", "MongoDB database collection to use")
@@ -129,11 +188,32 @@ func NewStartCommand() *cobra.Command {
 	flags.String("servicebuseventprovider.topic", "", "ServiceBus topic name")
 	handlerCmdConfig.BindPFlag("servicebuseventprovider.topic", flags.Lookup("servicebuseventprovider.topic"))
 
-	flags.String("servicebuseventprovider.key", "", "ServiceBus access key")
+	flags.String("servicebuseventprovider.key", "", "ServiceBus access key, prefer setting SERVICEBUSEVENTPROVIDER_KEY in the environment")
 	handlerCmdConfig.BindPFlag("servicebuseventprovider.key", flags.Lookup("servicebuseventprovider.key"))
 
 	flags.String("servicebuseventprovider.authorizationrulename", "", "ServiceBus authorization rule name")
 	handlerCmdConfig.BindPFlag("servicebuseventprovider.authorizationrulename", flags.Lookup("servicebuseventprovider.authorizationrulename"))
 
+	flags.Bool("amqpeventprovider.enabled", false, "Enable AMQP 1.0 Event provider")
+	handlerCmdConfig.BindPFlag("amqpeventprovider.enabled", flags.Lookup("amqpeventprovider.enabled"))
+
+	flags.String("amqpeventprovider.connectionstring", "", "AMQP broker connection string, prefer setting AMQPEVENTPROVIDER_CONNECTIONSTRING in the environment")
+	handlerCmdConfig.BindPFlag("amqpeventprovider.connectionstring", flags.Lookup("amqpeventprovider.connectionstring"))
+
+	flags.String("amqpeventprovider.topicaddress", "", "Address events are sent to, {topic} is replaced with the event type")
+	handlerCmdConfig.BindPFlag("amqpeventprovider.topicaddress", flags.Lookup("amqpeventprovider.topicaddress"))
+
+	flags.Bool("natseventprovider.enabled", false, "Enable NATS JetStream Event provider")
+	handlerCmdConfig.BindPFlag("natseventprovider.enabled", flags.Lookup("natseventprovider.enabled"))
+
+	flags.String("natseventprovider.url", "", "NATS server url, prefer setting NATSEVENTPROVIDER_URL in the environment")
+	handlerCmdConfig.BindPFlag("natseventprovider.url", flags.Lookup("natseventprovider.url"))
+
+	flags.Bool("rediseventprovider.enabled", false, "Enable Redis Streams Event provider")
+	handlerCmdConfig.BindPFlag("rediseventprovider.enabled", flags.Lookup("rediseventprovider.enabled"))
+
+	flags.String("rediseventprovider.url", "", "Redis server url, prefer setting REDISEVENTPROVIDER_URL in the environment")
+	handlerCmdConfig.BindPFlag("rediseventprovider.url", flags.Lookup("rediseventprovider.url"))
+
 	return cmd
 }
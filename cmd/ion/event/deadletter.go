@@ -0,0 +1,96 @@
+package event
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/lawrencegripper/ion/internal/pkg/servicebus"
+	"github.com/spf13/cobra"
+	"pack.ag/amqp"
+)
+
+type deadLetterOptions struct {
+	moduleName string
+	eventType  string
+	max        int
+	wait       int
+}
+
+var deadLetterOpts deadLetterOptions
+
+// deadLetterCmd represents the deadletter command
+var deadLetterCmd = &cobra.Command{
+	Use:   "deadletter",
+	Short: "inspect and replay the events a module has dead lettered",
+	RunE:  Event,
+}
+
+// receiveDeadLetters locks the messages in the module's dead letter queue, calling handle with each one.
+// handle returns true if it settled the message, the others are released back to the queue once
+// every message has been handled so none are received twice
+func receiveDeadLetters(handle func(deadLetter *servicebus.DeadLetter) (bool, error)) error {
+	receiver, err := amqpSession.NewReceiver(
+		amqp.LinkSourceAddress(servicebus.GetDeadLetterAmqpPath(deadLetterOpts.eventType, deadLetterOpts.moduleName)),
+		amqp.LinkCredit(100),
+	)
+	if err != nil {
+		return fmt.Errorf("error creating receiver link: %+v", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(deadLetterOpts.wait)*time.Second)
+		receiver.Close(ctx) //nolint: errcheck
+		cancel()
+	}()
+
+	deadLetters, err := servicebus.ReceiveDeadLetters(context.Background(), receiver, deadLetterOpts.max, time.Duration(deadLetterOpts.wait)*time.Second)
+	var unsettled []*servicebus.DeadLetter
+	for _, deadLetter := range deadLetters {
+		settled := false
+		if err == nil {
+			settled, err = handle(deadLetter)
+		}
+		if !settled {
+			unsettled = append(unsettled, deadLetter)
+		}
+	}
+	for _, deadLetter := range unsettled {
+		// Hand the message back without counting a delivery
+		deadLetter.Modify(false, false, nil) //nolint: errcheck
+	}
+	return err
+}
+
+// selectedIDs gets the set of message IDs chosen with --message-id, returning an error unless some were chosen or all is set
+func selectedIDs(ids []string, all bool) (map[string]bool, error) {
+	if len(ids) == 0 && !all {
+		return nil, fmt.Errorf("choose the dead lettered events with --message-id or use --all")
+	}
+	selected := map[string]bool{}
+	for _, id := range ids {
+		selected[id] = true
+	}
+	return selected, nil
+}
+
+// registerDeadLetter adds the deadletter commands to the event command
+func registerDeadLetter() {
+	deadLetterCmd.AddCommand(deadLetterListCmd)
+	deadLetterCmd.AddCommand(deadLetterShowCmd)
+	deadLetterCmd.AddCommand(deadLetterReplayCmd)
+	deadLetterCmd.AddCommand(deadLetterPurgeCmd)
+	eventCmd.AddCommand(deadLetterCmd)
+}
+
+func init() {
+
+	// Flags shared by the deadletter commands
+	deadLetterCmd.PersistentFlags().StringVar(&deadLetterOpts.moduleName, "module", "", "the name of the module whose dead lettered events to use")
+	deadLetterCmd.PersistentFlags().StringVar(&deadLetterOpts.eventType, "event-type", "", "the event type the module subscribes to")
+	deadLetterCmd.PersistentFlags().IntVar(&deadLetterOpts.max, "max", 0, "the most dead lettered events to read, 0 for all")
+	deadLetterCmd.PersistentFlags().IntVar(&deadLetterOpts.wait, "wait", 5, "seconds to wait for the next dead lettered event before stopping")
+
+	// Mark required flags
+	deadLetterCmd.MarkPersistentFlagRequired("module")     //nolint: errcheck
+	deadLetterCmd.MarkPersistentFlagRequired("event-type") //nolint: errcheck
+}
@@ -0,0 +1,39 @@
+package event
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/lawrencegripper/ion/internal/pkg/servicebus"
+	"github.com/spf13/cobra"
+)
+
+// deadLetterListCmd represents the deadletter list command
+var deadLetterListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list the events a module has dead lettered, leaving them in the dead letter queue",
+	RunE:  DeadLetterList,
+}
+
+// DeadLetterList lists the module's dead lettered events with the reason each failed
+func DeadLetterList(cmd *cobra.Command, args []string) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "MESSAGE ID\tCORRELATION ID\tDELIVERIES\tREASON") //nolint: errcheck
+	count := 0
+	err := receiveDeadLetters(func(deadLetter *servicebus.DeadLetter) (bool, error) {
+		correlationID := ""
+		if event, err := deadLetter.Event(); err == nil && event.Context != nil {
+			correlationID = event.Context.CorrelationID
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", deadLetter.ID(), correlationID, deadLetter.DeliveryCount(), deadLetter.Reason()) //nolint: errcheck
+		count++
+		return false, nil
+	})
+	w.Flush() //nolint: errcheck
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d dead lettered event(s)\n", count)
+	return nil
+}
@@ -0,0 +1,52 @@
+package event
+
+import (
+	"fmt"
+
+	"github.com/lawrencegripper/ion/internal/pkg/servicebus"
+	"github.com/spf13/cobra"
+)
+
+type deadLetterPurgeOptions struct {
+	messageIDs []string
+	all        bool
+}
+
+var deadLetterPurgeOpts deadLetterPurgeOptions
+
+// deadLetterPurgeCmd represents the deadletter purge command
+var deadLetterPurgeCmd = &cobra.Command{
+	Use:   "purge",
+	Short: "remove dead lettered events from a module's dead letter queue",
+	RunE:  DeadLetterPurge,
+}
+
+// DeadLetterPurge removes the chosen events from the module's dead letter queue
+func DeadLetterPurge(cmd *cobra.Command, args []string) error {
+	selected, err := selectedIDs(deadLetterPurgeOpts.messageIDs, deadLetterPurgeOpts.all)
+	if err != nil {
+		return err
+	}
+
+	count := 0
+	err = receiveDeadLetters(func(deadLetter *servicebus.DeadLetter) (bool, error) {
+		if !deadLetterPurgeOpts.all && !selected[deadLetter.ID()] {
+			return false, nil
+		}
+		if err := deadLetter.Accept(); err != nil {
+			return false, fmt.Errorf("error removing dead lettered event '%s': %+v", deadLetter.ID(), err)
+		}
+		fmt.Printf("purged %s\n", deadLetter.ID())
+		count++
+		return true, nil
+	})
+	fmt.Printf("purged %d dead lettered event(s)\n", count)
+	return err
+}
+
+func init() {
+
+	// Local flags for the purge command
+	deadLetterPurgeCmd.Flags().StringSliceVar(&deadLetterPurgeOpts.messageIDs, "message-id", nil, "the IDs of the dead lettered events to remove")
+	deadLetterPurgeCmd.Flags().BoolVar(&deadLetterPurgeOpts.all, "all", false, "remove every dead lettered event")
+}
@@ -0,0 +1,79 @@
+package event
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lawrencegripper/ion/internal/pkg/servicebus"
+	"github.com/spf13/cobra"
+	"pack.ag/amqp"
+)
+
+type deadLetterReplayOptions struct {
+	messageIDs    []string
+	all           bool
+	deliveryCount int
+}
+
+var deadLetterReplayOpts deadLetterReplayOptions
+
+// deadLetterReplayCmd represents the deadletter replay command
+var deadLetterReplayCmd = &cobra.Command{
+	Use:   "replay",
+	Short: "resubmit dead lettered events to the module",
+	RunE:  DeadLetterReplay,
+}
+
+// DeadLetterReplay sends the chosen events back to the topic, to be delivered to the module again,
+// then removes them from the dead letter queue
+func DeadLetterReplay(cmd *cobra.Command, args []string) error {
+	selected, err := selectedIDs(deadLetterReplayOpts.messageIDs, deadLetterReplayOpts.all)
+	if err != nil {
+		return err
+	}
+
+	sender, err := amqpSession.NewSender(
+		amqp.LinkTargetAddress("/" + strings.ToLower(deadLetterOpts.eventType)),
+	)
+	if err != nil {
+		return fmt.Errorf("error creating sender link: %+v", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(deadLetterOpts.wait)*time.Second)
+		sender.Close(ctx) //nolint: errcheck
+		cancel()
+	}()
+
+	count := 0
+	err = receiveDeadLetters(func(deadLetter *servicebus.DeadLetter) (bool, error) {
+		if !deadLetterReplayOpts.all && !selected[deadLetter.ID()] {
+			return false, nil
+		}
+		replay := servicebus.NewReplayMessage(deadLetter, deadLetterOpts.eventType, deadLetterOpts.moduleName, deadLetterReplayOpts.deliveryCount)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(deadLetterOpts.wait)*time.Second)
+		err := sender.Send(ctx, replay)
+		cancel()
+		if err != nil {
+			return false, fmt.Errorf("error resubmitting dead lettered event '%s': %+v", deadLetter.ID(), err)
+		}
+		// The event has been resubmitted so a failure here leaves a copy in the dead letter queue
+		if err := deadLetter.Accept(); err != nil {
+			return false, fmt.Errorf("resubmitted dead lettered event '%s' but failed to remove it: %+v", deadLetter.ID(), err)
+		}
+		fmt.Printf("replayed %s\n", deadLetter.ID())
+		count++
+		return true, nil
+	})
+	fmt.Printf("replayed %d dead lettered event(s)\n", count)
+	return err
+}
+
+func init() {
+
+	// Local flags for the replay command
+	deadLetterReplayCmd.Flags().StringSliceVar(&deadLetterReplayOpts.messageIDs, "message-id", nil, "the IDs of the dead lettered events to resubmit")
+	deadLetterReplayCmd.Flags().BoolVar(&deadLetterReplayOpts.all, "all", false, "resubmit every dead lettered event")
+	deadLetterReplayCmd.Flags().IntVar(&deadLetterReplayOpts.deliveryCount, "delivery-count", -1, "the number of attempts to treat each event as having already had, -1 to keep the retries recorded on the event")
+}
@@ -0,0 +1,114 @@
+package event
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/lawrencegripper/ion/cmd/ion/root"
+	"github.com/lawrencegripper/ion/internal/app/handler/dataplane/documentstorage"
+	"github.com/lawrencegripper/ion/internal/pkg/common"
+	"github.com/lawrencegripper/ion/internal/pkg/management/trace"
+	"github.com/lawrencegripper/ion/internal/pkg/servicebus"
+	"github.com/spf13/cobra"
+)
+
+type deadLetterShowOptions struct {
+	logs bool
+}
+
+var deadLetterShowOpts deadLetterShowOptions
+
+// deadLetterShowCmd represents the deadletter show command
+var deadLetterShowCmd = &cobra.Command{
+	Use:   "show [message id]",
+	Short: "show a dead lettered event with the reason it failed and the module's logs",
+	Args:  cobra.ExactArgs(1),
+	RunE:  DeadLetterShow,
+}
+
+// DeadLetterShow prints a dead lettered event, leaving it in the dead letter queue
+func DeadLetterShow(cmd *cobra.Command, args []string) error {
+	messageID := args[0]
+	var found *servicebus.DeadLetter
+	err := receiveDeadLetters(func(deadLetter *servicebus.DeadLetter) (bool, error) {
+		if found == nil && deadLetter.ID() == messageID {
+			found = deadLetter
+		}
+		return false, nil
+	})
+	if err != nil {
+		return err
+	}
+	if found == nil {
+		return fmt.Errorf("no dead lettered event with message ID '%s'", messageID)
+	}
+
+	fmt.Printf("message ID: %s\n", found.ID())
+	fmt.Printf("deliveries: %d\n", found.DeliveryCount())
+	fmt.Printf("reason:     %s\n", found.Reason())
+	fmt.Println(string(found.GetData()))
+
+	if !deadLetterShowOpts.logs {
+		return nil
+	}
+	event, err := found.Event()
+	if err != nil || event.Context == nil {
+		return fmt.Errorf("unable to find module logs without the event's context: %+v", err)
+	}
+	moduleLogs, err := getModuleLogs(event.Context)
+	if err != nil {
+		return fmt.Errorf("failed to get module logs: %+v", err)
+	}
+	if len(moduleLogs) == 0 {
+		fmt.Println("no module logs found")
+	}
+	for _, logs := range moduleLogs {
+		fmt.Printf("%s succeeded: %t logs: %s\n", logs.Description, logs.Succeeded, logs.Logs)
+	}
+	return nil
+}
+
+// getModuleLogs gets the logs the dispatcher stored for each of the module's attempts at the event
+// from the management server
+func getModuleLogs(eventContext *common.Context) ([]documentstorage.ModuleLogs, error) {
+	conn, err := root.GetManagementConnection()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close() //nolint: errcheck
+
+	response, err := trace.NewTraceServiceClient(conn).GetFlow(context.Background(), &trace.GetFlowRequest{
+		CorrelationID: eventContext.CorrelationID,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var documents []struct {
+		documentstorage.ModuleLogs
+		Context *common.Context `json:"context"`
+	}
+	if err := json.Unmarshal([]byte(response.FlowJSON), &documents); err != nil {
+		return nil, fmt.Errorf("error decoding flow: %+v", err)
+	}
+	var moduleLogs []documentstorage.ModuleLogs
+	for _, document := range documents {
+		if document.Context == nil || document.Context.DocumentType != common.ModuleLogsDocType {
+			continue
+		}
+		if document.Context.EventID != eventContext.EventID || !strings.EqualFold(document.Context.Name, deadLetterOpts.moduleName) {
+			continue
+		}
+		document.ModuleLogs.Context = document.Context
+		moduleLogs = append(moduleLogs, document.ModuleLogs)
+	}
+	return moduleLogs, nil
+}
+
+func init() {
+
+	// Local flags for the show command
+	deadLetterShowCmd.Flags().BoolVar(&deadLetterShowOpts.logs, "logs", true, "get the module's logs for the event from the management server")
+}
@@ -50,6 +50,7 @@ func Register() {
 	eventCmd.AddCommand(createCmd)
 	eventCmd.AddCommand(peekCmd)
 	eventCmd.AddCommand(getCmd)
+	registerDeadLetter()
 
 	// Add event command to root
 	root.RootCmd.AddCommand(eventCmd)
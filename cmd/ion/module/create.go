@@ -20,6 +20,15 @@ type createOptions struct {
 	moduleImage          string
 	handlerImage         string
 	maxExecutionTimeMins int32
+	cpuRequest           string
+	cpuLimit             string
+	memoryRequest        string
+	memoryLimit          string
+	gpuCount             int32
+	nodeSelector         []string
+	tolerations          []string
+	affinity             string
+	serviceAccountName   string
 }
 
 var createOpts createOptions
@@ -54,6 +63,15 @@ func Create(cmd *cobra.Command, args []string) error {
 		Retrycount:           createOpts.retryCount,
 		Provider:             createOpts.provider,
 		Configmap:            configMap,
+		Cpurequest:           createOpts.cpuRequest,
+		Cpulimit:             createOpts.cpuLimit,
+		Memoryrequest:        createOpts.memoryRequest,
+		Memorylimit:          createOpts.memoryLimit,
+		Gpucount:             createOpts.gpuCount,
+		Nodeselector:         createOpts.nodeSelector,
+		Tolerations:          createOpts.tolerations,
+		Affinity:             createOpts.affinity,
+		Serviceaccountname:   createOpts.serviceAccountName,
 	}
 
 	fmt.Println("creating module")
@@ -78,6 +96,15 @@ func init() {
 	createCmd.Flags().Int32Var(&createOpts.instanceCount, "instance-count", 1, "the number of dispatcher instance to create")
 	createCmd.Flags().Int32Var(&createOpts.retryCount, "retry-count", 1, "the number of dispatcher instance to create")
 	createCmd.Flags().Int32Var(&createOpts.maxExecutionTimeMins, "max-exec-mins", 5, "the maximum number of minutes the job can run for")
+	createCmd.Flags().StringVar(&createOpts.cpuRequest, "cpu-request", "", "the cpu requested by the module's container e.g. 500m (Kubernetes only)")
+	createCmd.Flags().StringVar(&createOpts.cpuLimit, "cpu-limit", "", "the cpu limit for the module's container e.g. 2 (Kubernetes only)")
+	createCmd.Flags().StringVar(&createOpts.memoryRequest, "memory-request", "", "the memory requested by the module's container e.g. 512Mi (Kubernetes only)")
+	createCmd.Flags().StringVar(&createOpts.memoryLimit, "memory-limit", "", "the memory limit for the module's container e.g. 2Gi (Kubernetes only)")
+	createCmd.Flags().Int32Var(&createOpts.gpuCount, "gpu-count", 0, "the number of nvidia GPUs for the module's container (Kubernetes only)")
+	createCmd.Flags().StringSliceVar(&createOpts.nodeSelector, "node-selector", []string{}, "node selector for the module's jobs in the form key=value (Kubernetes only)")
+	createCmd.Flags().StringSliceVar(&createOpts.tolerations, "toleration", []string{}, "toleration for the module's jobs in the form key[=value]:effect (Kubernetes only)")
+	createCmd.Flags().StringVar(&createOpts.affinity, "affinity", "", "JSON encoded affinity for the module's jobs (Kubernetes only)")
+	createCmd.Flags().StringVar(&createOpts.serviceAccountName, "service-account", "", "the service account used by the module's jobs (Kubernetes only)")
 
 	// Mark requried flags
 	createCmd.MarkFlagRequired("name")                //nolint: errcheck
@@ -0,0 +1,33 @@
+package dispatcher
+
+import (
+	"strings"
+	"time"
+
+	"github.com/lawrencegripper/ion/internal/app/handler/dataplane/documentstorage"
+	"github.com/lawrencegripper/ion/internal/pkg/common"
+)
+
+// ProcessedEventStore looks up the records the handler keeps of the events each module has finished processing
+type ProcessedEventStore interface {
+	GetProcessedEvent(id string) (*documentstorage.ProcessedEvent, error)
+}
+
+// findProcessed gets the record of the module having processed the event, if it was processed within the
+// dedup window. Events processed before the window, or not processed at all, return nil
+func findProcessed(store ProcessedEventStore, moduleName string, event common.Event, window time.Duration) (*documentstorage.ProcessedEvent, error) {
+	if event.Context == nil || event.Context.EventID == "" {
+		return nil, nil
+	}
+	processed, err := store.GetProcessedEvent(documentstorage.GetProcessedEventID(moduleName, event.Context.EventID))
+	if err != nil {
+		if strings.HasPrefix(err.Error(), documentstorage.NotFoundErr) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if time.Since(processed.ProcessedAt) > window {
+		return nil, nil
+	}
+	return processed, nil
+}
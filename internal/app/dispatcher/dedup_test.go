@@ -0,0 +1,79 @@
+package dispatcher
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/lawrencegripper/ion/internal/app/handler/dataplane/documentstorage"
+	"github.com/lawrencegripper/ion/internal/app/handler/dataplane/documentstorage/inmemory"
+	"github.com/lawrencegripper/ion/internal/pkg/common"
+)
+
+func newProcessedStore(moduleName, eventID string, processedAt time.Time) *inmemory.InMemoryDB {
+	store := &inmemory.InMemoryDB{}
+	_ = store.CreateProcessedEvent(&documentstorage.ProcessedEvent{
+		Context:     &common.Context{Name: moduleName, EventID: eventID},
+		ID:          documentstorage.GetProcessedEventID(moduleName, eventID),
+		ProcessedAt: processedAt,
+	})
+	return store
+}
+
+func newEventWithID(eventID string) common.Event {
+	return common.Event{Context: &common.Context{EventID: eventID}}
+}
+
+func TestFindProcessed_WithinWindow(t *testing.T) {
+	store := newProcessedStore("counter", "event1", time.Now().Add(-time.Minute))
+
+	processed, err := findProcessed(store, "counter", newEventWithID("event1"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if processed == nil {
+		t.Error("expected event processed within the window to be found")
+	}
+}
+
+func TestFindProcessed_IgnoresOtherModulesAndEvents(t *testing.T) {
+	store := newProcessedStore("counter", "event1", time.Now())
+
+	for _, test := range []struct{ moduleName, eventID string }{
+		{"downloader", "event1"},
+		{"counter", "event2"},
+	} {
+		processed, err := findProcessed(store, test.moduleName, newEventWithID(test.eventID), time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if processed != nil {
+			t.Errorf("expected %s not to have processed %s", test.moduleName, test.eventID)
+		}
+	}
+}
+
+func TestFindProcessed_OutsideWindow(t *testing.T) {
+	store := newProcessedStore("counter", "event1", time.Now().Add(-time.Hour*2))
+
+	processed, err := findProcessed(store, "counter", newEventWithID("event1"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if processed != nil {
+		t.Error("expected event processed before the window to be dispatched again")
+	}
+}
+
+type failingStore struct{}
+
+func (s failingStore) GetProcessedEvent(id string) (*documentstorage.ProcessedEvent, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestFindProcessed_ReturnsStoreErrors(t *testing.T) {
+	_, err := findProcessed(failingStore{}, "counter", newEventWithID("event1"), time.Hour)
+	if err == nil {
+		t.Error("expected the store's error to be returned")
+	}
+}
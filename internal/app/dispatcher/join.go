@@ -0,0 +1,321 @@
+package dispatcher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lawrencegripper/ion/internal/app/handler/dataplane/documentstorage"
+	"github.com/lawrencegripper/ion/internal/app/handler/helpers"
+	"github.com/lawrencegripper/ion/internal/pkg/common"
+	"github.com/lawrencegripper/ion/internal/pkg/messaging"
+	log "github.com/sirupsen/logrus"
+)
+
+// JoinStore holds the joins of the events a module is waiting on, and the metadata of the events they create
+type JoinStore interface {
+	GetJoin(id string) (*documentstorage.Join, error)
+	SaveJoin(join *documentstorage.Join) error
+	GetEventMetaByID(id string) (*documentstorage.EventMeta, error)
+	CreateEventMeta(eventMeta *documentstorage.EventMeta) error
+}
+
+// maxJoinTries is the number of times an event is added to its join when other dispatchers change the join at the same time
+const maxJoinTries = 5
+
+// joiner collects the events a module joins for each correlation. Each event is recorded in the correlation's
+// join as it arrives, once every event type has arrived the join's event is dispatched to the module
+type joiner struct {
+	store      JoinStore
+	moduleName string
+	eventTypes []string
+	timeout    time.Duration
+
+	// Only one message is added at a time by this dispatcher, joins are
+	// versioned so adds by other dispatchers are retried on conflict
+	mu sync.Mutex
+	// waiting are the correlations this dispatcher has added events to which haven't completed, by when they started
+	waiting map[string]time.Time
+}
+
+func newJoiner(store JoinStore, moduleName string, eventTypes []string, timeout time.Duration) *joiner {
+	return &joiner{
+		store:      store,
+		moduleName: moduleName,
+		eventTypes: eventTypes,
+		timeout:    timeout,
+		waiting:    map[string]time.Time{},
+	}
+}
+
+// joinedMessage is the message whose event completed a join. It's dispatched in place of the
+// joined events, with the join's event, and settled once the module has processed them
+type joinedMessage struct {
+	messaging.Message
+	event        common.Event
+	subscription messaging.Subscription
+}
+
+// EventData gets the event created by the join
+func (m *joinedMessage) EventData() (common.Event, error) {
+	return m.event, nil
+}
+
+// Body gets the encoded event created by the join
+func (m *joinedMessage) Body() []byte {
+	b, _ := json.Marshal(m.event)
+	return b
+}
+
+// add records the event in its correlation's join. When the event completes the join, the event
+// created by joining them is returned to be dispatched, otherwise nil is returned
+func (j *joiner) add(event common.Event, contextualLogger *log.Entry) (*common.Event, error) {
+	if event.Context == nil || event.Context.CorrelationID == "" || event.Context.EventID == "" {
+		return nil, fmt.Errorf("events without a correlation ID or event ID can't be joined")
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var err error
+	for try := 1; try <= maxJoinTries; try++ {
+		var joined *common.Event
+		joined, err = j.tryAdd(event, contextualLogger)
+		if err == nil || !strings.HasPrefix(err.Error(), documentstorage.ConflictErr) {
+			return joined, err
+		}
+		contextualLogger.WithError(err).Debug("join changed by another dispatcher, adding event again")
+	}
+	return nil, err
+}
+
+// tryAdd reads the event's join, adds the event and saves it. The save fails with a conflict
+// when another dispatcher has saved the join since it was read
+func (j *joiner) tryAdd(event common.Event, contextualLogger *log.Entry) (*common.Event, error) {
+	correlationID := event.Context.CorrelationID
+	id := documentstorage.GetJoinID(j.moduleName, correlationID)
+	join, err := j.store.GetJoin(id)
+	if err != nil && !strings.HasPrefix(err.Error(), documentstorage.NotFoundErr) {
+		return nil, fmt.Errorf("failed to get join '%s': %+v", id, err)
+	}
+	if join == nil {
+		join = &documentstorage.Join{
+			Context: &common.Context{
+				Name:          j.moduleName,
+				CorrelationID: correlationID,
+				EventID:       helpers.NewDeterministicGUID(id),
+			},
+			ID:        id,
+			Status:    documentstorage.JoinWaiting,
+			CreatedAt: time.Now().UTC(),
+		}
+	}
+	contextualLogger = contextualLogger.WithField("joinID", id)
+
+	switch join.Status {
+	case documentstorage.JoinDispatched:
+		if containsEvent(join.Events, event.Context.EventID) {
+			// The job for the join failed, or its message was redelivered, so it's dispatched again
+			contextualLogger.Info("event is part of a dispatched join, dispatching join again")
+			return j.newJoinedEvent(join), nil
+		}
+		contextualLogger.Warn("event arrived after its join was dispatched, skipping")
+		return nil, nil
+	case documentstorage.JoinTimedOut:
+		contextualLogger.Warn("event arrived after its join timed out, skipping")
+		return nil, nil
+	}
+
+	if j.timeout > 0 && time.Since(join.CreatedAt) > j.timeout {
+		j.timeOut(join, contextualLogger)
+		return nil, j.store.SaveJoin(join)
+	}
+
+	missing := j.missingEventTypes(join)
+	if containsType(missing, event.Type) {
+		join.Events = append(join.Events, event)
+		missing = j.missingEventTypes(join)
+	} else if !containsEvent(join.Events, event.Context.EventID) {
+		contextualLogger.Warn("join already has an event of this type, skipping")
+	}
+	if len(missing) > 0 {
+		contextualLogger.WithField("missingEventTypes", missing).Info("added event to join, waiting for the remaining events")
+		j.waiting[correlationID] = join.CreatedAt
+		return nil, j.store.SaveJoin(join)
+	}
+
+	// Every event has arrived, the metadata for the join's
+	// event is stored before the join is marked dispatched
+	// so modules receiving it can always look it up.
+	if err := j.createJoinedEventMeta(join); err != nil {
+		return nil, err
+	}
+	join.Status = documentstorage.JoinDispatched
+	if err := j.store.SaveJoin(join); err != nil {
+		return nil, err
+	}
+	delete(j.waiting, correlationID)
+	contextualLogger.WithField("joinedEvents", len(join.Events)).Info("all events for join have arrived, dispatching join")
+	return j.newJoinedEvent(join), nil
+}
+
+// expire times out the joins this dispatcher is waiting on which were started longer ago than the timeout
+func (j *joiner) expire() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	for correlationID, created := range j.waiting {
+		if j.timeout <= 0 || time.Since(created) <= j.timeout {
+			continue
+		}
+		delete(j.waiting, correlationID)
+		id := documentstorage.GetJoinID(j.moduleName, correlationID)
+		contextualLogger := log.WithField("joinID", id).WithField("correlationID", correlationID)
+		join, err := j.store.GetJoin(id)
+		if err != nil {
+			contextualLogger.WithError(err).Error("failed to get join to time it out")
+			continue
+		}
+		if join.Status != documentstorage.JoinWaiting {
+			continue // Completed by another dispatcher
+		}
+		j.timeOut(join, contextualLogger)
+		if err := j.store.SaveJoin(join); err != nil {
+			// Checked again on the next expiry, another dispatcher may have completed it
+			j.waiting[correlationID] = created
+			contextualLogger.WithError(err).Error("failed to save timed out join")
+		}
+	}
+}
+
+// timeOut marks the join as timed out so it's never dispatched
+func (j *joiner) timeOut(join *documentstorage.Join, contextualLogger *log.Entry) {
+	join.Status = documentstorage.JoinTimedOut
+	contextualLogger.WithField("missingEventTypes", j.missingEventTypes(join)).WithField("joinTimeout", j.timeout).Warn("join timed out before all its events arrived, its events won't be dispatched")
+}
+
+// missingEventTypes gets the event types yet to arrive for the join
+func (j *joiner) missingEventTypes(join *documentstorage.Join) []string {
+	var missing []string
+	for _, eventType := range j.eventTypes {
+		arrived := false
+		for _, event := range join.Events {
+			if strings.EqualFold(event.Type, eventType) {
+				arrived = true
+				break
+			}
+		}
+		if !arrived {
+			missing = append(missing, eventType)
+		}
+	}
+	return missing
+}
+
+// createJoinedEventMeta stores the metadata for the join's event, merging the files and data of the joined events.
+// Each event's files are put in a directory named after the event's type, so files with the same name from different
+// events don't collide. Where joined events have data with the same key the value from the first event to arrive is used
+func (j *joiner) createJoinedEventMeta(join *documentstorage.Join) error {
+	eventMeta := documentstorage.EventMeta{
+		Context: j.newJoinedEvent(join).Context,
+		Files:   []documentstorage.File{},
+		Data:    common.KeyValuePairs{},
+	}
+	keys := map[string]bool{}
+	for _, event := range join.Events {
+		eventMeta.Parents = append(eventMeta.Parents, event.Context.EventID)
+		parent, err := j.store.GetEventMetaByID(event.Context.EventID)
+		if err != nil {
+			if strings.HasPrefix(err.Error(), documentstorage.NotFoundErr) {
+				continue // Events published outside a module, such as by the front api, may not have metadata
+			}
+			return fmt.Errorf("failed to get metadata for joined event '%s': %+v", event.Context.EventID, err)
+		}
+		// The blob uri for each file is
+		// keyed by its name in the data
+		// so is renamed with the file.
+		files := map[string]bool{}
+		for _, file := range parent.Files {
+			if file.Name == "" {
+				continue
+			}
+			files[file.Name] = true
+			file.Name = joinedFileName(event.Type, file.Name)
+			eventMeta.Files = append(eventMeta.Files, file)
+		}
+		for _, kvp := range parent.Data {
+			if files[kvp.Key] {
+				kvp.Key = joinedFileName(event.Type, kvp.Key)
+			}
+			if !keys[kvp.Key] {
+				keys[kvp.Key] = true
+				eventMeta.Data = append(eventMeta.Data, kvp)
+			}
+		}
+	}
+	if err := j.store.CreateEventMeta(&eventMeta); err != nil {
+		return fmt.Errorf("failed to add metadata for join '%s': %+v", join.ID, err)
+	}
+	return nil
+}
+
+// joinedFileName gets the name of a joined event's file in the module's input blob directory
+func joinedFileName(eventType, fileName string) string {
+	return path.Join(eventType, fileName)
+}
+
+// newJoinedEvent creates the event dispatched for the join. Its ID is derived from the join's
+// so it's the same each time the join is dispatched
+func (j *joiner) newJoinedEvent(join *documentstorage.Join) *common.Event {
+	return &common.Event{
+		Type: strings.Join(j.eventTypes, ","),
+		Context: &common.Context{
+			Name:          j.moduleName,
+			EventID:       join.Context.EventID,
+			CorrelationID: join.Context.CorrelationID,
+			ParentEventID: join.Events[len(join.Events)-1].Context.EventID,
+		},
+	}
+}
+
+func containsType(eventTypes []string, eventType string) bool {
+	for _, t := range eventTypes {
+		if strings.EqualFold(t, eventType) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsEvent(events []common.Event, eventID string) bool {
+	for _, event := range events {
+		if event.Context != nil && event.Context.EventID == eventID {
+			return true
+		}
+	}
+	return false
+}
+
+// joinRenewer renews the locks of joined messages with the subscription each was received from
+type joinRenewer struct{}
+
+// RenewLocks renews the messages' locks, grouped by the subscription they were received from
+func (joinRenewer) RenewLocks(ctx context.Context, messages []messaging.Message) error {
+	bySubscription := map[messaging.Subscription][]messaging.Message{}
+	for _, m := range messages {
+		joined, ok := m.(*joinedMessage)
+		if !ok {
+			return fmt.Errorf("message %s wasn't dispatched for a join", m.ID())
+		}
+		bySubscription[joined.subscription] = append(bySubscription[joined.subscription], joined.Message)
+	}
+	for subscription, subscriptionMessages := range bySubscription {
+		if err := subscription.RenewLocks(ctx, subscriptionMessages); err != nil {
+			return err
+		}
+	}
+	return nil
+}
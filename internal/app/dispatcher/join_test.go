@@ -0,0 +1,163 @@
+package dispatcher
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lawrencegripper/ion/internal/app/handler/dataplane/documentstorage"
+	"github.com/lawrencegripper/ion/internal/app/handler/dataplane/documentstorage/inmemory"
+	"github.com/lawrencegripper/ion/internal/pkg/common"
+	log "github.com/sirupsen/logrus"
+)
+
+func newJoinEvent(store *inmemory.InMemoryDB, eventType, eventID string, files []documentstorage.File, data common.KeyValuePairs) common.Event {
+	context := &common.Context{Name: "upstream", EventID: eventID, CorrelationID: "correlation1", ParentEventID: "root"}
+	_ = store.CreateEventMeta(&documentstorage.EventMeta{Context: context, Files: files, Data: data})
+	return common.Event{Type: eventType, Context: context}
+}
+
+func TestJoiner_DispatchesOnceAllEventsArrive(t *testing.T) {
+	store := &inmemory.InMemoryDB{Contexts: map[string]documentstorage.EventMeta{}}
+	j := newJoiner(store, "report", []string{"page_downloaded", "title_found"}, time.Hour)
+	logger := log.NewEntry(log.StandardLogger())
+
+	page := newJoinEvent(store, "page_downloaded", "event1", []documentstorage.File{{Name: "result.json"}}, common.KeyValuePairs{{Key: "url", Value: "first"}, {Key: "result.json", Value: "page uri"}})
+	title := newJoinEvent(store, "title_found", "event2", []documentstorage.File{{Name: "result.json"}}, common.KeyValuePairs{{Key: "url", Value: "second"}, {Key: "title", Value: "Example"}, {Key: "result.json", Value: "title uri"}})
+
+	joined, err := j.add(page, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if joined != nil {
+		t.Fatal("expected join to wait for the title event")
+	}
+	joined, err = j.add(title, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if joined == nil {
+		t.Fatal("expected join to be dispatched once both events arrived")
+	}
+	if joined.Context.Name != "report" || joined.Context.CorrelationID != "correlation1" || joined.Context.ParentEventID != "event2" {
+		t.Errorf("unexpected joined event context %+v", joined.Context)
+	}
+
+	eventMeta, err := store.GetEventMetaByID(joined.Context.EventID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(eventMeta.Parents) != 2 || eventMeta.Parents[0] != "event1" || eventMeta.Parents[1] != "event2" {
+		t.Errorf("expected joined event's parents to be both events got %v", eventMeta.Parents)
+	}
+	// Files with the same name from each event are kept, in a directory for each event type
+	if names := eventMeta.FileNames(); len(names) != 2 || names[0] != "page_downloaded/result.json" || names[1] != "title_found/result.json" {
+		t.Errorf("expected files from both events by event type got %v", names)
+	}
+	data := eventMeta.Data.AsMap()
+	if data["url"] != "first" || data["title"] != "Example" {
+		t.Errorf("expected data merged with the first event's values kept got %v", data)
+	}
+	if data["page_downloaded/result.json"] != "page uri" || data["title_found/result.json"] != "title uri" {
+		t.Errorf("expected each file's blob uri renamed with the file got %v", data)
+	}
+
+	// A redelivered event from the join dispatches the same event again
+	again, err := j.add(page, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again == nil || again.Context.EventID != joined.Context.EventID {
+		t.Errorf("expected redelivered event to dispatch the join again got %+v", again)
+	}
+
+	// Events arriving after the join was dispatched are skipped
+	late := newJoinEvent(store, "title_found", "event3", nil, nil)
+	skipped, err := j.add(late, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if skipped != nil {
+		t.Error("expected late event not to be dispatched")
+	}
+}
+
+func TestJoiner_TimesOutIncompleteJoins(t *testing.T) {
+	store := &inmemory.InMemoryDB{Contexts: map[string]documentstorage.EventMeta{}}
+	j := newJoiner(store, "report", []string{"page_downloaded", "title_found"}, time.Millisecond)
+	logger := log.NewEntry(log.StandardLogger())
+
+	if _, err := j.add(newJoinEvent(store, "page_downloaded", "event1", nil, nil), logger); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 5)
+	j.expire()
+
+	join, err := store.GetJoin(documentstorage.GetJoinID("report", "correlation1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if join.Status != documentstorage.JoinTimedOut {
+		t.Errorf("expected join to time out got %s", join.Status)
+	}
+	joined, err := j.add(newJoinEvent(store, "title_found", "event2", nil, nil), logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if joined != nil {
+		t.Error("expected event arriving after the timeout not to be dispatched")
+	}
+}
+
+// racingStore lets another dispatcher add its event between a join being read and saved
+type racingStore struct {
+	*inmemory.InMemoryDB
+	beforeSave func()
+}
+
+func (s *racingStore) SaveJoin(join *documentstorage.Join) error {
+	if s.beforeSave != nil {
+		beforeSave := s.beforeSave
+		s.beforeSave = nil
+		beforeSave()
+	}
+	return s.InMemoryDB.SaveJoin(join)
+}
+
+func TestJoiner_DispatchersAddingAtOnceDontOverwriteEachOther(t *testing.T) {
+	store := &racingStore{InMemoryDB: &inmemory.InMemoryDB{Contexts: map[string]documentstorage.EventMeta{}}}
+	first := newJoiner(store, "report", []string{"page_downloaded", "title_found"}, time.Hour)
+	second := newJoiner(store, "report", []string{"page_downloaded", "title_found"}, time.Hour)
+	logger := log.NewEntry(log.StandardLogger())
+
+	page := newJoinEvent(store.InMemoryDB, "page_downloaded", "event1", nil, nil)
+	title := newJoinEvent(store.InMemoryDB, "title_found", "event2", nil, nil)
+
+	// The second dispatcher saves the join after the
+	// first has read it but before the first saves it
+	var secondJoined *common.Event
+	var secondErr error
+	store.beforeSave = func() {
+		secondJoined, secondErr = second.add(title, logger)
+	}
+	joined, err := first.add(page, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secondErr != nil {
+		t.Fatal(secondErr)
+	}
+	if secondJoined != nil {
+		t.Error("expected the second dispatcher's join to wait for the page event")
+	}
+	if joined == nil {
+		t.Fatal("expected the first dispatcher to add its event to the saved join and dispatch it")
+	}
+
+	join, err := store.GetJoin(documentstorage.GetJoinID("report", "correlation1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(join.Events) != 2 || join.Status != documentstorage.JoinDispatched {
+		t.Errorf("expected dispatched join with both events got %+v", join)
+	}
+}
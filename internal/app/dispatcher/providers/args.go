@@ -1,7 +1,6 @@
 package providers
 
 import (
-	"github.com/Azure/azure-sdk-for-go/services/servicebus/mgmt/2017-04-01/servicebus"
 	"github.com/joho/godotenv"
 	"github.com/lawrencegripper/ion/internal/pkg/common"
 	"github.com/lawrencegripper/ion/internal/pkg/messaging"
@@ -9,31 +8,87 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	"os"
+	"sort"
 	"strconv"
 )
 
-// GetSharedHandlerArgs gets the shared arguments used by the handler container
-func GetSharedHandlerArgs(c *types.Configuration, sbKeys servicebus.AccessKeys) []string {
-	return []string{
+// The handler reads any of its flags from the environment, with '.' replaced by '_',
+// so secrets are passed to it using these environment variables rather than as arguments
+const (
+	handlerBlobAccountKeyEnv    = "AZUREBLOBPROVIDER_BLOBACCOUNTKEY"
+	handlerS3SecretAccessKeyEnv = "S3PROVIDER_SECRETACCESSKEY"
+	handlerMongoDBPasswordEnv   = "MONGODBDOCPROVIDER_PASSWORD"
+)
+
+// GetSharedHandlerArgs gets the shared arguments used by the handler container, including the
+// message bus arguments from MessageBus.HandlerConfig. Secrets aren't included, see GetHandlerSecrets
+func GetSharedHandlerArgs(c *types.Configuration, busArgs []string) []string {
+	args := []string{
 		"start",
 		"--context.name=" + c.ModuleName,
-		"--azureblobprovider.enabled=true",
-		"--azureblobprovider.blobaccountname=" + c.Handler.AzureBlobStorageProvider.BlobAccountName,
-		"--azureblobprovider.blobaccountkey=" + c.Handler.AzureBlobStorageProvider.BlobAccountKey,
 		"--mongodbdocprovider.enabled=true",
 		"--mongodbdocprovider.collection=" + c.Handler.MongoDBDocumentStorageProvider.Collection,
 		"--mongodbdocprovider.name=" + c.Handler.MongoDBDocumentStorageProvider.Name,
-		"--mongodbdocprovider.password=" + c.Handler.MongoDBDocumentStorageProvider.Password,
 		"--mongodbdocprovider.port=" + strconv.Itoa(c.Handler.MongoDBDocumentStorageProvider.Port),
-		"--servicebuseventprovider.enabled=true",
-		"--servicebuseventprovider.namespace=" + c.ServiceBusNamespace,
-		"--servicebuseventprovider.topic=" + c.SubscribesToEvent,
-		"--servicebuseventprovider.key=" + *sbKeys.PrimaryKey,
-		"--servicebuseventprovider.authorizationrulename=" + *sbKeys.KeyName,
 		"--loglevel=" + c.LogLevel,
 		"--printconfig=" + strconv.FormatBool(c.Handler.PrintConfig),
 		"--valideventtypes=" + c.EventsPublished,
 	}
+	args = append(args, getBlobHandlerArgs(c)...)
+	return append(args, busArgs...)
+}
+
+// getBlobHandlerArgs gets the arguments for the handler's blob provider, an S3 compatible service
+// when one is configured and otherwise Azure Blob Storage
+func getBlobHandlerArgs(c *types.Configuration) []string {
+	if useS3(c) {
+		s3Config := c.Handler.S3BlobStorageProvider
+		return []string{
+			"--s3provider.enabled=true",
+			"--s3provider.endpoint=" + s3Config.Endpoint,
+			"--s3provider.region=" + s3Config.Region,
+			"--s3provider.bucket=" + s3Config.Bucket,
+			"--s3provider.accesskeyid=" + s3Config.AccessKeyID,
+			"--s3provider.usepathstyle=" + strconv.FormatBool(s3Config.UsePathStyle),
+		}
+	}
+	return []string{
+		"--azureblobprovider.enabled=true",
+		"--azureblobprovider.blobaccountname=" + c.Handler.AzureBlobStorageProvider.BlobAccountName,
+		"--azureblobprovider.blobendpoint=" + c.Handler.AzureBlobStorageProvider.Endpoint,
+	}
+}
+
+// useS3 checks whether the handler stores blobs in an S3 compatible service rather than Azure Blob Storage
+func useS3(c *types.Configuration) bool {
+	return c.Handler.S3BlobStorageProvider != nil && c.Handler.S3BlobStorageProvider.Bucket != ""
+}
+
+// GetHandlerSecrets gets the secrets used by the handler container keyed by the environment variable they are read from,
+// including the message bus secrets from MessageBus.HandlerConfig
+func GetHandlerSecrets(c *types.Configuration, busSecrets map[string]string) map[string]string {
+	secrets := map[string]string{
+		handlerMongoDBPasswordEnv: c.Handler.MongoDBDocumentStorageProvider.Password,
+	}
+	if useS3(c) {
+		secrets[handlerS3SecretAccessKeyEnv] = c.Handler.S3BlobStorageProvider.SecretAccessKey
+	} else {
+		secrets[handlerBlobAccountKeyEnv] = c.Handler.AzureBlobStorageProvider.BlobAccountKey
+	}
+	for name, value := range busSecrets {
+		secrets[name] = value
+	}
+	return secrets
+}
+
+// getSortedSecretNames gets the names of the secrets in a stable order
+func getSortedSecretNames(secrets map[string]string) []string {
+	names := make([]string, 0, len(secrets))
+	for name := range secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
 }
 
 func getMessageHandlerArgs(m messaging.Message) ([]string, error) {
@@ -1,7 +1,10 @@
 package providers
 
 import (
+	"strings"
 	"testing"
+
+	"github.com/lawrencegripper/ion/internal/pkg/types"
 )
 
 func TestGetEnvVaraibles(t *testing.T) {
@@ -32,3 +35,40 @@ func TestGetEnvVaraibles_MissingFile(t *testing.T) {
 	}
 	t.Log(err)
 }
+
+func TestHandlerSecretsNotPassedAsArgs(t *testing.T) {
+	config := &types.Configuration{
+		Handler: &types.HandlerConfig{
+			AzureBlobStorageProvider: &types.AzureBlobConfig{
+				BlobAccountName: "account",
+				BlobAccountKey:  "blobkey",
+			},
+			MongoDBDocumentStorageProvider: &types.MongoDBConfig{
+				Name:     "mongo",
+				Password: "mongopassword",
+			},
+		},
+	}
+	busArgs := []string{"--servicebuseventprovider.authorizationrulename=rule"}
+	busSecrets := map[string]string{"SERVICEBUSEVENTPROVIDER_KEY": "sbkey"}
+
+	args := strings.Join(GetSharedHandlerArgs(config, busArgs), " ")
+	secrets := GetHandlerSecrets(config, busSecrets)
+
+	expected := map[string]string{
+		handlerBlobAccountKeyEnv:      "blobkey",
+		handlerMongoDBPasswordEnv:     "mongopassword",
+		"SERVICEBUSEVENTPROVIDER_KEY": "sbkey",
+	}
+	for name, value := range expected {
+		if secrets[name] != value {
+			t.Errorf("secret %s incorrect Expected: %s Got: %s", name, value, secrets[name])
+		}
+		if strings.Contains(args, value) {
+			t.Errorf("secret %s shouldn't be passed as an argument", name)
+		}
+	}
+	if !strings.Contains(args, busArgs[0]) {
+		t.Errorf("expected message bus args to be passed to the handler, got: %s", args)
+	}
+}
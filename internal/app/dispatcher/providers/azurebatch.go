@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/Azure/go-autorest/autorest/azure"
 
@@ -29,11 +30,15 @@ type AzureBatch struct {
 	inprogressJobStore map[string]messaging.Message
 	jobID              string
 	handlerArgs        []string
+	handlerEnvVars     []apiv1.EnvVar
 	workerEnvVars      map[string]interface{}
 	ctx                context.Context
 	cancelOps          context.CancelFunc
 	logStore           *LogStore
 
+	// handlerSecretSettings are set in the environment of each task for its handler containers
+	handlerSecretSettings []batch.EnvironmentSetting
+
 	jobConfig   *types.JobConfig
 	batchConfig *types.AzureBatchConfig
 	poolClient  *batch.PoolClient
@@ -46,10 +51,12 @@ type AzureBatch struct {
 	listTasks  func() (*[]batch.CloudTask, error)
 	removeTask func(*batch.CloudTask) (autorest.Response, error)
 	getLogs    func(*batch.CloudTask) string
+
+	mu sync.Mutex
 }
 
 // NewAzureBatchProvider creates a provider for azure batch.
-func NewAzureBatchProvider(config *types.Configuration, sharedHandlerArgs []string) (*AzureBatch, error) {
+func NewAzureBatchProvider(config *types.Configuration, sharedHandlerArgs []string, handlerSecrets map[string]string) (*AzureBatch, error) {
 	if config == nil || config.AzureBatch == nil || config.Job == nil {
 		return nil, fmt.Errorf("Cannot create a provider - invalid configuration, require config, AzureBatch and Job")
 	}
@@ -83,6 +90,20 @@ func NewAzureBatchProvider(config *types.Configuration, sharedHandlerArgs []stri
 	}
 	b.poolClient = poolClient
 
+	// Secrets are set in the environment of each task, so they aren't part of its command line, and the
+	// handler containers are passed them from there. They're set per task rather than on the job, which
+	// can't be changed once created, so a restarted dispatcher's tasks get the current values
+	for _, name := range getSortedSecretNames(handlerSecrets) {
+		b.handlerSecretSettings = append(b.handlerSecretSettings, batch.EnvironmentSetting{
+			Name:  to.StringPtr(name),
+			Value: to.StringPtr(handlerSecrets[name]),
+		})
+		b.handlerEnvVars = append(b.handlerEnvVars, apiv1.EnvVar{
+			Name:  name,
+			Value: "$" + name,
+		})
+	}
+
 	jobClient, err := createOrGetJob(ctx, batchBaseURL, b.jobID, config.AzureBatch.PoolID, auth)
 	if err != nil {
 		return nil, err
@@ -142,6 +163,9 @@ func NewAzureBatchProvider(config *types.Configuration, sharedHandlerArgs []stri
 
 //GetActiveMessages gets the currently active messages
 func (b *AzureBatch) GetActiveMessages() []messaging.Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
 	activeMessages := make([]messaging.Message, 0, len(b.inprogressJobStore))
 	for _, m := range b.inprogressJobStore {
 		activeMessages = append(activeMessages, m)
@@ -151,6 +175,9 @@ func (b *AzureBatch) GetActiveMessages() []messaging.Message {
 
 // InProgressCount will show how many tasks are currently in progress
 func (b *AzureBatch) InProgressCount() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
 	return len(b.inprogressJobStore)
 }
 
@@ -163,6 +190,9 @@ func (b *AzureBatch) Dispatch(message messaging.Message) error {
 		return fmt.Errorf("invalid properties. Provider cannot be nil")
 	}
 
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
 	perJobArgs, err := getMessageHandlerArgs(message)
 	if err != nil {
 		return fmt.Errorf("failed generating handler args from message: %v", err)
@@ -213,6 +243,7 @@ func (b *AzureBatch) Dispatch(message messaging.Message) error {
 			Name:            "prepare",
 			Image:           b.jobConfig.HandlerImage,
 			Args:            append(fullHandlerArgs, "--action=prepare"),
+			Env:             b.handlerEnvVars,
 			ImagePullPolicy: pullPolicy,
 			VolumeMounts: []apiv1.VolumeMount{
 				{
@@ -228,6 +259,7 @@ func (b *AzureBatch) Dispatch(message messaging.Message) error {
 			Name:            "commit",
 			Image:           b.jobConfig.HandlerImage,
 			Args:            append(fullHandlerArgs, "--action=commit"),
+			Env:             b.handlerEnvVars,
 			ImagePullPolicy: pullPolicy,
 			VolumeMounts: []apiv1.VolumeMount{
 				{
@@ -284,6 +316,9 @@ func (b *AzureBatch) Dispatch(message messaging.Message) error {
 			},
 		},
 	}
+	if len(b.handlerSecretSettings) > 0 {
+		task.EnvironmentSettings = &b.handlerSecretSettings
+	}
 	_, err = b.createTask(task)
 	if err != nil {
 		log.WithError(err).Error("failed scheduling azurebatch task")
@@ -299,11 +334,36 @@ func (b *AzureBatch) Dispatch(message messaging.Message) error {
 	return nil
 }
 
+// Abort deletes the task for a message which can no longer be settled, for example because its lock
+// was lost, and forgets the message. The broker will redeliver the message so it isn't settled here
+func (b *AzureBatch) Abort(message messaging.Message) error {
+	if message == nil {
+		return fmt.Errorf("invalid input. Message cannot be nil")
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.inprogressJobStore, message.ID())
+
+	// Tasks are created with the message ID as their ID
+	_, err := b.removeTask(&batch.CloudTask{ID: to.StringPtr(message.ID())})
+	if err != nil {
+		return err
+	}
+	log.WithField("messageID", message.ID()).Warning("aborted task")
+	return nil
+}
+
 // Reconcile will check inprogress tasks against and accept/reject messages were the job has completed/failed
 func (b *AzureBatch) Reconcile() error {
 	if b == nil {
 		return fmt.Errorf("invalid properties. Provider cannot be nil")
 	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
 	tasks, err := b.listTasks()
 	if err != nil {
 		return err
@@ -331,7 +391,7 @@ func (b *AzureBatch) Reconcile() error {
 		// Job succeeded - accept the message so it is removed from the queue
 		if t.State == batch.TaskStateCompleted {
 
-			if *t.ExecutionInfo.ExitCode == 0 {
+			if t.ExecutionInfo != nil && t.ExecutionInfo.ExitCode != nil && *t.ExecutionInfo.ExitCode == 0 {
 				// Task has completed successfully
 				contextualLogger.Info("Task completed with success exit code")
 
@@ -380,8 +440,8 @@ func (b *AzureBatch) Reconcile() error {
 					log.WithError(err).WithField("task", t).WithField("messageID", messageID).Error("Failed to remove FAILED task from batch")
 				}
 
-				//ACK the message to requeue failure
-				err = sourceMessage.Reject()
+				//Requeue the message unless the module reported a permanent failure
+				err = settleFailedMessage(contextualLogger, sourceMessage, classifyTaskFailure(&t))
 
 				if err != nil {
 					log.WithFields(log.Fields{
@@ -80,7 +80,7 @@ func TestIntegrationAzureBatchDispatch(t *testing.T) {
 				},
 			}
 
-			p, err := NewAzureBatchProvider(config, []string{"-examplearg1=1"})
+			p, err := NewAzureBatchProvider(config, []string{"-examplearg1=1"}, map[string]string{})
 			if err != nil {
 				t.Error(err)
 				t.FailNow()
@@ -11,6 +11,7 @@ import (
 	"github.com/Azure/azure-sdk-for-go/services/batch/2017-09-01.6.0/batch"
 	"github.com/lawrencegripper/ion/internal/pkg/messaging"
 	"github.com/lawrencegripper/ion/internal/pkg/types"
+	apiv1 "k8s.io/api/core/v1"
 )
 
 const (
@@ -120,6 +121,51 @@ func TestAzureBatchDispatchAddsJob_CorrectPrepareAndCommit(t *testing.T) {
 	}
 }
 
+func TestAzureBatchDispatchPassesSecretsFromEnvironment(t *testing.T) {
+	inMemMockTaskStore := []batch.CloudTask{}
+
+	create := func(taskDetails batch.TaskAddParameter) (autorest.Response, error) {
+		inMemMockTaskStore = append(inMemMockTaskStore, batch.CloudTask{
+			CommandLine:         taskDetails.CommandLine,
+			EnvironmentSettings: taskDetails.EnvironmentSettings,
+		})
+		return autorest.Response{}, nil
+	}
+
+	b, _ := NewMockAzureBatchProvider(create, nil)
+	b.handlerEnvVars = []apiv1.EnvVar{
+		{
+			Name:  handlerBlobAccountKeyEnv,
+			Value: "$" + handlerBlobAccountKeyEnv,
+		},
+	}
+	b.handlerSecretSettings = []batch.EnvironmentSetting{
+		{
+			Name:  to.StringPtr(handlerBlobAccountKeyEnv),
+			Value: to.StringPtr("secret"),
+		},
+	}
+
+	err := b.Dispatch(newNoOpMockMessage(mockMessageID))
+	if err != nil {
+		t.Error(err)
+	}
+
+	commandLine := *inMemMockTaskStore[0].CommandLine
+	expected := handlerBlobAccountKeyEnv + "=$" + handlerBlobAccountKeyEnv
+	if strings.Count(commandLine, expected) != 2 {
+		t.Errorf("expected prepare and commit to be passed %s from the task environment", handlerBlobAccountKeyEnv)
+		t.Log(commandLine)
+	}
+	if strings.Contains(commandLine, "secret") {
+		t.Error("expected secret value not to be in the command line")
+	}
+	settings := inMemMockTaskStore[0].EnvironmentSettings
+	if settings == nil || len(*settings) != 1 || *(*settings)[0].Value != "secret" {
+		t.Errorf("expected secret to be set in the task environment got %+v", settings)
+	}
+}
+
 func TestAzureBatchDispatchAddsJobWithGPU(t *testing.T) {
 	//This is a very basic test.
 	//Without mandating all dev/build machines have a gpu this is the best I can do
@@ -271,6 +317,41 @@ func TestAzureBatchReconcileJobCompleted(t *testing.T) {
 	}
 }
 
+func TestAzureBatchAbortRemovesTask(t *testing.T) {
+	create := func(taskDetails batch.TaskAddParameter) (autorest.Response, error) {
+		return autorest.Response{}, nil
+	}
+	list := func() (*[]batch.CloudTask, error) {
+		return &[]batch.CloudTask{}, nil
+	}
+
+	b, _ := NewMockAzureBatchProvider(create, list)
+
+	var removedTaskID string
+	b.removeTask = func(t *batch.CloudTask) (autorest.Response, error) {
+		removedTaskID = *t.ID
+		return autorest.Response{}, nil
+	}
+
+	messageToSend := newNoOpMockMessage(mockMessageID)
+	err := b.Dispatch(messageToSend)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = b.Abort(messageToSend)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if removedTaskID != mockMessageID {
+		t.Errorf("expected task for message to be removed, got: %s", removedTaskID)
+	}
+	if b.InProgressCount() != 0 {
+		t.Error("expected aborted message to be removed from the inprogress store")
+	}
+}
+
 func TestAzureBatchReconcileJobFailed(t *testing.T) {
 	//Setup... it's a long one. We need to schedule a job first
 	inMemMockTaskStore := []batch.CloudTask{}
@@ -321,3 +402,54 @@ func TestAzureBatchReconcileJobFailed(t *testing.T) {
 		t.Error("Reconcile should remove jobs from the inmemory store once it has accepted or rejected them")
 	}
 }
+
+func TestAzureBatchAbortWhileReconciling(t *testing.T) {
+	inMemMockTaskStore := []batch.CloudTask{}
+
+	create := func(taskDetails batch.TaskAddParameter) (autorest.Response, error) {
+		inMemMockTaskStore = append(inMemMockTaskStore, batch.CloudTask{
+			ID: taskDetails.ID,
+		})
+		return autorest.Response{}, nil
+	}
+
+	list := func() (*[]batch.CloudTask, error) {
+		return &inMemMockTaskStore, nil
+	}
+
+	b, _ := NewMockAzureBatchProvider(create, list)
+
+	messages := []messaging.Message{}
+	for i := 0; i < 10; i++ {
+		message := newNoOpMockMessage(fmt.Sprintf("message%d", i))
+		err := b.Dispatch(message)
+		if err != nil {
+			t.Error(err)
+		}
+		messages = append(messages, message)
+	}
+
+	// Messages are aborted when their lock is lost, which happens alongside the reconcile loop
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, message := range messages {
+			err := b.Abort(message)
+			if err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		err := b.Reconcile()
+		if err != nil {
+			t.Error(err)
+		}
+		_ = b.GetActiveMessages()
+	}
+	<-done
+
+	if b.InProgressCount() != 0 {
+		t.Errorf("expected aborted messages to be removed from the inprogress store, in progress: %v", b.InProgressCount())
+	}
+}
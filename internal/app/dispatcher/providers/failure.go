@@ -0,0 +1,128 @@
+package providers
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/services/batch/2017-09-01.6.0/batch"
+	"github.com/lawrencegripper/ion/internal/pkg/common"
+	"github.com/lawrencegripper/ion/internal/pkg/messaging"
+	log "github.com/sirupsen/logrus"
+	batchv1 "k8s.io/api/batch/v1"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+// jobFailure describes why a job failed and whether retrying it could succeed
+type jobFailure struct {
+	permanent bool
+	reason    string
+}
+
+// settleFailedMessage dead letters the message for a permanent failure, otherwise rejects it so it's retried
+func settleFailedMessage(contextualLogger *log.Entry, message messaging.Message, failure jobFailure) error {
+	contextualLogger = contextualLogger.WithField("failureReason", failure.reason).WithField("permanentFailure", failure.permanent)
+	if failure.permanent {
+		contextualLogger.Warning("job failed permanently, dead lettering message")
+		return message.DeadLetter(failure.reason)
+	}
+	contextualLogger.Warning("job failed, rejecting message so it is retried")
+	return message.Reject()
+}
+
+// classifyJobFailure inspects the job and its pods to find out why it failed
+func classifyJobFailure(job *batchv1.Job, pods []apiv1.Pod) jobFailure {
+	for _, pod := range pods {
+		statuses := append(append([]apiv1.ContainerStatus{}, pod.Status.InitContainerStatuses...), pod.Status.ContainerStatuses...)
+		for _, status := range statuses {
+			terminated := status.State.Terminated
+			if terminated != nil && terminated.ExitCode == common.PermanentFailureExitCode {
+				return jobFailure{
+					permanent: true,
+					reason:    permanentFailureReason(status.Name, terminated.Message),
+				}
+			}
+		}
+	}
+
+	// Anything else could be caused by the environment the job ran in so is worth retrying
+	for _, pod := range pods {
+		if pod.Status.Reason == "Evicted" {
+			return jobFailure{reason: fmt.Sprintf("pod evicted: %s", pod.Status.Message)}
+		}
+		statuses := append(append([]apiv1.ContainerStatus{}, pod.Status.InitContainerStatuses...), pod.Status.ContainerStatuses...)
+		for _, status := range statuses {
+			if waiting := status.State.Waiting; waiting != nil &&
+				(waiting.Reason == "ErrImagePull" || waiting.Reason == "ImagePullBackOff") {
+				return jobFailure{reason: fmt.Sprintf("failed to pull image for container '%s': %s", status.Name, waiting.Message)}
+			}
+			if terminated := status.State.Terminated; terminated != nil && terminated.ExitCode != 0 {
+				return jobFailure{reason: fmt.Sprintf("container '%s' exited with code %d: %s", status.Name, terminated.ExitCode, terminated.Reason)}
+			}
+		}
+	}
+	for _, condition := range job.Status.Conditions {
+		if condition.Type == batchv1.JobFailed {
+			if condition.Reason == "DeadlineExceeded" {
+				return jobFailure{reason: "job exceeded its maximum running time"}
+			}
+			return jobFailure{reason: fmt.Sprintf("job failed: %s %s", condition.Reason, condition.Message)}
+		}
+	}
+	return jobFailure{reason: "job failed"}
+}
+
+// classifyTaskFailure uses the exit code of a batch task to find out why it failed.
+// The task's exit code is that of the first container to fail
+func classifyTaskFailure(t *batch.CloudTask) jobFailure {
+	if t.ExecutionInfo == nil {
+		return jobFailure{reason: "task failed without execution information"}
+	}
+	if t.ExecutionInfo.FailureInfo != nil && t.ExecutionInfo.FailureInfo.Code != nil {
+		reason := *t.ExecutionInfo.FailureInfo.Code
+		if t.ExecutionInfo.FailureInfo.Message != nil {
+			reason += ": " + *t.ExecutionInfo.FailureInfo.Message
+		}
+		return jobFailure{reason: fmt.Sprintf("task failed: %s", reason)}
+	}
+	if t.ExecutionInfo.ExitCode == nil {
+		return jobFailure{reason: "task failed without an exit code"}
+	}
+	if *t.ExecutionInfo.ExitCode == common.PermanentFailureExitCode {
+		return jobFailure{
+			permanent: true,
+			reason:    permanentFailureReason("", ""),
+		}
+	}
+	return jobFailure{reason: fmt.Sprintf("task exited with code %d", *t.ExecutionInfo.ExitCode)}
+}
+
+// classifyLocalFailure uses the error returned from running a local job to find out why it failed
+func classifyLocalFailure(err error) jobFailure {
+	if exitErr, ok := unwrapExitError(err); ok && exitErr.ExitCode() == common.PermanentFailureExitCode {
+		return jobFailure{
+			permanent: true,
+			reason:    permanentFailureReason("", ""),
+		}
+	}
+	return jobFailure{reason: err.Error()}
+}
+
+func unwrapExitError(err error) (*exec.ExitError, bool) {
+	if localErr, ok := err.(*localJobError); ok {
+		err = localErr.err
+	}
+	exitErr, ok := err.(*exec.ExitError)
+	return exitErr, ok
+}
+
+func permanentFailureReason(containerName, message string) string {
+	reason := "module reported a permanent failure"
+	if containerName != "" {
+		reason += fmt.Sprintf(" in container '%s'", containerName)
+	}
+	if message = strings.TrimSpace(message); message != "" {
+		reason += ": " + message
+	}
+	return reason
+}
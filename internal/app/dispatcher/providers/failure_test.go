@@ -0,0 +1,193 @@
+package providers
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/services/batch/2017-09-01.6.0/batch"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/lawrencegripper/ion/internal/pkg/common"
+	batchv1 "k8s.io/api/batch/v1"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+func podWithContainerState(name string, state apiv1.ContainerState) apiv1.Pod {
+	return apiv1.Pod{
+		Status: apiv1.PodStatus{
+			InitContainerStatuses: []apiv1.ContainerStatus{
+				{
+					Name:  name,
+					State: state,
+				},
+			},
+		},
+	}
+}
+
+func TestClassifyJobFailure(t *testing.T) {
+	failedJob := batchv1.Job{
+		Status: batchv1.JobStatus{
+			Conditions: []batchv1.JobCondition{
+				{
+					Type:   batchv1.JobFailed,
+					Reason: "BackoffLimitExceeded",
+				},
+			},
+		},
+	}
+	timedOutJob := batchv1.Job{
+		Status: batchv1.JobStatus{
+			Conditions: []batchv1.JobCondition{
+				{
+					Type:   batchv1.JobFailed,
+					Reason: "DeadlineExceeded",
+				},
+			},
+		},
+	}
+
+	testCases := []struct {
+		name           string
+		job            batchv1.Job
+		pods           []apiv1.Pod
+		expectedPerm   bool
+		reasonContains string
+	}{
+		{
+			name: "permanentexitcode",
+			job:  failedJob,
+			pods: []apiv1.Pod{
+				podWithContainerState("worker", apiv1.ContainerState{
+					Terminated: &apiv1.ContainerStateTerminated{
+						ExitCode: common.PermanentFailureExitCode,
+						Message:  "input file is corrupt",
+					},
+				}),
+			},
+			expectedPerm:   true,
+			reasonContains: "input file is corrupt",
+		},
+		{
+			name: "crash",
+			job:  failedJob,
+			pods: []apiv1.Pod{
+				podWithContainerState("worker", apiv1.ContainerState{
+					Terminated: &apiv1.ContainerStateTerminated{
+						ExitCode: 137,
+						Reason:   "OOMKilled",
+					},
+				}),
+			},
+			reasonContains: "OOMKilled",
+		},
+		{
+			name: "imagepull",
+			job:  timedOutJob,
+			pods: []apiv1.Pod{
+				podWithContainerState("worker", apiv1.ContainerState{
+					Waiting: &apiv1.ContainerStateWaiting{
+						Reason: "ImagePullBackOff",
+					},
+				}),
+			},
+			reasonContains: "failed to pull image",
+		},
+		{
+			name: "evicted",
+			job:  failedJob,
+			pods: []apiv1.Pod{
+				{
+					Status: apiv1.PodStatus{
+						Reason:  "Evicted",
+						Message: "node low on disk",
+					},
+				},
+			},
+			reasonContains: "evicted",
+		},
+		{
+			name:           "timeout",
+			job:            timedOutJob,
+			reasonContains: "maximum running time",
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			failure := classifyJobFailure(&test.job, test.pods)
+			if failure.permanent != test.expectedPerm {
+				t.Errorf("permanent incorrect Expected: %v Got: %v", test.expectedPerm, failure.permanent)
+			}
+			if !strings.Contains(failure.reason, test.reasonContains) {
+				t.Errorf("reason incorrect Expected to contain: %s Got: %s", test.reasonContains, failure.reason)
+			}
+		})
+	}
+}
+
+func TestClassifyTaskFailure(t *testing.T) {
+	testCases := []struct {
+		name         string
+		task         batch.CloudTask
+		expectedPerm bool
+	}{
+		{
+			name: "permanentexitcode",
+			task: batch.CloudTask{
+				ExecutionInfo: &batch.TaskExecutionInformation{
+					ExitCode: to.Int32Ptr(common.PermanentFailureExitCode),
+				},
+			},
+			expectedPerm: true,
+		},
+		{
+			name: "otherexitcode",
+			task: batch.CloudTask{
+				ExecutionInfo: &batch.TaskExecutionInformation{
+					ExitCode: to.Int32Ptr(1),
+				},
+			},
+		},
+		{
+			name: "batchfailure",
+			task: batch.CloudTask{
+				ExecutionInfo: &batch.TaskExecutionInformation{
+					ExitCode: to.Int32Ptr(common.PermanentFailureExitCode),
+					FailureInfo: &batch.TaskFailureInformation{
+						Code: to.StringPtr("TaskEnded"),
+					},
+				},
+			},
+		},
+		{
+			name: "noexecutioninfo",
+			task: batch.CloudTask{},
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			failure := classifyTaskFailure(&test.task)
+			if failure.permanent != test.expectedPerm {
+				t.Errorf("permanent incorrect Expected: %v Got: %v Reason: %s", test.expectedPerm, failure.permanent, failure.reason)
+			}
+		})
+	}
+}
+
+func TestClassifyLocalFailure(t *testing.T) {
+	permanentErr := exec.CommandContext(context.Background(), "sh", "-c", fmt.Sprintf("exit %d", common.PermanentFailureExitCode)).Run()
+	if failure := classifyLocalFailure(&localJobError{step: "worker", err: permanentErr}); !failure.permanent {
+		t.Errorf("expected exit code %d to be a permanent failure", common.PermanentFailureExitCode)
+	}
+
+	transientErr := exec.CommandContext(context.Background(), "false").Run()
+	if failure := classifyLocalFailure(&localJobError{step: "worker", err: transientErr}); failure.permanent {
+		t.Error("expected exit code 1 to be a transient failure")
+	}
+}
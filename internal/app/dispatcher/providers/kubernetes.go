@@ -1,6 +1,7 @@
 package providers
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"k8s.io/apimachinery/pkg/labels"
@@ -8,6 +9,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/lawrencegripper/ion/internal/pkg/messaging"
@@ -17,45 +19,73 @@ import (
 	log "github.com/sirupsen/logrus"
 	batchv1 "k8s.io/api/batch/v1"
 	apiv1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
 const (
-	dispatcherNameLabel = "ion/createdBy"
-	messageIDLabel      = "ion/messageid"
-	correlationIDLabel  = "ion/correlationid"
-	deliverycountlabel  = "ion/deliverycount"
-	moduleName          = "ion/modulename"
-	parentEventID       = "ion/parenteventid"
-	eventID             = "ion/eventid"
+	dispatcherNameLabel   = "ion/createdBy"
+	dispatcherModuleLabel = "ion/dispatchermodule"
+	messageIDLabel        = "ion/messageid"
+	correlationIDLabel    = "ion/correlationid"
+	deliverycountlabel    = "ion/deliverycount"
+	moduleName            = "ion/modulename"
+	parentEventID         = "ion/parenteventid"
+	eventID               = "ion/eventid"
 )
 
 //Check providers match interface at compile time
 var _ Provider = &Kubernetes{}
+var _ Watcher = &Kubernetes{}
+
+// recoveredJob is a job found at startup which was dispatched for a message we don't currently hold
+type recoveredJob struct {
+	job         batchv1.Job
+	recoveredAt time.Time
+}
 
 // Kubernetes schedules jobs onto k8s from the queue and monitors their progress
 type Kubernetes struct {
 	createJob        func(*batchv1.Job) (*batchv1.Job, error)
+	updateJob        func(*batchv1.Job) (*batchv1.Job, error)
+	getJob           func(name string) (*batchv1.Job, error)
 	listAllJobs      func() (*batchv1.JobList, error)
+	listModuleJobs   func() (*batchv1.JobList, error)
+	jobListWatcher   cache.ListerWatcher
 	removeJob        func(*batchv1.Job) error
+	createSecret     func(*apiv1.Secret) error
 	getLogs          func(b *batchv1.Job) (string, error)
+	listJobPods      func(b *batchv1.Job) ([]apiv1.Pod, error)
+	dispatcherExists func(name string) (bool, error)
 	client           *kubernetes.Clientset
 	jobConfig        *types.JobConfig
 	inflightJobStore map[string]messaging.Message
-	dispatcherName   string
-	moduleName       string
-	Namespace        string
-	pullSecret       string
-	handlerArgs      []string
-	workerEnvVars    map[string]interface{}
-	logStore         *LogStore
+	// settlingJobStore holds the messageIDs of inflight jobs which have finished and are having their logs
+	// stored and message settled, so the watch and Reconcile don't both settle the same message
+	settlingJobStore map[string]bool
+	// recoveredJobStore holds jobs started by a previous dispatcher for this module, keyed by messageID,
+	// which are waiting for their message to be redelivered
+	recoveredJobStore map[string]recoveredJob
+	dispatcherName    string
+	moduleName        string
+	Namespace         string
+	pullSecret        string
+	handlerSecretName string
+	podCustomisation  *podCustomisation
+	handlerArgs       []string
+	workerEnvVars     map[string]interface{}
+	logStore          *LogStore
+	mu                sync.Mutex
 }
 
 // NewKubernetesProvider Creates an instance and does basic setup
-func NewKubernetesProvider(config *types.Configuration, sharedHandlerArgs []string) (*Kubernetes, error) {
+func NewKubernetesProvider(config *types.Configuration, sharedHandlerArgs []string, handlerSecrets map[string]string) (*Kubernetes, error) {
 	if config == nil {
 		return nil, fmt.Errorf("invalid config. Cannot be nil")
 	}
@@ -88,23 +118,97 @@ func NewKubernetesProvider(config *types.Configuration, sharedHandlerArgs []stri
 
 	k.Namespace = config.Kubernetes.Namespace
 	k.pullSecret = config.Kubernetes.ImagePullSecretName
+	k.podCustomisation, err = newPodCustomisation(config.Kubernetes)
+	if err != nil {
+		return nil, err
+	}
 	k.jobConfig = config.Job
 	k.dispatcherName = config.Hostname
 	k.inflightJobStore = map[string]messaging.Message{}
+	k.settlingJobStore = map[string]bool{}
+	k.recoveredJobStore = map[string]recoveredJob{}
 	k.createJob = func(b *batchv1.Job) (*batchv1.Job, error) {
 		return k.client.BatchV1().Jobs(k.Namespace).Create(b)
 	}
+	k.updateJob = func(b *batchv1.Job) (*batchv1.Job, error) {
+		return k.client.BatchV1().Jobs(k.Namespace).Update(b)
+	}
+	k.getJob = func(name string) (*batchv1.Job, error) {
+		return k.client.BatchV1().Jobs(k.Namespace).Get(name, metav1.GetOptions{})
+	}
 	k.listAllJobs = func() (*batchv1.JobList, error) {
 		return k.client.BatchV1().Jobs(k.Namespace).List(metav1.ListOptions{
 			LabelSelector: fmt.Sprintf("%s=%s", dispatcherNameLabel, k.dispatcherName),
 		})
 	}
+	k.jobListWatcher = &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.LabelSelector = fmt.Sprintf("%s=%s", dispatcherNameLabel, k.dispatcherName)
+			return k.client.BatchV1().Jobs(k.Namespace).List(options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.LabelSelector = fmt.Sprintf("%s=%s", dispatcherNameLabel, k.dispatcherName)
+			return k.client.BatchV1().Jobs(k.Namespace).Watch(options)
+		},
+	}
+	k.listModuleJobs = func() (*batchv1.JobList, error) {
+		return k.client.BatchV1().Jobs(k.Namespace).List(metav1.ListOptions{
+			LabelSelector: fmt.Sprintf("%s=%s", dispatcherModuleLabel, k.moduleName),
+		})
+	}
 	k.removeJob = func(j *batchv1.Job) error {
-		return k.client.BatchV1().Jobs(k.Namespace).Delete(j.Name, &metav1.DeleteOptions{})
+		// Jobs orphan their pods by default, remove them too so aborted jobs stop running
+		propagation := metav1.DeletePropagationBackground
+		return k.client.BatchV1().Jobs(k.Namespace).Delete(j.Name, &metav1.DeleteOptions{
+			PropagationPolicy: &propagation,
+		})
 	}
 	k.getLogs = func(b *batchv1.Job) (string, error) {
 		return getLogsForJob(b.Namespace, b, k.client)
 	}
+	k.listJobPods = func(b *batchv1.Job) ([]apiv1.Pod, error) {
+		pods, err := k.client.CoreV1().Pods(b.Namespace).List(metav1.ListOptions{
+			LabelSelector: labels.SelectorFromSet(b.Spec.Selector.MatchLabels).String(),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return pods.Items, nil
+	}
+	k.dispatcherExists = func(name string) (bool, error) {
+		// Dispatchers are named after the pod they run in
+		_, err := k.client.CoreV1().Pods(k.Namespace).Get(name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	k.createSecret = func(s *apiv1.Secret) error {
+		secrets := k.client.CoreV1().Secrets(k.Namespace)
+		_, err := secrets.Create(s)
+		if apierrors.IsAlreadyExists(err) {
+			_, err = secrets.Update(s)
+		}
+		return err
+	}
+
+	// Secrets for the handler are stored in a k8s secret and exposed as environment variables
+	// so they don't appear in the job spec. The secret is shared by the module's dispatchers and
+	// isn't owned by any of them, jobs outlive the dispatcher which started them and their pods
+	// can't start without it
+	k.handlerSecretName = "ion-handler-" + strings.ToLower(k.moduleName)
+	err = k.createSecret(&apiv1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: k.handlerSecretName,
+			Labels: map[string]string{
+				dispatcherModuleLabel: k.moduleName,
+			},
+		},
+		StringData: handlerSecrets,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create secret for handler: %+v", err)
+	}
 
 	if config.Handler != nil &&
 		config.Handler.MongoDBDocumentStorageProvider != nil &&
@@ -119,11 +223,21 @@ func NewKubernetesProvider(config *types.Configuration, sharedHandlerArgs []stri
 		k.logStore = &LogStore{}
 	}
 
+	// Pick up jobs left behind by a previous dispatcher, their messages
+	// will be redelivered to us once the old locks expire
+	err = k.RecoverJobs()
+	if err != nil {
+		log.WithError(err).Error("failed to recover in-flight jobs, they will be cleaned up once finished")
+	}
+
 	return &k, nil
 }
 
 //GetActiveMessages gets the currently active messages
 func (k *Kubernetes) GetActiveMessages() []messaging.Message {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
 	activeMessages := make([]messaging.Message, 0, len(k.inflightJobStore))
 	for _, m := range k.inflightJobStore {
 		activeMessages = append(activeMessages, m)
@@ -133,115 +247,364 @@ func (k *Kubernetes) GetActiveMessages() []messaging.Message {
 
 // InProgressCount provides a count of the currently running jobs
 func (k *Kubernetes) InProgressCount() int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
 	return len(k.inflightJobStore)
 }
 
-// Reconcile will review the state of running jobs and accept or reject messages accordingly
-func (k *Kubernetes) Reconcile() error {
+// RecoverJobs finds jobs dispatched by any dispatcher for this module so that, when their message is
+// redelivered, the existing job can be adopted instead of running the module a second time
+func (k *Kubernetes) RecoverJobs() error {
 	if k == nil {
 		return fmt.Errorf("invalid properties. Provider cannot be nil")
 	}
-	// Todo: investigate using the field selector to limit the returned data to only
-	// completed or failed jobs
-	jobs, err := k.listAllJobs()
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	jobs, err := k.listModuleJobs()
 	if err != nil {
 		return err
 	}
 
 	for _, j := range jobs.Items {
-		messageID, ok := j.ObjectMeta.Labels[messageIDLabel]
 		contextualLogger := getLoggerForJob(&j)
+		messageID, ok := j.Labels[messageIDLabel]
 		if !ok {
-			contextualLogger.Error("job seen without messageid present in labels... skipping")
+			contextualLogger.Error("job seen without messageid present in labels... skipping recovery")
+			continue
+		}
+		if _, ok := k.inflightJobStore[messageID]; ok {
 			continue
 		}
 
-		sourceMessage, ok := k.inflightJobStore[messageID]
-		// If we don't have a message in flight for this job check some error cases
-		if !ok {
-			dipatcherName, ok := j.Labels[dispatcherNameLabel]
-			// Is it malformed?
-			if !ok {
-				contextualLogger.Error("job seen without dispatcher present in labels... skipping")
-				continue
-			}
-			// Is it someone elses?
-			if dipatcherName != k.dispatcherName {
-				contextualLogger.Debug("job seen with different dispatcher name present in labels... skipping")
-				continue
-			}
-			// Is it ours and we've forgotten
-			if dipatcherName == k.dispatcherName {
-				for _, condition := range j.Status.Conditions {
-					if jobIsFinishedAndOlderThanAnHour(condition) {
-						//Cleanup stuff that's been around a while
-						err = k.removeJob(&j)
-						if err != nil {
-							contextualLogger.Error("cleanup: failed to remove old job job from k8s")
-						}
-					}
-				}
+		existing, seen := k.recoveredJobStore[messageID]
+		// Keep the most recent attempt if several exist for the same message
+		if seen && getJobDeliveryCount(&existing.job) > getJobDeliveryCount(&j) {
+			continue
+		}
 
-				continue
-			}
+		contextualLogger.WithFields(log.Fields{
+			"eventID":       j.Labels[eventID],
+			"deliveryCount": j.Labels[deliverycountlabel],
+			"dispatcher":    j.Labels[dispatcherNameLabel],
+		}).Info("recovered job, waiting for message to be redelivered")
+		k.recoveredJobStore[messageID] = recoveredJob{
+			job:         j,
+			recoveredAt: time.Now(),
+		}
+	}
+
+	return nil
+}
+
+// adoptJob takes ownership of a job started by a previous dispatcher for a redelivered message
+func (k *Kubernetes) adoptJob(message messaging.Message, job batchv1.Job) error {
+	contextualLogger := GetLoggerForMessage(message, getLoggerForJob(&job)).WithField("eventID", job.Labels[eventID])
 
-			//Unknown case?!
-			contextualLogger.Info("unknown case when reconciling job")
+	for _, condition := range job.Status.Conditions {
+		if condition.Type != batchv1.JobComplete && condition.Type != batchv1.JobFailed {
 			continue
 		}
+		// The job finished while no dispatcher held the message, settle it now
+		jobSucceeded := condition.Type == batchv1.JobComplete
+		contextualLogger.WithField("succeeded", jobSucceeded).Info("recovered job already finished, settling message")
 
-		contextualLogger = GetLoggerForMessage(sourceMessage, contextualLogger)
-		for _, condition := range j.Status.Conditions {
-			// Job failed - reject the message so it goes back on the queue to be retried
-			if condition.Type == batchv1.JobFailed {
-				contextualLogger.Warning("job failed to execute in k8s")
+		logs, err := k.getLogs(&job)
+		if err != nil {
+			contextualLogger.WithError(err).Error("failed to get logs for job: getLogsFailed")
+		}
+		err = k.logStore.StoreLogs(contextualLogger, message, logs, jobSucceeded)
+		if err != nil {
+			contextualLogger.WithError(err).Error("failed to log to logstore")
+		}
 
-				logs, err := k.getLogs(&j)
-				if err != nil {
-					contextualLogger.WithError(err).Error("failed to get logs for job: getLogsFailed")
-				}
-				err = k.logStore.StoreLogs(contextualLogger, sourceMessage, logs, false)
-				if err != nil {
-					contextualLogger.WithError(err).Error("failed to log to logstore")
-				}
+		var failure jobFailure
+		if !jobSucceeded {
+			pods, err := k.listJobPods(&job)
+			if err != nil {
+				contextualLogger.WithError(err).Error("failed to get pods for job, treating failure as transient")
+			}
+			failure = classifyJobFailure(&job, pods)
+		}
+
+		err = k.removeJob(&job)
+		if err != nil {
+			contextualLogger.WithError(err).Error("failed to remove recovered job from k8s")
+		}
 
-				err = sourceMessage.Reject()
+		if jobSucceeded {
+			return message.Accept()
+		}
+		return settleFailedMessage(contextualLogger, message, failure)
+	}
 
-				if err != nil {
-					contextualLogger.Error("failed to reject message")
-					return err
-				}
+	// The job is still running, relabel it so our reconcile loop picks it up
+	adopted := job.DeepCopy()
+	adopted.Labels[dispatcherNameLabel] = k.dispatcherName
+	adopted.Labels[deliverycountlabel] = strconv.Itoa(message.DeliveryCount())
+	_, err := k.updateJob(adopted)
+	if err != nil {
+		// Without the label we'd never see the job complete so give the message up for another attempt
+		contextualLogger.WithError(err).Error("failed to adopt recovered job, abandoning message")
+		mErr := message.Reject()
+		if mErr != nil {
+			contextualLogger.WithError(mErr).Error("failed abandoning message after failing to adopt job")
+		}
+		return err
+	}
 
-				//Remove the message from the inflight message store
-				delete(k.inflightJobStore, messageID)
+	contextualLogger.Info("adopted running job for redelivered message")
+	k.inflightJobStore[message.ID()] = message
+	return nil
+}
+
+// expireRecoveredJobs forgets recovered jobs whose message hasn't been redelivered within the
+// max running time of a job. Other replicas for the module may still be running the job so it is
+// only removed from k8s once it has finished or the dispatcher which owns it has gone away
+func (k *Kubernetes) expireRecoveredJobs() {
+	maxWait := time.Duration(k.jobConfig.MaxRunningTimeMins)*time.Minute + time.Hour
+	for messageID, recovered := range k.recoveredJobStore {
+		if time.Since(recovered.recoveredAt) < maxWait {
+			continue
+		}
+		contextualLogger := getLoggerForJob(&recovered.job)
+		remove, err := k.isRecoveredJobOrphaned(recovered.job.Name)
+		if err != nil {
+			contextualLogger.WithError(err).Error("failed to check whether recovered job is still owned, will retry")
+			continue
+		}
+		if remove {
+			contextualLogger.Info("message for recovered job not redelivered, removing job")
+			err = k.removeJob(&recovered.job)
+			if err != nil {
+				contextualLogger.WithError(err).Error("cleanup: failed to remove recovered job from k8s")
 			}
+		} else {
+			contextualLogger.Info("message for recovered job not redelivered, leaving job with its dispatcher")
+		}
+		delete(k.recoveredJobStore, messageID)
+	}
+}
+
+// isRecoveredJobOrphaned checks the current state of a recovered job, as another dispatcher may have
+// adopted it since it was recovered, and is true when it has finished or its dispatcher no longer exists
+func (k *Kubernetes) isRecoveredJobOrphaned(name string) (bool, error) {
+	job, err := k.getJob(name)
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, condition := range job.Status.Conditions {
+		if condition.Type == batchv1.JobComplete || condition.Type == batchv1.JobFailed {
+			return true, nil
+		}
+	}
+	dispatcherName, ok := job.Labels[dispatcherNameLabel]
+	if !ok {
+		return true, nil
+	}
+	exists, err := k.dispatcherExists(dispatcherName)
+	return !exists, err
+}
 
-			// Job succeeded - accept the message so it is removed from the queue
-			if condition.Type == batchv1.JobComplete {
-				contextualLogger.Info("job successfully to execute in k8s")
+// Reconcile will review the state of running jobs and accept or reject messages accordingly.
+// When the job watch is running this acts as a periodic resync in case events were missed
+func (k *Kubernetes) Reconcile() error {
+	if k == nil {
+		return fmt.Errorf("invalid properties. Provider cannot be nil")
+	}
 
-				logs, err := k.getLogs(&j)
-				if err != nil {
-					contextualLogger.WithError(err).Error("failed to get logs for job: getLogsFailed")
-				}
-				err = k.logStore.StoreLogs(contextualLogger, sourceMessage, logs, true)
-				if err != nil {
-					contextualLogger.WithError(err).Error("failed to log to logstore")
-				}
+	k.mu.Lock()
+	k.expireRecoveredJobs()
+	k.mu.Unlock()
+
+	// Todo: investigate using the field selector to limit the returned data to only
+	// completed or failed jobs
+	jobs, err := k.listAllJobs()
+	if err != nil {
+		return err
+	}
+
+	for i := range jobs.Items {
+		err = k.reconcileJob(&jobs.Items[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Watch reacts to jobs completing or failing as they happen rather than waiting for the next Reconcile.
+// It blocks until the context is cancelled, the informer relists and rewatches jobs when its watch expires
+func (k *Kubernetes) Watch(ctx context.Context) {
+	// Reconcile already resyncs periodically so the informer doesn't need to
+	informer := cache.NewSharedInformer(k.jobListWatcher, &batchv1.Job{}, 0)
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: k.onJobChanged,
+		UpdateFunc: func(_, newObj interface{}) {
+			k.onJobChanged(newObj)
+		},
+	})
+	informer.Run(ctx.Done())
+}
 
-				err = sourceMessage.Accept()
+func (k *Kubernetes) onJobChanged(obj interface{}) {
+	job, ok := obj.(*batchv1.Job)
+	if !ok {
+		log.WithField("object", obj).Warning("unexpected object type received watching jobs")
+		return
+	}
+	err := k.reconcileJob(job)
+	if err != nil {
+		getLoggerForJob(job).WithError(err).Error("failed to reconcile job from watch event")
+	}
+}
 
+// reconcileJob settles the message for a job once it has completed or failed. The job's state is
+// read under k.mu but its logs are stored and message settled without it, so slow calls don't block
+// dispatching or lock renewal. Callers mustn't hold k.mu
+func (k *Kubernetes) reconcileJob(j *batchv1.Job) error {
+	messageID, ok := j.ObjectMeta.Labels[messageIDLabel]
+	contextualLogger := getLoggerForJob(j)
+	if !ok {
+		contextualLogger.Error("job seen without messageid present in labels... skipping")
+		return nil
+	}
+
+	finished, succeeded := getJobResult(j)
+
+	k.mu.Lock()
+	sourceMessage, inflight := k.inflightJobStore[messageID]
+	_, recovered := k.recoveredJobStore[messageID]
+	settling := k.settlingJobStore[messageID]
+	if inflight && finished && !settling {
+		k.settlingJobStore[messageID] = true
+	}
+	k.mu.Unlock()
+
+	// If we don't have a message in flight for this job check some error cases
+	if !inflight {
+		// Is it waiting for its message to be redelivered?
+		if recovered {
+			contextualLogger.Debug("job recovered and waiting for message redelivery... skipping")
+			return nil
+		}
+		dipatcherName, ok := j.Labels[dispatcherNameLabel]
+		// Is it malformed?
+		if !ok {
+			contextualLogger.Error("job seen without dispatcher present in labels... skipping")
+			return nil
+		}
+		// Is it someone elses?
+		if dipatcherName != k.dispatcherName {
+			contextualLogger.Debug("job seen with different dispatcher name present in labels... skipping")
+			return nil
+		}
+		// Is it ours and we've forgotten
+		for _, condition := range j.Status.Conditions {
+			if jobIsFinishedAndOlderThanAnHour(condition) {
+				//Cleanup stuff that's been around a while
+				err := k.removeJob(j)
 				if err != nil {
-					contextualLogger.Error("failed to accept message")
-					return err
+					contextualLogger.Error("cleanup: failed to remove old job job from k8s")
 				}
-
-				//Remove the message from the inflight message store
-				delete(k.inflightJobStore, messageID)
+				return nil
 			}
 		}
+		return nil
+	}
+
+	// Still running, or already being settled from another event
+	if !finished || settling {
+		return nil
+	}
+
+	contextualLogger = GetLoggerForMessage(sourceMessage, contextualLogger)
+	err := k.settleJob(contextualLogger, sourceMessage, j, succeeded)
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	delete(k.settlingJobStore, messageID)
+	if err != nil {
+		// Leave the message inflight so the next event or Reconcile tries again
+		return err
+	}
+	//Remove the message from the inflight message store
+	delete(k.inflightJobStore, messageID)
+	return nil
+}
+
+// settleJob stores the logs for a finished job and accepts its message if it succeeded. Failed
+// jobs have their message rejected so it goes back on the queue to be retried, unless the module
+// reported that retrying won't help
+func (k *Kubernetes) settleJob(contextualLogger *log.Entry, sourceMessage messaging.Message, j *batchv1.Job, succeeded bool) error {
+	var failure jobFailure
+	if succeeded {
+		contextualLogger.Info("job successfully to execute in k8s")
+	} else {
+		contextualLogger.Warning("job failed to execute in k8s")
+
+		pods, err := k.listJobPods(j)
+		if err != nil {
+			contextualLogger.WithError(err).Error("failed to get pods for job, treating failure as transient")
+		}
+		failure = classifyJobFailure(j, pods)
+	}
+
+	logs, err := k.getLogs(j)
+	if err != nil {
+		contextualLogger.WithError(err).Error("failed to get logs for job: getLogsFailed")
+	}
+	err = k.logStore.StoreLogs(contextualLogger, sourceMessage, logs, succeeded)
+	if err != nil {
+		contextualLogger.WithError(err).Error("failed to log to logstore")
 	}
 
+	if succeeded {
+		err = sourceMessage.Accept()
+		if err != nil {
+			contextualLogger.Error("failed to accept message")
+		}
+		return err
+	}
+	err = settleFailedMessage(contextualLogger, sourceMessage, failure)
+	if err != nil {
+		contextualLogger.Error("failed to reject message")
+	}
+	return err
+}
+
+// Abort deletes the job for a message which can no longer be settled, for example because its lock
+// was lost, and forgets the message. The broker will redeliver the message so it isn't settled here
+func (k *Kubernetes) Abort(message messaging.Message) error {
+	if message == nil {
+		return fmt.Errorf("invalid input. Message cannot be nil")
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	delete(k.inflightJobStore, message.ID())
+
+	jobs, err := k.listAllJobs()
+	if err != nil {
+		return err
+	}
+	for i, j := range jobs.Items {
+		if j.Labels[messageIDLabel] != message.ID() {
+			continue
+		}
+		err = k.removeJob(&jobs.Items[i])
+		if err != nil {
+			return err
+		}
+		getLoggerForJob(&jobs.Items[i]).Warning("aborted job")
+	}
 	return nil
 }
 
@@ -254,6 +617,15 @@ func (k *Kubernetes) Dispatch(message messaging.Message) error {
 		return fmt.Errorf("invalid properties. Provider cannot be nil")
 	}
 
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	// If a previous dispatcher already started a job for this message adopt it rather than running the module again
+	if recovered, ok := k.recoveredJobStore[message.ID()]; ok {
+		delete(k.recoveredJobStore, message.ID())
+		return k.adoptJob(message, recovered.job)
+	}
+
 	perJobArgs, err := getMessageHandlerArgs(message)
 	if err != nil {
 		return fmt.Errorf("failed generating handler args from message: %v", err)
@@ -264,12 +636,13 @@ func (k *Kubernetes) Dispatch(message messaging.Message) error {
 
 	eventData, err := message.EventData()
 	labels := map[string]string{
-		dispatcherNameLabel: k.dispatcherName,
-		messageIDLabel:      message.ID(),
-		deliverycountlabel:  strconv.Itoa(message.DeliveryCount()),
-		parentEventID:       eventData.Context.ParentEventID,
-		eventID:             eventData.Context.EventID,
-		moduleName:          eventData.Context.Name,
+		dispatcherNameLabel:   k.dispatcherName,
+		dispatcherModuleLabel: k.moduleName,
+		messageIDLabel:        message.ID(),
+		deliverycountlabel:    strconv.Itoa(message.DeliveryCount()),
+		parentEventID:         eventData.Context.ParentEventID,
+		eventID:               eventData.Context.EventID,
+		moduleName:            eventData.Context.Name,
 	}
 
 	workerEnvVars := []apiv1.EnvVar{
@@ -291,6 +664,19 @@ func (k *Kubernetes) Dispatch(message messaging.Message) error {
 		pullPolicy = apiv1.PullAlways
 	}
 
+	var handlerEnvFrom []apiv1.EnvFromSource
+	if k.handlerSecretName != "" {
+		handlerEnvFrom = []apiv1.EnvFromSource{
+			{
+				SecretRef: &apiv1.SecretEnvSource{
+					LocalObjectReference: apiv1.LocalObjectReference{
+						Name: k.handlerSecretName,
+					},
+				},
+			},
+		}
+	}
+
 	handlerPrepareAgs := append(fullHandlerArgs, "--action=prepare")
 	handlerCommitAgs := append(fullHandlerArgs, "--action=commit")
 	deadlineSeconds := k.jobConfig.MaxRunningTimeMins * 60
@@ -313,6 +699,7 @@ func (k *Kubernetes) Dispatch(message messaging.Message) error {
 							Name:            "prepare",
 							Image:           k.jobConfig.HandlerImage,
 							Args:            handlerPrepareAgs,
+							EnvFrom:         handlerEnvFrom,
 							ImagePullPolicy: pullPolicy,
 							VolumeMounts: []apiv1.VolumeMount{
 								{
@@ -326,6 +713,8 @@ func (k *Kubernetes) Dispatch(message messaging.Message) error {
 							Image:           k.jobConfig.WorkerImage,
 							Env:             workerEnvVars,
 							ImagePullPolicy: pullPolicy,
+							// Surface the end of the module's logs as the failure reason if it doesn't write one
+							TerminationMessagePolicy: apiv1.TerminationMessageFallbackToLogsOnError,
 							VolumeMounts: []apiv1.VolumeMount{
 								{
 									Name:      "ionvolume",
@@ -339,6 +728,7 @@ func (k *Kubernetes) Dispatch(message messaging.Message) error {
 							Name:            "commit",
 							Image:           k.jobConfig.HandlerImage,
 							Args:            handlerCommitAgs,
+							EnvFrom:         handlerEnvFrom,
 							ImagePullPolicy: pullPolicy,
 							VolumeMounts: []apiv1.VolumeMount{
 								{
@@ -362,6 +752,9 @@ func (k *Kubernetes) Dispatch(message messaging.Message) error {
 		},
 	}
 
+	// Apply module specific resources, scheduling and service account
+	k.podCustomisation.applyTo(&job.Spec.Template.Spec)
+
 	// Set pull secrete if specified
 	if k.pullSecret != "" {
 		job.Spec.Template.Spec.ImagePullSecrets = []apiv1.LocalObjectReference{
@@ -388,6 +781,19 @@ func (k *Kubernetes) Dispatch(message messaging.Message) error {
 	return nil
 }
 
+// getJobResult checks whether the job has completed or failed, using the first of those conditions set
+func getJobResult(job *batchv1.Job) (finished, succeeded bool) {
+	for _, condition := range job.Status.Conditions {
+		if condition.Type == batchv1.JobFailed {
+			return true, false
+		}
+		if condition.Type == batchv1.JobComplete {
+			return true, true
+		}
+	}
+	return false, false
+}
+
 func jobIsFinishedAndOlderThanAnHour(condition batchv1.JobCondition) bool {
 	return condition.Type == batchv1.JobFailed ||
 		condition.Type == batchv1.JobComplete &&
@@ -451,6 +857,14 @@ func getClientSet() (*kubernetes.Clientset, error) {
 	return clientset, nil
 }
 
+func getJobDeliveryCount(job *batchv1.Job) int {
+	count, err := strconv.Atoi(job.Labels[deliverycountlabel])
+	if err != nil {
+		return -1
+	}
+	return count
+}
+
 func getJobName(m messaging.Message, moduleName string) string {
 	return strings.ToLower(moduleName+m.ID()) + "-v" + strconv.Itoa(m.DeliveryCount())
 }
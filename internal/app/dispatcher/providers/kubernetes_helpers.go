@@ -0,0 +1,177 @@
+package providers
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/lawrencegripper/ion/internal/pkg/types"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const gpuResourceName apiv1.ResourceName = "nvidia.com/gpu"
+
+// handlerResources are applied to the prepare and commit containers, which only move files
+// and metadata so need far less than the worker
+var handlerResources = apiv1.ResourceRequirements{
+	Requests: apiv1.ResourceList{
+		apiv1.ResourceCPU:    resource.MustParse("100m"),
+		apiv1.ResourceMemory: resource.MustParse("128Mi"),
+	},
+	Limits: apiv1.ResourceList{
+		apiv1.ResourceCPU:    resource.MustParse("1"),
+		apiv1.ResourceMemory: resource.MustParse("512Mi"),
+	},
+}
+
+// podCustomisation holds the module specific pod settings parsed from the KubernetesConfig
+type podCustomisation struct {
+	workerResources    apiv1.ResourceRequirements
+	nodeSelector       map[string]string
+	tolerations        []apiv1.Toleration
+	affinity           *apiv1.Affinity
+	serviceAccountName string
+}
+
+// newPodCustomisation validates and parses the module specific pod settings
+func newPodCustomisation(config *types.KubernetesConfig) (*podCustomisation, error) {
+	p := &podCustomisation{}
+	if config == nil {
+		return p, nil
+	}
+
+	var err error
+	p.workerResources, err = getWorkerResources(config)
+	if err != nil {
+		return nil, err
+	}
+	p.nodeSelector, err = parseNodeSelector(config.NodeSelector)
+	if err != nil {
+		return nil, err
+	}
+	p.tolerations, err = parseTolerations(config.Tolerations)
+	if err != nil {
+		return nil, err
+	}
+	if config.Affinity != "" {
+		p.affinity = &apiv1.Affinity{}
+		err = json.Unmarshal([]byte(config.Affinity), p.affinity)
+		if err != nil {
+			return nil, fmt.Errorf("invalid affinity '%s': %+v", config.Affinity, err)
+		}
+	}
+	p.serviceAccountName = config.ServiceAccountName
+
+	return p, nil
+}
+
+// applyTo sets the customisations on the pod spec of a job. The worker container is matched by name
+func (p *podCustomisation) applyTo(spec *apiv1.PodSpec) {
+	for i := range spec.InitContainers {
+		if spec.InitContainers[i].Name == "worker" {
+			spec.InitContainers[i].Resources = p.workerResources
+		} else {
+			spec.InitContainers[i].Resources = handlerResources
+		}
+	}
+	for i := range spec.Containers {
+		spec.Containers[i].Resources = handlerResources
+	}
+	spec.NodeSelector = p.nodeSelector
+	spec.Tolerations = p.tolerations
+	spec.Affinity = p.affinity
+	spec.ServiceAccountName = p.serviceAccountName
+}
+
+func getWorkerResources(config *types.KubernetesConfig) (apiv1.ResourceRequirements, error) {
+	requirements := apiv1.ResourceRequirements{
+		Requests: apiv1.ResourceList{},
+		Limits:   apiv1.ResourceList{},
+	}
+
+	quantities := []struct {
+		value string
+		name  apiv1.ResourceName
+		list  apiv1.ResourceList
+	}{
+		{config.CPURequest, apiv1.ResourceCPU, requirements.Requests},
+		{config.CPULimit, apiv1.ResourceCPU, requirements.Limits},
+		{config.MemoryRequest, apiv1.ResourceMemory, requirements.Requests},
+		{config.MemoryLimit, apiv1.ResourceMemory, requirements.Limits},
+	}
+	for _, q := range quantities {
+		if q.value == "" {
+			continue
+		}
+		quantity, err := resource.ParseQuantity(q.value)
+		if err != nil {
+			return requirements, fmt.Errorf("invalid %s quantity '%s': %+v", q.name, q.value, err)
+		}
+		q.list[q.name] = quantity
+	}
+
+	// GPUs can only be set as limits, k8s will default the request to match
+	if config.GPUCount > 0 {
+		requirements.Limits[gpuResourceName] = resource.MustParse(strconv.Itoa(config.GPUCount))
+	}
+
+	if len(requirements.Requests) == 0 {
+		requirements.Requests = nil
+	}
+	if len(requirements.Limits) == 0 {
+		requirements.Limits = nil
+	}
+	return requirements, nil
+}
+
+// parseNodeSelector converts entries in the form key=value to a node selector
+func parseNodeSelector(entries []string) (map[string]string, error) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	selector := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid node selector '%s', expected key=value", entry)
+		}
+		selector[parts[0]] = parts[1]
+	}
+	return selector, nil
+}
+
+// parseTolerations converts entries in the form key[=value]:effect to tolerations.
+// An entry without a value tolerates any value for the key
+func parseTolerations(entries []string) ([]apiv1.Toleration, error) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	tolerations := make([]apiv1.Toleration, 0, len(entries))
+	for _, entry := range entries {
+		sep := strings.LastIndex(entry, ":")
+		if sep < 1 {
+			return nil, fmt.Errorf("invalid toleration '%s', expected key[=value]:effect", entry)
+		}
+		toleration := apiv1.Toleration{
+			Effect: apiv1.TaintEffect(entry[sep+1:]),
+		}
+		switch toleration.Effect {
+		case apiv1.TaintEffectNoSchedule, apiv1.TaintEffectPreferNoSchedule, apiv1.TaintEffectNoExecute:
+		default:
+			return nil, fmt.Errorf("invalid toleration '%s', unknown effect '%s'", entry, toleration.Effect)
+		}
+
+		keyValue := strings.SplitN(entry[:sep], "=", 2)
+		toleration.Key = keyValue[0]
+		if len(keyValue) == 2 {
+			toleration.Operator = apiv1.TolerationOpEqual
+			toleration.Value = keyValue[1]
+		} else {
+			toleration.Operator = apiv1.TolerationOpExists
+		}
+		tolerations = append(tolerations, toleration)
+	}
+	return tolerations, nil
+}
@@ -0,0 +1,117 @@
+package providers
+
+import (
+	"testing"
+
+	"github.com/lawrencegripper/ion/internal/pkg/types"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+func TestParseTolerations(t *testing.T) {
+	testCases := []struct {
+		name        string
+		entry       string
+		expected    apiv1.Toleration
+		expectError bool
+	}{
+		{
+			name:  "keyvalue",
+			entry: "sku=gpu:NoSchedule",
+			expected: apiv1.Toleration{
+				Key:      "sku",
+				Operator: apiv1.TolerationOpEqual,
+				Value:    "gpu",
+				Effect:   apiv1.TaintEffectNoSchedule,
+			},
+		},
+		{
+			name:  "keyonly",
+			entry: "dedicated:NoExecute",
+			expected: apiv1.Toleration{
+				Key:      "dedicated",
+				Operator: apiv1.TolerationOpExists,
+				Effect:   apiv1.TaintEffectNoExecute,
+			},
+		},
+		{
+			name:        "noeffect",
+			entry:       "sku=gpu",
+			expectError: true,
+		},
+		{
+			name:        "unknowneffect",
+			entry:       "sku=gpu:Sometimes",
+			expectError: true,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			tolerations, err := parseTolerations([]string{test.entry})
+			if test.expectError {
+				if err == nil {
+					t.Error("expected error parsing toleration")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tolerations[0] != test.expected {
+				t.Errorf("toleration incorrect Expected: %+v Got: %+v", test.expected, tolerations[0])
+			}
+		})
+	}
+}
+
+func TestParseNodeSelector(t *testing.T) {
+	selector, err := parseNodeSelector([]string{"agentpool=gpu", "zone=a=b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if selector["agentpool"] != "gpu" || selector["zone"] != "a=b" {
+		t.Errorf("node selector incorrect Got: %v", selector)
+	}
+
+	_, err = parseNodeSelector([]string{"agentpool"})
+	if err == nil {
+		t.Error("expected error for node selector without a value")
+	}
+}
+
+func TestNewPodCustomisationRejectsInvalidConfig(t *testing.T) {
+	testCases := []struct {
+		name   string
+		config *types.KubernetesConfig
+	}{
+		{
+			name:   "badquantity",
+			config: &types.KubernetesConfig{CPULimit: "lots"},
+		},
+		{
+			name:   "badaffinity",
+			config: &types.KubernetesConfig{Affinity: "{not json"},
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			_, err := newPodCustomisation(test.config)
+			if err == nil {
+				t.Error("expected error for invalid config")
+			}
+		})
+	}
+}
+
+func TestWorkerResourcesEmptyWhenUnset(t *testing.T) {
+	resources, err := getWorkerResources(&types.KubernetesConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resources.Requests != nil || resources.Limits != nil {
+		t.Errorf("expected no resources when unset Got: %+v", resources)
+	}
+}
@@ -35,7 +35,7 @@ func TestIntegrationKubernetesDispatch(t *testing.T) {
 		t.Skip("Skipping integration test in short mode...")
 	}
 
-	p, err := NewKubernetesProvider(config, []string{"-examplearg1=1"})
+	p, err := NewKubernetesProvider(config, []string{"-examplearg1=1"}, map[string]string{})
 	if err != nil {
 		t.Error(err)
 		t.FailNow()
@@ -79,7 +79,7 @@ func TestIntegrationKubernetesDispatch_MaxExecutionTime(t *testing.T) {
 		t.Skip("Skipping integration test in short mode...")
 	}
 
-	p, err := NewKubernetesProvider(config, []string{"-examplearg1=1"})
+	p, err := NewKubernetesProvider(config, []string{"-examplearg1=1"}, map[string]string{})
 	if err != nil {
 		t.Error(err)
 		t.FailNow()
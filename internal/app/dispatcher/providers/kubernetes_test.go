@@ -1,19 +1,25 @@
 package providers
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/lawrencegripper/ion/internal/pkg/common"
 	"github.com/lawrencegripper/ion/internal/pkg/messaging"
 	"github.com/lawrencegripper/ion/internal/pkg/types"
-	"pack.ag/amqp"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 	batchv1 "k8s.io/api/batch/v1"
+	apiv1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
 )
 
 func NewMockKubernetesProvider(create func(b *batchv1.Job) (*batchv1.Job, error), list func() (*batchv1.JobList, error)) (*Kubernetes, error) {
@@ -25,20 +31,62 @@ func NewMockKubernetesProvider(create func(b *batchv1.Job) (*batchv1.Job, error)
 		WorkerImage:  "worker-image",
 	}
 	k.dispatcherName = mockDispatcherName
+	k.podCustomisation = &podCustomisation{}
 
 	k.inflightJobStore = map[string]messaging.Message{}
+	k.settlingJobStore = map[string]bool{}
+	k.recoveredJobStore = map[string]recoveredJob{}
 	k.createJob = create
+	k.updateJob = func(j *batchv1.Job) (*batchv1.Job, error) {
+		return j, nil
+	}
+	k.getJob = func(name string) (*batchv1.Job, error) {
+		jobs, err := list()
+		if err != nil {
+			return nil, err
+		}
+		for i := range jobs.Items {
+			if jobs.Items[i].Name == name {
+				return &jobs.Items[i], nil
+			}
+		}
+		return nil, apierrors.NewNotFound(batchv1.Resource("jobs"), name)
+	}
 	k.listAllJobs = list
+	k.listModuleJobs = list
+	k.jobListWatcher = newMockJobListWatcher(list, func() watch.Interface {
+		return watch.NewFake()
+	})
 	k.removeJob = func(j *batchv1.Job) error {
 		return nil
 	}
 	k.getLogs = func(b *batchv1.Job) (string, error) {
 		return "logs", fmt.Errorf("failed getting logs")
 	}
+	k.listJobPods = func(b *batchv1.Job) ([]apiv1.Pod, error) {
+		return []apiv1.Pod{}, nil
+	}
+	k.dispatcherExists = func(name string) (bool, error) {
+		return true, nil
+	}
 	k.logStore = &LogStore{}
 	return &k, nil
 }
 
+func newMockJobListWatcher(list func() (*batchv1.JobList, error), newWatch func() watch.Interface) cache.ListerWatcher {
+	return &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			if list == nil {
+				return &batchv1.JobList{}, nil
+			}
+			return list()
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			return newWatch(), nil
+		},
+	}
+}
+
 func TestGetJobName(t *testing.T) {
 	messageToSend := MockMessage{
 		MessageID:          mockMessageID,
@@ -226,6 +274,94 @@ func TestK8s_DispatchedJobConfiguration(t *testing.T) {
 	}
 }
 
+func TestK8s_DispatchedJobCustomisation(t *testing.T) {
+	inMemMockJobStore := []batchv1.Job{}
+
+	create := func(b *batchv1.Job) (*batchv1.Job, error) {
+		inMemMockJobStore = append(inMemMockJobStore, *b)
+		return b, nil
+	}
+
+	k, _ := NewMockKubernetesProvider(create, nil)
+	customisation, err := newPodCustomisation(&types.KubernetesConfig{
+		CPURequest:         "500m",
+		MemoryLimit:        "2Gi",
+		GPUCount:           1,
+		NodeSelector:       []string{"agentpool=gpu"},
+		Tolerations:        []string{"sku=gpu:NoSchedule"},
+		Affinity:           `{"nodeAffinity":{"requiredDuringSchedulingIgnoredDuringExecution":{"nodeSelectorTerms":[{"matchExpressions":[{"key":"zone","operator":"In","values":["a"]}]}]}}}`,
+		ServiceAccountName: "module-sa",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.podCustomisation = customisation
+
+	err = k.Dispatch(newNoOpMockMessage(mockMessageID))
+	if err != nil {
+		t.Error(err)
+	}
+
+	spec := inMemMockJobStore[0].Spec.Template.Spec
+	worker := spec.InitContainers[1]
+	if cpu := worker.Resources.Requests[apiv1.ResourceCPU]; cpu.String() != "500m" {
+		t.Errorf("worker cpu request wrong Expected: 500m Got: %s", cpu.String())
+	}
+	if memory := worker.Resources.Limits[apiv1.ResourceMemory]; memory.String() != "2Gi" {
+		t.Errorf("worker memory limit wrong Expected: 2Gi Got: %s", memory.String())
+	}
+	if gpu := worker.Resources.Limits[gpuResourceName]; gpu.String() != "1" {
+		t.Errorf("worker gpu limit wrong Expected: 1 Got: %s", gpu.String())
+	}
+	for _, handler := range []apiv1.Container{spec.InitContainers[0], spec.Containers[0]} {
+		if _, ok := handler.Resources.Limits[gpuResourceName]; ok {
+			t.Errorf("handler container %s shouldn't request a gpu", handler.Name)
+		}
+		if _, ok := handler.Resources.Limits[apiv1.ResourceMemory]; !ok {
+			t.Errorf("handler container %s should have default resources", handler.Name)
+		}
+	}
+	if spec.NodeSelector["agentpool"] != "gpu" {
+		t.Errorf("node selector not set Got: %v", spec.NodeSelector)
+	}
+	if len(spec.Tolerations) != 1 || spec.Tolerations[0].Key != "sku" {
+		t.Errorf("tolerations not set Got: %v", spec.Tolerations)
+	}
+	if spec.Affinity == nil || spec.Affinity.NodeAffinity == nil {
+		t.Error("affinity not set")
+	}
+	if spec.ServiceAccountName != "module-sa" {
+		t.Errorf("service account wrong Expected: module-sa Got: %s", spec.ServiceAccountName)
+	}
+}
+
+func TestK8s_DispatchedJobUsesHandlerSecret(t *testing.T) {
+	inMemMockJobStore := []batchv1.Job{}
+
+	create := func(b *batchv1.Job) (*batchv1.Job, error) {
+		inMemMockJobStore = append(inMemMockJobStore, *b)
+		return b, nil
+	}
+
+	k, _ := NewMockKubernetesProvider(create, nil)
+	k.handlerSecretName = "ion-handler-module"
+
+	err := k.Dispatch(newNoOpMockMessage(mockMessageID))
+	if err != nil {
+		t.Error(err)
+	}
+
+	spec := inMemMockJobStore[0].Spec.Template.Spec
+	for _, handler := range []apiv1.Container{spec.InitContainers[0], spec.Containers[0]} {
+		if len(handler.EnvFrom) != 1 || handler.EnvFrom[0].SecretRef == nil || handler.EnvFrom[0].SecretRef.Name != k.handlerSecretName {
+			t.Errorf("handler container %s should read its environment from the handler secret Got: %+v", handler.Name, handler.EnvFrom)
+		}
+	}
+	if len(spec.InitContainers[1].EnvFrom) != 0 {
+		t.Error("worker container shouldn't be given the handler secrets")
+	}
+}
+
 func CheckLabelsAssignedCorrectly(t *testing.T, job batchv1.Job, expectedMessageID string) {
 	testCases := []struct {
 		labelName     string
@@ -383,12 +519,618 @@ func TestReconcileJobFailed(t *testing.T) {
 	}
 }
 
+func TestReconcileJobFailedPermanently(t *testing.T) {
+	inMemMockJobStore := []batchv1.Job{}
+
+	create := func(b *batchv1.Job) (*batchv1.Job, error) {
+		inMemMockJobStore = append(inMemMockJobStore, *b)
+		return b, nil
+	}
+
+	list := func() (*batchv1.JobList, error) {
+		return &batchv1.JobList{
+			Items: inMemMockJobStore,
+		}, nil
+	}
+
+	k, _ := NewMockKubernetesProvider(create, list)
+	k.listJobPods = func(b *batchv1.Job) ([]apiv1.Pod, error) {
+		return []apiv1.Pod{
+			podWithContainerState("worker", apiv1.ContainerState{
+				Terminated: &apiv1.ContainerStateTerminated{
+					ExitCode: common.PermanentFailureExitCode,
+					Message:  "unsupported file format",
+				},
+			}),
+		}, nil
+	}
+
+	var rejectedMessage bool
+	var deadLetterReason string
+	messageToSend := MockMessage{
+		MessageID: mockMessageID,
+		Rejected: func() {
+			rejectedMessage = true
+		},
+		DeadLettered: func(reason string) {
+			deadLetterReason = reason
+		},
+	}
+
+	err := k.Dispatch(messageToSend)
+	if err != nil {
+		t.Error(err)
+	}
+
+	job := &inMemMockJobStore[0]
+	job.Status.Conditions = append(job.Status.Conditions, batchv1.JobCondition{
+		Type: batchv1.JobFailed,
+	})
+
+	err = k.Reconcile()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if rejectedMessage {
+		t.Error("Permanently failed job shouldn't be retried")
+	}
+	if !strings.Contains(deadLetterReason, "unsupported file format") {
+		t.Errorf("Expected message to be dead lettered with the module's reason Got: %s", deadLetterReason)
+	}
+	if len(k.inflightJobStore) != 0 {
+		t.Error("Reconcile should remove jobs from the inmemory store once it has dead lettered them")
+	}
+}
+
+func TestAbortRemovesJob(t *testing.T) {
+	inMemMockJobStore := []batchv1.Job{}
+
+	create := func(b *batchv1.Job) (*batchv1.Job, error) {
+		inMemMockJobStore = append(inMemMockJobStore, *b)
+		return b, nil
+	}
+
+	list := func() (*batchv1.JobList, error) {
+		return &batchv1.JobList{
+			Items: inMemMockJobStore,
+		}, nil
+	}
+
+	k, _ := NewMockKubernetesProvider(create, list)
+
+	var removedJobs []string
+	k.removeJob = func(j *batchv1.Job) error {
+		removedJobs = append(removedJobs, j.Name)
+		return nil
+	}
+
+	messageToSend := MockMessage{
+		MessageID: mockMessageID,
+		Accepted: func() {
+			t.Error("message shouldn't be accepted when its job is aborted")
+		},
+		Rejected: func() {
+			t.Error("message shouldn't be rejected when its job is aborted")
+		},
+	}
+	err := k.Dispatch(messageToSend)
+	if err != nil {
+		t.Error(err)
+	}
+	err = k.Dispatch(newNoOpMockMessage("othermessage"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = k.Abort(messageToSend)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(removedJobs) != 1 || removedJobs[0] != inMemMockJobStore[0].Name {
+		t.Errorf("expected only the aborted message's job to be removed, got: %v", removedJobs)
+	}
+	if k.InProgressCount() != 1 {
+		t.Errorf("expected aborted message to be removed from the inflight store, in progress: %v", k.InProgressCount())
+	}
+}
+
+func TestWatchSettlesCompletedJob(t *testing.T) {
+	inMemMockJobStore := []batchv1.Job{}
+
+	create := func(b *batchv1.Job) (*batchv1.Job, error) {
+		inMemMockJobStore = append(inMemMockJobStore, *b)
+		return b, nil
+	}
+
+	list := func() (*batchv1.JobList, error) {
+		return &batchv1.JobList{
+			Items: inMemMockJobStore,
+		}, nil
+	}
+
+	k, _ := NewMockKubernetesProvider(create, list)
+	fakeWatcher := watch.NewFake()
+	k.jobListWatcher = newMockJobListWatcher(list, func() watch.Interface {
+		return fakeWatcher
+	})
+
+	accepted := make(chan struct{})
+	messageToSend := MockMessage{
+		MessageID: mockMessageID,
+		Accepted: func() {
+			close(accepted)
+		},
+	}
+
+	err := k.Dispatch(messageToSend)
+	if err != nil {
+		t.Error(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go k.Watch(ctx)
+
+	// A job which is still running shouldn't be settled
+	job := inMemMockJobStore[0]
+	fakeWatcher.Modify(&job)
+
+	completedJob := job.DeepCopy()
+	completedJob.Status.Conditions = append(completedJob.Status.Conditions, batchv1.JobCondition{
+		Type: batchv1.JobComplete,
+	})
+	fakeWatcher.Modify(completedJob)
+
+	select {
+	case <-accepted:
+	case <-time.After(time.Second * 5):
+		t.Fatal("Failed to accept message from watch event. Expected message to be marked as accepted as job is complete")
+	}
+
+	if k.InProgressCount() != 0 {
+		t.Error("Watch should remove jobs from the inmemory store once it has accepted or rejected them")
+	}
+}
+
+func TestWatchRestartsWhenClosed(t *testing.T) {
+	k, _ := NewMockKubernetesProvider(nil, nil)
+
+	watchStarted := make(chan *watch.FakeWatcher, 2)
+	k.jobListWatcher = newMockJobListWatcher(nil, func() watch.Interface {
+		fakeWatcher := watch.NewFake()
+		watchStarted <- fakeWatcher
+		return fakeWatcher
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go k.Watch(ctx)
+
+	select {
+	case firstWatcher := <-watchStarted:
+		firstWatcher.Stop()
+	case <-time.After(time.Second * 5):
+		t.Fatal("expected watch to be started")
+	}
+
+	select {
+	case <-watchStarted:
+	case <-time.After(time.Second * 5):
+		t.Fatal("expected watch to be restarted after it was closed")
+	}
+}
+
+func TestReconcileSettlesJobWithoutHoldingLock(t *testing.T) {
+	inMemMockJobStore := []batchv1.Job{}
+
+	create := func(b *batchv1.Job) (*batchv1.Job, error) {
+		inMemMockJobStore = append(inMemMockJobStore, *b)
+		return b, nil
+	}
+
+	list := func() (*batchv1.JobList, error) {
+		return &batchv1.JobList{
+			Items: inMemMockJobStore,
+		}, nil
+	}
+
+	k, _ := NewMockKubernetesProvider(create, list)
+
+	acceptCount := 0
+	messageToSend := MockMessage{
+		MessageID: mockMessageID,
+		Accepted: func() {
+			acceptCount++
+		},
+	}
+
+	err := k.Dispatch(messageToSend)
+	if err != nil {
+		t.Error(err)
+	}
+
+	job := &inMemMockJobStore[0]
+	job.Status.Conditions = append(job.Status.Conditions, batchv1.JobCondition{
+		Type: batchv1.JobComplete,
+	})
+
+	// Getting logs is slow, other calls shouldn't block on it and an event for the
+	// same job arriving meanwhile shouldn't settle the message a second time
+	k.getLogs = func(b *batchv1.Job) (string, error) {
+		if k.InProgressCount() != 1 {
+			t.Error("expected message to stay inflight until it is settled")
+		}
+		err := k.reconcileJob(b)
+		if err != nil {
+			t.Error(err)
+		}
+		return "logs", nil
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- k.Reconcile()
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("reconcile blocked, expected logs to be got without holding the lock")
+	}
+
+	if acceptCount != 1 {
+		t.Errorf("expected message to be accepted once, got %d", acceptCount)
+	}
+	if k.InProgressCount() != 0 {
+		t.Error("expected message to be removed from the inflight store once settled")
+	}
+}
+
+func newRecoveredJob(dispatcherName string, deliveryCount int, conditions ...batchv1.JobConditionType) batchv1.Job {
+	job := batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "recoveredjob",
+			Labels: map[string]string{
+				dispatcherNameLabel:   dispatcherName,
+				dispatcherModuleLabel: "module",
+				messageIDLabel:        mockMessageID,
+				eventID:               "barry",
+				deliverycountlabel:    strconv.Itoa(deliveryCount),
+			},
+		},
+	}
+	for _, c := range conditions {
+		job.Status.Conditions = append(job.Status.Conditions, batchv1.JobCondition{
+			Type: c,
+		})
+	}
+	return job
+}
+
+func TestRecoverJobsAdoptsRunningJob(t *testing.T) {
+	inMemMockJobStore := []batchv1.Job{
+		newRecoveredJob("previousdispatcher", 0),
+	}
+	var created, updated []batchv1.Job
+
+	create := func(b *batchv1.Job) (*batchv1.Job, error) {
+		created = append(created, *b)
+		return b, nil
+	}
+
+	list := func() (*batchv1.JobList, error) {
+		return &batchv1.JobList{
+			Items: inMemMockJobStore,
+		}, nil
+	}
+
+	k, _ := NewMockKubernetesProvider(create, list)
+	k.updateJob = func(j *batchv1.Job) (*batchv1.Job, error) {
+		updated = append(updated, *j)
+		return j, nil
+	}
+
+	err := k.RecoverJobs()
+	if err != nil {
+		t.Error(err)
+	}
+
+	messageToSend := newNoOpMockMessage(mockMessageID)
+	messageToSend.DeliveryCountValue = 1
+
+	err = k.Dispatch(messageToSend)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(created) != 0 {
+		t.Errorf("Expected recovered job to be adopted, not recreated. Created: %v", len(created))
+	}
+	if len(updated) != 1 {
+		t.Fatalf("Expected recovered job to be relabelled Got: %v updates", len(updated))
+	}
+	if updated[0].Labels[dispatcherNameLabel] != mockDispatcherName {
+		t.Errorf("Expected job to be relabelled with dispatcher name Got: %s", updated[0].Labels[dispatcherNameLabel])
+	}
+	if updated[0].Labels[deliverycountlabel] != "1" {
+		t.Errorf("Expected job to be relabelled with delivery count Got: %s", updated[0].Labels[deliverycountlabel])
+	}
+	if inMemMockJobStore[0].Labels[dispatcherNameLabel] != "previousdispatcher" {
+		t.Error("Adopting a job shouldn't modify the recovered copy")
+	}
+	if k.InProgressCount() != 1 {
+		t.Errorf("Expected adopted message to be in flight Got: %v", k.InProgressCount())
+	}
+	if len(k.recoveredJobStore) != 0 {
+		t.Error("Expected adopted job to be removed from the recovered store")
+	}
+}
+
+func TestRecoverJobsSettlesFinishedJob(t *testing.T) {
+	testCases := []struct {
+		name           string
+		condition      batchv1.JobConditionType
+		expectAccepted bool
+	}{
+		{
+			name:           "completed",
+			condition:      batchv1.JobComplete,
+			expectAccepted: true,
+		},
+		{
+			name:           "failed",
+			condition:      batchv1.JobFailed,
+			expectAccepted: false,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			inMemMockJobStore := []batchv1.Job{
+				newRecoveredJob("previousdispatcher", 0, test.condition),
+			}
+
+			list := func() (*batchv1.JobList, error) {
+				return &batchv1.JobList{
+					Items: inMemMockJobStore,
+				}, nil
+			}
+
+			k, _ := NewMockKubernetesProvider(nil, list)
+			removed := false
+			k.removeJob = func(j *batchv1.Job) error {
+				removed = true
+				return nil
+			}
+
+			err := k.RecoverJobs()
+			if err != nil {
+				t.Error(err)
+			}
+
+			var accepted, rejected bool
+			messageToSend := MockMessage{
+				MessageID: mockMessageID,
+				Accepted: func() {
+					accepted = true
+				},
+				Rejected: func() {
+					rejected = true
+				},
+			}
+
+			err = k.Dispatch(messageToSend)
+			if err != nil {
+				t.Error(err)
+			}
+
+			if accepted != test.expectAccepted || rejected == test.expectAccepted {
+				t.Errorf("Message settled incorrectly Accepted: %v Rejected: %v", accepted, rejected)
+			}
+			if !removed {
+				t.Error("Expected finished recovered job to be removed")
+			}
+			if k.InProgressCount() != 0 {
+				t.Error("Settled message shouldn't be in flight")
+			}
+		})
+	}
+}
+
+func TestRecoverJobsAbandonsMessageWhenAdoptFails(t *testing.T) {
+	inMemMockJobStore := []batchv1.Job{
+		newRecoveredJob("previousdispatcher", 0),
+	}
+
+	list := func() (*batchv1.JobList, error) {
+		return &batchv1.JobList{
+			Items: inMemMockJobStore,
+		}, nil
+	}
+
+	k, _ := NewMockKubernetesProvider(nil, list)
+	k.updateJob = func(j *batchv1.Job) (*batchv1.Job, error) {
+		return nil, fmt.Errorf("simulated update failure")
+	}
+
+	err := k.RecoverJobs()
+	if err != nil {
+		t.Error(err)
+	}
+
+	rejected := false
+	messageToSend := MockMessage{
+		MessageID: mockMessageID,
+		Rejected: func() {
+			rejected = true
+		},
+	}
+
+	err = k.Dispatch(messageToSend)
+	if err == nil {
+		t.Error("Expected error ... didn't see one!")
+	}
+	if !rejected {
+		t.Error("Expected message to be abandoned when job can't be adopted")
+	}
+	if k.InProgressCount() != 0 {
+		t.Error("Abandoned message shouldn't be in flight")
+	}
+}
+
+func TestRecoverJobsKeepsLatestAttempt(t *testing.T) {
+	latest := newRecoveredJob("previousdispatcher", 2)
+	latest.Name = "latest"
+	inMemMockJobStore := []batchv1.Job{
+		newRecoveredJob("previousdispatcher", 1),
+		latest,
+		newRecoveredJob("previousdispatcher", 0),
+	}
+
+	list := func() (*batchv1.JobList, error) {
+		return &batchv1.JobList{
+			Items: inMemMockJobStore,
+		}, nil
+	}
+
+	k, _ := NewMockKubernetesProvider(nil, list)
+
+	err := k.RecoverJobs()
+	if err != nil {
+		t.Error(err)
+	}
+
+	recovered, ok := k.recoveredJobStore[mockMessageID]
+	if !ok {
+		t.Fatal("Expected job to be recovered")
+	}
+	if recovered.job.Name != "latest" {
+		t.Errorf("Expected latest attempt to be recovered Got: %s", recovered.job.Name)
+	}
+}
+
+func TestExpireRecoveredJobs(t *testing.T) {
+	testCases := []struct {
+		name                 string
+		current              []batchv1.Job
+		liveDispatchers      []string
+		dispatcherCheckError error
+		expectRemoved        bool
+		expectForgotten      bool
+	}{
+		{
+			name:            "running with live dispatcher",
+			current:         []batchv1.Job{newRecoveredJob("otherdispatcher", 0)},
+			liveDispatchers: []string{"otherdispatcher"},
+			expectRemoved:   false,
+			expectForgotten: true,
+		},
+		{
+			name:            "running with dispatcher gone",
+			current:         []batchv1.Job{newRecoveredJob("otherdispatcher", 0)},
+			expectRemoved:   true,
+			expectForgotten: true,
+		},
+		{
+			name:            "finished with live dispatcher",
+			current:         []batchv1.Job{newRecoveredJob("otherdispatcher", 0, batchv1.JobComplete)},
+			liveDispatchers: []string{"otherdispatcher"},
+			expectRemoved:   true,
+			expectForgotten: true,
+		},
+		{
+			name:            "adopted by live dispatcher since recovery",
+			current:         []batchv1.Job{newRecoveredJob("adoptingdispatcher", 1)},
+			liveDispatchers: []string{"adoptingdispatcher"},
+			expectRemoved:   false,
+			expectForgotten: true,
+		},
+		{
+			name:            "already removed",
+			expectRemoved:   false,
+			expectForgotten: true,
+		},
+		{
+			name:                 "failed to check dispatcher",
+			current:              []batchv1.Job{newRecoveredJob("otherdispatcher", 0)},
+			dispatcherCheckError: fmt.Errorf("simulated pod get failure"),
+			expectRemoved:        false,
+			expectForgotten:      false,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			list := func() (*batchv1.JobList, error) {
+				return &batchv1.JobList{
+					Items: test.current,
+				}, nil
+			}
+
+			k, _ := NewMockKubernetesProvider(nil, list)
+			removed := false
+			k.removeJob = func(j *batchv1.Job) error {
+				removed = true
+				return nil
+			}
+			k.dispatcherExists = func(name string) (bool, error) {
+				for _, d := range test.liveDispatchers {
+					if d == name {
+						return true, nil
+					}
+				}
+				return false, test.dispatcherCheckError
+			}
+			k.recoveredJobStore[mockMessageID] = recoveredJob{
+				job:         newRecoveredJob("previousdispatcher", 0),
+				recoveredAt: time.Now().Add(-2 * time.Hour),
+			}
+
+			k.expireRecoveredJobs()
+
+			if removed != test.expectRemoved {
+				t.Errorf("Expected job removed: %v Got: %v", test.expectRemoved, removed)
+			}
+			if _, ok := k.recoveredJobStore[mockMessageID]; ok == test.expectForgotten {
+				t.Errorf("Expected job forgotten: %v Got: %v", test.expectForgotten, !ok)
+			}
+		})
+	}
+}
+
+func TestExpireRecoveredJobsWaitsForRedelivery(t *testing.T) {
+	k, _ := NewMockKubernetesProvider(nil, nil)
+	k.removeJob = func(j *batchv1.Job) error {
+		t.Error("Expected recent recovered job not to be removed")
+		return nil
+	}
+	k.recoveredJobStore[mockMessageID] = recoveredJob{
+		job:         newRecoveredJob("previousdispatcher", 0),
+		recoveredAt: time.Now(),
+	}
+
+	k.expireRecoveredJobs()
+
+	if _, ok := k.recoveredJobStore[mockMessageID]; !ok {
+		t.Error("Expected recent recovered job to be kept")
+	}
+}
+
 // AmqpMessage Wrapper for amqp
 type MockMessage struct {
 	MessageID          string
 	DeliveryCountValue int
 	Accepted           func()
 	Rejected           func()
+	Released           func()
+	DeadLettered       func(reason string)
 	JSONValue          string
 }
 
@@ -401,6 +1143,9 @@ func newNoOpMockMessage(id string) MockMessage {
 	message.Rejected = func() {
 		log.WithField("messageID", message.MessageID).Info("message rejected")
 	}
+	message.DeadLettered = func(reason string) {
+		log.WithField("messageID", message.MessageID).WithField("reason", reason).Info("message dead lettered")
+	}
 	return message
 }
 
@@ -409,11 +1154,6 @@ func (m MockMessage) DeliveryCount() int {
 	return m.DeliveryCountValue
 }
 
-// GetAMQPMessage get the original amqp message
-func (m MockMessage) GetAMQPMessage() *amqp.Message {
-	return nil
-}
-
 // ID get the ID
 func (m MockMessage) ID() string {
 	return m.MessageID
@@ -436,6 +1176,20 @@ func (m MockMessage) Reject() error {
 	return nil
 }
 
+// Release hand the message back without counting a failed delivery
+func (m MockMessage) Release() error {
+	if m.Released != nil {
+		m.Released()
+	}
+	return nil
+}
+
+// DeadLetter mark the message as failed permanently
+func (m MockMessage) DeadLetter(reason string) error {
+	m.DeadLettered(reason)
+	return nil
+}
+
 // EventData deserialize json value to type
 func (m MockMessage) EventData() (common.Event, error) {
 	a := common.Event{}
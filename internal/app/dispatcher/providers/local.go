@@ -0,0 +1,336 @@
+package providers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lawrencegripper/ion/internal/pkg/messaging"
+	"github.com/lawrencegripper/ion/internal/pkg/types"
+	log "github.com/sirupsen/logrus"
+)
+
+//Check providers match interface at compile time
+var _ Provider = &Local{}
+
+// localJobResult holds the outcome of a job run as local processes
+type localJobResult struct {
+	logs    string
+	err     error
+	baseDir string
+}
+
+// localJobError records which step of a local job failed
+type localJobError struct {
+	step string
+	err  error
+}
+
+func (e *localJobError) Error() string {
+	return fmt.Sprintf("%s failed: %+v", e.step, e.err)
+}
+
+// Local runs the prepare, worker and commit steps of a job as processes on the local machine
+type Local struct {
+	inprogressJobStore map[string]messaging.Message
+	completedJobStore  map[string]localJobResult
+	cancelJobStore     map[string]context.CancelFunc
+	mu                 sync.Mutex
+	handlerArgs        []string
+	handlerEnvVars     []string
+	workerEnvVars      map[string]interface{}
+	ctx                context.Context
+	cancelOps          context.CancelFunc
+	logStore           *LogStore
+
+	jobConfig   *types.JobConfig
+	localConfig *types.LocalConfig
+
+	// Used to allow mocking of process execution for testing
+	runJob func(ctx context.Context, baseDir string, handlerArgs, workerEnv []string) (string, error)
+}
+
+// NewLocalProvider creates a provider which runs jobs as local processes
+func NewLocalProvider(config *types.Configuration, sharedHandlerArgs []string, handlerSecrets map[string]string) (*Local, error) {
+	if config == nil || config.Local == nil || config.Job == nil {
+		return nil, fmt.Errorf("Cannot create a provider - invalid configuration, require config, Local and Job")
+	}
+	if config.Local.HandlerBinary == "" || config.Local.WorkerBinary == "" {
+		return nil, fmt.Errorf("Cannot create a provider - invalid configuration, require handler and worker binary paths")
+	}
+
+	l := Local{}
+	l.handlerArgs = sharedHandlerArgs
+	// Secrets are passed to the handler processes in their environment rather than as arguments
+	for _, name := range getSortedSecretNames(handlerSecrets) {
+		l.handlerEnvVars = append(l.handlerEnvVars, name+"="+handlerSecrets[name])
+	}
+	l.inprogressJobStore = make(map[string]messaging.Message)
+	l.completedJobStore = make(map[string]localJobResult)
+	l.cancelJobStore = make(map[string]context.CancelFunc)
+	l.jobConfig = config.Job
+	l.localConfig = config.Local
+	l.workerEnvVars = map[string]interface{}{}
+	if config.Handler != nil {
+		l.workerEnvVars["HANDLER_PORT"] = config.Handler.ServerPort
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	l.ctx = ctx
+	l.cancelOps = cancel
+
+	// Add module specific config
+	envs, err := getModuleEnvironmentVars(config.ModuleConfigPath)
+	if err != nil {
+		log.WithField("filepath", config.ModuleConfigPath).Error("failed to load addition module config from file")
+	} else {
+		for key, value := range envs {
+			l.workerEnvVars[key] = value
+		}
+	}
+
+	if l.localConfig.BaseDir != "" {
+		err = os.MkdirAll(l.localConfig.BaseDir, os.ModePerm)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create local base directory '%s': %+v", l.localConfig.BaseDir, err)
+		}
+	}
+
+	l.runJob = func(ctx context.Context, baseDir string, handlerArgs, workerEnv []string) (string, error) {
+		return runLocalJob(ctx, l.localConfig, baseDir, handlerArgs, l.handlerEnvVars, workerEnv)
+	}
+
+	if config.Handler != nil &&
+		config.Handler.MongoDBDocumentStorageProvider != nil &&
+		config.Handler.AzureBlobStorageProvider != nil &&
+		config.Handler.AzureBlobStorageProvider.BlobAccountName != "" {
+		l.logStore, err = NewLogStore(config.Handler.MongoDBDocumentStorageProvider, config.Handler.AzureBlobStorageProvider, config.ModuleName)
+		if err != nil {
+			log.WithError(err).Error("failed to create log store")
+			return nil, err
+		}
+	} else {
+		log.Info("Skipping logstore config as not provided")
+		l.logStore = &LogStore{}
+	}
+
+	return &l, nil
+}
+
+//GetActiveMessages gets the currently active messages
+func (l *Local) GetActiveMessages() []messaging.Message {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	activeMessages := make([]messaging.Message, 0, len(l.inprogressJobStore))
+	for _, m := range l.inprogressJobStore {
+		activeMessages = append(activeMessages, m)
+	}
+	return activeMessages
+}
+
+// InProgressCount provides a count of the currently running jobs
+func (l *Local) InProgressCount() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return len(l.inprogressJobStore)
+}
+
+// Dispatch starts the processes for the message in the background
+func (l *Local) Dispatch(message messaging.Message) error {
+	if message == nil {
+		return fmt.Errorf("invalid input. Message cannot be nil")
+	}
+	if l == nil {
+		return fmt.Errorf("invalid properties. Provider cannot be nil")
+	}
+
+	perJobArgs, err := getMessageHandlerArgs(message)
+	if err != nil {
+		return fmt.Errorf("failed generating handler args from message: %v", err)
+	}
+	fullHandlerArgs := append(l.handlerArgs, perJobArgs...)
+	//Prevent later append calls overwriting original backing array: https://stackoverflow.com/a/40036950/3437018
+	fullHandlerArgs = fullHandlerArgs[:len(fullHandlerArgs):len(fullHandlerArgs)]
+
+	// Each job gets its own directory which takes the place of '/ion' in the container providers
+	baseDir, err := ioutil.TempDir(l.localConfig.BaseDir, message.ID()+"-v"+strconv.Itoa(message.DeliveryCount())+"-")
+	if err != nil {
+		log.WithError(err).Error("failed creating base directory for local job")
+		mErr := message.Reject()
+		if mErr != nil {
+			log.WithError(mErr).Error("failed rejecting message after failing to create local job")
+		}
+		return err
+	}
+
+	workerEnvVars := []string{
+		"SHARED_SECRET=" + message.ID(), //Todo: source from common place with args
+		"HANDLER_BASE_DIR=" + baseDir,
+	}
+	for key, value := range l.workerEnvVars {
+		workerEnvVars = append(workerEnvVars, fmt.Sprintf("%s=%v", key, value))
+	}
+
+	// Each job can be cancelled on its own if it needs to be aborted
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if l.jobConfig.MaxRunningTimeMins > 0 {
+		ctx, cancel = context.WithTimeout(l.ctx, time.Duration(l.jobConfig.MaxRunningTimeMins)*time.Minute)
+	} else {
+		ctx, cancel = context.WithCancel(l.ctx)
+	}
+
+	messageID := message.ID()
+	l.mu.Lock()
+	l.inprogressJobStore[messageID] = message
+	l.cancelJobStore[messageID] = cancel
+	l.mu.Unlock()
+
+	go func() {
+		defer cancel()
+
+		logs, err := l.runJob(ctx, baseDir, fullHandlerArgs, workerEnvVars)
+
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		delete(l.cancelJobStore, messageID)
+		l.completedJobStore[messageID] = localJobResult{
+			logs:    logs,
+			err:     err,
+			baseDir: baseDir,
+		}
+	}()
+
+	log.WithField("messageid", messageID).WithField("basedir", baseDir).Info("local job started for message")
+	return nil
+}
+
+// Abort kills the processes for a message which can no longer be settled, for example because its lock
+// was lost, and forgets the message. The broker will redeliver the message so it isn't settled here
+func (l *Local) Abort(message messaging.Message) error {
+	if message == nil {
+		return fmt.Errorf("invalid input. Message cannot be nil")
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.inprogressJobStore, message.ID())
+	if cancel, ok := l.cancelJobStore[message.ID()]; ok {
+		cancel()
+		delete(l.cancelJobStore, message.ID())
+		log.WithField("messageID", message.ID()).Warning("aborted local job")
+	}
+	return nil
+}
+
+// Reconcile will accept or reject messages for jobs which have finished running
+func (l *Local) Reconcile() error {
+	if l == nil {
+		return fmt.Errorf("invalid properties. Provider cannot be nil")
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for messageID, result := range l.completedJobStore {
+		contextualLogger := log.WithField("messageID", messageID).WithField("basedir", result.baseDir)
+
+		sourceMessage, ok := l.inprogressJobStore[messageID]
+		if !ok {
+			contextualLogger.Info("local job seen without source message... skipping")
+			err := os.RemoveAll(result.baseDir)
+			if err != nil {
+				contextualLogger.WithError(err).Error("failed to remove base directory for local job")
+			}
+			delete(l.completedJobStore, messageID)
+			continue
+		}
+
+		contextualLogger = GetLoggerForMessage(sourceMessage, contextualLogger)
+		jobSucceeded := result.err == nil
+
+		err := l.logStore.StoreLogs(contextualLogger, sourceMessage, result.logs, jobSucceeded)
+		if err != nil {
+			contextualLogger.WithError(err).Error("failed to log to logstore")
+		}
+
+		err = os.RemoveAll(result.baseDir)
+		if err != nil {
+			contextualLogger.WithError(err).Error("failed to remove base directory for local job")
+		}
+
+		if jobSucceeded {
+			// Job succeeded - accept the message so it is removed from the queue
+			contextualLogger.Info("local job completed successfully")
+			err = sourceMessage.Accept()
+			if err != nil {
+				contextualLogger.Error("failed to accept message")
+				return err
+			}
+		} else {
+			// Job failed - retry it unless the module reported it can't succeed
+			contextualLogger.WithError(result.err).Warning("local job failed to execute")
+			err = settleFailedMessage(contextualLogger, sourceMessage, classifyLocalFailure(result.err))
+			if err != nil {
+				contextualLogger.Error("failed to reject message")
+				return err
+			}
+		}
+
+		//Remove the message from the inflight message store
+		delete(l.inprogressJobStore, messageID)
+		delete(l.completedJobStore, messageID)
+	}
+
+	return nil
+}
+
+// runLocalJob runs prepare, worker and commit one after the other, stopping at the first failure
+func runLocalJob(ctx context.Context, config *types.LocalConfig, baseDir string, handlerArgs, handlerEnv, workerEnv []string) (string, error) {
+	handlerArgs = append(handlerArgs, "--basedir="+baseDir)
+	handlerArgs = handlerArgs[:len(handlerArgs):len(handlerArgs)]
+
+	stringBuilder := strings.Builder{}
+
+	stringBuilder.WriteString("\n\n ------ Preparer logs ------ \n\n") //nolint: errcheck
+	logs, err := runLocalProcess(ctx, config.HandlerBinary, append(handlerArgs, "--action=prepare"), handlerEnv)
+	stringBuilder.WriteString(logs) //nolint: errcheck
+	if err != nil {
+		return stringBuilder.String(), &localJobError{step: "prepare", err: err}
+	}
+
+	stringBuilder.WriteString("\n\n ------ Worker logs ------ \n\n") //nolint: errcheck
+	logs, err = runLocalProcess(ctx, config.WorkerBinary, config.WorkerArgs, workerEnv)
+	stringBuilder.WriteString(logs) //nolint: errcheck
+	if err != nil {
+		return stringBuilder.String(), &localJobError{step: "worker", err: err}
+	}
+
+	stringBuilder.WriteString("\n\n ------ Committer logs ------ \n\n") //nolint: errcheck
+	logs, err = runLocalProcess(ctx, config.HandlerBinary, append(handlerArgs, "--action=commit"), handlerEnv)
+	stringBuilder.WriteString(logs) //nolint: errcheck
+	if err != nil {
+		return stringBuilder.String(), &localJobError{step: "commit", err: err}
+	}
+
+	return stringBuilder.String(), nil
+}
+
+func runLocalProcess(ctx context.Context, binary string, args, env []string) (string, error) {
+	var output bytes.Buffer
+	cmd := exec.CommandContext(ctx, binary, args...)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	err := cmd.Run()
+	return output.String(), err
+}
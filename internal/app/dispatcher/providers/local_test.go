@@ -0,0 +1,296 @@
+package providers
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lawrencegripper/ion/internal/pkg/messaging"
+	"github.com/lawrencegripper/ion/internal/pkg/types"
+)
+
+func NewMockLocalProvider(run func(ctx context.Context, baseDir string, handlerArgs, workerEnv []string) (string, error)) (*Local, error) {
+	l := Local{}
+	l.handlerArgs = []string{"--things=stuff"}
+	l.jobConfig = &types.JobConfig{
+		MaxRunningTimeMins: 1,
+	}
+	l.localConfig = &types.LocalConfig{
+		HandlerBinary: "true",
+		WorkerBinary:  "true",
+		BaseDir:       os.TempDir(),
+	}
+	l.ctx = context.Background()
+	l.inprogressJobStore = map[string]messaging.Message{}
+	l.completedJobStore = map[string]localJobResult{}
+	l.cancelJobStore = map[string]context.CancelFunc{}
+	l.workerEnvVars = map[string]interface{}{}
+	l.runJob = run
+	l.logStore = &LogStore{}
+	return &l, nil
+}
+
+// waitForLocalJobs blocks until all dispatched jobs have finished running
+func waitForLocalJobs(t *testing.T, l *Local) {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		l.mu.Lock()
+		finished := len(l.completedJobStore) == len(l.inprogressJobStore)
+		l.mu.Unlock()
+		if finished {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("timed out waiting for local jobs to finish")
+}
+
+func TestLocalDispatchRunsJob(t *testing.T) {
+	var seenBaseDir string
+	var seenArgs, seenEnv []string
+	run := func(ctx context.Context, baseDir string, handlerArgs, workerEnv []string) (string, error) {
+		seenBaseDir = baseDir
+		seenArgs = handlerArgs
+		seenEnv = workerEnv
+		return "logs", nil
+	}
+
+	l, _ := NewMockLocalProvider(run)
+	l.workerEnvVars["thing"] = "stuff"
+
+	messageToSend := newNoOpMockMessage(mockMessageID)
+
+	err := l.Dispatch(messageToSend)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if l.InProgressCount() != 1 {
+		t.Errorf("In progress count incorrect Expected: 1 Got: %v", l.InProgressCount())
+	}
+
+	waitForLocalJobs(t, l)
+
+	if _, err := os.Stat(seenBaseDir); err != nil {
+		t.Errorf("expected job base directory to exist: %+v", err)
+	}
+	if !strings.Contains(strings.Join(seenArgs, " "), "--context.eventid=barry") {
+		t.Errorf("handler args missing message context Got: %v", seenArgs)
+	}
+
+	env := strings.Join(seenEnv, " ")
+	for _, expected := range []string{"SHARED_SECRET=" + mockMessageID, "HANDLER_BASE_DIR=" + seenBaseDir, "thing=stuff"} {
+		if !strings.Contains(env, expected) {
+			t.Errorf("worker env missing %s Got: %v", expected, seenEnv)
+		}
+	}
+
+	err = l.Reconcile()
+	if err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(seenBaseDir); !os.IsNotExist(err) {
+		t.Error("expected job base directory to be removed after reconcile")
+	}
+}
+
+func TestLocalReconcileJobCompleted(t *testing.T) {
+	run := func(ctx context.Context, baseDir string, handlerArgs, workerEnv []string) (string, error) {
+		return "logs", nil
+	}
+
+	l, _ := NewMockLocalProvider(run)
+
+	var acceptedMessage bool
+	messageToSend := MockMessage{
+		MessageID: mockMessageID,
+		Accepted: func() {
+			acceptedMessage = true
+		},
+	}
+
+	err := l.Dispatch(messageToSend)
+	if err != nil {
+		t.Error(err)
+	}
+
+	waitForLocalJobs(t, l)
+
+	err = l.Reconcile()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if !acceptedMessage {
+		t.Error("Failed to accept message during reconcilation. Expected message to be marked as accepted as job is complete")
+	}
+
+	if l.InProgressCount() != 0 {
+		t.Error("Reconcile should remove jobs from the inmemory store once it has accepted or rejected them")
+	}
+}
+
+func TestLocalReconcileJobFailed(t *testing.T) {
+	run := func(ctx context.Context, baseDir string, handlerArgs, workerEnv []string) (string, error) {
+		return "logs", fmt.Errorf("worker failed")
+	}
+
+	l, _ := NewMockLocalProvider(run)
+
+	var rejectedMessage bool
+	messageToSend := MockMessage{
+		MessageID: mockMessageID,
+		Rejected: func() {
+			rejectedMessage = true
+		},
+	}
+
+	err := l.Dispatch(messageToSend)
+	if err != nil {
+		t.Error(err)
+	}
+
+	waitForLocalJobs(t, l)
+
+	err = l.Reconcile()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if !rejectedMessage {
+		t.Error("Failed to reject message during reconcilation. Expected message to be marked as rejected as job failed")
+	}
+
+	if l.InProgressCount() != 0 {
+		t.Error("Reconcile should remove jobs from the inmemory store once it has accepted or rejected them")
+	}
+}
+
+func TestLocalReconcileSkipsRunningJobs(t *testing.T) {
+	release := make(chan struct{})
+	run := func(ctx context.Context, baseDir string, handlerArgs, workerEnv []string) (string, error) {
+		<-release
+		return "logs", nil
+	}
+
+	l, _ := NewMockLocalProvider(run)
+
+	messageToSend := newNoOpMockMessage(mockMessageID)
+	err := l.Dispatch(messageToSend)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = l.Reconcile()
+	if err != nil {
+		t.Error(err)
+	}
+	if l.InProgressCount() != 1 {
+		t.Error("Reconcile shouldn't remove jobs which are still running")
+	}
+
+	close(release)
+	waitForLocalJobs(t, l)
+
+	err = l.Reconcile()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLocalAbortCancelsJob(t *testing.T) {
+	cancelled := make(chan struct{})
+	run := func(ctx context.Context, baseDir string, handlerArgs, workerEnv []string) (string, error) {
+		<-ctx.Done()
+		close(cancelled)
+		return "", ctx.Err()
+	}
+
+	l, _ := NewMockLocalProvider(run)
+
+	messageToSend := MockMessage{
+		MessageID: mockMessageID,
+		Rejected: func() {
+			t.Error("message shouldn't be rejected when its job is aborted")
+		},
+	}
+	err := l.Dispatch(messageToSend)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = l.Abort(messageToSend)
+	if err != nil {
+		t.Error(err)
+	}
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second * 5):
+		t.Fatal("expected aborting to cancel the running job")
+	}
+	if l.InProgressCount() != 0 {
+		t.Error("expected aborted message to be removed from the inprogress store")
+	}
+
+	// The cancelled job finishing shouldn't settle the message
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		l.mu.Lock()
+		finished := len(l.completedJobStore) == 1
+		l.mu.Unlock()
+		if finished {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	err = l.Reconcile()
+	if err != nil {
+		t.Error(err)
+	}
+	if len(l.completedJobStore) != 0 {
+		t.Error("expected reconcile to forget the aborted job")
+	}
+}
+
+func TestRunLocalJob(t *testing.T) {
+	testCases := []struct {
+		name          string
+		workerBinary  string
+		expectSuccess bool
+	}{
+		{
+			name:          "workersucceeds",
+			workerBinary:  "true",
+			expectSuccess: true,
+		},
+		{
+			name:          "workerfails",
+			workerBinary:  "false",
+			expectSuccess: false,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			config := &types.LocalConfig{
+				HandlerBinary: "true",
+				WorkerBinary:  test.workerBinary,
+			}
+			logs, err := runLocalJob(context.Background(), config, os.TempDir(), []string{}, []string{}, []string{})
+			if test.expectSuccess && err != nil {
+				t.Errorf("expected job to succeed Got: %+v", err)
+			}
+			if !test.expectSuccess && err == nil {
+				t.Error("expected job to fail")
+			}
+			if !strings.Contains(logs, "Worker logs") {
+				t.Errorf("expected logs to contain worker section Got: %s", logs)
+			}
+		})
+	}
+}
@@ -2,22 +2,29 @@ package providers
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
-	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/azure/azure-storage-blob-go/2016-05-31/azblob"
+	"github.com/lawrencegripper/ion/internal/app/handler/dataplane/blobstorage/azure"
 	"github.com/lawrencegripper/ion/internal/app/handler/dataplane/documentstorage"
 	"github.com/lawrencegripper/ion/internal/app/handler/dataplane/documentstorage/mongodb"
 	"github.com/lawrencegripper/ion/internal/pkg/messaging"
 	"github.com/lawrencegripper/ion/internal/pkg/types"
 	log "github.com/sirupsen/logrus"
+	"path"
 	"time"
 )
 
+// logsContainerName is the blob container module logs are stored in
+const logsContainerName = "logs"
+
 //LogStore captures modules logs
 type LogStore struct {
 	mongoStore   *mongodb.MongoDB
-	blobStore    *storage.BlobStorageClient
-	containerRef *storage.Container
+	credential   *azblob.SharedKeyCredential
+	containerURL *azblob.ContainerURL
+	sasProtocol  azblob.SASProtocol
 	moduleName   string
 }
 
@@ -43,15 +50,27 @@ func NewLogStore(mongoConfig *types.MongoDBConfig, blobConfig *types.AzureBlobCo
 
 	logStore.mongoStore = mongoStore
 
-	blobClient, err := storage.NewBasicClient(blobConfig.BlobAccountName, blobConfig.BlobAccountKey)
+	serviceURL, err := azure.GetServiceURL(blobConfig.BlobAccountName, blobConfig.Endpoint)
 	if err != nil {
 		return nil, fmt.Errorf("failed initialising blob connection: %+v", err)
 	}
-	blobStore := blobClient.GetBlobService()
-	logStore.blobStore = &blobStore
-
-	logStore.containerRef = logStore.blobStore.GetContainerReference("logs")
-	_, err = logStore.containerRef.CreateIfNotExists(&storage.CreateContainerOptions{})
+	logStore.credential = azblob.NewSharedKeyCredential(blobConfig.BlobAccountName, blobConfig.BlobAccountKey)
+	logStore.sasProtocol = azure.GetSASProtocol(serviceURL)
+	p := azblob.NewPipeline(logStore.credential, azblob.PipelineOptions{
+		Retry: azblob.RetryOptions{
+			Policy:   azblob.RetryPolicyExponential,
+			MaxTries: 3,
+		},
+	})
+	containerURL := *serviceURL
+	containerURL.Path = path.Join(containerURL.Path, logsContainerName)
+	logsContainer := azblob.NewContainerURL(containerURL, p)
+	logStore.containerURL = &logsContainer
+
+	_, err = logStore.containerURL.Create(context.Background(), azblob.Metadata{}, azblob.PublicAccessNone)
+	if serr, ok := err.(azblob.StorageError); ok && serr.ServiceCode() == azure.ContainerAlreadyExistsErr {
+		err = nil
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to create log container in blob: %+v", err)
 	}
@@ -61,7 +80,7 @@ func NewLogStore(mongoConfig *types.MongoDBConfig, blobConfig *types.AzureBlobCo
 
 //StoreLogs persists logs to blob storage then creates a link to them in mongo
 func (l *LogStore) StoreLogs(logger *log.Entry, message messaging.Message, stdout string, jobSuceeded bool) error {
-	if l.mongoStore == nil || l.blobStore == nil {
+	if l.mongoStore == nil || l.containerURL == nil {
 		return errors.New("logstore not configured, failed to log messages")
 	}
 
@@ -71,29 +90,23 @@ func (l *LogStore) StoreLogs(logger *log.Entry, message messaging.Message, stdou
 		return err
 	}
 
-	stdOutBuffer := bytes.NewBufferString(stdout)
-
-	blobRef := l.containerRef.GetBlobReference(fmt.Sprintf("%s/%s/%s-attempt-%d.log", eventData.Context.CorrelationID, eventData.Context.EventID, eventData.Context.Name, message.DeliveryCount()))
-	err = blobRef.CreateBlockBlobFromReader(stdOutBuffer, &storage.PutBlobOptions{})
+	blobName := fmt.Sprintf("%s/%s/%s-attempt-%d.log", eventData.Context.CorrelationID, eventData.Context.EventID, eventData.Context.Name, message.DeliveryCount())
+	blobURL := l.containerURL.NewBlockBlobURL(blobName)
+	_, err = blobURL.PutBlob(context.Background(), bytes.NewReader([]byte(stdout)), azblob.BlobHTTPHeaders{}, azblob.Metadata{}, azblob.BlobAccessConditions{})
 	if err != nil {
 		logger.WithError(err).Error("failed to get upload logs to blob")
 		return err
 	}
 
-	readStorageOptions := storage.BlobSASOptions{
-		BlobServiceSASPermissions: storage.BlobServiceSASPermissions{
-			Read: true,
-		},
-		SASOptions: storage.SASOptions{
-			Start:  time.Now().Add(time.Duration(-1) * time.Hour),
-			Expiry: time.Now().Add(time.Duration(24) * time.Hour),
-		},
-	}
-	sasURL, err := blobRef.GetSASURI(readStorageOptions)
-	if err != nil {
-		logger.WithError(err).Error("failed to store logs for job in blobstore")
-		return err
-	}
+	sasQueryParams := azblob.BlobSASSignatureValues{
+		Protocol:      l.sasProtocol,
+		StartTime:     time.Now().UTC().Add(time.Duration(-1) * time.Hour),
+		ExpiryTime:    time.Now().UTC().Add(time.Duration(24) * time.Hour),
+		Permissions:   azblob.BlobSASPermissions{Read: true}.String(),
+		ContainerName: logsContainerName,
+		BlobName:      blobName,
+	}.NewSASQueryParameters(l.credential)
+	sasURL := fmt.Sprintf("%s?%s", blobURL, sasQueryParams.Encode())
 
 	// This event data will have the parent modules name, we want the logs to be stored under this module
 	// so we update the context
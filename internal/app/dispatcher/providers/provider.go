@@ -1,6 +1,8 @@
 package providers
 
 import (
+	"context"
+
 	"github.com/lawrencegripper/ion/internal/pkg/messaging"
 	log "github.com/sirupsen/logrus"
 )
@@ -11,6 +13,13 @@ type Provider interface {
 	Dispatch(message messaging.Message) error
 	InProgressCount() int
 	GetActiveMessages() []messaging.Message
+	Abort(message messaging.Message) error
+}
+
+// Watcher is implemented by providers which can be notified as jobs finish, so Reconcile
+// is only needed as a periodic resync
+type Watcher interface {
+	Watch(ctx context.Context)
 }
 
 //GetLoggerForMessage Adds context fields to the logger for the message
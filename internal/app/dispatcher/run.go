@@ -2,51 +2,169 @@ package dispatcher
 
 import (
 	"context"
-	"pack.ag/amqp"
+	"os"
+	"os/signal"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/lawrencegripper/ion/internal/app/dispatcher/providers" //TODO couldn't it be moved into internal/pkg ?
-	"github.com/lawrencegripper/ion/internal/pkg/messaging"            //TODO couldn't it be moved into internal/pkg ?
-	"github.com/lawrencegripper/ion/internal/pkg/servicebus"
+	"github.com/lawrencegripper/ion/internal/app/handler/dataplane/documentstorage/mongodb"
+	"github.com/lawrencegripper/ion/internal/pkg/messagebus"
+	"github.com/lawrencegripper/ion/internal/pkg/messaging" //TODO couldn't it be moved into internal/pkg ?
 	"github.com/lawrencegripper/ion/internal/pkg/types"
 
 	log "github.com/sirupsen/logrus"
 )
 
-// Run will start the dispatcher server and wait for new AMQP messages
+// Run will start the dispatcher server and wait for new AMQP messages. When the process is asked to
+// stop it stops receiving, waits for in-flight jobs to finish then releases any messages left
 func Run(cfg *types.Configuration) {
-	ctx := context.Background()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	shutdown := make(chan os.Signal, 1)
+	signal.Notify(shutdown, syscall.SIGTERM, os.Interrupt)
 
 	var provider providers.Provider
-	amqpConnection := servicebus.NewAmqpConnection(ctx, cfg)
-	handlerArgs := providers.GetSharedHandlerArgs(cfg, amqpConnection.AccessKeys)
+	bus, err := messagebus.New(ctx, cfg)
+	if err != nil {
+		log.WithError(err).Panic("Couldn't connect to message bus")
+	}
+	busArgs, busSecrets := bus.HandlerConfig()
+	handlerArgs := providers.GetSharedHandlerArgs(cfg, busArgs)
+	handlerSecrets := providers.GetHandlerSecrets(cfg, busSecrets)
 
 	if cfg.AzureBatch != nil {
 		log.Info("Using Azure batch provider...")
-		batchProvider, err := providers.NewAzureBatchProvider(cfg, handlerArgs)
+		batchProvider, err := providers.NewAzureBatchProvider(cfg, handlerArgs, handlerSecrets)
 		if err != nil {
 			log.WithError(err).Panic("Couldn't create azure batch provider")
 		}
 		provider = batchProvider
+	} else if cfg.Local != nil {
+		log.Info("Using local process provider...")
+		localProvider, err := providers.NewLocalProvider(cfg, handlerArgs, handlerSecrets)
+		if err != nil {
+			log.WithError(err).Panic("Couldn't create local provider")
+		}
+		provider = localProvider
 	} else {
 		log.Info("Defaulting to using Kubernetes provider...")
-		k8sProvider, err := providers.NewKubernetesProvider(cfg, handlerArgs)
+		k8sProvider, err := providers.NewKubernetesProvider(cfg, handlerArgs, handlerSecrets)
 		if err != nil {
 			log.WithError(err).Panic("Couldn't create kubernetes provider")
 		}
 		provider = k8sProvider
 	}
 
+	var store DocumentStore
+	if cfg.Handler != nil && cfg.Handler.MongoDBDocumentStorageProvider != nil && cfg.Handler.MongoDBDocumentStorageProvider.Name != "" {
+		mongoConfig := cfg.Handler.MongoDBDocumentStorageProvider
+		mongoStore, err := mongodb.NewMongoDB(&mongodb.Config{
+			Enabled:    true,
+			Name:       mongoConfig.Name,
+			Collection: mongoConfig.Collection,
+			Password:   mongoConfig.Password,
+			Port:       mongoConfig.Port,
+		})
+		if err != nil {
+			log.WithError(err).Panic("Couldn't connect to document store")
+		}
+		defer mongoStore.Close()
+		store = mongoStore
+	} else {
+		log.Info("No document store configured, events won't be deduplicated or joined")
+	}
+
+	stopCtx, stop := context.WithCancel(ctx)
+	go func() {
+		select {
+		case sig := <-shutdown:
+			log.WithField("signal", sig).Info("shutting down, no longer receiving messages")
+			stop()
+		case <-stopCtx.Done():
+		}
+	}()
+	Serve(stopCtx, cfg, bus, provider, store)
+
+	err = bus.Close()
+	if err != nil {
+		log.WithError(err).Error("failed to close message bus")
+	}
+	log.Info("dispatcher stopped")
+
+	//init flaeg
+	//flaeg := flaeg.New(rootCmd, os.Args[1:])
+
+	//run test
+	//if err := flaeg.Run(); err != nil {
+	//	fmt.Printf("Error %s \n", err.Error())
+	//}
+}
+
+// DocumentStore is the handler's document store, which the dispatcher uses to skip events a module has
+// already processed and to join the events a module subscribes to
+type DocumentStore interface {
+	ProcessedEventStore
+	JoinStore
+}
+
+// Serve subscribes the module to its events on the bus and dispatches the messages it receives to the provider
+// until stopCtx is cancelled. It then stops receiving, waits for in-flight jobs to finish and releases any messages
+// left before closing the subscriptions. The bus is left open for the caller to close.
+// Events the module has already processed within the job's dedup window are accepted without being
+// dispatched again, a nil store dispatches every event. A module subscribing to several events is only
+// dispatched once all of them have arrived for a correlation, which needs a store to record them
+func Serve(stopCtx context.Context, cfg *types.Configuration, bus messaging.MessageBus, provider providers.Provider, store DocumentStore) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	eventTypes := cfg.SubscribedEvents()
+	if len(eventTypes) < 1 {
+		log.Panic("Module doesn't subscribe to any events")
+	}
+	var join *joiner
+	if len(eventTypes) > 1 {
+		if store == nil {
+			log.Panic("Subscribing to several events needs a document store to join them")
+		}
+		join = newJoiner(store, cfg.ModuleName, eventTypes, time.Duration(cfg.Job.JoinTimeoutMins)*time.Minute)
+		log.WithField("eventTypes", eventTypes).WithField("joinTimeout", join.timeout).Info("joining events before dispatching")
+	}
+
+	subscriptions := make([]messaging.Subscription, 0, len(eventTypes))
+	for _, eventType := range eventTypes {
+		subscription, err := bus.Subscribe(ctx, eventType, cfg.ModuleName)
+		if err != nil {
+			log.WithError(err).WithField("eventType", eventType).Panic("Couldn't subscribe to event")
+		}
+		subscriptions = append(subscriptions, subscription)
+	}
+
+	// Joined messages may come from any of the subscriptions, so
+	// their locks are renewed with the one each was received from
+	var renewer lockRenewer = subscriptions[0]
+	if join != nil {
+		renewer = joinRenewer{}
+	}
+
+	// Receiving stops as soon as we're asked to shutdown, everything else carries on until
+	// in-flight jobs have been drained
+	receiveCtx, stopReceiving := context.WithCancel(stopCtx)
+	var receiving sync.WaitGroup
+
 	var wg sync.WaitGroup
 
-	wg.Add(4)
+	wg.Add(2 + len(subscriptions))
 	go func() {
 		defer wg.Done()
 		for {
 			// Locks are held for 1 mins, renew every 20 sec to keep locks
-			time.Sleep(20 * time.Second)
-			// allow 20seconds for the renew operation, keeping a 25 second buffer
+			if !sleep(ctx, 20*time.Second) {
+				return
+			}
+			// allow 15 seconds for the renew operation, keeping a 25 second buffer
 			timeAllowanceForRenewalRequest := time.Second * 15
 
 			// Renew message locks with ServiceBus
@@ -57,73 +175,71 @@ func Run(cfg *types.Configuration) {
 				continue
 			}
 
-			messagesAMQP := make([]*amqp.Message, 0, len(activeMessages))
-			for _, m := range activeMessages {
-				originalMessage := m.GetAMQPMessage()
-				messagesAMQP = append(messagesAMQP, originalMessage)
-			}
+			renewContextWithDeadline, cancelRenew := context.WithTimeout(ctx, timeAllowanceForRenewalRequest)
+			failedMessages := renewLocks(renewContextWithDeadline, renewer, activeMessages)
+			cancelRenew()
 
-			renewContextWithDeadline, cancel := context.WithTimeout(ctx, timeAllowanceForRenewalRequest)
-			defer cancel()
-			err := amqpConnection.RenewLocks(renewContextWithDeadline, messagesAMQP)
-			if err != nil {
-				// Todo: Additional could be put in here to cleanup operations. See: #171
-				// https://github.com/lawrencegripper/ion/issues/171
-				log.WithError(err).Panic("Failed to renew locks therefore cannot continue operation as message could be reassigned to another dispatcher.")
-			}
-		}
-	}()
-	go func() {
-		defer wg.Done()
-		for {
-			// output queue stats every 30 seconds
-			time.Sleep(30 * time.Second)
-			queueStats, err := amqpConnection.GetQueueDepth()
-			if err != nil {
-				log.WithError(err).Error("failed getting queue depth from listener")
+			// Without a lock the message could be given to another dispatcher, so stop our job for it
+			// rather than running it twice. The other messages are unaffected
+			for _, message := range failedMessages {
+				contextualLogger := providers.GetLoggerForMessage(message, log.NewEntry(log.StandardLogger()))
+				contextualLogger.Error("failed to renew message lock, aborting job as message could be reassigned to another dispatcher")
+				err := provider.Abort(message)
+				if err != nil {
+					contextualLogger.WithError(err).Error("failed to abort job")
+				}
 			}
-			log.WithField("activeMessageCount", queueStats.ActiveMessageCount).WithField("deadLetteredMessageCount", queueStats.DeadLetterMessageCount).Info("listenerStats")
 		}
 	}()
-	go func() {
-		defer wg.Done()
-		for {
-			message, err := amqpConnection.Receiver.Receive(ctx)
-
-			if err != nil {
-				// Todo: Investigate the type of error here. If this could be triggered by a poisened message
-				// app shouldn't panic.
-				log.WithError(err).Panic("Error received dequeuing message")
-			}
-
-			if message == nil {
-				log.WithError(err).Panic("Error received dequeuing message - nil message")
-			}
-
-			wrapper := messaging.NewAmqpMessageWrapper(message)
-			contextualLogger := providers.GetLoggerForMessage(wrapper, log.NewEntry(log.StandardLogger()))
-			contextualLogger.Debug("message received")
-
-			if wrapper.DeliveryCount() > cfg.Job.RetryCount+1 {
-				contextualLogger.Error("message re-received when above retryCount. AMQP provider wrongly redelivered message.")
-				err := wrapper.Reject()
+	for i := range subscriptions {
+		subscription, eventType := subscriptions[i], eventTypes[i]
+		go func() {
+			defer wg.Done()
+			for {
+				// output queue stats every 30 seconds
+				if !sleep(ctx, 30*time.Second) {
+					return
+				}
+				queueStats, err := subscription.GetQueueDepth()
+				if err == messaging.ErrQueueDepthUnsupported {
+					log.Info("message bus doesn't report queue depth, stopping listener stats")
+					return
+				}
 				if err != nil {
-					contextualLogger.Error("error rejecting message")
+					log.WithError(err).Error("failed getting queue depth from listener")
 				}
+				log.WithField("eventType", eventType).WithField("activeMessageCount", queueStats.ActiveMessageCount).WithField("deadLetteredMessageCount", queueStats.DeadLetterMessageCount).Info("listenerStats")
 			}
-			err = provider.Dispatch(wrapper)
-			if err != nil {
-				contextualLogger.WithError(err).Error("Couldn't dispatch message to kubernetes provider")
+		}()
+		receiving.Add(1)
+		go func() {
+			defer receiving.Done()
+			receive(receiveCtx, cfg, subscription, provider, store, join)
+		}()
+	}
+	if join != nil {
+		// Joins this dispatcher is waiting on are timed out even if none of their events arrive again
+		go func() {
+			for sleep(ctx, joinExpiryInterval) {
+				join.expire()
 			}
+		}()
+	}
 
-			contextualLogger.Debug("message dispatched")
-		}
-	}()
+	// Providers which can watch their jobs settle messages as jobs finish,
+	// so only need reconciling occasionally to catch missed events
+	reconcileInterval := time.Second * 15
+	if watcher, ok := provider.(providers.Watcher); ok {
+		go watcher.Watch(ctx)
+		reconcileInterval = watchResyncInterval
+	}
 
 	go func() {
 		defer wg.Done()
 		for {
-			time.Sleep(time.Second * 15)
+			if !sleep(ctx, reconcileInterval) {
+				return
+			}
 
 			if len(provider.GetActiveMessages()) < 1 {
 				log.Debug("no active messages, skipping reconciling...")
@@ -140,13 +256,237 @@ func Run(cfg *types.Configuration) {
 			log.WithField("inProgress", provider.InProgressCount()).Info("providerStats")
 		}
 	}()
+
+	<-stopCtx.Done()
+	stopReceiving()
+	receiving.Wait()
+	for _, subscription := range subscriptions {
+		subscription.ReleasePending()
+	}
+
+	drainTimeout := time.Duration(cfg.Job.DrainTimeoutSecs) * time.Second
+	if !drain(provider, drainTimeout) {
+		log.WithField("inProgress", provider.InProgressCount()).WithField("drainTimeout", drainTimeout).Warn("jobs still running after drain timeout, releasing their messages")
+	}
+	for _, message := range provider.GetActiveMessages() {
+		releaseMessage(message)
+	}
+
+	cancel()
 	wg.Wait()
+	for _, subscription := range subscriptions {
+		err := subscription.Close()
+		if err != nil {
+			log.WithError(err).Error("failed to close subscription")
+		}
+	}
+}
 
-	//init flaeg
-	//flaeg := flaeg.New(rootCmd, os.Args[1:])
+// receive dispatches the messages received from the subscription until the context is cancelled. Each
+// message's event is added to its join first when the module joins events, and only the message
+// completing the join is dispatched
+func receive(ctx context.Context, cfg *types.Configuration, subscription messaging.Subscription, provider providers.Provider, store DocumentStore, join *joiner) {
+	for {
+		// Stop taking messages while we're running as many jobs as allowed
+		if !waitForCapacity(ctx, provider, cfg.Job.MaxConcurrent) {
+			return
+		}
 
-	//run test
-	//if err := flaeg.Run(); err != nil {
-	//	fmt.Printf("Error %s \n", err.Error())
-	//}
+		message, err := subscription.Receive(ctx)
+		if ctx.Err() != nil {
+			if message != nil {
+				releaseMessage(message)
+			}
+			return
+		}
+
+		if err != nil {
+			// Todo: Investigate the type of error here. If this could be triggered by a poisened message
+			// app shouldn't panic.
+			log.WithError(err).Panic("Error received dequeuing message")
+		}
+
+		if message == nil {
+			log.WithError(err).Panic("Error received dequeuing message - nil message")
+		}
+
+		contextualLogger := providers.GetLoggerForMessage(message, log.NewEntry(log.StandardLogger()))
+		contextualLogger.Debug("message received")
+
+		if message.DeliveryCount() > cfg.Job.RetryCount+1 {
+			contextualLogger.Error("message re-received when above retryCount. Message bus wrongly redelivered message, dead lettering it")
+			err := message.DeadLetter(messaging.MaxDeliveryCountExceededReason)
+			if err != nil {
+				contextualLogger.WithError(err).Error("error dead lettering message")
+			}
+			continue
+		}
+		if join != nil {
+			message = joinMessage(join, subscription, message, contextualLogger)
+			if message == nil {
+				continue
+			}
+			contextualLogger = providers.GetLoggerForMessage(message, log.NewEntry(log.StandardLogger()))
+		}
+		if store != nil && cfg.Job.DedupWindowMins > 0 && skipProcessed(store, cfg, message, contextualLogger) {
+			continue
+		}
+
+		err = provider.Dispatch(message)
+		if err != nil {
+			contextualLogger.WithError(err).Error("Couldn't dispatch message to kubernetes provider")
+		}
+
+		contextualLogger.Debug("message dispatched")
+	}
+}
+
+// joinMessage adds the message's event to its join. The message is accepted once its event is recorded in the join,
+// unless the event completes the join. The message is then returned with the join's event to be dispatched,
+// otherwise nil is returned
+func joinMessage(join *joiner, subscription messaging.Subscription, message messaging.Message, contextualLogger *log.Entry) messaging.Message {
+	event, err := message.EventData()
+	if err != nil {
+		contextualLogger.WithError(err).Error("failed to read event to join, rejecting message")
+		if err := message.Reject(); err != nil {
+			contextualLogger.WithError(err).Error("error rejecting message")
+		}
+		return nil
+	}
+	joined, err := join.add(event, contextualLogger)
+	if err != nil {
+		// The message is redelivered so its event is added once the store is available again
+		contextualLogger.WithError(err).Error("failed to add event to join, rejecting message")
+		if err := message.Reject(); err != nil {
+			contextualLogger.WithError(err).Error("error rejecting message")
+		}
+		return nil
+	}
+	if joined == nil {
+		if err := message.Accept(); err != nil {
+			contextualLogger.WithError(err).Error("error accepting joined message")
+		}
+		return nil
+	}
+	return &joinedMessage{Message: message, event: *joined, subscription: subscription}
+}
+
+// joinExpiryInterval is how often joins which have been waiting longer than the join timeout are timed out
+var joinExpiryInterval = time.Minute
+
+// skipProcessed accepts the message without dispatching it if the module has already processed its event
+// within the dedup window. Returns true if the message was skipped
+func skipProcessed(store ProcessedEventStore, cfg *types.Configuration, message messaging.Message, contextualLogger *log.Entry) bool {
+	event, err := message.EventData()
+	if err != nil {
+		contextualLogger.WithError(err).Warn("failed to read event, dispatching without checking for duplicates")
+		return false
+	}
+	window := time.Duration(cfg.Job.DedupWindowMins) * time.Minute
+	processed, err := findProcessed(store, cfg.ModuleName, event, window)
+	if err != nil {
+		contextualLogger.WithError(err).Warn("failed to check whether event was already processed, dispatching anyway")
+		return false
+	}
+	if processed == nil {
+		return false
+	}
+	contextualLogger.WithField("processedAt", processed.ProcessedAt).WithField("dedupWindow", window).Info("event already processed by module, accepting duplicate message without dispatching")
+	err = message.Accept()
+	if err != nil {
+		contextualLogger.WithError(err).Error("failed to accept duplicate message")
+	}
+	return true
+}
+
+// watchResyncInterval is how often jobs are fully reconciled when the provider is also watching them
+var watchResyncInterval = time.Minute * 2
+
+// capacityPollInterval is how often the receive loop checks for free capacity when at maxConcurrent
+var capacityPollInterval = time.Second
+
+// waitForCapacity blocks until the provider is running fewer than maxConcurrent jobs. A maxConcurrent of 0 or less is unlimited.
+// Returns false if the context is cancelled while waiting
+func waitForCapacity(ctx context.Context, provider providers.Provider, maxConcurrent int) bool {
+	if maxConcurrent < 1 {
+		return ctx.Err() == nil
+	}
+	for provider.InProgressCount() >= maxConcurrent {
+		log.WithField("inProgress", provider.InProgressCount()).WithField("maxConcurrent", maxConcurrent).Debug("at max concurrent jobs, waiting for capacity")
+		if !sleep(ctx, capacityPollInterval) {
+			return false
+		}
+	}
+	return ctx.Err() == nil
+}
+
+// drainPollInterval is how often in-flight jobs are checked while shutting down
+var drainPollInterval = time.Second
+
+// drain waits for the provider's in-flight jobs to finish, returning false if some are still running after the timeout
+func drain(provider providers.Provider, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for provider.InProgressCount() > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		log.WithField("inProgress", provider.InProgressCount()).Info("waiting for in-flight jobs to finish")
+		time.Sleep(drainPollInterval)
+	}
+	return true
+}
+
+// lockRenewer renews the locks held on messages with the broker
+type lockRenewer interface {
+	RenewLocks(ctx context.Context, messages []messaging.Message) error
+}
+
+// lockRenewalRetryInterval is how long to wait before retrying locks which failed to renew
+var lockRenewalRetryInterval = time.Second * 2
+
+// renewLocks renews the locks for the messages, retrying until the context's deadline. All the locks are renewed
+// in one request, if that fails each lock is renewed on its own to find which failed. Returns the messages whose
+// locks couldn't be renewed
+func renewLocks(ctx context.Context, renewer lockRenewer, messages []messaging.Message) []messaging.Message {
+	err := renewer.RenewLocks(ctx, messages)
+	if err == nil {
+		return nil
+	}
+	log.WithError(err).Warn("failed to renew message locks, renewing each lock individually")
+
+	pending := messages
+	for {
+		failed := make([]messaging.Message, 0, len(pending))
+		for _, message := range pending {
+			err := renewer.RenewLocks(ctx, []messaging.Message{message})
+			if err != nil {
+				log.WithError(err).WithField("messageID", message.ID()).Warn("failed to renew message lock")
+				failed = append(failed, message)
+			}
+		}
+		if len(failed) == 0 || !sleep(ctx, lockRenewalRetryInterval) {
+			return failed
+		}
+		pending = failed
+	}
+}
+
+// releaseMessage hands the message back to the broker so another dispatcher can pick it up
+func releaseMessage(message messaging.Message) {
+	err := message.Release()
+	if err != nil {
+		log.WithError(err).WithField("messageID", message.ID()).Error("failed to release message")
+		return
+	}
+	log.WithField("messageID", message.ID()).Info("released message")
+}
+
+// sleep waits for the duration, returning false early if the context is cancelled
+func sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
 }
@@ -0,0 +1,179 @@
+package dispatcher
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lawrencegripper/ion/internal/pkg/amqpmessage"
+	"github.com/lawrencegripper/ion/internal/pkg/messaging"
+	"pack.ag/amqp"
+)
+
+type mockProvider struct {
+	mu         sync.Mutex
+	inProgress int
+}
+
+func (p *mockProvider) Reconcile() error                         { return nil }
+func (p *mockProvider) Dispatch(message messaging.Message) error { return nil }
+func (p *mockProvider) GetActiveMessages() []messaging.Message   { return nil }
+func (p *mockProvider) Abort(message messaging.Message) error    { return nil }
+func (p *mockProvider) InProgressCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.inProgress
+}
+func (p *mockProvider) setInProgress(count int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.inProgress = count
+}
+
+func TestWaitForCapacity_Unlimited(t *testing.T) {
+	provider := &mockProvider{inProgress: 100}
+
+	done := make(chan struct{})
+	go func() {
+		waitForCapacity(context.Background(), provider, 0)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("expected no wait when maxConcurrent is unlimited")
+	}
+}
+
+func TestWaitForCapacity_BlocksUntilCapacityFrees(t *testing.T) {
+	capacityPollInterval = time.Millisecond * 10
+	provider := &mockProvider{inProgress: 2}
+
+	done := make(chan struct{})
+	go func() {
+		waitForCapacity(context.Background(), provider, 2)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("expected to wait while at max concurrent jobs")
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	provider.setInProgress(1)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("expected wait to finish once capacity was available")
+	}
+}
+
+func TestWaitForCapacity_StopsWhenCancelled(t *testing.T) {
+	capacityPollInterval = time.Millisecond * 10
+	provider := &mockProvider{inProgress: 2}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	result := make(chan bool)
+	go func() {
+		result <- waitForCapacity(ctx, provider, 2)
+	}()
+
+	cancel()
+
+	select {
+	case hasCapacity := <-result:
+		if hasCapacity {
+			t.Error("expected wait to report no capacity when cancelled")
+		}
+	case <-time.After(time.Second):
+		t.Error("expected wait to finish when cancelled")
+	}
+}
+
+func TestDrain_WaitsForInFlightJobs(t *testing.T) {
+	drainPollInterval = time.Millisecond * 10
+	provider := &mockProvider{inProgress: 1}
+
+	go func() {
+		time.Sleep(time.Millisecond * 50)
+		provider.setInProgress(0)
+	}()
+
+	if !drain(provider, time.Second) {
+		t.Error("expected drain to finish once jobs completed")
+	}
+}
+
+func TestDrain_TimesOut(t *testing.T) {
+	drainPollInterval = time.Millisecond * 10
+	provider := &mockProvider{inProgress: 1}
+
+	start := time.Now()
+	if drain(provider, time.Millisecond*50) {
+		t.Error("expected drain to time out while jobs were still running")
+	}
+	if time.Since(start) > time.Second {
+		t.Error("expected drain to stop waiting after the timeout")
+	}
+}
+
+// mockLockRenewer fails to renew the locks of the given messages
+type mockLockRenewer struct {
+	failing map[string]bool
+	calls   int
+}
+
+func (r *mockLockRenewer) RenewLocks(ctx context.Context, messages []messaging.Message) error {
+	r.calls++
+	for _, m := range messages {
+		if r.failing[m.ID()] {
+			return errors.New("lock lost")
+		}
+	}
+	return nil
+}
+
+func newLockedMessage(id string) messaging.Message {
+	return amqpmessage.NewWrapper(&amqp.Message{
+		Properties: &amqp.MessageProperties{MessageID: id},
+	})
+}
+
+func TestRenewLocks_AllRenewed(t *testing.T) {
+	renewer := &mockLockRenewer{}
+	messages := []messaging.Message{newLockedMessage("1"), newLockedMessage("2")}
+
+	failed := renewLocks(context.Background(), renewer, messages)
+
+	if len(failed) != 0 {
+		t.Errorf("expected no failed messages got %d", len(failed))
+	}
+	if renewer.calls != 1 {
+		t.Errorf("expected locks to be renewed in a single request, got %d requests", renewer.calls)
+	}
+}
+
+func TestRenewLocks_ReturnsOnlyFailedMessages(t *testing.T) {
+	lockRenewalRetryInterval = time.Millisecond * 10
+	lost := newLockedMessage("lost")
+	renewer := &mockLockRenewer{
+		failing: map[string]bool{lost.ID(): true},
+	}
+	messages := []messaging.Message{newLockedMessage("1"), lost, newLockedMessage("2")}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	failed := renewLocks(ctx, renewer, messages)
+
+	if len(failed) != 1 || failed[0].ID() != "lost" {
+		t.Errorf("expected only the lost message to fail, got %v", failed)
+	}
+	if renewer.calls < 5 {
+		t.Errorf("expected the failed lock to be retried, got %d requests", renewer.calls)
+	}
+}
@@ -0,0 +1,117 @@
+package e2e
+
+import (
+	"sync"
+
+	"github.com/lawrencegripper/ion/internal/app/handler/dataplane"
+	"github.com/lawrencegripper/ion/internal/app/handler/dataplane/documentstorage"
+	"github.com/lawrencegripper/ion/internal/app/handler/dataplane/documentstorage/inmemory"
+)
+
+// Check document store matches interface at compile time
+var _ dataplane.DocumentStorageProvider = &DocumentStore{}
+
+// DocumentStore is an in-memory document store shared by the components the harness runs.
+// Unlike inmemory.InMemoryDB it's safe for concurrent jobs and isn't saved to disk when closed
+type DocumentStore struct {
+	mu sync.Mutex
+	db *inmemory.InMemoryDB
+}
+
+// NewDocumentStore creates an empty document store
+func NewDocumentStore() *DocumentStore {
+	return &DocumentStore{
+		db: &inmemory.InMemoryDB{
+			Insights:  map[string]documentstorage.Insight{},
+			Contexts:  map[string]documentstorage.EventMeta{},
+			Outboxes:  map[string]documentstorage.Outbox{},
+			Processed: map[string]documentstorage.ProcessedEvent{},
+			Joins:     map[string]documentstorage.Join{},
+		},
+	}
+}
+
+// GetEventMetaByID returns a single document matching a given document ID
+func (s *DocumentStore) GetEventMetaByID(id string) (*documentstorage.EventMeta, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.db.GetEventMetaByID(id)
+}
+
+// CreateEventMeta creates a new event context document
+func (s *DocumentStore) CreateEventMeta(eventMeta *documentstorage.EventMeta) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.db.CreateEventMeta(eventMeta)
+}
+
+// CreateInsight creates an insights document
+func (s *DocumentStore) CreateInsight(insight *documentstorage.Insight) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.db.CreateInsight(insight)
+}
+
+// GetOutbox returns the outbox with the given ID
+func (s *DocumentStore) GetOutbox(id string) (*documentstorage.Outbox, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.db.GetOutbox(id)
+}
+
+// SaveOutbox creates or replaces an outbox document
+func (s *DocumentStore) SaveOutbox(outbox *documentstorage.Outbox) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.db.SaveOutbox(outbox)
+}
+
+// GetProcessedEvent returns the record of a module processing an event
+func (s *DocumentStore) GetProcessedEvent(id string) (*documentstorage.ProcessedEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.db.GetProcessedEvent(id)
+}
+
+// CreateProcessedEvent records that a module has processed an event
+func (s *DocumentStore) CreateProcessedEvent(processed *documentstorage.ProcessedEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.db.CreateProcessedEvent(processed)
+}
+
+// Insights gets the insights created by modules in the flow with the correlation ID
+func (s *DocumentStore) Insights(correlationID string) []documentstorage.Insight {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var insights []documentstorage.Insight
+	for _, insight := range s.db.Insights {
+		if insight.Context != nil && insight.Context.CorrelationID == correlationID {
+			insights = append(insights, insight)
+		}
+	}
+	return insights
+}
+
+// GetJoin returns the join with the given ID
+func (s *DocumentStore) GetJoin(id string) (*documentstorage.Join, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.db.GetJoin(id)
+}
+
+// SaveJoin creates or replaces a join document
+func (s *DocumentStore) SaveJoin(join *documentstorage.Join) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.db.SaveJoin(join)
+}
+
+// processed checks whether the module has recorded processing the event
+func (s *DocumentStore) processed(moduleName, eventID string) bool {
+	_, err := s.GetProcessedEvent(documentstorage.GetProcessedEventID(moduleName, eventID))
+	return err == nil
+}
+
+// Close does nothing, the store is shared by every job the harness runs
+func (s *DocumentStore) Close() {}
@@ -0,0 +1,376 @@
+package e2e
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lawrencegripper/ion/internal/app/handler/dataplane/documentstorage"
+	"github.com/lawrencegripper/ion/internal/app/handler/module"
+	"github.com/lawrencegripper/ion/internal/pkg/common"
+	"github.com/lawrencegripper/ion/internal/pkg/inmemorybus"
+	"github.com/lawrencegripper/ion/internal/pkg/types"
+)
+
+const waitTimeout = time.Second * 10
+
+func newHarness(t *testing.T, retryCount int) (*Harness, func()) {
+	dir, err := ioutil.TempDir("", "ion-e2e-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHarness(dir, &types.JobConfig{
+		RetryCount:       retryCount,
+		DrainTimeoutSecs: 5,
+		DedupWindowMins:  60,
+	})
+	return h, func() {
+		h.Close()
+		_ = os.RemoveAll(dir)
+	}
+}
+
+// postLink submits the url to the front api, returning the event it published
+func postLink(t *testing.T, h *Harness, url string) common.Event {
+	body, _ := json.Marshal(map[string]string{"url": url})
+	recorder := httptest.NewRecorder()
+	h.FrontAPI().ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected front api to succeed got %d %s", recorder.Code, recorder.Body.String())
+	}
+	var event common.Event
+	if err := json.Unmarshal(recorder.Body.Bytes(), &event); err != nil {
+		t.Fatal(err)
+	}
+	return event
+}
+
+// waitFor polls the condition until it's met or the wait times out
+func waitFor(t *testing.T, description string, condition func() bool) {
+	deadline := time.Now().Add(waitTimeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", description)
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+}
+
+func readInputMeta(env *module.Environment) (map[string]string, error) {
+	b, err := ioutil.ReadFile(env.InputMetaFilePath)
+	if err != nil {
+		return nil, err
+	}
+	var kvps common.KeyValuePairs
+	err = json.Unmarshal(b, &kvps)
+	return kvps.AsMap(), err
+}
+
+func writeJSON(path string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, os.ModePerm)
+}
+
+func TestLinkFlowsThroughModules(t *testing.T) {
+	h, cleanup := newHarness(t, 1)
+	defer cleanup()
+
+	// The downloader stores a page for the link and publishes an event for it
+	err := h.AddModule(ModuleConfig{
+		Name:              "downloader",
+		SubscribesToEvent: "frontapi.new_link",
+		EventsPublished:   "page_downloaded",
+		Run: func(env *module.Environment) error {
+			meta, err := readInputMeta(env)
+			if err != nil {
+				return err
+			}
+			page := "<html>" + meta["url"] + "</html>"
+			if err := ioutil.WriteFile(filepath.Join(env.OutputBlobDirPath, "page.html"), []byte(page), os.ModePerm); err != nil {
+				return err
+			}
+			if err := writeJSON(env.OutputMetaFilePath, common.KeyValuePairs{{Key: "downloaded", Value: meta["url"]}}); err != nil {
+				return err
+			}
+			return writeJSON(filepath.Join(env.OutputEventsDirPath, "event1.json"), common.KeyValuePairs{
+				{Key: "eventType", Value: "page_downloaded"},
+				{Key: "files", Value: "page.html"},
+				{Key: "url", Value: meta["url"]},
+			})
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The counter reads the page from the downloader and records its length
+	var mu sync.Mutex
+	var pages []string
+	err = h.AddModule(ModuleConfig{
+		Name:              "counter",
+		SubscribesToEvent: "page_downloaded",
+		Run: func(env *module.Environment) error {
+			page, err := ioutil.ReadFile(filepath.Join(env.InputBlobDirPath, "page.html"))
+			if err != nil {
+				return err
+			}
+			meta, err := readInputMeta(env)
+			if err != nil {
+				return err
+			}
+			if meta["url"] != "http://example.com" {
+				return fmt.Errorf("expected url in event meta got %v", meta)
+			}
+			mu.Lock()
+			pages = append(pages, string(page))
+			mu.Unlock()
+			return writeJSON(env.OutputMetaFilePath, common.KeyValuePairs{{Key: "length", Value: fmt.Sprint(len(page))}})
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := postLink(t, h, "http://example.com")
+
+	waitFor(t, "insights from both modules", func() bool {
+		return len(h.DocumentStore.Insights(event.Context.CorrelationID)) == 2
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	if len(pages) != 1 || pages[0] != "<html>http://example.com</html>" {
+		t.Errorf("expected counter to read the downloaded page once got %v", pages)
+	}
+	for _, insight := range h.DocumentStore.Insights(event.Context.CorrelationID) {
+		if insight.Name == "counter" && insight.Data.AsMap()["length"] != "31" {
+			t.Errorf("expected counter to record the page length got %+v", insight.Data)
+		}
+	}
+	waitFor(t, "messages to be accepted", func() bool {
+		return h.Broker.ActiveMessageCount("frontapi.new_link", "downloader") == 0 &&
+			h.Broker.ActiveMessageCount("page_downloaded", "counter") == 0
+	})
+}
+
+func TestRedeliveredEventIsSkipped(t *testing.T) {
+	h, cleanup := newHarness(t, 1)
+	defer cleanup()
+
+	var mu sync.Mutex
+	runs := 0
+	err := h.AddModule(ModuleConfig{
+		Name:              "counter",
+		SubscribesToEvent: "frontapi.new_link",
+		Run: func(env *module.Environment) error {
+			mu.Lock()
+			defer mu.Unlock()
+			runs++
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := postLink(t, h, "http://example.com")
+	waitFor(t, "event to be processed", func() bool {
+		return h.Broker.ActiveMessageCount("frontapi.new_link", "counter") == 0 &&
+			h.DocumentStore.processed("counter", event.Context.EventID)
+	})
+
+	// The same event is delivered again, as it would be if a publish was retried
+	if err := inmemorybus.NewPublisher(h.Broker).Publish(context.Background(), event); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "duplicate to be accepted", func() bool {
+		return h.Broker.ActiveMessageCount("frontapi.new_link", "counter") == 0
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	if runs != 1 {
+		t.Errorf("expected the module to run once got %d", runs)
+	}
+}
+
+func TestJoinedEventsDispatchModuleOnce(t *testing.T) {
+	h, cleanup := newHarness(t, 1)
+	defer cleanup()
+
+	// Two modules each store a blob for the link and publish their own event
+	for _, upstream := range []struct{ name, eventType, file string }{
+		{"downloader", "page_downloaded", "result.txt"},
+		{"titler", "title_found", "result.txt"},
+	} {
+		upstream := upstream
+		err := h.AddModule(ModuleConfig{
+			Name:              upstream.name,
+			SubscribesToEvent: "frontapi.new_link",
+			EventsPublished:   upstream.eventType,
+			Run: func(env *module.Environment) error {
+				if err := ioutil.WriteFile(filepath.Join(env.OutputBlobDirPath, upstream.file), []byte(upstream.name), os.ModePerm); err != nil {
+					return err
+				}
+				return writeJSON(filepath.Join(env.OutputEventsDirPath, "event1.json"), common.KeyValuePairs{
+					{Key: "eventType", Value: upstream.eventType},
+					{Key: "files", Value: upstream.file},
+					{Key: upstream.name, Value: "done"},
+				})
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The report is only run once both events have arrived, with the blobs and data of each.
+	// Each event's blobs are in a directory named after its type, so they don't collide
+	var mu sync.Mutex
+	var reports []string
+	err := h.AddModule(ModuleConfig{
+		Name:              "report",
+		SubscribesToEvent: "page_downloaded,title_found",
+		Run: func(env *module.Environment) error {
+			page, err := ioutil.ReadFile(filepath.Join(env.InputBlobDirPath, "page_downloaded", "result.txt"))
+			if err != nil {
+				return err
+			}
+			title, err := ioutil.ReadFile(filepath.Join(env.InputBlobDirPath, "title_found", "result.txt"))
+			if err != nil {
+				return err
+			}
+			meta, err := readInputMeta(env)
+			if err != nil {
+				return err
+			}
+			if meta["downloader"] != "done" || meta["titler"] != "done" {
+				return fmt.Errorf("expected data from both events got %v", meta)
+			}
+			mu.Lock()
+			reports = append(reports, string(page)+","+string(title))
+			mu.Unlock()
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := postLink(t, h, "http://example.com")
+
+	waitFor(t, "events to be joined and accepted", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(reports) == 1 &&
+			h.Broker.ActiveMessageCount("page_downloaded", "report") == 0 &&
+			h.Broker.ActiveMessageCount("title_found", "report") == 0
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	if reports[0] != "downloader,titler" {
+		t.Errorf("expected report to read both blobs got %s", reports[0])
+	}
+	join, err := h.DocumentStore.GetJoin(documentstorage.GetJoinID("report", event.Context.CorrelationID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if join.Status != documentstorage.JoinDispatched || len(join.Events) != 2 {
+		t.Errorf("expected join dispatched with both events got %s %d", join.Status, len(join.Events))
+	}
+}
+
+func TestFailedJobIsRetriedThenDeadLettered(t *testing.T) {
+	h, cleanup := newHarness(t, 2)
+	defer cleanup()
+
+	var mu sync.Mutex
+	attempts := 0
+	err := h.AddModule(ModuleConfig{
+		Name:              "flaky",
+		SubscribesToEvent: "frontapi.new_link",
+		Run: func(env *module.Environment) error {
+			mu.Lock()
+			defer mu.Unlock()
+			attempts++
+			return fmt.Errorf("attempt %d failed", attempts)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := postLink(t, h, "http://example.com")
+
+	waitFor(t, "message to be dead lettered", func() bool {
+		return len(h.Broker.DeadLetters("frontapi.new_link", "flaky")) == 1
+	})
+	deadLetter := h.Broker.DeadLetters("frontapi.new_link", "flaky")[0]
+	if deadLetter.ID != event.Context.EventID || deadLetter.DeliveryCount != 3 {
+		t.Errorf("expected event dead lettered after 3 deliveries got %s %d", deadLetter.ID, deadLetter.DeliveryCount)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if attempts != 3 {
+		t.Errorf("expected the job to be attempted 3 times got %d", attempts)
+	}
+}
+
+func TestModuleFailureIsDeadLetteredWithoutRetry(t *testing.T) {
+	h, cleanup := newHarness(t, 2)
+	defer cleanup()
+
+	err := h.AddModule(ModuleConfig{
+		Name:              "broken",
+		SubscribesToEvent: "frontapi.new_link",
+		EventsPublished:   "page_downloaded",
+		Run: func(env *module.Environment) error {
+			// Events aren't published by a module which has failed
+			if err := writeJSON(filepath.Join(env.OutputEventsDirPath, "event1.json"), common.KeyValuePairs{
+				{Key: "eventType", Value: "page_downloaded"},
+			}); err != nil {
+				return err
+			}
+			return writeJSON(env.OutputFailurePath, common.ModuleFailure{Reason: "unsupported link"})
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = h.AddModule(ModuleConfig{
+		Name:              "counter",
+		SubscribesToEvent: "page_downloaded",
+		Run: func(env *module.Environment) error {
+			return fmt.Errorf("counter shouldn't run")
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	postLink(t, h, "http://example.com")
+
+	waitFor(t, "message to be dead lettered", func() bool {
+		return len(h.Broker.DeadLetters("frontapi.new_link", "broken")) == 1
+	})
+	deadLetter := h.Broker.DeadLetters("frontapi.new_link", "broken")[0]
+	if deadLetter.DeliveryCount != 1 || deadLetter.Reason != "unsupported link" {
+		t.Errorf("expected message dead lettered on first delivery with the module's reason got %+v", deadLetter)
+	}
+	if count := h.Broker.ActiveMessageCount("page_downloaded", "counter"); count != 0 {
+		t.Errorf("expected no events from the failed module got %d", count)
+	}
+}
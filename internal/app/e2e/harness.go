@@ -0,0 +1,158 @@
+package e2e
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/lawrencegripper/ion/internal/app/dispatcher"
+	"github.com/lawrencegripper/ion/internal/app/frontapi/links"
+	"github.com/lawrencegripper/ion/internal/app/handler/module"
+	"github.com/lawrencegripper/ion/internal/pkg/common"
+	"github.com/lawrencegripper/ion/internal/pkg/inmemorybus"
+	"github.com/lawrencegripper/ion/internal/pkg/types"
+)
+
+// frontAPIEventType is the event published by the front api for each new link
+const frontAPIEventType = "frontapi.new_link"
+
+// Module is run in place of a module's container. The handler has prepared the environment when it's
+// called, and commits whatever the module leaves in the environment's output paths once it returns.
+// Returning an error fails the job so its message is retried
+type Module func(env *module.Environment) error
+
+// ModuleConfig describes a module run by the harness
+type ModuleConfig struct {
+	Name string
+	// SubscribesToEvent is a comma separated list of the event types the module is dispatched for,
+	// with several the module is dispatched once all of them have arrived for a correlation
+	SubscribesToEvent string
+	// EventsPublished is a comma separated list of the event types the module can publish
+	EventsPublished string
+	Run             Module
+}
+
+// Harness runs the front api, and a dispatcher and handler for each module, in a single process.
+// The components share an in-memory message bus and document store, and blobs are stored on local disk,
+// so a flow through several modules can be tested end to end without any external services
+type Harness struct {
+	Broker        *inmemorybus.Broker
+	DocumentStore *DocumentStore
+
+	dir    string
+	job    *types.JobConfig
+	ctx    context.Context
+	stop   context.CancelFunc
+	wg     sync.WaitGroup
+	mu     sync.Mutex
+	closed bool
+}
+
+// NewHarness creates a harness which keeps the blobs and job directories of its modules under dir.
+// Failed jobs are retried as set out in the job configuration, after which the broker dead letters them
+func NewHarness(dir string, job *types.JobConfig) *Harness {
+	broker := inmemorybus.NewBroker()
+	broker.MaxDeliveryCount = job.RetryCount + 1
+	ctx, stop := context.WithCancel(context.Background())
+	return &Harness{
+		Broker:        broker,
+		DocumentStore: NewDocumentStore(),
+		dir:           dir,
+		job:           job,
+		ctx:           ctx,
+		stop:          stop,
+	}
+}
+
+// FrontAPI gets the front api's handler for new links, publishing to the harness's bus
+func (h *Harness) FrontAPI() http.Handler {
+	links.InitMessageBus(inmemorybus.NewPublisher(h.Broker), frontAPIEventType)
+	links.InitDocumentStore(h.DocumentStore)
+	return http.HandlerFunc(links.Process)
+}
+
+// AddModule starts a dispatcher for the module which runs its jobs in process. The module's subscription
+// is created before returning so it receives any events published afterwards
+func (h *Harness) AddModule(config ModuleConfig) error {
+	cfg := &types.Configuration{
+		ModuleName:        config.Name,
+		SubscribesToEvent: config.SubscribesToEvent,
+		EventsPublished:   config.EventsPublished,
+		Job:               h.job,
+	}
+	bus := inmemorybus.NewBus(h.Broker, cfg)
+	for _, eventType := range cfg.SubscribedEvents() {
+		subscription, err := bus.Subscribe(h.ctx, eventType, cfg.ModuleName)
+		if err != nil {
+			return err
+		}
+		_ = subscription.Close()
+	}
+
+	provider := newInProcessProvider(h, config, filepath.Join(h.dir, "jobs", config.Name))
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		dispatcher.Serve(h.ctx, cfg, bus, provider, h.DocumentStore)
+	}()
+	return nil
+}
+
+// Close stops the dispatchers, waiting for their in-flight jobs to finish
+func (h *Harness) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return
+	}
+	h.closed = true
+	h.stop()
+	h.wg.Wait()
+}
+
+// blobDir gets the directory the module's job for the event stores its output blobs in
+func (h *Harness) blobDir(eventID, moduleName string) string {
+	return filepath.Join(h.dir, "blobs", eventID, moduleName)
+}
+
+// joinBlobDirs copies the blobs stored for each of the events into a directory in dir named after the event's type,
+// so a joined event's job can read them from one place
+func (h *Harness) joinBlobDirs(events []common.Event, dir string) error {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	for _, event := range events {
+		eventMeta, err := h.DocumentStore.GetEventMetaByID(event.Context.EventID)
+		if err != nil {
+			continue // Events published by the front api have no blobs
+		}
+		eventDir := filepath.Join(dir, event.Type)
+		if err := os.MkdirAll(eventDir, os.ModePerm); err != nil {
+			return err
+		}
+		parentDir := h.blobDir(eventMeta.Context.ParentEventID, eventMeta.Context.Name)
+		files, err := ioutil.ReadDir(parentDir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			if file.IsDir() {
+				continue
+			}
+			b, err := ioutil.ReadFile(filepath.Join(parentDir, file.Name()))
+			if err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(filepath.Join(eventDir, file.Name()), b, os.ModePerm); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
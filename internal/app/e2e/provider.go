@@ -0,0 +1,191 @@
+package e2e
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/lawrencegripper/ion/internal/app/dispatcher/providers"
+	"github.com/lawrencegripper/ion/internal/app/handler/committer"
+	"github.com/lawrencegripper/ion/internal/app/handler/dataplane"
+	"github.com/lawrencegripper/ion/internal/app/handler/dataplane/blobstorage/filesystem"
+	"github.com/lawrencegripper/ion/internal/app/handler/dataplane/documentstorage"
+	"github.com/lawrencegripper/ion/internal/app/handler/dataplane/events"
+	"github.com/lawrencegripper/ion/internal/app/handler/module"
+	"github.com/lawrencegripper/ion/internal/app/handler/preparer"
+	"github.com/lawrencegripper/ion/internal/pkg/common"
+	"github.com/lawrencegripper/ion/internal/pkg/inmemorybus"
+	"github.com/lawrencegripper/ion/internal/pkg/messaging"
+	log "github.com/sirupsen/logrus"
+)
+
+//Check provider matches interface at compile time
+var _ providers.Provider = &inProcessProvider{}
+
+// inProcessProvider runs the prepare, module and commit steps of each job in a goroutine, settling
+// the job's message as soon as it finishes
+type inProcessProvider struct {
+	harness *Harness
+	config  ModuleConfig
+	jobsDir string
+
+	mu         sync.Mutex
+	inProgress map[string]messaging.Message
+}
+
+func newInProcessProvider(harness *Harness, config ModuleConfig, jobsDir string) *inProcessProvider {
+	return &inProcessProvider{
+		harness:    harness,
+		config:     config,
+		jobsDir:    jobsDir,
+		inProgress: map[string]messaging.Message{},
+	}
+}
+
+// Dispatch starts the job for the message
+func (p *inProcessProvider) Dispatch(message messaging.Message) error {
+	event, err := message.EventData()
+	if err != nil {
+		return err
+	}
+	if event.Context == nil {
+		event.Context = &common.Context{}
+	}
+	// The dispatcher gives the handler the event's context under the module's name
+	context := &common.Context{
+		Name:          p.config.Name,
+		EventID:       event.Context.EventID,
+		CorrelationID: event.Context.CorrelationID,
+		ParentEventID: event.Context.ParentEventID,
+	}
+	// Blobs are read from where the module which published the event stored them
+	inputDir := p.harness.blobDir(event.Context.ParentEventID, event.Context.Name)
+	baseDir := filepath.Join(p.jobsDir, message.ID()+"-v"+strconv.Itoa(message.DeliveryCount()))
+	if eventMeta, err := p.harness.DocumentStore.GetEventMetaByID(event.Context.EventID); err == nil && len(eventMeta.Parents) > 0 {
+		// A joined event's blobs were stored by the modules which published each of the joined events
+		inputDir = filepath.Join(baseDir, "joined")
+		join, err := p.harness.DocumentStore.GetJoin(documentstorage.GetJoinID(p.config.Name, event.Context.CorrelationID))
+		if err != nil {
+			return err
+		}
+		if err := p.harness.joinBlobDirs(join.Events, inputDir); err != nil {
+			return err
+		}
+	}
+
+	p.mu.Lock()
+	p.inProgress[message.ID()] = message
+	p.mu.Unlock()
+
+	go func() {
+		err := p.runJob(context, baseDir, inputDir)
+
+		p.mu.Lock()
+		_, active := p.inProgress[message.ID()]
+		delete(p.inProgress, message.ID())
+		p.mu.Unlock()
+		if !active {
+			// The job was aborted so its message can no longer be settled
+			return
+		}
+		p.settle(message, err)
+	}()
+	return nil
+}
+
+// runJob runs the job in its own base directory, taking the place of '/ion' in a module's container
+func (p *inProcessProvider) runJob(context *common.Context, baseDir, inputDir string) error {
+	environment := module.GetModuleEnvironment(baseDir)
+
+	dataPlane, err := p.newDataPlane(context, inputDir, environment)
+	if err != nil {
+		return err
+	}
+	prepare := preparer.NewPreparer(baseDir, nil)
+	err = prepare.Prepare(context, dataPlane)
+	prepare.Close()
+	if err != nil {
+		return fmt.Errorf("prepare failed: %+v", err)
+	}
+
+	if err := p.config.Run(environment); err != nil {
+		return fmt.Errorf("module failed: %+v", err)
+	}
+
+	dataPlane, err = p.newDataPlane(context, inputDir, environment)
+	if err != nil {
+		return err
+	}
+	commit := committer.NewCommitter(baseDir, nil)
+	defer commit.Close()
+	return commit.Commit(context, dataPlane, strings.Split(p.config.EventsPublished, ","))
+}
+
+// newDataPlane creates the data plane the handler would use for the job, backed by the harness
+func (p *inProcessProvider) newDataPlane(context *common.Context, inputDir string, environment *module.Environment) (*dataplane.DataPlane, error) {
+	blobStorage, err := filesystem.NewBlobStorage(&filesystem.Config{
+		InputDir:  inputDir,
+		OutputDir: p.harness.blobDir(context.EventID, context.Name),
+	}, environment)
+	if err != nil {
+		return nil, err
+	}
+	return &dataplane.DataPlane{
+		BlobStorageProvider:     blobStorage,
+		DocumentStorageProvider: p.harness.DocumentStore,
+		EventPublisher:          events.NewEventPublisher(inmemorybus.NewPublisher(p.harness.Broker)),
+	}, nil
+}
+
+// settle accepts the message if the job succeeded, dead letters it if the module reported a permanent failure
+// and otherwise rejects it so it's retried
+func (p *inProcessProvider) settle(message messaging.Message, jobErr error) {
+	contextualLogger := providers.GetLoggerForMessage(message, log.WithField("module", p.config.Name))
+	var err error
+	if failure, ok := jobErr.(*committer.ModuleFailedError); ok {
+		contextualLogger.WithField("failureReason", failure.Reason).Warning("job failed permanently, dead lettering message")
+		err = message.DeadLetter(failure.Reason)
+	} else if jobErr != nil {
+		contextualLogger.WithError(jobErr).Warning("job failed, rejecting message so it is retried")
+		err = message.Reject()
+	} else {
+		contextualLogger.Info("job succeeded, accepting message")
+		err = message.Accept()
+	}
+	if err != nil {
+		contextualLogger.WithError(err).Error("failed to settle message")
+	}
+}
+
+// Reconcile does nothing as jobs settle their message when they finish
+func (p *inProcessProvider) Reconcile() error {
+	return nil
+}
+
+// InProgressCount provides a count of the currently running jobs
+func (p *inProcessProvider) InProgressCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.inProgress)
+}
+
+// GetActiveMessages gets the messages for the currently running jobs
+func (p *inProcessProvider) GetActiveMessages() []messaging.Message {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	messages := make([]messaging.Message, 0, len(p.inProgress))
+	for _, message := range p.inProgress {
+		messages = append(messages, message)
+	}
+	return messages
+}
+
+// Abort forgets the message so its job's outcome is ignored. The job itself can't be stopped
+func (p *inProcessProvider) Abort(message messaging.Message) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.inProgress, message.ID())
+	return nil
+}
@@ -6,8 +6,6 @@ import (
 	"net/http"
 	"time"
 
-	"pack.ag/amqp"
-
 	log "github.com/sirupsen/logrus"
 
 	"github.com/satori/go.uuid"
@@ -41,13 +39,6 @@ func Process(w http.ResponseWriter, r *http.Request) {
 		},
 	}
 
-	eventJSON, err := json.Marshal(event)
-	if err != nil {
-		log.Errorf("failed marshalling event to json: %v", err)
-		http.Error(w, "Failed marshalling event", http.StatusInternalServerError)
-		return
-	}
-
 	// Create event metadata that
 	// can store additional metadata
 	// without bloating th event such
@@ -68,8 +59,8 @@ func Process(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Infoln("Publishing event", amqpSender.Address())
-	err = amqpSender.Send(ctx, amqp.NewMessage(eventJSON))
+	log.Infoln("Publishing event", event.Type)
+	err = publisher.Publish(ctx, event)
 	if err != nil {
 		log.Errorln(err)
 		http.Error(w, "Failed publishing event", http.StatusInternalServerError)
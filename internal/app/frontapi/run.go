@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/lawrencegripper/ion/internal/app/frontapi/links"
+	"github.com/lawrencegripper/ion/internal/pkg/messagebus"
 	"github.com/lawrencegripper/ion/internal/pkg/types"
 
 	"github.com/gorilla/mux"
@@ -19,8 +20,13 @@ import (
 // Run starts the webserver that on port
 func Run(cfg *types.Configuration, port int) {
 
-	log.Info("Initialising AMQP connection")
-	links.InitAmqp(cfg, "frontapi.new_link")
+	log.Info("Initialising message bus")
+	bus, err := messagebus.New(context.Background(), cfg)
+	if err != nil {
+		log.WithError(err).Fatal("Couldn't connect to message bus")
+	}
+	defer bus.Close() // nolint: errcheck
+	links.InitMessageBus(bus, "frontapi.new_link")
 	log.Info("Initialising Mongo connection")
 	links.InitMongoDB(cfg)
 
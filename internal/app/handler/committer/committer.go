@@ -4,11 +4,15 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/lawrencegripper/ion/internal/app/handler/development"
+	"io"
 	"io/ioutil"
+	"mime"
+	"net/http"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/lawrencegripper/ion/internal/app/handler/dataplane"
 	"github.com/lawrencegripper/ion/internal/app/handler/dataplane/documentstorage"
@@ -25,6 +29,16 @@ const (
 	filesToIncludeKey = "files"
 )
 
+// ModuleFailedError is returned when the module reported a permanent failure in out/failure.json.
+// Nothing is committed for a module which has failed
+type ModuleFailedError struct {
+	Reason string
+}
+
+func (e *ModuleFailedError) Error() string {
+	return fmt.Sprintf("module reported a permanent failure: %s", e.Reason)
+}
+
 // Committer holds the data and methods needed to commit
 // the module's environment to the data plane.
 type Committer struct {
@@ -76,10 +90,15 @@ func (c *Committer) Commit(context *common.Context, dataPlane *dataplane.DataPla
 	c.environment = module.GetModuleEnvironment(c.baseDir)
 	c.context = context
 
+	if err := c.checkModuleFailure(c.environment.OutputFailurePath); err != nil {
+		return err
+	}
+
 	if err := c.doCommit(); err != nil {
 		return err
 	}
 
+	c.recordProcessed()
 	return nil
 }
 
@@ -96,7 +115,7 @@ func (c *Committer) doCommit() error {
 	logger.Info(c.context, "committing module's environment to the data plane")
 
 	// Commit blob data to an external blob store
-	blobURIs, err := c.commitBlob(c.environment.OutputBlobDirPath)
+	blobURIs, blobFiles, err := c.commitBlob(c.environment.OutputBlobDirPath)
 	if err != nil {
 		return fmt.Errorf("error committing blob data: %+v", err)
 	}
@@ -108,7 +127,7 @@ func (c *Committer) doCommit() error {
 	}
 
 	// Commit events to an external messaging system
-	err = c.commitEvents(c.environment.OutputEventsDirPath, blobURIs)
+	err = c.commitEvents(c.environment.OutputEventsDirPath, blobURIs, blobFiles)
 	if err != nil {
 		return fmt.Errorf("error committing events: %+v", err)
 	}
@@ -124,11 +143,49 @@ func (c *Committer) doCommit() error {
 	return nil
 }
 
-//CommitBlob commits the blob directory to an external blob provider
-func (c *Committer) commitBlob(blobsDir string) (map[string]string, error) {
+// recordProcessed records that the module has processed the event so the dispatcher
+// can skip it if it's delivered again. The commit has already succeeded so failing
+// to record it is only logged, a redelivered event would be processed again
+func (c *Committer) recordProcessed() {
+	processed := documentstorage.ProcessedEvent{
+		Context:     c.context,
+		ID:          documentstorage.GetProcessedEventID(c.context.Name, c.context.EventID),
+		ProcessedAt: time.Now().UTC(),
+	}
+	if err := c.dataPlane.CreateProcessedEvent(&processed); err != nil {
+		logger.Error(c.context, fmt.Sprintf("failed to record event as processed with error '%+v'", err))
+	}
+}
+
+// checkModuleFailure returns a ModuleFailedError if the module has written a failure file
+func (c *Committer) checkModuleFailure(failurePath string) error {
+	if _, err := os.Stat(failurePath); os.IsNotExist(err) {
+		return nil
+	}
+
+	failure := common.ModuleFailure{}
+	bytes, err := ioutil.ReadFile(failurePath)
+	if err == nil {
+		err = json.Unmarshal(bytes, &failure)
+	}
+	if err != nil {
+		logger.Error(c.context, fmt.Sprintf("failed to read failure file '%s' with error '%+v'", failurePath, err))
+	}
+	if failure.Reason == "" {
+		failure.Reason = "no reason given"
+	}
+
+	return &ModuleFailedError{
+		Reason: failure.Reason,
+	}
+}
+
+//CommitBlob commits the blob directory to an external blob provider,
+//describing each file by its path relative to the blob directory
+func (c *Committer) commitBlob(blobsDir string) (map[string]string, map[string]documentstorage.File, error) {
 	if _, err := os.Stat(blobsDir); os.IsNotExist(err) {
 		logger.Debug(c.context, fmt.Sprintf("blob output directory '%s' does not exists '%+v'", blobsDir, err))
-		return nil, nil
+		return nil, nil, nil
 	}
 
 	files := make([]string, 0)
@@ -140,19 +197,62 @@ func (c *Committer) commitBlob(blobsDir string) (map[string]string, error) {
 		return err
 	})
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+
+	blobFiles := make(map[string]documentstorage.File, len(files))
+	for _, filePath := range files {
+		name, err := helpers.GetBlobName(blobsDir, filePath)
+		if err != nil {
+			return nil, nil, err
+		}
+		file, err := describeFile(name, filePath)
+		if err != nil {
+			return nil, nil, err
+		}
+		blobFiles[name] = file
 	}
 
 	blobURIs, err := c.dataPlane.PutBlobs(files)
 	if err != nil {
-		return nil, fmt.Errorf("failed to commit blob: %+v", err)
+		return nil, nil, fmt.Errorf("failed to commit blob: %+v", err)
 	}
 
 	logger.Info(c.context, "committed blob data")
 	logger.DebugWithFields(c.context, "blob file names", map[string]interface{}{
 		"files": files,
 	})
-	return blobURIs, nil
+	return blobURIs, blobFiles, nil
+}
+
+//describeFile gets the SHA-256, size and content type of an output file.
+//The content type is guessed from the file's extension, or its content
+//when the extension isn't known
+func describeFile(name, filePath string) (documentstorage.File, error) {
+	hash, size, err := helpers.HashFile(filePath)
+	if err != nil {
+		return documentstorage.File{}, err
+	}
+	contentType := mime.TypeByExtension(filepath.Ext(filePath))
+	if contentType == "" {
+		f, err := os.Open(filePath)
+		if err != nil {
+			return documentstorage.File{}, err
+		}
+		defer f.Close() // nolint: errcheck
+		head := make([]byte, 512)
+		n, err := io.ReadFull(f, head)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return documentstorage.File{}, err
+		}
+		contentType = http.DetectContentType(head[:n])
+	}
+	return documentstorage.File{
+		Name:        name,
+		SHA256:      hash,
+		Size:        size,
+		ContentType: contentType,
+	}, nil
 }
 
 //CommitMeta commits the metadata document to an external provider
@@ -195,13 +295,63 @@ func (c *Committer) commitInsights(insightsPath string) error {
 	return nil
 }
 
-//CommitEvents commits the events directory to an external provider
-func (c *Committer) commitEvents(eventsPath string, blobURIs map[string]string) error {
-	if _, err := os.Stat(eventsPath); os.IsNotExist(err) {
-		logger.Info(c.context, fmt.Sprintf("events output directory '%s' does not exists '%+v'", eventsPath, err))
-		return nil
+//CommitEvents commits the events directory to an external provider.
+//The events are first recorded in an outbox document so, if the commit
+//fails part way through, a retry publishes the same events with the
+//same IDs and skips those already published.
+func (c *Committer) commitEvents(eventsPath string, blobURIs map[string]string, blobFiles map[string]documentstorage.File) error {
+	outboxID := documentstorage.GetOutboxID(c.context)
+	outbox, err := c.dataPlane.GetOutbox(outboxID)
+	if err != nil && !strings.HasPrefix(err.Error(), documentstorage.NotFoundErr) {
+		return fmt.Errorf("failed to get outbox '%s' with error '%+v'", outboxID, err)
+	}
+	if outbox != nil {
+		logger.Info(c.context, fmt.Sprintf("resuming commit from outbox with %d unpublished event(s)", countUnpublished(outbox)))
+	} else {
+		if _, err := os.Stat(eventsPath); os.IsNotExist(err) {
+			logger.Info(c.context, fmt.Sprintf("events output directory '%s' does not exists '%+v'", eventsPath, err))
+			return nil
+		}
+		outbox, err = c.planEvents(outboxID, eventsPath, blobURIs, blobFiles)
+		if err != nil {
+			return err
+		}
+		// Nothing is published until the outbox is
+		// stored so a retry will publish the same events.
+		err = c.dataPlane.SaveOutbox(outbox)
+		if err != nil {
+			return fmt.Errorf("failed to save outbox '%s' with error '%+v'", outboxID, err)
+		}
 	}
 
+	// Every event's metadata is stored before any
+	// event is published so modules receiving them
+	// can always look it up.
+	pending := make([]int, 0, len(outbox.Events))
+	for i := range outbox.Events {
+		if outbox.Events[i].Published {
+			continue
+		}
+		eventMeta := outbox.Events[i].Meta
+		err = c.dataPlane.CreateEventMeta(&eventMeta)
+		if err != nil {
+			return fmt.Errorf("failed to add context '%+v' with error '%+v'", eventMeta, err)
+		}
+		pending = append(pending, i)
+	}
+
+	if err := c.publishEvents(outbox, pending); err != nil {
+		return err
+	}
+
+	logger.Info(c.context, "committed events")
+	return nil
+}
+
+//planEvents reads the events from the output events directory
+//into an outbox, giving each event an ID derived from the file
+//it was read from and describing the files it includes
+func (c *Committer) planEvents(outboxID, eventsPath string, blobURIs map[string]string, blobFiles map[string]documentstorage.File) (*documentstorage.Outbox, error) {
 	// Read each of the event files stored in the
 	// output events directory. Events will be
 	// de-serialized into an expected structure,
@@ -211,7 +361,12 @@ func (c *Committer) commitEvents(eventsPath string, blobURIs map[string]string)
 	// reference.
 	files, err := ioutil.ReadDir(eventsPath)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	outbox := &documentstorage.Outbox{
+		Context: c.context,
+		ID:      outboxID,
+		Events:  make([]documentstorage.OutboxEvent, 0, len(files)),
 	}
 	for _, file := range files {
 		fileName := file.Name()
@@ -219,7 +374,7 @@ func (c *Committer) commitEvents(eventsPath string, blobURIs map[string]string)
 		f, err := os.Open(eventFilePath)
 		defer f.Close() // nolint: errcheck
 		if err != nil {
-			return fmt.Errorf("failed to read file '%s' with error: '%+v'", fileName, err)
+			return nil, fmt.Errorf("failed to read file '%s' with error: '%+v'", fileName, err)
 		}
 
 		// Decode event into map
@@ -227,14 +382,18 @@ func (c *Committer) commitEvents(eventsPath string, blobURIs map[string]string)
 		decoder := json.NewDecoder(f)
 		err = decoder.Decode(&kvps)
 		if err != nil {
-			return fmt.Errorf("failed to unmarshal map '%s' with error: '%+v'", fileName, err)
+			return nil, fmt.Errorf("failed to unmarshal map '%s' with error: '%+v'", fileName, err)
 		}
 		logger.DebugWithFields(c.context, "event data from file", map[string]interface{}{
 			"event": kvps,
 		})
 
 		var eventType string
-		var incFiles []string
+		var incFiles []documentstorage.File
+		// The blob providers read each file from the
+		// uri keyed by its name in the event's data,
+		// these follow the module's own data.
+		var blobDataField common.KeyValuePairs
 		eventDataField := make(common.KeyValuePairs, 0, len(kvps)+1)
 		for _, kvp := range kvps {
 			switch kvp.Key {
@@ -245,20 +404,30 @@ func (c *Committer) commitEvents(eventsPath string, blobURIs map[string]string)
 				}
 				eventType = kvp.Value
 			case filesToIncludeKey:
-				incFiles = strings.Split(kvp.Value, ",")
-				for _, f := range incFiles {
+				for _, f := range strings.Split(kvp.Value, ",") {
 					if f == "" {
 						continue // ignore empty strings
 					}
-					if !c.fileExistsInEnv(f) {
-						return fmt.Errorf("file '%s' specified in event does not exist in output", f)
+					// Files are referred to by their path in
+					// the output blob directory so files with
+					// the same name in different directories
+					// don't collide.
+					name, err := helpers.GetBlobName(c.environment.OutputBlobDirPath, filepath.Join(c.environment.OutputBlobDirPath, filepath.FromSlash(f)))
+					if err != nil {
+						return nil, fmt.Errorf("file '%s' specified in event is not in output: %+v", f, err)
+					}
+					if !c.fileExistsInEnv(name) {
+						return nil, fmt.Errorf("file '%s' specified in event does not exist in output", f)
 					}
-					if _, exists := blobURIs[f]; exists {
+					file := blobFiles[name]
+					file.Name = name
+					incFiles = append(incFiles, file)
+					if _, exists := blobURIs[name]; exists {
 						blobInfo := common.KeyValuePair{
-							Key:   f,
-							Value: blobURIs[f],
+							Key:   name,
+							Value: blobURIs[name],
 						}
-						eventDataField = append(eventDataField, blobInfo)
+						blobDataField = append(blobDataField, blobInfo)
 					}
 				}
 			default:
@@ -267,10 +436,14 @@ func (c *Committer) commitEvents(eventsPath string, blobURIs map[string]string)
 		}
 
 		if eventType == "" {
-			return fmt.Errorf("eventType is a required key value pair in an event")
+			return nil, fmt.Errorf("eventType is a required key value pair in an event")
 		}
+		eventDataField = append(eventDataField, blobDataField...)
 
-		eventID := helpers.NewGUID()
+		// The ID is the same each time this
+		// module commits the same event file
+		// so duplicates can be detected.
+		eventID := helpers.NewDeterministicGUID(c.context.EventID, c.context.Name, fileName)
 
 		// Create a new context for this event.
 		// We can only build a partial context
@@ -306,24 +479,69 @@ func (c *Committer) commitEvents(eventsPath string, blobURIs map[string]string)
 			Data:    eventDataField,
 		}
 
-		err = c.dataPlane.CreateEventMeta(&eventMeta)
-		if err != nil {
-			return fmt.Errorf("failed to add context '%+v' with error '%+v'", eventMeta, err)
-		}
-		err = c.dataPlane.Publish(event)
-		if err != nil {
-			return fmt.Errorf("failed to publish event '%+v' with error '%+v'", event, err)
-		}
+		outbox.Events = append(outbox.Events, documentstorage.OutboxEvent{
+			Event: event,
+			Meta:  eventMeta,
+		})
 		if c.devConfig.Enabled {
 			_ = c.devConfig.WriteMetadata(fileName, eventMeta)
 			_ = c.devConfig.WriteEvent(fileName, event)
 		}
 	}
+	return outbox, nil
+}
 
-	logger.Info(c.context, "committed events")
+// publishEvents publishes the outbox's pending events,
+// together when the event publisher supports batches,
+// marking them published in the outbox as they're sent
+func (c *Committer) publishEvents(outbox *documentstorage.Outbox, pending []int) error {
+	if len(pending) == 0 {
+		return nil
+	}
+	if batchPublisher, ok := c.dataPlane.EventPublisher.(dataplane.BatchEventPublisher); ok && len(pending) > 1 {
+		events := make([]common.Event, 0, len(pending))
+		for _, i := range pending {
+			events = append(events, outbox.Events[i].Event)
+		}
+		if err := batchPublisher.PublishBatch(events); err != nil {
+			return fmt.Errorf("failed to publish %d events with error '%+v'", len(events), err)
+		}
+		for _, i := range pending {
+			outbox.Events[i].Published = true
+		}
+		return c.saveOutbox(outbox)
+	}
+	for _, i := range pending {
+		event := outbox.Events[i].Event
+		if err := c.dataPlane.Publish(event); err != nil {
+			return fmt.Errorf("failed to publish event '%+v' with error '%+v'", event, err)
+		}
+		outbox.Events[i].Published = true
+		if err := c.saveOutbox(outbox); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// saveOutbox records which of the outbox's events have been published
+func (c *Committer) saveOutbox(outbox *documentstorage.Outbox) error {
+	if err := c.dataPlane.SaveOutbox(outbox); err != nil {
+		return fmt.Errorf("failed to save outbox '%s' with error '%+v'", outbox.ID, err)
+	}
+	return nil
+}
+
+func countUnpublished(outbox *documentstorage.Outbox) int {
+	count := 0
+	for _, e := range outbox.Events {
+		if !e.Published {
+			count++
+		}
+	}
+	return count
+}
+
 func (c *Committer) isValidEventType(eventType string) bool {
 	if !helpers.ContainsString(c.validEventTypes, eventType) {
 		return false
@@ -1,6 +1,8 @@
 package committer_test
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -13,11 +15,13 @@ import (
 	"github.com/lawrencegripper/ion/internal/app/handler/committer"
 	"github.com/lawrencegripper/ion/internal/app/handler/dataplane"
 	"github.com/lawrencegripper/ion/internal/app/handler/dataplane/blobstorage/filesystem"
+	"github.com/lawrencegripper/ion/internal/app/handler/dataplane/documentstorage"
 	"github.com/lawrencegripper/ion/internal/app/handler/dataplane/documentstorage/inmemory"
 	"github.com/lawrencegripper/ion/internal/app/handler/dataplane/events/mock"
 	"github.com/lawrencegripper/ion/internal/app/handler/module"
 	"github.com/lawrencegripper/ion/internal/pkg/common"
 	log "github.com/sirupsen/logrus"
+	"gopkg.in/mgo.v2/bson"
 )
 
 const testdata = "testdata"
@@ -377,12 +381,218 @@ func TestCommitEvents(t *testing.T) {
 	}
 }
 
+func TestCommitSkippedWhenModuleFailed(t *testing.T) {
+	reset()
+	outputFilePath := filepath.Join(environment.OutputBlobDirPath, "file1.txt")
+	if err := ioutil.WriteFile(outputFilePath, []byte("partial"), 0644); err != nil {
+		t.Fatalf("error creating test file '%s'", outputFilePath)
+	}
+	failure, _ := json.Marshal(common.ModuleFailure{Reason: "unsupported file format"})
+	if err := ioutil.WriteFile(environment.OutputFailurePath, failure, 0644); err != nil {
+		t.Fatalf("error creating failure file '%s'", environment.OutputFailurePath)
+	}
+
+	err := c.Commit(context, dataPlane, eventTypes)
+	failedErr, ok := err.(*committer.ModuleFailedError)
+	if !ok {
+		t.Fatalf("expected module failed error but got '%+v'", err)
+	}
+	if failedErr.Reason != "unsupported file format" {
+		t.Errorf("expected failure reason 'unsupported file format' but got '%s'", failedErr.Reason)
+	}
+
+	files, _ := ioutil.ReadDir(persistentOutBlobDir)
+	if len(files) != 0 {
+		t.Errorf("expected nothing to be committed but found %d blobs", len(files))
+	}
+
+	reset()
+}
+
+// flakyPublisher records the events it publishes, failing once after failAfter events
+type flakyPublisher struct {
+	failAfter int
+	published []common.Event
+	failed    bool
+}
+
+func (p *flakyPublisher) Publish(event common.Event) error {
+	if !p.failed && len(p.published) == p.failAfter {
+		p.failed = true
+		return fmt.Errorf("connection lost")
+	}
+	p.published = append(p.published, event)
+	return nil
+}
+
+func (p *flakyPublisher) Close() {}
+
+func TestCommitResumesFromOutbox(t *testing.T) {
+	reset()
+	for i := 0; i < 3; i++ {
+		b, _ := json.Marshal(common.KeyValuePairs{{Key: "eventType", Value: "test_events"}})
+		outputEventFilePath := filepath.Join(environment.OutputEventsDirPath, fmt.Sprintf("event%d.json", i))
+		if err := ioutil.WriteFile(outputEventFilePath, b, os.ModePerm); err != nil {
+			t.Fatalf("error writing event file: '%+v'", err)
+		}
+	}
+	publisher := &flakyPublisher{failAfter: 1}
+	flakyDataPlane := &dataplane.DataPlane{
+		BlobStorageProvider:     dataPlane.BlobStorageProvider,
+		DocumentStorageProvider: dataPlane.DocumentStorageProvider,
+		EventPublisher:          publisher,
+	}
+
+	if err := c.Commit(context, flakyDataPlane, eventTypes); err == nil {
+		t.Fatal("expected commit to fail when publishing fails")
+	}
+	if len(publisher.published) != 1 {
+		t.Fatalf("expected 1 event published before the failure but got %d", len(publisher.published))
+	}
+
+	// The module's output is unchanged for the retry
+	if err := c.Commit(context, flakyDataPlane, eventTypes); err != nil {
+		t.Fatalf("expected retried commit to succeed but got '%+v'", err)
+	}
+	if len(publisher.published) != 3 {
+		t.Fatalf("expected each event published once but got %d", len(publisher.published))
+	}
+	ids := map[string]bool{}
+	for _, event := range publisher.published {
+		ids[event.Context.EventID] = true
+		if _, err := dataPlane.GetEventMetaByID(event.Context.EventID); err != nil {
+			t.Errorf("expected metadata for event '%s' but got '%+v'", event.Context.EventID, err)
+		}
+	}
+	if len(ids) != 3 {
+		t.Errorf("expected 3 distinct event IDs but got %v", ids)
+	}
+
+	// Committing the same output again gives the same event IDs
+	reset()
+	for i := 0; i < 3; i++ {
+		b, _ := json.Marshal(common.KeyValuePairs{{Key: "eventType", Value: "test_events"}})
+		_ = ioutil.WriteFile(filepath.Join(environment.OutputEventsDirPath, fmt.Sprintf("event%d.json", i)), b, os.ModePerm)
+	}
+	republisher := &flakyPublisher{failAfter: -1}
+	flakyDataPlane.DocumentStorageProvider = dataPlane.DocumentStorageProvider
+	flakyDataPlane.EventPublisher = republisher
+	if err := c.Commit(context, flakyDataPlane, eventTypes); err != nil {
+		t.Fatal(err)
+	}
+	for _, event := range republisher.published {
+		if !ids[event.Context.EventID] {
+			t.Errorf("expected event ID '%s' to match the earlier commit", event.Context.EventID)
+		}
+	}
+
+	reset()
+}
+
+func TestCommitRecordsFileHashes(t *testing.T) {
+	reset()
+	content := []byte("<html>frame</html>")
+	_ = os.MkdirAll(filepath.Join(environment.OutputBlobDirPath, "pages"), os.ModePerm)
+	if err := ioutil.WriteFile(filepath.Join(environment.OutputBlobDirPath, "pages", "page"), content, os.ModePerm); err != nil {
+		t.Fatalf("error creating test file '%+v'", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(environment.OutputBlobDirPath, "title.txt"), []byte("title"), os.ModePerm); err != nil {
+		t.Fatalf("error creating test file '%+v'", err)
+	}
+	b, _ := json.Marshal(common.KeyValuePairs{
+		{Key: "eventType", Value: "test_events"},
+		{Key: "files", Value: "./pages/page,title.txt"},
+	})
+	if err := ioutil.WriteFile(filepath.Join(environment.OutputEventsDirPath, "event0.json"), b, os.ModePerm); err != nil {
+		t.Fatalf("error writing event file: '%+v'", err)
+	}
+	publisher := &flakyPublisher{failAfter: -1}
+	if err := c.Commit(context, &dataplane.DataPlane{
+		BlobStorageProvider:     dataPlane.BlobStorageProvider,
+		DocumentStorageProvider: dataPlane.DocumentStorageProvider,
+		EventPublisher:          publisher,
+	}, eventTypes); err != nil {
+		t.Fatal(err)
+	}
+	if len(publisher.published) != 1 {
+		t.Fatalf("expected 1 event published but got %d", len(publisher.published))
+	}
+	eventMeta, err := dataPlane.GetEventMetaByID(publisher.published[0].Context.EventID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(eventMeta.Files) != 2 {
+		t.Fatalf("expected 2 files in event meta but got %+v", eventMeta.Files)
+	}
+	sum := sha256.Sum256(content)
+	expected := documentstorage.File{
+		Name:        "pages/page",
+		SHA256:      hex.EncodeToString(sum[:]),
+		Size:        int64(len(content)),
+		ContentType: "text/html; charset=utf-8",
+	}
+	if eventMeta.Files[0] != expected {
+		t.Errorf("expected file %+v but got %+v", expected, eventMeta.Files[0])
+	}
+	if eventMeta.Files[1].Name != "title.txt" || eventMeta.Files[1].ContentType != "text/plain; charset=utf-8" {
+		t.Errorf("expected text file title.txt but got %+v", eventMeta.Files[1])
+	}
+	if eventMeta.Data.AsMap()["pages/page"] == "" {
+		t.Errorf("expected blob uri keyed by the file's path in the output directory but got %+v", eventMeta.Data)
+	}
+
+	reset()
+}
+
+func TestCommitRejectsFilesOutsideOutput(t *testing.T) {
+	reset()
+	b, _ := json.Marshal(common.KeyValuePairs{
+		{Key: "eventType", Value: "test_events"},
+		{Key: "files", Value: "../events/event0.json"},
+	})
+	if err := ioutil.WriteFile(filepath.Join(environment.OutputEventsDirPath, "event0.json"), b, os.ModePerm); err != nil {
+		t.Fatalf("error writing event file: '%+v'", err)
+	}
+	if err := c.Commit(context, dataPlane, eventTypes); err == nil {
+		t.Error("expected commit to fail for a file outside the output blob directory")
+	}
+
+	reset()
+}
+
+func TestFileReadsBareNames(t *testing.T) {
+	var eventMeta documentstorage.EventMeta
+	if err := json.Unmarshal([]byte(`{"files":["page.html",{"name":"title.txt","sha256":"abc","size":5}]}`), &eventMeta); err != nil {
+		t.Fatal(err)
+	}
+	names := eventMeta.FileNames()
+	if len(names) != 2 || names[0] != "page.html" || names[1] != "title.txt" {
+		t.Errorf("expected both file names but got %v", names)
+	}
+	if eventMeta.Files[1].SHA256 != "abc" || eventMeta.Files[1].Size != 5 {
+		t.Errorf("expected structured file to keep its hash and size but got %+v", eventMeta.Files[1])
+	}
+
+	b, _ := bson.Marshal(bson.M{"files": []interface{}{"page.html", bson.M{"name": "title.txt", "sha256": "abc", "size": 5}}})
+	eventMeta = documentstorage.EventMeta{}
+	if err := bson.Unmarshal(b, &eventMeta); err != nil {
+		t.Fatal(err)
+	}
+	if names := eventMeta.FileNames(); len(names) != 2 || names[0] != "page.html" || eventMeta.Files[1].SHA256 != "abc" {
+		t.Errorf("expected both files from bson but got %+v", eventMeta.Files)
+	}
+}
+
 func reset() {
 	refreshDataplane()
 	refreshEnv()
 }
 
 func refreshDataplane() {
+	// Each test commits the same context so
+	// starts from an empty document store
+	// rather than resuming an earlier outbox
+	dataPlane.DocumentStorageProvider, _ = inmemory.NewInMemoryDB()
 	refreshDir(persistentEventsDir)
 	refreshDir(persistentInBlobDir)
 	refreshDir(persistentOutBlobDir)
@@ -2,7 +2,11 @@ package handler
 
 import (
 	"github.com/lawrencegripper/ion/internal/app/handler/dataplane/blobstorage/azure"
+	"github.com/lawrencegripper/ion/internal/app/handler/dataplane/blobstorage/s3"
 	"github.com/lawrencegripper/ion/internal/app/handler/dataplane/documentstorage/mongodb"
+	"github.com/lawrencegripper/ion/internal/app/handler/dataplane/events/amqp"
+	"github.com/lawrencegripper/ion/internal/app/handler/dataplane/events/nats"
+	"github.com/lawrencegripper/ion/internal/app/handler/dataplane/events/redis"
 	"github.com/lawrencegripper/ion/internal/app/handler/dataplane/events/servicebus"
 	"github.com/lawrencegripper/ion/internal/app/handler/development"
 	"github.com/lawrencegripper/ion/internal/pkg/common"
@@ -17,8 +21,12 @@ type Configuration struct {
 	Context                        *common.Context            `description:"The module details"`
 	ValidEventTypes                string                     `description:"Valid event type names as a comma delimited list"`
 	AzureBlobStorageProvider       *azure.Config              `description:"Azure Storage Blob provider" export:"true"`
+	S3BlobStorageProvider          *s3.Config                 `description:"S3 compatible blob provider" export:"true"`
 	MongoDBDocumentStorageProvider *mongodb.Config            `description:"MongoDB metastore provider" export:"true"`
 	ServiceBusEventProvider        *servicebus.Config         `description:"ServiceBus event publisher" export:"true"`
+	AMQPEventProvider              *amqp.Config               `description:"AMQP 1.0 event publisher" export:"true"`
+	NATSEventProvider              *nats.Config               `description:"NATS JetStream event publisher" export:"true"`
+	RedisEventProvider             *redis.Config              `description:"Redis Streams event publisher" export:"true"`
 	PrintConfig                    bool                       `description:"Set to print config on start" export:"true"`
 	LogFile                        string                     `description:"File to log output to"`
 	LogLevel                       string                     `description:"Logging level, possible values {debug, info, warn, error}"`
@@ -30,8 +38,12 @@ func NewConfiguration() Configuration {
 	cfg := Configuration{}
 	cfg.Context = &common.Context{}
 	cfg.AzureBlobStorageProvider = &azure.Config{}
+	cfg.S3BlobStorageProvider = &s3.Config{}
 	cfg.MongoDBDocumentStorageProvider = &mongodb.Config{}
 	cfg.ServiceBusEventProvider = &servicebus.Config{}
+	cfg.AMQPEventProvider = &amqp.Config{}
+	cfg.NATSEventProvider = &nats.Config{}
+	cfg.RedisEventProvider = &redis.Config{}
 	cfg.DevelopmentConfiguration = &development.Configuration{}
 	return cfg
 }
@@ -21,4 +21,7 @@ const (
 
 	// OutputEventsDir is the output event data
 	OutputEventsDir = "out/events"
+
+	// OutputFailureFile is written by the module to report a failure which retrying won't fix
+	OutputFailureFile = "out/failure.json"
 )
@@ -2,9 +2,9 @@ package azure
 
 import (
 	"context"
+	"crypto/md5"
 	"fmt"
-	"io/ioutil"
-	"net/http"
+	"io"
 	"net/url"
 	"os"
 	"path"
@@ -14,6 +14,7 @@ import (
 	"time"
 
 	"github.com/azure/azure-storage-blob-go/2016-05-31/azblob"
+	"github.com/lawrencegripper/ion/internal/app/handler/dataplane/blobstorage/download"
 	"github.com/lawrencegripper/ion/internal/app/handler/dataplane/documentstorage"
 	"github.com/lawrencegripper/ion/internal/app/handler/helpers"
 	"github.com/lawrencegripper/ion/internal/app/handler/module"
@@ -33,6 +34,7 @@ type Config struct {
 	BlobAccountName string `description:"Azure Blob Storage account name"`
 	BlobAccountKey  string `description:"Azure Blob Storage account key"`
 	ContainerName   string `description:"Azure Blob Storage container name"`
+	BlobEndpoint    string `description:"Azure Blob Storage endpoint, defaults to https://<account>.blob.core.windows.net"`
 }
 
 //BlobStorage is responsible for handling the connections to Azure Blob Storage
@@ -44,11 +46,16 @@ type BlobStorage struct {
 	eventMeta        *documentstorage.EventMeta
 	accountKey       string
 	accountName      string
+	serviceURL       *url.URL
 	env              *module.Environment
 }
 
 //NewBlobStorage creates a new Azure Blob Storage object
 func NewBlobStorage(config *Config, inputBlobPrefix, outputBlobPrefix string, eventMeta *documentstorage.EventMeta, env *module.Environment) (*BlobStorage, error) {
+	serviceURL, err := GetServiceURL(config.BlobAccountName, config.BlobEndpoint)
+	if err != nil {
+		return nil, err
+	}
 	asb := &BlobStorage{
 		containerName:    config.ContainerName,
 		outputBlobPrefix: outputBlobPrefix,
@@ -56,12 +63,35 @@ func NewBlobStorage(config *Config, inputBlobPrefix, outputBlobPrefix string, ev
 		eventMeta:        eventMeta,
 		accountName:      config.BlobAccountName,
 		accountKey:       config.BlobAccountKey,
+		serviceURL:       serviceURL,
 		env:              env,
 	}
 	return asb, nil
 }
 
-//PutBlobs puts a file into Azure Blob Storage
+//GetServiceURL gets the url of the account's blob service. An empty endpoint uses the Azure public cloud,
+//otherwise the endpoint is used as is, such as an Azure Government or China endpoint or the Azurite emulator's
+//http://127.0.0.1:10000/devstoreaccount1
+func GetServiceURL(accountName, endpoint string) (*url.URL, error) {
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s.blob.core.windows.net", accountName)
+	}
+	serviceURL, err := url.Parse(strings.TrimSuffix(endpoint, "/"))
+	if err != nil || serviceURL.Scheme == "" || serviceURL.Host == "" {
+		return nil, fmt.Errorf("invalid blob endpoint '%s', expected a url such as https://%s.blob.core.windows.net", endpoint, accountName)
+	}
+	return serviceURL, nil
+}
+
+//GetSASProtocol gets the protocols a SAS for the blob service allows, emulators served over http can't use https only SAS
+func GetSASProtocol(serviceURL *url.URL) azblob.SASProtocol {
+	if serviceURL.Scheme == "https" {
+		return azblob.SASProtocolHTTPS
+	}
+	return azblob.SASProtocolHTTPSandHTTP
+}
+
+//PutBlobs puts a file into Azure Blob Storage, returning a SAS url to read each one by its path in the output blob directory
 func (a *BlobStorage) PutBlobs(filePaths []string) (map[string]string, error) {
 	blobSASURIs := make(map[string]string)
 
@@ -72,9 +102,9 @@ func (a *BlobStorage) PutBlobs(filePaths []string) (map[string]string, error) {
 			MaxTries: 3,
 		},
 	})
-	URL, _ := url.Parse(
-		fmt.Sprintf("https://%s.blob.core.windows.net/%s", a.accountName, a.containerName))
-	containerURL := azblob.NewContainerURL(*URL, p)
+	URL := *a.serviceURL
+	URL.Path = path.Join(URL.Path, a.containerName)
+	containerURL := azblob.NewContainerURL(URL, p)
 	ctx := context.Background()
 	_, err := containerURL.Create(ctx, azblob.Metadata{}, azblob.PublicAccessNone)
 	if err != nil {
@@ -88,12 +118,11 @@ func (a *BlobStorage) PutBlobs(filePaths []string) (map[string]string, error) {
 	}
 
 	for _, filePath := range filePaths {
-		filePathOutOfEnv := strings.Replace(filePath, a.env.OutputBlobDirPath, "", 1)
-		if filePathOutOfEnv[0] == '/' {
-			filePathOutOfEnv = filePathOutOfEnv[1:]
+		blobName, err := helpers.GetBlobName(a.env.OutputBlobDirPath, filePath)
+		if err != nil {
+			return nil, err
 		}
-		filePathOutOfEnv = filepath.Clean(filePathOutOfEnv)
-		blobPath := helpers.JoinBlobPath(a.outputBlobPrefix, filePathOutOfEnv)
+		blobPath := helpers.JoinBlobPath(a.outputBlobPrefix, blobName)
 		file, err := os.Open(filePath)
 		if err != nil {
 			return nil, fmt.Errorf("failed to read data from file '%s', error: '%+v'", filePath, err)
@@ -105,6 +134,15 @@ func (a *BlobStorage) PutBlobs(filePaths []string) (map[string]string, error) {
 			return nil, err
 		}
 
+		// The MD5 is stored with the blob and returned
+		// when it's downloaded so it can be verified
+		hasher := md5.New()
+		if _, err := io.Copy(hasher, file); err != nil {
+			return nil, fmt.Errorf("failed to hash file '%s', error: '%+v'", filePath, err)
+		}
+		var headers azblob.BlobHTTPHeaders
+		copy(headers.ContentMD5[:], hasher.Sum(nil))
+
 		b := stat.Size()
 		kb := float64(b) / 1024
 		mb := float64(kb / 1024)
@@ -122,14 +160,15 @@ func (a *BlobStorage) PutBlobs(filePaths []string) (map[string]string, error) {
 		blobURL := containerURL.WithPipeline(p).NewBlockBlobURL(blobPath)
 		parallelism := uint16(runtime.NumCPU())
 		_, err = azblob.UploadFileToBlockBlob(ctx, file, blobURL, azblob.UploadToBlockBlobOptions{
-			BlockSize:   1 * 1024 * 1024,
-			Parallelism: parallelism})
+			BlockSize:       1 * 1024 * 1024,
+			BlobHTTPHeaders: headers,
+			Parallelism:     parallelism})
 		if err != nil {
 			return nil, err
 		}
 
 		sasQueryParams := azblob.BlobSASSignatureValues{
-			Protocol:      azblob.SASProtocolHTTPS,
+			Protocol:      GetSASProtocol(a.serviceURL),
 			StartTime:     time.Now().UTC().Add(-1 * time.Hour),
 			ExpiryTime:    time.Now().UTC().Add(24 * time.Hour),
 			Permissions:   azblob.BlobSASPermissions{Read: true}.String(),
@@ -138,47 +177,34 @@ func (a *BlobStorage) PutBlobs(filePaths []string) (map[string]string, error) {
 		}.NewSASQueryParameters(c)
 
 		queryParams := sasQueryParams.Encode()
-		_, filename := filepath.Split(filePathOutOfEnv)
-		blobSASURIs[filename] = fmt.Sprintf("%s?%s", blobURL, queryParams)
+		blobSASURIs[blobName] = fmt.Sprintf("%s?%s", blobURL, queryParams)
 	}
 	return blobSASURIs, nil
 }
 
-//GetBlobs gets each of the provided blobs from Azure Blob Storage
+//GetBlobs gets each of the provided blobs from Azure Blob Storage, streaming them to disk in parallel
+//and verifying each against the MD5 recorded when it was put
 func (a *BlobStorage) GetBlobs(outputDir string, filePaths []string) error {
 	if a.eventMeta == nil {
 		log.Info("skipping getblob as eventmeta is nil meaning this is an orphaned event or the first in a workflow")
 		return nil
 	}
 	dataAsMap := a.eventMeta.Data.AsMap()
+	files := make([]download.File, 0, len(filePaths))
 	for _, filePath := range filePaths {
-		_, filename := filepath.Split(filePath)
-		fileSASURL, ok := dataAsMap[filename]
+		fileSASURL, ok := dataAsMap[filePath]
 		if !ok {
 			log.WithField("filepath", filePath).WithField("eventMeta", a.eventMeta).Error("couldn't find SAS url for azure blob data")
 			return fmt.Errorf("failed to find sas url for azure blob data in event meta: %+v", a.eventMeta)
 		}
-
-		resp, err := http.Get(fileSASURL)
-		if err != nil {
-			log.WithField("filepath", filePath).WithField("eventMeta", a.eventMeta).Error("couldn't download data from SAS url for azure blob data")
-			return fmt.Errorf("Couldn't download data from SAS url for azure blob url: %+v data: %+v", fileSASURL, a.eventMeta)
-		}
-
-		bytes, err := ioutil.ReadAll(resp.Body)
-		defer resp.Body.Close() //nolint: errcheck
-
-		if err != nil {
-			return fmt.Errorf("failed to read blob '%s' with error '%+v'", fileSASURL, err)
-		}
-		dirPath := filepath.Dir(filePath)
-		dirPathInEnv := path.Join(outputDir, dirPath)
-		_ = os.MkdirAll(dirPathInEnv, os.ModePerm)
-		filePathInEnv := filepath.Join(outputDir, filePath)
-		err = ioutil.WriteFile(filePathInEnv, bytes, os.ModePerm)
-		if err != nil {
-			return fmt.Errorf("failed to write file '%s' with error '%+v'", filePathInEnv, err)
-		}
+		files = append(files, download.File{
+			URL:  fileSASURL,
+			Path: filepath.Join(outputDir, filePath),
+		})
+	}
+	if err := download.NewDownloader(runtime.NumCPU()).Files(files); err != nil {
+		log.WithField("eventMeta", a.eventMeta).Error("couldn't download data from SAS url for azure blob data")
+		return err
 	}
 	return nil
 }
@@ -0,0 +1,60 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/azure/azure-storage-blob-go/2016-05-31/azblob"
+	"github.com/lawrencegripper/ion/internal/app/handler/dataplane/blobstorage/azure"
+)
+
+// cSpell:ignore azurite, devstoreaccount, usgovcloudapi
+
+func TestGetServiceURL(t *testing.T) {
+	testCases := []struct {
+		name        string
+		endpoint    string
+		expected    string
+		expectedSAS azblob.SASProtocol
+	}{
+		{
+			name:        "public cloud by default",
+			endpoint:    "",
+			expected:    "https://account.blob.core.windows.net",
+			expectedSAS: azblob.SASProtocolHTTPS,
+		},
+		{
+			name:        "azure government",
+			endpoint:    "https://account.blob.core.usgovcloudapi.net/",
+			expected:    "https://account.blob.core.usgovcloudapi.net",
+			expectedSAS: azblob.SASProtocolHTTPS,
+		},
+		{
+			name:        "azurite",
+			endpoint:    "http://127.0.0.1:10000/devstoreaccount1/",
+			expected:    "http://127.0.0.1:10000/devstoreaccount1",
+			expectedSAS: azblob.SASProtocolHTTPSandHTTP,
+		},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			serviceURL, err := azure.GetServiceURL("account", test.endpoint)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if serviceURL.String() != test.expected {
+				t.Errorf("expected %s got %s", test.expected, serviceURL.String())
+			}
+			if protocol := azure.GetSASProtocol(serviceURL); protocol != test.expectedSAS {
+				t.Errorf("expected SAS protocol %s got %s", test.expectedSAS, protocol)
+			}
+		})
+	}
+}
+
+func TestGetServiceURLRejectsInvalidEndpoint(t *testing.T) {
+	for _, endpoint := range []string{"account.blob.core.windows.net", "://bad"} {
+		if _, err := azure.GetServiceURL("account", endpoint); err == nil {
+			t.Errorf("expected error for endpoint '%s'", endpoint)
+		}
+	}
+}
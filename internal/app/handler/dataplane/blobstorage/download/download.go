@@ -0,0 +1,181 @@
+package download
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cSpell:ignore nolint
+
+const (
+	defaultMaxTries   = 3
+	defaultRetryDelay = 1 * time.Second
+
+	//ContentMD5Header holds the base64 encoded MD5 of the blob recorded when it was committed
+	ContentMD5Header = "Content-MD5"
+)
+
+//File is a blob to download and the path to write it to
+type File struct {
+	URL  string
+	Path string
+}
+
+//Downloader streams blobs over http straight to disk
+type Downloader struct {
+	Client      *http.Client
+	Parallelism int
+	MaxTries    int
+	RetryDelay  time.Duration
+}
+
+//NewDownloader creates a Downloader getting at most parallelism files at once, or one per CPU when less than 1
+func NewDownloader(parallelism int) *Downloader {
+	if parallelism < 1 {
+		parallelism = runtime.NumCPU()
+	}
+	return &Downloader{
+		Client:      &http.Client{},
+		Parallelism: parallelism,
+		MaxTries:    defaultMaxTries,
+		RetryDelay:  defaultRetryDelay,
+	}
+}
+
+//StatusError is returned when a blob's url responds with anything other than 200 OK
+type StatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status %d getting blob: %s", e.StatusCode, e.Body)
+}
+
+//ChecksumError is returned when a downloaded blob doesn't match the MD5 recorded when it was committed
+type ChecksumError struct {
+	Expected string
+	Actual   string
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("blob content MD5 '%s' doesn't match the MD5 '%s' recorded when it was committed", e.Actual, e.Expected)
+}
+
+//Files downloads each of the files, Parallelism at a time. Failed connections, server errors,
+//throttling and checksum mismatches are retried. The first error is returned once all
+//downloads have finished, files are only written to their path once complete and verified
+func (d *Downloader) Files(files []File) error {
+	parallelism := d.Parallelism
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	work := make(chan File)
+	errs := make(chan error, len(files))
+	var wg sync.WaitGroup
+	for i := 0; i < parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range work {
+				if err := d.file(f); err != nil {
+					errs <- fmt.Errorf("failed to get blob for '%s' with error '%+v'", f.Path, err)
+				}
+			}
+		}()
+	}
+	for _, f := range files {
+		work <- f
+	}
+	close(work)
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+//file downloads a single file, retrying transient errors with an exponential backoff
+func (d *Downloader) file(f File) error {
+	var err error
+	var retry bool
+	for try := 1; try <= d.MaxTries; try++ {
+		if try > 1 {
+			time.Sleep(d.RetryDelay * time.Duration(1<<uint(try-2)))
+		}
+		retry, err = d.try(f)
+		if err == nil || !retry {
+			return err
+		}
+	}
+	return err
+}
+
+//try downloads the file once, reporting whether a failure is worth retrying
+func (d *Downloader) try(f File) (bool, error) {
+	resp, err := d.Client.Get(f.URL)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close() //nolint: errcheck
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return isTransient(resp.StatusCode), &StatusError{
+			StatusCode: resp.StatusCode,
+			Body:       strings.TrimSpace(string(b)),
+		}
+	}
+
+	dir := filepath.Dir(f.Path)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return false, err
+	}
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(f.Path)+".download-")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name()) // nolint: errcheck
+
+	hasher := md5.New()
+	_, err = io.Copy(io.MultiWriter(tmp, hasher), resp.Body)
+	closeErr := tmp.Close()
+	if err != nil {
+		return true, err
+	}
+	if closeErr != nil {
+		return false, closeErr
+	}
+
+	if expected := resp.Header.Get(ContentMD5Header); expected != "" {
+		expectedSum, err := base64.StdEncoding.DecodeString(expected)
+		if err != nil {
+			return false, fmt.Errorf("invalid %s header '%s'", ContentMD5Header, expected)
+		}
+		if sum := hasher.Sum(nil); !bytes.Equal(sum, expectedSum) {
+			return true, &ChecksumError{
+				Expected: expected,
+				Actual:   base64.StdEncoding.EncodeToString(sum),
+			}
+		}
+	}
+	// Temp files are only readable by their owner
+	if err := os.Chmod(tmp.Name(), os.ModePerm); err != nil {
+		return false, err
+	}
+	return false, os.Rename(tmp.Name(), f.Path)
+}
+
+//isTransient is true for statuses which may succeed if the request is sent again
+func isTransient(statusCode int) bool {
+	return statusCode == http.StatusRequestTimeout || statusCode == http.StatusTooManyRequests || statusCode >= 500
+}
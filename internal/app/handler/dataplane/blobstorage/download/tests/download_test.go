@@ -0,0 +1,183 @@
+package tests
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lawrencegripper/ion/internal/app/handler/dataplane/blobstorage/download"
+)
+
+// blobServer serves blobs with their Content-MD5, failing the first requests for each as configured
+type blobServer struct {
+	mu       sync.Mutex
+	blobs    map[string]string
+	failures map[string]int
+	status   int
+	corrupt  bool
+	requests map[string]int
+	inflight int
+	peak     int
+}
+
+func newBlobServer(blobs map[string]string) *blobServer {
+	return &blobServer{
+		blobs:    blobs,
+		failures: map[string]int{},
+		requests: map[string]int{},
+	}
+}
+
+func (b *blobServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.mu.Lock()
+	b.requests[r.URL.Path]++
+	b.inflight++
+	if b.inflight > b.peak {
+		b.peak = b.inflight
+	}
+	fail := b.failures[r.URL.Path] >= b.requests[r.URL.Path]
+	content, ok := b.blobs[r.URL.Path]
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		b.inflight--
+		b.mu.Unlock()
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte("<Error><Code>BlobNotFound</Code></Error>"))
+		return
+	}
+	if fail && !b.corrupt {
+		w.WriteHeader(b.status)
+		return
+	}
+	sum := md5.Sum([]byte(content))
+	w.Header().Set(download.ContentMD5Header, base64.StdEncoding.EncodeToString(sum[:]))
+	if fail {
+		content = strings.ToUpper(content)
+	}
+	_, _ = w.Write([]byte(content))
+}
+
+func newDownloader(parallelism int) *download.Downloader {
+	downloader := download.NewDownloader(parallelism)
+	downloader.RetryDelay = time.Millisecond
+	return downloader
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "ion-download-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestFilesDownloadsInParallel(t *testing.T) {
+	blobs := map[string]string{}
+	for _, name := range []string{"/a", "/b", "/c", "/d", "/e", "/f"} {
+		blobs[name] = "blob " + name
+	}
+	server := newBlobServer(blobs)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	dir := tempDir(t)
+	defer os.RemoveAll(dir) // nolint: errcheck
+
+	var files []download.File
+	for name := range blobs {
+		files = append(files, download.File{URL: ts.URL + name, Path: filepath.Join(dir, "nested", name)})
+	}
+	if err := newDownloader(2).Files(files); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range blobs {
+		b, err := ioutil.ReadFile(filepath.Join(dir, "nested", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != content {
+			t.Errorf("expected %s got %s", content, string(b))
+		}
+	}
+	if server.peak > 2 {
+		t.Errorf("expected at most 2 downloads at once got %d", server.peak)
+	}
+	entries, _ := ioutil.ReadDir(filepath.Join(dir, "nested"))
+	if len(entries) != len(blobs) {
+		t.Errorf("expected only the %d downloaded files, got %d entries", len(blobs), len(entries))
+	}
+}
+
+func TestFilesRetriesTransientErrors(t *testing.T) {
+	testCases := []struct {
+		name    string
+		status  int
+		corrupt bool
+	}{
+		{name: "server error", status: http.StatusServiceUnavailable},
+		{name: "throttled", status: http.StatusTooManyRequests},
+		{name: "checksum mismatch", corrupt: true},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			server := newBlobServer(map[string]string{"/blob": "content"})
+			server.failures["/blob"] = 2
+			server.status = test.status
+			server.corrupt = test.corrupt
+			ts := httptest.NewServer(server)
+			defer ts.Close()
+			dir := tempDir(t)
+			defer os.RemoveAll(dir) // nolint: errcheck
+
+			filePath := filepath.Join(dir, "blob")
+			if err := newDownloader(1).Files([]download.File{{URL: ts.URL + "/blob", Path: filePath}}); err != nil {
+				t.Fatal(err)
+			}
+			if server.requests["/blob"] != 3 {
+				t.Errorf("expected 3 requests got %d", server.requests["/blob"])
+			}
+			b, _ := ioutil.ReadFile(filePath)
+			if string(b) != "content" {
+				t.Errorf("expected content got %s", string(b))
+			}
+		})
+	}
+}
+
+func TestFilesFailsWithoutWritingFile(t *testing.T) {
+	server := newBlobServer(map[string]string{"/blob": "content"})
+	server.failures["/blob"] = 3
+	server.corrupt = true
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	dir := tempDir(t)
+	defer os.RemoveAll(dir) // nolint: errcheck
+
+	files := []download.File{
+		{URL: ts.URL + "/missing", Path: filepath.Join(dir, "missing")},
+		{URL: ts.URL + "/blob", Path: filepath.Join(dir, "blob")},
+	}
+	err := newDownloader(2).Files(files)
+	if err == nil {
+		t.Fatal("expected error downloading missing and corrupt blobs")
+	}
+	if server.requests["/missing"] != 1 {
+		t.Errorf("expected not found not to be retried, got %d requests", server.requests["/missing"])
+	}
+	entries, _ := ioutil.ReadDir(dir)
+	if len(entries) != 0 {
+		t.Errorf("expected no files to be written, got %d", len(entries))
+	}
+}
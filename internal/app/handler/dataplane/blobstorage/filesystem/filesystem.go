@@ -6,8 +6,8 @@ import (
 	"os"
 	"path"
 	"path/filepath"
-	"strings"
 
+	"github.com/lawrencegripper/ion/internal/app/handler/helpers"
 	"github.com/lawrencegripper/ion/internal/app/handler/module"
 )
 
@@ -38,22 +38,22 @@ func NewBlobStorage(config *Config, env *module.Environment) (*BlobStorage, erro
 	return fs, nil
 }
 
-//PutBlobs puts in the filesystem directory
+//PutBlobs puts in the filesystem directory, returning the path of each one by its path in the output blob directory
 func (a *BlobStorage) PutBlobs(filePaths []string) (map[string]string, error) {
 	uris := make(map[string]string)
 	for _, filePath := range filePaths {
-		nakedFilePath := strings.Replace(filePath, a.env.OutputBlobDirPath, "", -1)
-		if nakedFilePath[0] == '/' {
-			nakedFilePath = nakedFilePath[1:]
+		blobName, err := helpers.GetBlobName(a.env.OutputBlobDirPath, filePath)
+		if err != nil {
+			return nil, err
 		}
-		destPath := filepath.FromSlash(path.Join(a.outDir, nakedFilePath))
+		destPath := filepath.FromSlash(path.Join(a.outDir, blobName))
 		if err := os.MkdirAll(filepath.Dir(destPath), os.ModePerm); err != nil {
 			return nil, fmt.Errorf("error creating output directory %s: %+v", destPath, err)
 		}
 		if err := copy(filePath, destPath); err != nil {
 			return nil, fmt.Errorf("error copying file to blob storage '%+v'", err)
 		}
-		uris[filePath] = destPath
+		uris[blobName] = destPath
 	}
 	return uris, nil
 }
@@ -0,0 +1,193 @@
+package s3
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/lawrencegripper/ion/internal/app/handler/dataplane/blobstorage/download"
+	"github.com/lawrencegripper/ion/internal/app/handler/dataplane/documentstorage"
+	"github.com/lawrencegripper/ion/internal/app/handler/helpers"
+	"github.com/lawrencegripper/ion/internal/app/handler/module"
+	"github.com/minio/minio-go"
+	"github.com/minio/minio-go/pkg/credentials"
+	log "github.com/sirupsen/logrus"
+)
+
+// cSpell:ignore nolint, golint, minio, presigned, presign
+
+const (
+	// BucketAlreadyOwnedByYouErr returned when creating a bucket we've already created
+	BucketAlreadyOwnedByYouErr = "BucketAlreadyOwnedByYou"
+	// AccessDeniedErr returned when the credentials aren't allowed to make the request
+	AccessDeniedErr = "AccessDenied"
+)
+
+//Config to setup a S3 compatible blob provider
+type Config struct {
+	Enabled           bool   `description:"Enable S3 compatible blob storage provider"`
+	Endpoint          string `description:"S3 endpoint url, e.g. https://s3.eu-west-1.amazonaws.com or http://localhost:9000 for MinIO"`
+	Region            string `description:"S3 region used to sign requests"`
+	Bucket            string `description:"S3 bucket name"`
+	AccessKeyID       string `description:"S3 access key ID"`
+	SecretAccessKey   string `description:"S3 secret access key"`
+	UsePathStyle      bool   `description:"Address the bucket in the url's path rather than its host, as MinIO and Ceph expect"`
+	Parallelism       int    `description:"Number of parts of a multipart upload sent at once"`
+	PresignExpiryMins int    `description:"Minutes the presigned urls in event metadata are valid for"`
+}
+
+//BlobStorage is responsible for handling the connections to an S3 compatible service
+// nolint: golint
+type BlobStorage struct {
+	client           *minio.Client
+	bucket           string
+	parallelism      int
+	presignExpiry    time.Duration
+	httpClient       *http.Client
+	outputBlobPrefix string
+	inputBlobPrefix  string
+	eventMeta        *documentstorage.EventMeta
+	env              *module.Environment
+}
+
+//NewBlobStorage creates a new S3 Blob Storage object, creating the bucket if it doesn't exist
+func NewBlobStorage(config *Config, inputBlobPrefix, outputBlobPrefix string, eventMeta *documentstorage.EventMeta, env *module.Environment) (*BlobStorage, error) {
+	if err := helpers.ErrorIfEmpty(config.Endpoint, config.Bucket, config.AccessKeyID, config.SecretAccessKey); err != nil {
+		return nil, fmt.Errorf("s3 provider requires an endpoint, bucket, access key ID and secret access key: %+v", err)
+	}
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil || endpoint.Host == "" || strings.Trim(endpoint.Path, "/") != "" {
+		return nil, fmt.Errorf("invalid s3 endpoint '%s', expected a url without a path", config.Endpoint)
+	}
+	// Setting the region saves the client looking up the bucket's location, which needs its own permission
+	region := config.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	lookup := minio.BucketLookupDNS
+	if config.UsePathStyle {
+		lookup = minio.BucketLookupPath
+	}
+	client, err := minio.NewWithOptions(endpoint.Host, &minio.Options{
+		Creds:        credentials.NewStaticV4(config.AccessKeyID, config.SecretAccessKey, ""),
+		Secure:       endpoint.Scheme == "https",
+		Region:       region,
+		BucketLookup: lookup,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create s3 client: %+v", err)
+	}
+	parallelism := config.Parallelism
+	if parallelism < 1 {
+		parallelism = runtime.NumCPU()
+	}
+	presignExpiry := time.Duration(config.PresignExpiryMins) * time.Minute
+	if presignExpiry <= 0 {
+		presignExpiry = 24 * time.Hour
+	}
+	s := &BlobStorage{
+		client:           client,
+		bucket:           config.Bucket,
+		parallelism:      parallelism,
+		presignExpiry:    presignExpiry,
+		httpClient:       &http.Client{},
+		outputBlobPrefix: outputBlobPrefix,
+		inputBlobPrefix:  inputBlobPrefix,
+		eventMeta:        eventMeta,
+		env:              env,
+	}
+	if err := s.ensureBucket(region); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+//PutBlobs puts each file into the bucket, returning a presigned url to read each one by its path in the output blob directory
+func (s *BlobStorage) PutBlobs(filePaths []string) (map[string]string, error) {
+	blobURIs := make(map[string]string)
+	for _, filePath := range filePaths {
+		blobName, err := helpers.GetBlobName(s.env.OutputBlobDirPath, filePath)
+		if err != nil {
+			return nil, err
+		}
+		key := helpers.JoinBlobPath(s.outputBlobPrefix, blobName)
+
+		// Large files are uploaded in parts, parallelism at a time
+		_, err = s.client.FPutObject(s.bucket, key, filePath, minio.PutObjectOptions{NumThreads: uint(s.parallelism)})
+		if err != nil {
+			return nil, fmt.Errorf("failed to put file '%s' to s3 object '%s', error: '%+v'", filePath, key, err)
+		}
+
+		presignedURL, err := s.client.PresignedGetObject(s.bucket, key, s.presignExpiry, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to presign s3 object '%s', error: '%+v'", key, err)
+		}
+		blobURIs[blobName] = presignedURL.String()
+	}
+	return blobURIs, nil
+}
+
+//GetBlobs gets each of the provided blobs using the presigned urls in the event's metadata,
+//streaming them to disk in parallel
+func (s *BlobStorage) GetBlobs(outputDir string, filePaths []string) error {
+	if s.eventMeta == nil {
+		log.Info("skipping getblob as eventmeta is nil meaning this is an orphaned event or the first in a workflow")
+		return nil
+	}
+	dataAsMap := s.eventMeta.Data.AsMap()
+	files := make([]download.File, 0, len(filePaths))
+	for _, filePath := range filePaths {
+		presignedURL, ok := dataAsMap[filePath]
+		if !ok {
+			log.WithField("filepath", filePath).WithField("eventMeta", s.eventMeta).Error("couldn't find presigned url for s3 blob data")
+			return fmt.Errorf("failed to find presigned url for s3 blob data in event meta: %+v", s.eventMeta)
+		}
+		files = append(files, download.File{
+			URL:  presignedURL,
+			Path: filepath.Join(outputDir, filePath),
+		})
+	}
+	downloader := download.NewDownloader(s.parallelism)
+	downloader.Client = s.httpClient
+	if err := downloader.Files(files); err != nil {
+		log.WithField("eventMeta", s.eventMeta).Error("couldn't download data from presigned url for s3 blob data")
+		return err
+	}
+	return nil
+}
+
+//Close cleans up any external resources
+func (s *BlobStorage) Close() {
+}
+
+//ensureBucket creates the bucket if it doesn't already exist. Credentials only allowed to use an existing
+//bucket are denied creating one, which is fine as long as the bucket exists
+func (s *BlobStorage) ensureBucket(region string) error {
+	exists, existsErr := s.client.BucketExists(s.bucket)
+	if existsErr == nil && exists {
+		return nil
+	}
+	if existsErr != nil && minio.ToErrorResponse(existsErr).Code != AccessDeniedErr {
+		return fmt.Errorf("failed to check s3 bucket '%s' exists, error: '%+v'", s.bucket, existsErr)
+	}
+
+	err := s.client.MakeBucket(s.bucket, region)
+	if err == nil {
+		return nil
+	}
+	switch minio.ToErrorResponse(err).Code {
+	case BucketAlreadyOwnedByYouErr:
+		return nil
+	case AccessDeniedErr:
+		// Without permission to check for the bucket either, assume it exists and let puts fail if it doesn't
+		if existsErr != nil {
+			log.WithField("bucket", s.bucket).Warn("not allowed to check for or create s3 bucket, assuming it exists")
+			return nil
+		}
+	}
+	return fmt.Errorf("failed to create s3 bucket '%s', error: '%+v'", s.bucket, err)
+}
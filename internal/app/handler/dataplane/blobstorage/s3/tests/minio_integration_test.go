@@ -0,0 +1,82 @@
+package tests
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lawrencegripper/ion/internal/app/handler/dataplane/blobstorage/s3"
+	"github.com/lawrencegripper/ion/internal/app/handler/dataplane/documentstorage"
+	"github.com/lawrencegripper/ion/internal/app/handler/helpers"
+	"github.com/lawrencegripper/ion/internal/app/handler/module"
+	"github.com/lawrencegripper/ion/internal/pkg/common"
+)
+
+// Run against a local MinIO, for example:
+// docker run -p 9000:9000 -e MINIO_ACCESS_KEY=minio -e MINIO_SECRET_KEY=minio123 minio/minio server /data
+// S3_ENDPOINT=http://localhost:9000 S3_ACCESS_KEY_ID=minio S3_SECRET_ACCESS_KEY=minio123 go test ./...
+func TestMinIOIntegration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode...")
+	}
+	endpoint := os.Getenv("S3_ENDPOINT")
+	if endpoint == "" {
+		t.Fatal("env var 'S3_ENDPOINT' not set!")
+	}
+
+	dir, err := ioutil.TempDir("", "ion-minio-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	env := module.GetModuleEnvironment(dir)
+	if err := env.Build(); err != nil {
+		t.Fatal(err)
+	}
+
+	content := bytes.Repeat([]byte("ion"), 22*1024*1024) // 66MB, sent as a multipart upload
+	filePath := filepath.Join(env.OutputBlobDirPath, "nested", "blob.bin")
+	_ = os.MkdirAll(filepath.Dir(filePath), os.ModePerm)
+	if err := ioutil.WriteFile(filePath, content, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &s3.Config{
+		Endpoint:        endpoint,
+		Region:          os.Getenv("S3_REGION"),
+		Bucket:          "ion-integration",
+		AccessKeyID:     os.Getenv("S3_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+		UsePathStyle:    true,
+	}
+	eventID := helpers.NewGUID()
+	writer, err := s3.NewBlobStorage(config, "", helpers.JoinBlobPath(eventID, "writer"), nil, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	urls, err := writer.PutBlobs([]string{filePath})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	eventMeta := &documentstorage.EventMeta{
+		Files: []documentstorage.File{{Name: "nested/blob.bin"}},
+		Data:  common.KeyValuePairs{{Key: "nested/blob.bin", Value: urls["nested/blob.bin"]}},
+	}
+	reader, err := s3.NewBlobStorage(config, helpers.JoinBlobPath(eventID, "writer"), "", eventMeta, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reader.GetBlobs(env.InputBlobDirPath, eventMeta.FileNames()); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(env.InputBlobDirPath, "nested", "blob.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, content) {
+		t.Error("expected blob read from MinIO to match the blob put")
+	}
+}
@@ -0,0 +1,280 @@
+package tests
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/lawrencegripper/ion/internal/app/handler/dataplane/blobstorage/s3"
+	"github.com/lawrencegripper/ion/internal/app/handler/dataplane/documentstorage"
+	"github.com/lawrencegripper/ion/internal/app/handler/module"
+	"github.com/lawrencegripper/ion/internal/pkg/common"
+)
+
+// cSpell:ignore presign, presigned, minio
+
+// fakeS3 stores objects in memory, accepting any signed request
+type fakeS3 struct {
+	mu             sync.Mutex
+	buckets        map[string]bool
+	objects        map[string][]byte
+	denyHead       bool
+	denyCreate     bool
+	bucketCreates  int
+	unsigned       int
+	requestsByVerb map[string]int
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{
+		buckets:        map[string]bool{},
+		objects:        map[string][]byte{},
+		requestsByVerb: map[string]int{},
+	}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.requestsByVerb[r.Method]++
+	query := r.URL.Query()
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=access/") && query.Get("X-Amz-Signature") == "" {
+		f.unsigned++
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	segments := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	bucket := segments[0]
+	if len(segments) == 1 || segments[1] == "" {
+		switch {
+		case r.Method == http.MethodHead && f.denyHead:
+			w.WriteHeader(http.StatusForbidden)
+		case r.Method == http.MethodHead && !f.buckets[bucket]:
+			w.WriteHeader(http.StatusNotFound)
+		case r.Method == http.MethodHead:
+		case r.Method == http.MethodPut && f.denyCreate:
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte("<Error><Code>AccessDenied</Code><Message>denied</Message></Error>"))
+		case r.Method == http.MethodPut && f.buckets[bucket]:
+			w.WriteHeader(http.StatusConflict)
+			_, _ = w.Write([]byte("<Error><Code>BucketAlreadyOwnedByYou</Code><Message>exists</Message></Error>"))
+		case r.Method == http.MethodPut:
+			f.bucketCreates++
+			f.buckets[bucket] = true
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+		return
+	}
+	key := r.URL.Path
+	switch r.Method {
+	case http.MethodPut:
+		body, err := readBody(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.objects[key] = body
+		w.Header().Set("ETag", "\"etag\"")
+	case http.MethodGet:
+		object, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(object)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// readBody reads the request body, decoding the chunks of a streaming signed upload
+func readBody(r *http.Request) ([]byte, error) {
+	if r.Header.Get("X-Amz-Content-Sha256") != "STREAMING-AWS4-HMAC-SHA256-PAYLOAD" {
+		return ioutil.ReadAll(r.Body)
+	}
+	var body []byte
+	reader := bufio.NewReader(r.Body)
+	for {
+		header, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.ParseInt(strings.SplitN(header, ";", 2)[0], 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		chunk := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, chunk); err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return body, nil
+		}
+		body = append(body, chunk[:size]...)
+	}
+}
+
+func newTestEnvironment(t *testing.T) (*module.Environment, string) {
+	dir, err := ioutil.TempDir("", "ion-s3-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := module.GetModuleEnvironment(dir)
+	if err := env.Build(); err != nil {
+		t.Fatal(err)
+	}
+	return env, dir
+}
+
+func newTestConfig(endpoint string) *s3.Config {
+	return &s3.Config{
+		Endpoint:        endpoint,
+		Bucket:          "ion",
+		AccessKeyID:     "access",
+		SecretAccessKey: "secret",
+		UsePathStyle:    true,
+		Parallelism:     2,
+	}
+}
+
+func TestPutThenGetBlobs(t *testing.T) {
+	fake := newFakeS3()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	env, dir := newTestEnvironment(t)
+	defer os.RemoveAll(dir) // nolint: errcheck
+
+	// Files with the same name in different directories don't collide
+	files := map[string][]byte{"small.txt": []byte("small blob"), "a/frame.jpg": []byte("a"), "b/frame.jpg": []byte("b")}
+	var filePaths []string
+	for name, content := range files {
+		filePath := filepath.Join(env.OutputBlobDirPath, filepath.FromSlash(name))
+		_ = os.MkdirAll(filepath.Dir(filePath), os.ModePerm)
+		if err := ioutil.WriteFile(filePath, content, os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		filePaths = append(filePaths, filePath)
+	}
+
+	config := newTestConfig(server.URL)
+	writer, err := s3.NewBlobStorage(config, "parent/module", "event1/module", nil, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	urls, err := writer.PutBlobs(filePaths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fake.objects["/ion/event1/module/small.txt"], files["small.txt"]) {
+		t.Errorf("expected blob to be put got %s", string(fake.objects["/ion/event1/module/small.txt"]))
+	}
+	// Putting more blobs reuses the bucket
+	if _, err := writer.PutBlobs(filePaths[:1]); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(urls) != len(files) {
+		t.Errorf("expected a presigned url for each of the %d files got %v", len(files), urls)
+	}
+	eventMeta := &documentstorage.EventMeta{}
+	for name, u := range urls {
+		eventMeta.Files = append(eventMeta.Files, documentstorage.File{Name: name})
+		if !strings.Contains(u, "X-Amz-Signature=") {
+			t.Errorf("expected presigned url for %s got %s", name, u)
+		}
+		eventMeta.Data = append(eventMeta.Data, common.KeyValuePair{Key: name, Value: u})
+	}
+	reader, err := s3.NewBlobStorage(config, "event1/module", "event2/next", eventMeta, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reader.GetBlobs(env.InputBlobDirPath, eventMeta.FileNames()); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		b, err := ioutil.ReadFile(filepath.Join(env.InputBlobDirPath, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, content) {
+			t.Errorf("expected %s to match the blob put", name)
+		}
+	}
+	if fake.bucketCreates != 1 {
+		t.Errorf("expected the bucket to be created once got %d", fake.bucketCreates)
+	}
+	if fake.unsigned != 0 {
+		t.Errorf("expected every request to be signed, %d weren't", fake.unsigned)
+	}
+}
+
+func TestNewBlobStorageWithoutCreateBucketPermission(t *testing.T) {
+	testCases := []struct {
+		name          string
+		bucketExists  bool
+		denyHead      bool
+		expectSuccess bool
+	}{
+		{
+			name:          "bucket exists",
+			bucketExists:  true,
+			expectSuccess: true,
+		},
+		{
+			name:          "can't check bucket exists",
+			bucketExists:  true,
+			denyHead:      true,
+			expectSuccess: true,
+		},
+		{
+			name:          "bucket missing",
+			expectSuccess: false,
+		},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			fake := newFakeS3()
+			fake.buckets["ion"] = test.bucketExists
+			fake.denyHead = test.denyHead
+			fake.denyCreate = true
+			server := httptest.NewServer(fake)
+			defer server.Close()
+
+			_, err := s3.NewBlobStorage(newTestConfig(server.URL), "", "event1/module", nil, nil)
+			if test.expectSuccess && err != nil {
+				t.Errorf("expected denied bucket creation not to be fatal: %+v", err)
+			}
+			if !test.expectSuccess && err == nil {
+				t.Error("expected error when the bucket is missing and can't be created")
+			}
+			if test.bucketExists && !test.denyHead && fake.requestsByVerb[http.MethodPut] != 0 {
+				t.Error("expected an existing bucket not to be created")
+			}
+		})
+	}
+}
+
+func TestNewBlobStorageRequiresCredentials(t *testing.T) {
+	_, err := s3.NewBlobStorage(&s3.Config{Endpoint: "http://localhost:9000", Bucket: "ion"}, "", "", nil, nil)
+	if err == nil {
+		t.Error("expected error without credentials")
+	}
+}
+
+func TestNewBlobStorageRejectsEndpointWithPath(t *testing.T) {
+	config := newTestConfig("http://localhost:9000/prefix")
+	if _, err := s3.NewBlobStorage(config, "", "", nil, nil); err == nil {
+		t.Error("expected error for endpoint with a path")
+	}
+}
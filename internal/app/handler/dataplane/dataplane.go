@@ -10,6 +10,12 @@ type DocumentStorageProvider interface {
 	GetEventMetaByID(id string) (*documentstorage.EventMeta, error)
 	CreateEventMeta(metadata *documentstorage.EventMeta) error
 	CreateInsight(insight *documentstorage.Insight) error
+	GetOutbox(id string) (*documentstorage.Outbox, error)
+	SaveOutbox(outbox *documentstorage.Outbox) error
+	GetProcessedEvent(id string) (*documentstorage.ProcessedEvent, error)
+	CreateProcessedEvent(processed *documentstorage.ProcessedEvent) error
+	GetJoin(id string) (*documentstorage.Join, error)
+	SaveJoin(join *documentstorage.Join) error
 	Close()
 }
 
@@ -26,6 +32,11 @@ type EventPublisher interface {
 	Close()
 }
 
+//BatchEventPublisher is implemented by event publishers which can publish several events together
+type BatchEventPublisher interface {
+	PublishBatch(events []common.Event) error
+}
+
 // DataPlane is the module's API to
 // external providers
 type DataPlane struct {
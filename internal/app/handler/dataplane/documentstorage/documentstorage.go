@@ -1,12 +1,20 @@
 package documentstorage
 
 import (
+	"encoding/json"
+	"time"
+
 	"github.com/lawrencegripper/ion/internal/pkg/common"
+	"gopkg.in/mgo.v2/bson"
 )
 
 const (
 	// NotFoundErr returned when a document is not found in document storage
 	NotFoundErr = "document not found"
+	// ConflictErr returned when a document has changed since it was read
+	ConflictErr = "document changed since it was read"
+
+	bsonStringKind = 0x02
 )
 
 //Insight is used to export structure data
@@ -19,8 +27,111 @@ type Insight struct {
 //EventMeta is a single entry in a document
 type EventMeta struct {
 	*common.Context
-	Files []string             `bson:"files" json:"files"`
+	Files []File               `bson:"files" json:"files"`
 	Data  common.KeyValuePairs `bson:"data" json:"data"`
+	//Parents are the IDs of the events joined to create this event
+	Parents []string `bson:"parents,omitempty" json:"parents,omitempty"`
+}
+
+//FileNames gets the name of each of the event's files
+func (e *EventMeta) FileNames() []string {
+	names := make([]string, 0, len(e.Files))
+	for _, file := range e.Files {
+		names = append(names, file.Name)
+	}
+	return names
+}
+
+//File is a blob committed by a module for an event. The name is
+//its path in the module's output blob directory
+type File struct {
+	Name        string `bson:"name" json:"name"`
+	SHA256      string `bson:"sha256" json:"sha256"`
+	Size        int64  `bson:"size" json:"size"`
+	ContentType string `bson:"contenttype" json:"contentType"`
+}
+
+// file has File's fields without its unmarshal methods
+type file File
+
+//SetBSON reads files stored as a bare name, before their hash and size were recorded
+func (f *File) SetBSON(raw bson.Raw) error {
+	if raw.Kind == bsonStringKind {
+		*f = File{}
+		return raw.Unmarshal(&f.Name)
+	}
+	return raw.Unmarshal((*file)(f))
+}
+
+//UnmarshalJSON reads files stored as a bare name, before their hash and size were recorded
+func (f *File) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		*f = File{}
+		return json.Unmarshal(b, &f.Name)
+	}
+	return json.Unmarshal(b, (*file)(f))
+}
+
+//Outbox records the events planned by a module's commit
+//so a retried commit publishes the same events, skipping
+//those which have already been published
+type Outbox struct {
+	*common.Context
+	ID     string        `bson:"id" json:"id"`
+	Events []OutboxEvent `bson:"events" json:"events"`
+}
+
+//OutboxEvent is an event planned by a commit
+type OutboxEvent struct {
+	Event     common.Event `bson:"event" json:"event"`
+	Meta      EventMeta    `bson:"meta" json:"meta"`
+	Published bool         `bson:"published" json:"published"`
+}
+
+//GetOutboxID gets the ID of the outbox for the commit of a module's context
+func GetOutboxID(context *common.Context) string {
+	return "outbox_" + context.Name + "_" + context.EventID
+}
+
+//ProcessedEvent records that a module has finished processing an event
+//so the dispatcher can skip the event if it's delivered again
+type ProcessedEvent struct {
+	*common.Context
+	ID          string    `bson:"id" json:"id"`
+	ProcessedAt time.Time `bson:"processedat" json:"processedAt"`
+}
+
+//GetProcessedEventID gets the ID of the record of a module processing an event
+func GetProcessedEventID(moduleName, eventID string) string {
+	return "processed_" + moduleName + "_" + eventID
+}
+
+const (
+	//JoinWaiting is the status of a join still waiting for some of its events
+	JoinWaiting = "waiting"
+	//JoinDispatched is the status of a join whose events have all arrived
+	JoinDispatched = "dispatched"
+	//JoinTimedOut is the status of a join whose events didn't all arrive in time
+	JoinTimedOut = "timedout"
+)
+
+//Join collects the events a module joins for a correlation
+//until one of each of the event types has arrived
+type Join struct {
+	*common.Context
+	ID        string         `bson:"id" json:"id"`
+	Events    []common.Event `bson:"events" json:"events"`
+	Status    string         `bson:"status" json:"status"`
+	CreatedAt time.Time      `bson:"createdat" json:"createdAt"`
+	//Version is incremented each time the join is saved. A join is only
+	//saved if it's unchanged since it was read, so dispatchers adding
+	//events to the same join at once don't overwrite each other's
+	Version int `bson:"version" json:"version"`
+}
+
+//GetJoinID gets the ID of the join of a module's events for a correlation
+func GetJoinID(moduleName, correlationID string) string {
+	return "join_" + moduleName + "_" + correlationID
 }
 
 //ModuleLogs is a single entry in a document
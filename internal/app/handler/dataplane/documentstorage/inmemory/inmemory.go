@@ -7,6 +7,7 @@ import (
 	"os"
 
 	"github.com/lawrencegripper/ion/internal/app/handler/dataplane/documentstorage"
+	"github.com/lawrencegripper/ion/internal/pkg/common"
 )
 
 const (
@@ -16,8 +17,11 @@ const (
 //nolint:golint
 //InMemoryDB is an in memory DB
 type InMemoryDB struct {
-	Insights map[string]documentstorage.Insight   `json:"insights"`
-	Contexts map[string]documentstorage.EventMeta `json:"contexts"`
+	Insights  map[string]documentstorage.Insight        `json:"insights"`
+	Contexts  map[string]documentstorage.EventMeta      `json:"contexts"`
+	Outboxes  map[string]documentstorage.Outbox         `json:"outboxes"`
+	Processed map[string]documentstorage.ProcessedEvent `json:"processed"`
+	Joins     map[string]documentstorage.Join           `json:"joins"`
 }
 
 //NewInMemoryDB creates a new InMemoryDB object
@@ -27,9 +31,15 @@ func NewInMemoryDB() (*InMemoryDB, error) {
 		// Create new
 		insights := make(map[string]documentstorage.Insight)
 		contexts := make(map[string]documentstorage.EventMeta)
+		outboxes := make(map[string]documentstorage.Outbox)
+		processed := make(map[string]documentstorage.ProcessedEvent)
+		joins := make(map[string]documentstorage.Join)
 		return &InMemoryDB{
-			Insights: insights,
-			Contexts: contexts,
+			Insights:  insights,
+			Contexts:  contexts,
+			Outboxes:  outboxes,
+			Processed: processed,
+			Joins:     joins,
 		}, nil
 	}
 	// Load from disk
@@ -66,6 +76,71 @@ func (db *InMemoryDB) CreateInsight(insight *documentstorage.Insight) error {
 	return nil
 }
 
+//GetOutbox returns the outbox with the given ID
+func (db *InMemoryDB) GetOutbox(id string) (*documentstorage.Outbox, error) {
+	outbox, exist := db.Outboxes[id]
+	if !exist {
+		return nil, fmt.Errorf("%s %s", documentstorage.NotFoundErr, id)
+	}
+	outbox.Events = append([]documentstorage.OutboxEvent{}, outbox.Events...)
+	return &outbox, nil
+}
+
+//SaveOutbox creates or replaces an outbox document
+func (db *InMemoryDB) SaveOutbox(outbox *documentstorage.Outbox) error {
+	if db.Outboxes == nil {
+		db.Outboxes = make(map[string]documentstorage.Outbox) // Loaded from disk before outboxes were stored
+	}
+	saved := *outbox
+	saved.Events = append([]documentstorage.OutboxEvent{}, outbox.Events...)
+	db.Outboxes[outbox.ID] = saved
+	return nil
+}
+
+//GetProcessedEvent returns the record of a module processing an event
+func (db *InMemoryDB) GetProcessedEvent(id string) (*documentstorage.ProcessedEvent, error) {
+	processed, exist := db.Processed[id]
+	if !exist {
+		return nil, fmt.Errorf("%s %s", documentstorage.NotFoundErr, id)
+	}
+	return &processed, nil
+}
+
+//CreateProcessedEvent records that a module has processed an event
+func (db *InMemoryDB) CreateProcessedEvent(processed *documentstorage.ProcessedEvent) error {
+	if db.Processed == nil {
+		db.Processed = make(map[string]documentstorage.ProcessedEvent) // Loaded from disk before processed events were stored
+	}
+	db.Processed[processed.ID] = *processed
+	return nil
+}
+
+//GetJoin returns the join with the given ID
+func (db *InMemoryDB) GetJoin(id string) (*documentstorage.Join, error) {
+	join, exist := db.Joins[id]
+	if !exist {
+		return nil, fmt.Errorf("%s %s", documentstorage.NotFoundErr, id)
+	}
+	join.Events = append([]common.Event{}, join.Events...)
+	return &join, nil
+}
+
+//SaveJoin creates or replaces a join document if it's unchanged since it was read, incrementing its version
+func (db *InMemoryDB) SaveJoin(join *documentstorage.Join) error {
+	if db.Joins == nil {
+		db.Joins = make(map[string]documentstorage.Join) // Loaded from disk before joins were stored
+	}
+	if existing, exist := db.Joins[join.ID]; exist && existing.Version != join.Version || !exist && join.Version != 0 {
+		return fmt.Errorf("%s %s", documentstorage.ConflictErr, join.ID)
+	}
+	saved := *join
+	saved.Events = append([]common.Event{}, join.Events...)
+	saved.Version++
+	db.Joins[join.ID] = saved
+	join.Version = saved.Version
+	return nil
+}
+
 //Close cleans up external resources
 func (db *InMemoryDB) Close() {
 	b, err := json.Marshal(db)
@@ -161,6 +161,89 @@ func (db *MongoDB) CreateInsight(insight *documentstorage.Insight) error {
 	return nil
 }
 
+//GetOutbox returns the outbox with the given ID
+func (db *MongoDB) GetOutbox(id string) (*documentstorage.Outbox, error) {
+	outbox := documentstorage.Outbox{}
+	err := db.Collection.Find(bson.M{"id": id}).One(&outbox)
+	if err != nil {
+		if err.Error() == mongoDBNotFoundErr {
+			return nil, fmt.Errorf("%s %s", documentstorage.NotFoundErr, id)
+		}
+		return nil, fmt.Errorf("error get document %s, error: %+v", id, err)
+	}
+	return &outbox, nil
+}
+
+//SaveOutbox creates or replaces an outbox document
+func (db *MongoDB) SaveOutbox(outbox *documentstorage.Outbox) error {
+	outbox.Context.DocumentType = common.OutboxDocType
+	selector := bson.M{"id": outbox.ID}
+	update := bson.M{"$set": outbox}
+	_, err := db.Collection.Upsert(selector, update)
+	if err != nil {
+		return fmt.Errorf("error creates document: %+v", err)
+	}
+	return nil
+}
+
+//GetProcessedEvent returns the record of a module processing an event
+func (db *MongoDB) GetProcessedEvent(id string) (*documentstorage.ProcessedEvent, error) {
+	processed := documentstorage.ProcessedEvent{}
+	err := db.Collection.Find(bson.M{"id": id}).One(&processed)
+	if err != nil {
+		if err.Error() == mongoDBNotFoundErr {
+			return nil, fmt.Errorf("%s %s", documentstorage.NotFoundErr, id)
+		}
+		return nil, fmt.Errorf("error get document %s, error: %+v", id, err)
+	}
+	return &processed, nil
+}
+
+//CreateProcessedEvent records that a module has processed an event
+func (db *MongoDB) CreateProcessedEvent(processed *documentstorage.ProcessedEvent) error {
+	processed.Context.DocumentType = common.ProcessedEventDocType
+	selector := bson.M{"id": processed.ID}
+	update := bson.M{"$set": processed}
+	_, err := db.Collection.Upsert(selector, update)
+	if err != nil {
+		return fmt.Errorf("error creates document: %+v", err)
+	}
+	return nil
+}
+
+//GetJoin returns the join with the given ID
+func (db *MongoDB) GetJoin(id string) (*documentstorage.Join, error) {
+	join := documentstorage.Join{}
+	err := db.Collection.Find(bson.M{"id": id}).One(&join)
+	if err != nil {
+		if err.Error() == mongoDBNotFoundErr {
+			return nil, fmt.Errorf("%s %s", documentstorage.NotFoundErr, id)
+		}
+		return nil, fmt.Errorf("error get document %s, error: %+v", id, err)
+	}
+	return &join, nil
+}
+
+//SaveJoin creates or replaces a join document if it's unchanged since it was read, incrementing its version.
+//The join's ID is its document's _id, so when another version has been saved the upsert's insert
+//is rejected as a duplicate
+func (db *MongoDB) SaveJoin(join *documentstorage.Join) error {
+	join.Context.DocumentType = common.JoinDocType
+	saved := *join
+	saved.Version++
+	selector := bson.M{"_id": join.ID, "version": join.Version}
+	update := bson.M{"$set": saved}
+	_, err := db.Collection.Upsert(selector, update)
+	if err != nil {
+		if mongo.IsDup(err) {
+			return fmt.Errorf("%s %s", documentstorage.ConflictErr, join.ID)
+		}
+		return fmt.Errorf("error creates document: %+v", err)
+	}
+	join.Version = saved.Version
+	return nil
+}
+
 //CreateModuleLogs creates an insights document
 func (db *MongoDB) CreateModuleLogs(logs *documentstorage.ModuleLogs) error {
 	logs.Context.DocumentType = common.ModuleLogsDocType
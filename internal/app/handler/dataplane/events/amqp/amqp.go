@@ -0,0 +1,23 @@
+package amqp
+
+import (
+	"fmt"
+
+	"github.com/lawrencegripper/ion/internal/pkg/amqpbus"
+	"github.com/lawrencegripper/ion/internal/pkg/messaging"
+)
+
+//Config to setup an AMQP 1.0 event publisher
+type Config struct {
+	Enabled          bool   `description:"Enable AMQP event provider"`
+	ConnectionString string `description:"AMQP broker connection string"`
+	TopicAddress     string `description:"Address events are sent to, {topic} is replaced with the event type"`
+}
+
+//NewPublisher connects to the AMQP broker
+func NewPublisher(config *Config) (messaging.Publisher, error) {
+	if config.ConnectionString == "" {
+		return nil, fmt.Errorf("amqp connection string is required")
+	}
+	return amqpbus.NewPublisher(config.ConnectionString, config.TopicAddress)
+}
@@ -0,0 +1,57 @@
+package events
+
+import (
+	"context"
+	"time"
+
+	"github.com/lawrencegripper/ion/internal/pkg/common"
+	"github.com/lawrencegripper/ion/internal/pkg/messaging"
+	log "github.com/sirupsen/logrus"
+)
+
+//PublishTimeout is how long publishing a single event can take
+var PublishTimeout = time.Second * 30
+
+//EventPublisher publishes the module's events using a message bus publisher
+type EventPublisher struct {
+	publisher messaging.Publisher
+}
+
+//NewEventPublisher returns a new EventPublisher object
+func NewEventPublisher(publisher messaging.Publisher) *EventPublisher {
+	return &EventPublisher{
+		publisher: publisher,
+	}
+}
+
+//Publish publishes the event onto the message bus
+func (e *EventPublisher) Publish(event common.Event) error {
+	ctx, cancel := context.WithTimeout(context.Background(), PublishTimeout)
+	defer cancel()
+	return e.publisher.Publish(ctx, event)
+}
+
+//PublishBatch publishes the events together if the message bus publisher supports batches,
+//otherwise one at a time
+func (e *EventPublisher) PublishBatch(events []common.Event) error {
+	batchPublisher, ok := e.publisher.(messaging.BatchPublisher)
+	if !ok {
+		for _, event := range events {
+			if err := e.Publish(event); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), PublishTimeout)
+	defer cancel()
+	return batchPublisher.PublishBatch(ctx, events)
+}
+
+//Close cleans up the message bus publisher
+func (e *EventPublisher) Close() {
+	err := e.publisher.Close()
+	if err != nil {
+		log.WithError(err).Error("failed to close event publisher")
+	}
+}
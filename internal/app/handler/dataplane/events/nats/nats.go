@@ -0,0 +1,22 @@
+package nats
+
+import (
+	"fmt"
+
+	"github.com/lawrencegripper/ion/internal/pkg/messaging"
+	"github.com/lawrencegripper/ion/internal/pkg/natsbus"
+)
+
+//Config to setup a NATS JetStream event publisher
+type Config struct {
+	Enabled bool   `description:"Enable NATS JetStream event provider"`
+	URL     string `description:"NATS server url"`
+}
+
+//NewPublisher connects to the NATS server
+func NewPublisher(config *Config) (messaging.Publisher, error) {
+	if config.URL == "" {
+		return nil, fmt.Errorf("nats url is required")
+	}
+	return natsbus.NewPublisher(config.URL)
+}
@@ -0,0 +1,22 @@
+package redis
+
+import (
+	"fmt"
+
+	"github.com/lawrencegripper/ion/internal/pkg/messaging"
+	"github.com/lawrencegripper/ion/internal/pkg/redisbus"
+)
+
+//Config to setup a Redis Streams event publisher
+type Config struct {
+	Enabled bool   `description:"Enable Redis Streams event provider"`
+	URL     string `description:"Redis server url"`
+}
+
+//NewPublisher connects to the Redis server
+func NewPublisher(config *Config) (messaging.Publisher, error) {
+	if config.URL == "" {
+		return nil, fmt.Errorf("redis url is required")
+	}
+	return redisbus.NewPublisher(config.URL)
+}
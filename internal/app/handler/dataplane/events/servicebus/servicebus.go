@@ -1,22 +1,21 @@
 package servicebus
 
 import (
-	"bytes"
-	"crypto/hmac"
-	"crypto/sha256"
-	"encoding/base64"
+	"context"
 	"encoding/json"
 	"fmt"
-	"net/http"
-	"strconv"
+	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/lawrencegripper/ion/internal/pkg/common"
-	"k8s.io/kubernetes/third_party/forked/golang/template"
+	"github.com/lawrencegripper/ion/internal/pkg/messaging"
+	log "github.com/sirupsen/logrus"
+	"pack.ag/amqp"
 )
 
-// cSpell:ignore kubernetes, nolint
+// cSpell:ignore nolint, amqps
 
 //Config to setup a ServiceBus event publisher
 type Config struct {
@@ -27,83 +26,297 @@ type Config struct {
 	AuthorizationRuleName string `description:"ServiceBus authorization rule name"`
 }
 
-//ServiceBus handles the connection to an external Service Bus
+const (
+	// Service Bus errors which clear up on their own so the send is retried
+	errorServerBusy amqp.ErrorCondition = "com.microsoft:server-busy"
+	errorTimeout    amqp.ErrorCondition = "com.microsoft:timeout"
+
+	// batchMessageFormat is the format of a Service Bus batch, whose data sections each hold an encoded message
+	batchMessageFormat uint32 = 0x80013700
+)
+
+var (
+	//SenderMaxAge is how long a sender is used before being recreated
+	//workaround for issue: https://github.com/lawrencegripper/ion/issues/128
+	SenderMaxAge = time.Minute * 9
+	//MaxBatchSize is the largest batch sent in one message, leaving room under the 256KB message limit of the standard tier
+	MaxBatchSize = 200 * 1024
+	//MaxSendAttempts is how many times a send is attempted before giving up
+	MaxSendAttempts = 5
+)
+
+var _ messaging.Publisher = &ServiceBus{}
+var _ messaging.BatchPublisher = &ServiceBus{}
+
+//Sender sends messages to a topic, it's satisfied by *amqp.Sender
+type Sender interface {
+	Send(ctx context.Context, msg *amqp.Message) error
+	Close(ctx context.Context) error
+}
+
+//ServiceBus publishes events to Service Bus topics over a single AMQP connection, reusing a sender for each topic.
+//Sends which fail because Service Bus is busy or had an internal error are retried with backoff
 type ServiceBus struct {
-	PartialURL string `description:"This is the SB url without the topic name set. Replace %%TOPIC_PLACEHOLDER%% with the required topic before using"`
-	Key        string
-	SKN        string
+	//RetryPolicy is how long to wait between attempts at a send
+	RetryPolicy messaging.RetryPolicy
+	//NewSender creates the sender for a topic, it's used to allow mocking of the AMQP link for testing
+	NewSender func(topic string) (Sender, error)
+
+	connectionString string
+	mu               sync.Mutex
+	client           *amqp.Client
+	session          *amqp.Session
+	senders          map[string]*topicSender
 }
 
-const topicPlaceholderText = "%%TOPIC_PLACEHOLDER%%"
+type topicSender struct {
+	sender  Sender
+	created time.Time
+}
 
-//NewServiceBus creates a new Service Bus object
+//NewServiceBus creates a new Service Bus object. The connection is opened when the first event is published
 func NewServiceBus(config *Config) (*ServiceBus, error) {
+	if config.Namespace == "" || config.AuthorizationRuleName == "" || config.Key == "" {
+		return nil, fmt.Errorf("servicebus namespace, authorization rule name and key are required")
+	}
 	sb := &ServiceBus{
-		PartialURL: fmt.Sprintf("https://%s.servicebus.windows.net/%s/messages", config.Namespace, topicPlaceholderText),
-		Key:        config.Key,
-		SKN:        config.AuthorizationRuleName,
+		RetryPolicy: messaging.RetryPolicy{
+			InitialDelay: time.Second,
+			Multiplier:   2,
+			MaxDelay:     time.Second * 30,
+		},
+		connectionString: fmt.Sprintf("amqps://%s:%s@%s.servicebus.windows.net",
+			url.QueryEscape(config.AuthorizationRuleName), url.QueryEscape(config.Key), config.Namespace),
+		senders: map[string]*topicSender{},
 	}
-	//TODO: validate connection for fast failure
+	sb.NewSender = sb.createSender
 	return sb, nil
 }
 
 //Publish publishes an event onto a Service Bus topic
-func (s *ServiceBus) Publish(e common.Event) error {
+func (s *ServiceBus) Publish(ctx context.Context, e common.Event) error {
+	message, err := newEventMessage(e)
+	if err != nil {
+		return err
+	}
+	return s.send(ctx, e.Type, message)
+}
+
+//PublishBatch publishes the events, sending those for the same topic together in as few messages as the size limit allows
+func (s *ServiceBus) PublishBatch(ctx context.Context, events []common.Event) error {
+	var topics []string
+	messagesByTopic := map[string][][]byte{}
+	for _, e := range events {
+		message, err := newEventMessage(e)
+		if err != nil {
+			return err
+		}
+		encoded, err := message.MarshalBinary()
+		if err != nil {
+			return fmt.Errorf("error encoding event for topic '%s': %+v", e.Type, err)
+		}
+		if _, exists := messagesByTopic[e.Type]; !exists {
+			topics = append(topics, e.Type)
+		}
+		messagesByTopic[e.Type] = append(messagesByTopic[e.Type], encoded)
+	}
 
-	// generate a url for the correct topic for this event
-	sbURL := strings.Replace(s.PartialURL, topicPlaceholderText, e.Type, -1)
+	for _, topic := range topics {
+		for _, batch := range splitBatches(messagesByTopic[topic], MaxBatchSize) {
+			message := &amqp.Message{
+				Format: batchMessageFormat,
+				Data:   batch,
+			}
+			if err := s.send(ctx, topic, message); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
 
-	b, err := json.Marshal(e)
+//Close cleans up any outstanding connections to Service Bus
+func (s *ServiceBus) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for topic := range s.senders {
+		s.closeSender(topic)
+	}
+	return s.closeConnection()
+}
+
+//send sends the message to the topic, retrying failures which could clear up on their own
+func (s *ServiceBus) send(ctx context.Context, topic string, message *amqp.Message) error {
+	topic = strings.ToLower(topic)
+	for attempt := 1; ; attempt++ {
+		sender, err := s.getSender(topic)
+		if err == nil {
+			err = sender.Send(ctx, message)
+			if err == nil {
+				return nil
+			}
+			s.discardBrokenLink(topic, err)
+		}
+
+		if !isRetryable(err) || attempt >= MaxSendAttempts || ctx.Err() != nil {
+			return fmt.Errorf("error publishing to servicebus topic '%s' after %d attempt(s): %s", topic, attempt, describeError(err))
+		}
+		delay := s.RetryPolicy.Delay(attempt)
+		log.WithError(err).WithField("topic", topic).WithField("attempt", attempt).WithField("delay", delay).Warn("failed to publish to servicebus, retrying")
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("error publishing to servicebus topic '%s' after %d attempt(s): %s", topic, attempt, describeError(err))
+		case <-time.After(delay):
+		}
+	}
+}
+
+//getSender gets the sender for the topic, replacing it if it has been in use longer than SenderMaxAge
+func (s *ServiceBus) getSender(topic string) (Sender, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, ok := s.senders[topic]
+	if ok && time.Since(existing.created) < SenderMaxAge {
+		return existing.sender, nil
+	}
+	if ok {
+		s.closeSender(topic)
+	}
+	sender, err := s.NewSender(topic)
 	if err != nil {
-		return fmt.Errorf("error publishing event %+v", err)
+		return nil, err
 	}
-	req, err := http.NewRequest(http.MethodPost, sbURL, bytes.NewBuffer(b))
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", generateSAS(sbURL, s.SKN, s.Key))
+	s.senders[topic] = &topicSender{
+		sender:  sender,
+		created: time.Now(),
+	}
+	return sender, nil
+}
+
+//discardBrokenLink closes the topic's sender if the error means it can't be used again,
+//and the connection too if that's what broke
+func (s *ServiceBus) discardBrokenLink(topic string, err error) {
+	if _, rejected := err.(*amqp.Error); rejected {
+		return // The message was rejected but the link is fine
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closeSender(topic)
+	if err == amqp.ErrConnClosed || err == amqp.ErrSessionClosed {
+		_ = s.closeConnection()
+	}
+}
 
-	//TODO: optimize
-	client := &http.Client{}
-	res, err := client.Do(req)
+//createSender opens a sender for the topic, connecting to the namespace if needed
+func (s *ServiceBus) createSender(topic string) (Sender, error) {
+	if s.session == nil {
+		client, err := amqp.Dial(s.connectionString)
+		if err != nil {
+			return nil, fmt.Errorf("error connecting to servicebus: %+v", err)
+		}
+		session, err := client.NewSession()
+		if err != nil {
+			_ = client.Close()
+			return nil, fmt.Errorf("error creating servicebus session: %+v", err)
+		}
+		s.client = client
+		s.session = session
+	}
+	sender, err := s.session.NewSender(
+		amqp.LinkTargetAddress("/" + topic),
+	)
 	if err != nil {
-		return fmt.Errorf("error publishing event %+v", err)
+		_ = s.closeConnection()
+		return nil, fmt.Errorf("error creating sender for topic '%s': %+v", topic, err)
 	}
+	return sender, nil
+}
 
-	switch res.StatusCode {
-	case http.StatusCreated:
+//closeSender closes and forgets the topic's sender, the caller must hold the lock
+func (s *ServiceBus) closeSender(topic string) {
+	existing, ok := s.senders[topic]
+	if !ok {
+		return
+	}
+	delete(s.senders, topic)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+	if err := existing.sender.Close(ctx); err != nil {
+		log.WithError(err).WithField("topic", topic).Debug("failed to close sender")
+	}
+}
+
+//closeConnection closes the connection to the namespace, the caller must hold the lock
+func (s *ServiceBus) closeConnection() error {
+	client := s.client
+	s.client = nil
+	s.session = nil
+	if client == nil {
 		return nil
-	case http.StatusBadRequest:
-		return fmt.Errorf("bad request")
-	case http.StatusUnauthorized:
-		return fmt.Errorf("authorization failure")
-	case http.StatusForbidden:
-		return fmt.Errorf("quota exceeded or message to large")
-	case http.StatusGone:
-		return fmt.Errorf("specified queue or topic does not exist")
-	case http.StatusInternalServerError:
-		return fmt.Errorf("internal error")
-	default:
-		return fmt.Errorf("unknown status code")
 	}
+	return client.Close()
 }
 
-//Close cleans up any outstanding connections to Service Bus
-func (s *ServiceBus) Close() {
-}
-
-//generateSAS builds a SAS token for use as a HTTP header
-// nolint: errcheck
-func generateSAS(uri, skn, key string) string {
-	encoded := template.URLQueryEscaper(uri)
-	now := time.Now().Unix()
-	week := 60 * 60 * 24 * 7
-	ts := now + int64(week)
-	signature := encoded + "\n" + strconv.Itoa(int(ts))
-	k := []byte(key)
-	hmac := hmac.New(sha256.New, k)
-	hmac.Write([]byte(signature))
-	hmacString := template.URLQueryEscaper(base64.StdEncoding.EncodeToString(hmac.Sum(nil)))
-
-	result := "SharedAccessSignature sr=" + encoded + "&sig=" +
-		hmacString + "&se=" + strconv.Itoa(int(ts)) + "&skn=" + skn
-	return result
+//newEventMessage creates the message for an event, using the event ID as the message ID
+func newEventMessage(e common.Event) (*amqp.Message, error) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return nil, fmt.Errorf("error marshalling event for topic '%s': %+v", e.Type, err)
+	}
+	message := amqp.NewMessage(b)
+	message.Properties = &amqp.MessageProperties{
+		ContentType: "application/json",
+	}
+	if e.Context != nil && e.Context.EventID != "" {
+		message.Properties.MessageID = e.Context.EventID
+	}
+	return message, nil
+}
+
+//splitBatches groups the encoded messages into batches no larger than maxSize, a message larger than maxSize is sent on its own
+func splitBatches(messages [][]byte, maxSize int) [][][]byte {
+	var batches [][][]byte
+	var batch [][]byte
+	size := 0
+	for _, message := range messages {
+		if len(batch) > 0 && size+len(message) > maxSize {
+			batches = append(batches, batch)
+			batch = nil
+			size = 0
+		}
+		batch = append(batch, message)
+		size += len(message)
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+//isRetryable checks whether the error is from throttling, a server error or a broken connection, which could succeed if retried
+func isRetryable(err error) bool {
+	switch e := err.(type) {
+	case *amqp.Error:
+		switch e.Condition {
+		case errorServerBusy, errorTimeout, amqp.ErrorInternalError:
+			return true
+		}
+		return false
+	case *amqp.DetachError:
+		return e.RemoteError == nil || e.RemoteError.Condition != amqp.ErrorNotFound && e.RemoteError.Condition != amqp.ErrorUnauthorizedAccess
+	}
+	// Failing to connect, or the connection or link closing under us
+	return true
+}
+
+//describeError gets the condition and description of an error returned by Service Bus
+func describeError(err error) string {
+	if detach, ok := err.(*amqp.DetachError); ok && detach.RemoteError != nil {
+		err = detach.RemoteError
+	}
+	if amqpErr, ok := err.(*amqp.Error); ok {
+		return fmt.Sprintf("status '%s': %s", amqpErr.Condition, amqpErr.Description)
+	}
+	return err.Error()
 }
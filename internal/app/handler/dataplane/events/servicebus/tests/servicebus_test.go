@@ -0,0 +1,198 @@
+package servicebus_test
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/lawrencegripper/ion/internal/app/handler/dataplane/events/servicebus"
+	"github.com/lawrencegripper/ion/internal/pkg/common"
+	"github.com/lawrencegripper/ion/internal/pkg/messaging"
+	"pack.ag/amqp"
+)
+
+// fakeSender returns the queued errors from each send before succeeding
+type fakeSender struct {
+	mu     sync.Mutex
+	errors []error
+	sent   []*amqp.Message
+	closed bool
+}
+
+func (f *fakeSender) Send(ctx context.Context, msg *amqp.Message) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.errors) > 0 {
+		err := f.errors[0]
+		f.errors = f.errors[1:]
+		return err
+	}
+	f.sent = append(f.sent, msg)
+	return nil
+}
+
+func (f *fakeSender) Close(ctx context.Context) error {
+	f.closed = true
+	return nil
+}
+
+func newTestServiceBus(t *testing.T, senders ...*fakeSender) (*servicebus.ServiceBus, *[]string) {
+	sb, err := servicebus.NewServiceBus(&servicebus.Config{
+		Namespace:             "ion",
+		AuthorizationRuleName: "RootManageSharedAccessKey",
+		Key:                   "key",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb.RetryPolicy = messaging.RetryPolicy{}
+	var topics []string
+	sb.NewSender = func(topic string) (servicebus.Sender, error) {
+		topics = append(topics, topic)
+		if len(topics) > len(senders) {
+			t.Fatalf("unexpected sender created for %s", topic)
+		}
+		return senders[len(topics)-1], nil
+	}
+	return sb, &topics
+}
+
+func newEvent(eventType, eventID string) common.Event {
+	return common.Event{
+		Type:    eventType,
+		Context: &common.Context{EventID: eventID},
+	}
+}
+
+func TestPublishRetriesWhenThrottled(t *testing.T) {
+	sender := &fakeSender{
+		errors: []error{
+			&amqp.Error{Condition: "com.microsoft:server-busy", Description: "namespace is throttled"},
+			&amqp.Error{Condition: amqp.ErrorInternalError, Description: "try again"},
+		},
+	}
+	sb, topics := newTestServiceBus(t, sender)
+
+	err := sb.Publish(context.Background(), newEvent("Face_Detected", "event1"))
+	if err != nil {
+		t.Fatalf("expected publish to succeed after retrying got %+v", err)
+	}
+	if len(sender.sent) != 1 || sender.sent[0].Properties.MessageID != "event1" {
+		t.Errorf("expected event1 to be sent once got %+v", sender.sent)
+	}
+	if len(*topics) != 1 || (*topics)[0] != "face_detected" {
+		t.Errorf("expected one sender reused for the topic got %v", *topics)
+	}
+}
+
+func TestPublishDoesNotRetryRejectedMessage(t *testing.T) {
+	sender := &fakeSender{
+		errors: []error{
+			&amqp.Error{Condition: amqp.ErrorMessageSizeExceeded, Description: "message is too large"},
+		},
+	}
+	sb, _ := newTestServiceBus(t, sender)
+
+	err := sb.Publish(context.Background(), newEvent("face_detected", "event1"))
+	if err == nil {
+		t.Fatal("expected publish to fail")
+	}
+	for _, expected := range []string{"'face_detected'", "1 attempt", string(amqp.ErrorMessageSizeExceeded), "message is too large"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected error to contain %s got %s", expected, err.Error())
+		}
+	}
+}
+
+func TestPublishGivesUpAfterMaxAttempts(t *testing.T) {
+	busy := &amqp.Error{Condition: "com.microsoft:server-busy"}
+	sender := &fakeSender{}
+	for i := 0; i < servicebus.MaxSendAttempts; i++ {
+		sender.errors = append(sender.errors, busy)
+	}
+	sb, _ := newTestServiceBus(t, sender)
+
+	err := sb.Publish(context.Background(), newEvent("face_detected", "event1"))
+	if err == nil || !strings.Contains(err.Error(), "5 attempt") {
+		t.Errorf("expected publish to fail after 5 attempts got %+v", err)
+	}
+}
+
+func TestPublishRecreatesDetachedSender(t *testing.T) {
+	detached := &fakeSender{errors: []error{&amqp.DetachError{}}}
+	replacement := &fakeSender{}
+	sb, topics := newTestServiceBus(t, detached, replacement)
+
+	err := sb.Publish(context.Background(), newEvent("face_detected", "event1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !detached.closed || len(*topics) != 2 || len(replacement.sent) != 1 {
+		t.Errorf("expected detached sender to be replaced, closed: %t senders: %v", detached.closed, *topics)
+	}
+}
+
+func TestPublishBatchGroupsEventsByTopic(t *testing.T) {
+	faces := &fakeSender{}
+	cars := &fakeSender{}
+	sb, topics := newTestServiceBus(t, faces, cars)
+
+	events := []common.Event{
+		newEvent("face_detected", "event1"),
+		newEvent("car_detected", "event2"),
+		newEvent("face_detected", "event3"),
+	}
+	if err := sb.PublishBatch(context.Background(), events); err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Join(*topics, ",") != "face_detected,car_detected" {
+		t.Errorf("expected a sender for each topic got %v", *topics)
+	}
+	if len(faces.sent) != 1 || len(faces.sent[0].Data) != 2 {
+		t.Fatalf("expected both face events in one batch got %+v", faces.sent)
+	}
+	batch := faces.sent[0]
+	if batch.Format != 0x80013700 {
+		t.Errorf("expected batch message format got %x", batch.Format)
+	}
+	if !bytes.Contains(batch.Data[0], []byte("event1")) || !bytes.Contains(batch.Data[1], []byte("event3")) {
+		t.Error("expected each data section to hold an encoded event")
+	}
+	if len(cars.sent) != 1 || len(cars.sent[0].Data) != 1 {
+		t.Errorf("expected car event in its own batch got %+v", cars.sent)
+	}
+}
+
+func TestPublishBatchSplitsLargeBatches(t *testing.T) {
+	sender := &fakeSender{}
+	sb, _ := newTestServiceBus(t, sender)
+	maxBatchSize := servicebus.MaxBatchSize
+	servicebus.MaxBatchSize = 300
+	defer func() { servicebus.MaxBatchSize = maxBatchSize }()
+
+	var events []common.Event
+	for i := 0; i < 5; i++ {
+		events = append(events, newEvent("face_detected", strings.Repeat("a", 100)))
+	}
+	if err := sb.PublishBatch(context.Background(), events); err != nil {
+		t.Fatal(err)
+	}
+
+	total := 0
+	for _, batch := range sender.sent {
+		size := 0
+		for _, data := range batch.Data {
+			size += len(data)
+		}
+		if size > 300 && len(batch.Data) > 1 {
+			t.Errorf("batch of %d bytes is over the limit", size)
+		}
+		total += len(batch.Data)
+	}
+	if len(sender.sent) < 2 || total != 5 {
+		t.Errorf("expected 5 events split over several batches got %d events in %d batches", total, len(sender.sent))
+	}
+}
@@ -1,7 +1,10 @@
 package helpers
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"path"
 	"path/filepath"
 	"strings"
@@ -57,12 +60,33 @@ func RemoveFile(filePath string) error {
 	return nil
 }
 
+//HashFile gets the hex encoded SHA-256 and the size of a file
+func HashFile(filePath string) (string, int64, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to open file '%s' with error: '%+v'", filePath, err)
+	}
+	defer f.Close() // nolint: errcheck
+
+	hasher := sha256.New()
+	size, err := io.Copy(hasher, f)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to hash file '%s' with error: '%+v'", filePath, err)
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), size, nil
+}
+
 //NewGUID generates a new guid as a string
 func NewGUID() string {
 	guid := fmt.Sprintf("%v", uuid.NewV4())
 	return guid
 }
 
+//NewDeterministicGUID generates a guid from the names, the same names always give the same guid
+func NewDeterministicGUID(names ...string) string {
+	return fmt.Sprintf("%v", uuid.NewV5(uuid.NameSpaceOID, strings.Join(names, "/")))
+}
+
 //JoinBlobPath returns a formatted blob path
 func JoinBlobPath(strs ...string) string {
 	var allStrs []string
@@ -72,6 +96,19 @@ func JoinBlobPath(strs ...string) string {
 	return strings.Join(allStrs, `/`)
 }
 
+//GetBlobName gets the name a file is stored under, its slash separated path
+//relative to the blob directory, erroring if the file isn't in the directory
+func GetBlobName(blobDir, filePath string) (string, error) {
+	rel, err := filepath.Rel(blobDir, filePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to get path of file '%s' in blob directory '%s' with error: '%+v'", filePath, blobDir, err)
+	}
+	if rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("file '%s' is not in blob directory '%s'", filePath, blobDir)
+	}
+	return filepath.ToSlash(rel), nil
+}
+
 //ContainsString checks whether a string is in a slice of strings
 func ContainsString(slice []string, target string) bool {
 	for _, s := range slice {
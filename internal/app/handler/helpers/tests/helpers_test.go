@@ -4,6 +4,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
 	"testing"
 
 	"github.com/lawrencegripper/ion/internal/app/handler/helpers"
@@ -109,6 +110,50 @@ func TestJoinBlobPath(t *testing.T) {
 	}
 }
 
+func TestGetBlobName(t *testing.T) {
+	testCases := []struct {
+		filePath string
+		expected string
+		err      bool
+	}{
+		{
+			filePath: "/ion/out/data/frame.jpg",
+			expected: "frame.jpg",
+		},
+		{
+			filePath: "/ion/out/data/a/frame.jpg",
+			expected: "a/frame.jpg",
+		},
+		{
+			filePath: "/ion/out/data/b/../c/./frame.jpg",
+			expected: "c/frame.jpg",
+		},
+		{
+			filePath: "/ion/out/frame.jpg",
+			err:      true,
+		},
+		{
+			filePath: "/ion/out/data",
+			err:      true,
+		},
+	}
+	for _, test := range testCases {
+		actual, err := helpers.GetBlobName("/ion/out/data", filepath.FromSlash(test.filePath))
+		if test.err {
+			if err == nil {
+				t.Errorf("expecting error for '%s' but got '%s'", test.filePath, actual)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error for '%s': %+v", test.filePath, err)
+		}
+		if actual != test.expected {
+			t.Errorf("expecting '%s' but got '%s'", test.expected, actual)
+		}
+	}
+}
+
 func TestRemoveFile(t *testing.T) {
 	testCases := []struct {
 		filename string
@@ -167,6 +167,14 @@ func TestDevIntegration(t *testing.T) {
 		}
 		break
 	}
+
+	// The blob uris follow, keyed by each file's path in the output directory
+	kvpMap := kvps.AsMap()
+	for _, name := range []string{blob1, blob2} {
+		if kvpMap[name] == "" {
+			t.Errorf("expected blob uri for '%s' in key value pairs: '%+v'", name, kvps)
+		}
+	}
 }
 
 func writeLargeOutputBlob(path string, sizeInMB float64) error {
@@ -17,6 +17,7 @@ type Environment struct {
 	OutputBlobDirPath   string
 	OutputMetaFilePath  string
 	OutputEventsDirPath string
+	OutputFailurePath   string
 }
 
 // GetModuleEnvironment returns a struct that represents
@@ -30,6 +31,7 @@ func GetModuleEnvironment(baseDir string) *Environment {
 		OutputBlobDirPath:   helpers.GetPath(baseDir, constants.OutputBlobDir),
 		OutputMetaFilePath:  helpers.GetPath(baseDir, constants.OutputInsightsFile),
 		OutputEventsDirPath: helpers.GetPath(baseDir, constants.OutputEventsDir),
+		OutputFailurePath:   helpers.GetPath(baseDir, constants.OutputFailureFile),
 	}
 }
 
@@ -64,5 +66,8 @@ func (m *Environment) Clear() error {
 	if err := helpers.ClearDir(m.OutputEventsDirPath); err != nil {
 		return fmt.Errorf("could not create output events directory, %+v", err)
 	}
+	if err := helpers.RemoveFile(m.OutputFailurePath); err != nil {
+		return fmt.Errorf("could not remove output failure file, %+v", err)
+	}
 	return nil
 }
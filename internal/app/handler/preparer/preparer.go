@@ -6,6 +6,7 @@ import (
 	"github.com/lawrencegripper/ion/internal/app/handler/development"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/lawrencegripper/ion/internal/app/handler/dataplane"
@@ -132,11 +133,24 @@ func (p *Preparer) prepareData() error {
 	// Assume those that don't have a context are the
 	// first event in the graph or orphaned.
 	if eventMeta != nil {
+		if len(eventMeta.Parents) > 0 {
+			logger.InfoWithFields(p.context, "event joins several events, preparing their merged files and data", map[string]interface{}{
+				"parents": eventMeta.Parents,
+			})
+		}
 		logger.InfoWithFields(p.context, "getting blobs for files", map[string]interface{}{
 			"files": eventMeta.Files,
 			"data":  eventMeta.Data,
 		})
-		err = p.dataPlane.GetBlobs(p.environment.InputBlobDirPath, eventMeta.Files)
+		fileNames, err := p.getFileNames(eventMeta.Files)
+		if err != nil {
+			return err
+		}
+		err = p.dataPlane.GetBlobs(p.environment.InputBlobDirPath, fileNames)
+		if err != nil {
+			return err
+		}
+		err = p.verifyFiles(eventMeta.Files)
 		if err != nil {
 			return err
 		}
@@ -155,6 +169,42 @@ func (p *Preparer) prepareData() error {
 	return nil
 }
 
+// getFileNames gets the path of each file in the input blob directory, which
+// matches its path in the output blob directory of the module that committed it.
+// Files which would be written outside the input blob directory are rejected
+func (p *Preparer) getFileNames(files []documentstorage.File) ([]string, error) {
+	fileNames := make([]string, 0, len(files))
+	for _, file := range files {
+		filePath := filepath.Join(p.environment.InputBlobDirPath, filepath.FromSlash(file.Name))
+		name, err := helpers.GetBlobName(p.environment.InputBlobDirPath, filePath)
+		if err != nil {
+			return nil, fmt.Errorf("invalid file '%s' in event meta: %+v", file.Name, err)
+		}
+		fileNames = append(fileNames, name)
+	}
+	return fileNames, nil
+}
+
+// verifyFiles checks each file got matches the SHA-256 and size recorded
+// when it was committed. Files committed before their hashes were
+// recorded aren't checked
+func (p *Preparer) verifyFiles(files []documentstorage.File) error {
+	for _, file := range files {
+		if file.SHA256 == "" {
+			continue
+		}
+		hash, size, err := helpers.HashFile(filepath.Join(p.environment.InputBlobDirPath, file.Name))
+		if err != nil {
+			return err
+		}
+		if hash != file.SHA256 || size != file.Size {
+			return fmt.Errorf("file '%s' with SHA-256 '%s' and size %d doesn't match the SHA-256 '%s' and size %d recorded when it was committed",
+				file.Name, hash, size, file.SHA256, file.Size)
+		}
+	}
+	return nil
+}
+
 func (p *Preparer) getEventMeta() (*documentstorage.EventMeta, error) {
 	context, err := p.dataPlane.GetEventMetaByID(p.context.EventID)
 	if err != nil {
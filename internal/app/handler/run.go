@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/lawrencegripper/ion/internal/app/handler/dataplane/documentstorage"
 	"github.com/lawrencegripper/ion/internal/app/handler/development"
+	"io/ioutil"
 	"path/filepath"
 
 	"os"
@@ -16,13 +17,19 @@ import (
 	"github.com/lawrencegripper/ion/internal/app/handler/dataplane"
 	"github.com/lawrencegripper/ion/internal/app/handler/dataplane/blobstorage/azure"
 	"github.com/lawrencegripper/ion/internal/app/handler/dataplane/blobstorage/filesystem"
+	"github.com/lawrencegripper/ion/internal/app/handler/dataplane/blobstorage/s3"
 	"github.com/lawrencegripper/ion/internal/app/handler/dataplane/documentstorage/inmemory"
 	"github.com/lawrencegripper/ion/internal/app/handler/dataplane/documentstorage/mongodb"
+	"github.com/lawrencegripper/ion/internal/app/handler/dataplane/events"
+	"github.com/lawrencegripper/ion/internal/app/handler/dataplane/events/amqp"
 	"github.com/lawrencegripper/ion/internal/app/handler/dataplane/events/mock"
+	"github.com/lawrencegripper/ion/internal/app/handler/dataplane/events/nats"
+	"github.com/lawrencegripper/ion/internal/app/handler/dataplane/events/redis"
 	"github.com/lawrencegripper/ion/internal/app/handler/dataplane/events/servicebus"
 	"github.com/lawrencegripper/ion/internal/app/handler/helpers"
 	"github.com/lawrencegripper/ion/internal/app/handler/module"
 	"github.com/lawrencegripper/ion/internal/app/handler/preparer"
+	"github.com/lawrencegripper/ion/internal/pkg/common"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -37,7 +44,14 @@ const (
 	// Providers
 	metaProviderMongoDB      string = "mongodb"
 	blobProviderAzureStorage string = "azureblob"
+	blobProviderS3           string = "s3"
 	eventProviderServiceBus  string = "servicebus"
+	eventProviderAMQP        string = "amqp"
+	eventProviderNATS        string = "nats"
+	eventProviderRedis       string = "redis"
+
+	// Read by kubernetes as the reason a container terminated
+	terminationLogPath = "/dev/termination-log"
 )
 
 // Run the handler using config
@@ -96,6 +110,10 @@ func Run(config Configuration) {
 		committer := committer.NewCommitter(baseDir, config.DevelopmentConfiguration)
 		defer committer.Close()
 		if err := committer.Commit(config.Context, dataPlane, validEventTypes); err != nil {
+			if reason, failed := isModuleFailure(err); failed {
+				committer.Close()
+				exitWithPermanentFailure(reason)
+			}
 			panic(fmt.Sprintf("error during commit %+v", err))
 		}
 	} else {
@@ -103,6 +121,25 @@ func Run(config Configuration) {
 	}
 }
 
+// isModuleFailure checks whether the commit failed because the module reported a permanent failure
+func isModuleFailure(err error) (string, bool) {
+	failure, ok := err.(*committer.ModuleFailedError)
+	if !ok {
+		return "", false
+	}
+	return failure.Reason, true
+}
+
+// exitWithPermanentFailure exits with the code the dispatcher uses to dead letter rather than retry the message.
+// The reason is written to the termination log so the dispatcher can record it
+func exitWithPermanentFailure(reason string) {
+	log.WithField("reason", reason).Error("module reported a permanent failure, skipping commit")
+	if err := ioutil.WriteFile(terminationLogPath, []byte(reason), 0644); err != nil {
+		log.WithError(err).Debug("failed to write termination log")
+	}
+	os.Exit(common.PermanentFailureExitCode)
+}
+
 func getDefaultBaseDir() string {
 	switch runtime.GOOS {
 	case "windows":
@@ -149,24 +186,31 @@ func getBlobProvider(config *Configuration, meta dataplane.DocumentStorageProvid
 		log.Info("using azure blob storage provider")
 		c := config.AzureBlobStorageProvider
 		log.Info("getting event meta as the blob provider requires the SAS urls")
-		eventMeta, err := meta.GetEventMetaByID(config.Context.EventID)
-		if err != nil {
-			if strings.HasPrefix(err.Error(), documentstorage.NotFoundErr) {
-				log.Info("no event meta found, likely handler invoked manually")
-			} else {
-				log.WithError(err).Panic("failed while getting event meta for blob provider to use SAS urls")
-			}
-		}
 		azureBlob, err := azure.NewBlobStorage(c,
 			helpers.JoinBlobPath(config.Context.ParentEventID, config.Context.Name),
 			helpers.JoinBlobPath(config.Context.EventID, config.Context.Name),
-			eventMeta,
+			getBlobEventMeta(config, meta),
 			module.GetModuleEnvironment(config.BaseDir),
 		)
 		if err != nil {
 			panic(fmt.Errorf("failed to establish blob storage with provider '%s', error: %+v", blobProviderAzureStorage, err))
 		}
 		return azureBlob
+	}
+	if config.S3BlobStorageProvider.Enabled {
+		log.Info("using s3 blob storage provider")
+		c := config.S3BlobStorageProvider
+		log.Info("getting event meta as the blob provider requires the presigned urls")
+		s3Blob, err := s3.NewBlobStorage(c,
+			helpers.JoinBlobPath(config.Context.ParentEventID, config.Context.Name),
+			helpers.JoinBlobPath(config.Context.EventID, config.Context.Name),
+			getBlobEventMeta(config, meta),
+			module.GetModuleEnvironment(config.BaseDir),
+		)
+		if err != nil {
+			panic(fmt.Errorf("failed to establish blob storage with provider '%s', error: %+v", blobProviderS3, err))
+		}
+		return s3Blob
 	} // else
 	log.Info("defaulting to filesystem blob storage provider")
 	fsBlob, err := filesystem.NewBlobStorage(&filesystem.Config{
@@ -179,6 +223,19 @@ func getBlobProvider(config *Configuration, meta dataplane.DocumentStorageProvid
 	return fsBlob
 }
 
+// getBlobEventMeta gets the meta for the event, which holds the urls the blob providers read the event's blobs from
+func getBlobEventMeta(config *Configuration, meta dataplane.DocumentStorageProvider) *documentstorage.EventMeta {
+	eventMeta, err := meta.GetEventMetaByID(config.Context.EventID)
+	if err != nil {
+		if strings.HasPrefix(err.Error(), documentstorage.NotFoundErr) {
+			log.Info("no event meta found, likely handler invoked manually")
+		} else {
+			log.WithError(err).Panic("failed while getting event meta for blob provider to use its urls")
+		}
+	}
+	return eventMeta
+}
+
 func getEventProvider(config *Configuration) dataplane.EventPublisher {
 	if config.ServiceBusEventProvider.Enabled {
 		log.Info("using azure service bus event publisher")
@@ -187,7 +244,31 @@ func getEventProvider(config *Configuration) dataplane.EventPublisher {
 		if err != nil {
 			panic(fmt.Errorf("failed to establish event publisher with provider '%s', error: %+v", eventProviderServiceBus, err))
 		}
-		return serviceBus
+		return events.NewEventPublisher(serviceBus)
+	}
+	if config.AMQPEventProvider.Enabled {
+		log.Info("using amqp event publisher")
+		publisher, err := amqp.NewPublisher(config.AMQPEventProvider)
+		if err != nil {
+			panic(fmt.Errorf("failed to establish event publisher with provider '%s', error: %+v", eventProviderAMQP, err))
+		}
+		return events.NewEventPublisher(publisher)
+	}
+	if config.NATSEventProvider.Enabled {
+		log.Info("using nats jetstream event publisher")
+		publisher, err := nats.NewPublisher(config.NATSEventProvider)
+		if err != nil {
+			panic(fmt.Errorf("failed to establish event publisher with provider '%s', error: %+v", eventProviderNATS, err))
+		}
+		return events.NewEventPublisher(publisher)
+	}
+	if config.RedisEventProvider.Enabled {
+		log.Info("using redis streams event publisher")
+		publisher, err := redis.NewPublisher(config.RedisEventProvider)
+		if err != nil {
+			panic(fmt.Errorf("failed to establish event publisher with provider '%s', error: %+v", eventProviderRedis, err))
+		}
+		return events.NewEventPublisher(publisher)
 	} // else
 	log.Info("defaulting to filesystem event publisher")
 	fsEvents := mock.NewEventPublisher(filepath.FromSlash(path.Join(config.DevelopmentConfiguration.ModuleDir, development.EventsDirExt)))
@@ -238,6 +238,11 @@ func (k *Kubernetes) Create(ctx context.Context, r *module.ModuleCreateRequest)
 
 	configMapFilePath := "/etc/config"
 
+	// Give running jobs as long as they're allowed to run to finish when the dispatcher is stopped,
+	// the pod must be allowed to outlive this so it can release any messages left afterwards
+	drainTimeoutSecs := int64(r.Maxexecutiontimemins) * 60
+	terminationGracePeriodSecs := drainTimeoutSecs + 30
+
 	// Create an argument list to provide the the dispatcher binary
 	dispatcherArgs := []string{
 		"start",
@@ -251,11 +256,13 @@ func (k *Kubernetes) Create(ctx context.Context, r *module.ModuleCreateRequest)
 		"--job.retrycount=" + fmt.Sprintf("%d", r.Retrycount),
 		"--job.pullalways=false",
 		"--job.maxrunningtimemins=" + fmt.Sprintf("%d", r.Maxexecutiontimemins),
+		"--job.draintimeoutsecs=" + fmt.Sprintf("%d", drainTimeoutSecs),
 		"--kubernetes.namespace=" + k.namespace,
 		"--kubernetes.imagepullsecretname=" + sharedImagePullSecretName,
 		"--loglevel=" + logLevel,
 		"--printconfig=true",
 	}
+	dispatcherArgs = append(dispatcherArgs, getPodCustomisationArgs(r)...)
 
 	dispatcherDeploymentName := id
 
@@ -286,6 +293,7 @@ func (k *Kubernetes) Create(ctx context.Context, r *module.ModuleCreateRequest)
 					},
 				},
 				Spec: apiv1.PodSpec{
+					TerminationGracePeriodSeconds: &terminationGracePeriodSecs,
 					Containers: []apiv1.Container{
 						{
 							Name:  "ion-dispatcher",
@@ -473,3 +481,35 @@ func getClientSet() (*kubernetes.Clientset, error) {
 }
 
 func int32Ptr(i int32) *int32 { return &i }
+
+// getPodCustomisationArgs converts the module's pod settings to dispatcher arguments,
+// omitting any which are unset so the dispatcher defaults apply
+func getPodCustomisationArgs(r *module.ModuleCreateRequest) []string {
+	args := []string{}
+	optional := []struct {
+		flag  string
+		value string
+	}{
+		{"--kubernetes.cpurequest=", r.Cpurequest},
+		{"--kubernetes.cpulimit=", r.Cpulimit},
+		{"--kubernetes.memoryrequest=", r.Memoryrequest},
+		{"--kubernetes.memorylimit=", r.Memorylimit},
+		{"--kubernetes.affinity=", r.Affinity},
+		{"--kubernetes.serviceaccountname=", r.Serviceaccountname},
+	}
+	for _, o := range optional {
+		if o.value != "" {
+			args = append(args, o.flag+o.value)
+		}
+	}
+	if r.Gpucount > 0 {
+		args = append(args, fmt.Sprintf("--kubernetes.gpucount=%d", r.Gpucount))
+	}
+	for _, selector := range r.Nodeselector {
+		args = append(args, "--kubernetes.nodeselector="+selector)
+	}
+	for _, toleration := range r.Tolerations {
+		args = append(args, "--kubernetes.tolerations="+toleration)
+	}
+	return args
+}
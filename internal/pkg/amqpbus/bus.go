@@ -0,0 +1,291 @@
+package amqpbus
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lawrencegripper/ion/internal/pkg/amqpmessage"
+	"github.com/lawrencegripper/ion/internal/pkg/common"
+	"github.com/lawrencegripper/ion/internal/pkg/messaging"
+	"github.com/lawrencegripper/ion/internal/pkg/types"
+	"github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+	"pack.ag/amqp"
+)
+
+const (
+	// DefaultTopicAddress sends events to an address named after the event type
+	DefaultTopicAddress = topicPlaceholder
+	// DefaultSubscriptionAddress receives from a queue on the event type's address using the
+	// fully qualified queue name syntax understood by ActiveMQ Artemis
+	DefaultSubscriptionAddress = topicPlaceholder + "::" + subscriptionPlaceholder
+
+	topicPlaceholder        = "{topic}"
+	subscriptionPlaceholder = "{subscription}"
+)
+
+// The handler reads its flags from the environment, with '.' replaced by '_',
+// so the connection string, which holds the broker credentials, is passed using this environment variable
+const handlerConnectionStringEnv = "AMQPEVENTPROVIDER_CONNECTIONSTRING"
+
+var _ messaging.MessageBus = &Bus{}
+var _ messaging.Publisher = &Publisher{}
+
+// Bus is a messaging.MessageBus for any AMQP 1.0 broker, such as ActiveMQ Artemis or Qpid.
+// It doesn't use a management plane so topics and subscriptions are never created explicitly,
+// instead the broker must either auto-create the addresses attached to or have them configured up front
+type Bus struct {
+	*Publisher
+	config        *types.AMQPConfig
+	maxConcurrent int
+}
+
+// NewBus connects to the broker in the configuration's connection string
+func NewBus(ctx context.Context, config *types.Configuration) (*Bus, error) {
+	if config.AMQP == nil || config.AMQP.ConnectionString == "" {
+		return nil, fmt.Errorf("amqp connection string is required")
+	}
+	publisher, err := NewPublisher(config.AMQP.ConnectionString, config.AMQP.TopicAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	maxConcurrent := 0
+	if config.Job != nil {
+		maxConcurrent = config.Job.MaxConcurrent
+		if config.Job.RetryInitialDelaySecs > 0 {
+			log.Warn("the amqp message bus doesn't support delayed retries, failed jobs will be retried straight away")
+		}
+	}
+	return &Bus{
+		Publisher:     publisher,
+		config:        config.AMQP,
+		maxConcurrent: maxConcurrent,
+	}, nil
+}
+
+// Subscribe starts receiving from the module's subscription to the event type
+func (b *Bus) Subscribe(ctx context.Context, eventType, moduleName string) (messaging.Subscription, error) {
+	if eventType == "" {
+		return nil, fmt.Errorf("empty event type not allowed")
+	}
+	if moduleName == "" {
+		return nil, fmt.Errorf("empty module name not allowed")
+	}
+
+	address := getSubscriptionAddress(b.config.SubscriptionAddress, eventType, getSubscriptionName(eventType, moduleName))
+	linkOptions := []amqp.LinkOption{
+		amqp.LinkSourceAddress(address),
+	}
+	// Limit the messages the broker will hand us to the number of jobs we can run at once
+	if b.maxConcurrent > 0 {
+		linkOptions = append(linkOptions, amqp.LinkCredit(uint32(b.maxConcurrent)))
+	}
+	receiver, err := b.session.NewReceiver(linkOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("error receiving from '%s': %+v", address, err)
+	}
+	log.WithField("address", address).Info("subscribed to amqp address")
+	return &subscription{receiver: receiver}, nil
+}
+
+// HandlerConfig gets the arguments and secrets the handler needs to publish events to the broker
+func (b *Bus) HandlerConfig() ([]string, map[string]string) {
+	args := []string{
+		"--amqpeventprovider.enabled=true",
+		"--amqpeventprovider.topicaddress=" + b.topicAddress,
+	}
+	secrets := map[string]string{
+		handlerConnectionStringEnv: b.config.ConnectionString,
+	}
+	return args, secrets
+}
+
+// Publisher sends events to an AMQP 1.0 broker
+type Publisher struct {
+	client       *amqp.Client
+	session      *amqp.Session
+	topicAddress string
+	senders      map[string]*amqp.Sender
+	mu           sync.Mutex
+}
+
+// NewPublisher connects to the broker. Events are sent to topicAddress with {topic}
+// replaced by the event type, if topicAddress is empty DefaultTopicAddress is used
+func NewPublisher(connectionString, topicAddress string) (*Publisher, error) {
+	if topicAddress == "" {
+		topicAddress = DefaultTopicAddress
+	}
+	client, err := amqp.Dial(connectionString)
+	if err != nil {
+		return nil, fmt.Errorf("error dialing amqp broker: %+v", err)
+	}
+	session, err := client.NewSession()
+	if err != nil {
+		_ = client.Close()
+		return nil, fmt.Errorf("error creating amqp session: %+v", err)
+	}
+	return &Publisher{
+		client:       client,
+		session:      session,
+		topicAddress: topicAddress,
+		senders:      map[string]*amqp.Sender{},
+	}, nil
+}
+
+// Publish sends the event to the address for its type
+func (p *Publisher) Publish(ctx context.Context, event common.Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("error marshalling event %+v", err)
+	}
+	sender, err := p.getSender(event.Type)
+	if err != nil {
+		return err
+	}
+	err = sender.Send(ctx, newEventMessage(event, body))
+	if err != nil {
+		return fmt.Errorf("error publishing event to topic '%s': %+v", event.Type, err)
+	}
+	return nil
+}
+
+// Close closes the senders and the connection to the broker
+func (p *Publisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+	for topic, sender := range p.senders {
+		err := sender.Close(ctx)
+		if err != nil {
+			log.WithError(err).WithField("topic", topic).Error("failed to close sender")
+		}
+		delete(p.senders, topic)
+	}
+	return p.client.Close()
+}
+
+// getSender gets the sender for the topic, creating it on first use
+func (p *Publisher) getSender(topic string) (*amqp.Sender, error) {
+	topic = strings.ToLower(topic)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if sender, ok := p.senders[topic]; ok {
+		return sender, nil
+	}
+	address := getTopicAddress(p.topicAddress, topic)
+	sender, err := p.session.NewSender(
+		amqp.LinkTargetAddress(address),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error creating sender for '%s': %+v", address, err)
+	}
+	p.senders[topic] = sender
+	return sender, nil
+}
+
+// subscription receives messages from a module's queue on the broker
+type subscription struct {
+	receiver *amqp.Receiver
+}
+
+// Receive waits for the next message. Rejected messages are redelivered straight away
+func (s *subscription) Receive(ctx context.Context) (messaging.Message, error) {
+	for {
+		message, err := s.receiver.Receive(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if message == nil {
+			return nil, fmt.Errorf("nil message received")
+		}
+
+		// Jobs are tracked by message ID so messages from publishers which don't set one can't be run
+		if message.Properties == nil || message.Properties.MessageID == nil {
+			log.Warn("message received without a message-id, dead lettering")
+			err = amqpmessage.NewWrapper(message).DeadLetter("message has no message-id")
+			if err != nil {
+				log.WithError(err).Error("failed to dead letter message")
+			}
+			continue
+		}
+
+		return amqpmessage.NewWrapper(message), nil
+	}
+}
+
+// RenewLocks does nothing, a generic AMQP broker keeps a message assigned to the receiver until it's
+// settled or the link is closed so there are no locks which can expire
+func (s *subscription) RenewLocks(ctx context.Context, messages []messaging.Message) error {
+	return nil
+}
+
+// GetQueueDepth isn't supported as reading queue statistics needs a broker-specific management API
+func (s *subscription) GetQueueDepth() (messaging.QueueDepth, error) {
+	return messaging.QueueDepth{}, messaging.ErrQueueDepthUnsupported
+}
+
+// ReleasePending hands back messages the broker sent us that were never received
+func (s *subscription) ReleasePending() {
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+		message, err := s.receiver.Receive(ctx)
+		cancel()
+		if err != nil || message == nil {
+			return
+		}
+		err = message.Release()
+		if err != nil {
+			log.WithError(err).Error("failed to release prefetched message")
+		}
+	}
+}
+
+// Close stops receiving from the subscription. Messages which haven't been settled will be redelivered
+func (s *subscription) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	return s.receiver.Close(ctx)
+}
+
+// newEventMessage creates the message for an event. The event ID is used as the message ID,
+// unlike Service Bus a generic broker won't assign one
+func newEventMessage(event common.Event, body []byte) *amqp.Message {
+	messageID := ""
+	if event.Context != nil {
+		messageID = event.Context.EventID
+	}
+	if messageID == "" {
+		messageID = uuid.Must(uuid.NewV4(), nil).String()
+	}
+	message := amqp.NewMessage(body)
+	message.Properties = &amqp.MessageProperties{
+		MessageID:   messageID,
+		ContentType: "application/json",
+	}
+	return message
+}
+
+func getTopicAddress(format, topic string) string {
+	return strings.Replace(format, topicPlaceholder, strings.ToLower(topic), -1)
+}
+
+func getSubscriptionAddress(format, topic, subscriptionName string) string {
+	if format == "" {
+		format = DefaultSubscriptionAddress
+	}
+	return strings.Replace(getTopicAddress(format, topic), subscriptionPlaceholder, subscriptionName, -1)
+}
+
+// getSubscriptionName matches the subscription names used by the servicebus bus
+func getSubscriptionName(eventName, moduleName string) string {
+	return strings.ToLower(eventName) + "_" + strings.ToLower(moduleName)
+}
@@ -0,0 +1,112 @@
+package amqpmessage
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/lawrencegripper/ion/internal/pkg/common"
+	"github.com/lawrencegripper/ion/internal/pkg/messaging"
+
+	log "github.com/sirupsen/logrus"
+	"pack.ag/amqp"
+)
+
+// deadLetterCondition is recorded by the broker as the reason a message was dead lettered
+const deadLetterCondition amqp.ErrorCondition = "ion:permanent-failure"
+
+// Message wraps an amqp message received from any AMQP 1.0 broker
+type Message struct {
+	// Todo: Should this be private?
+	OriginalMessage *amqp.Message
+	retrier         *Retrier
+}
+
+// NewWrapper wraps the message, rejecting it makes it available to be delivered again straight away
+func NewWrapper(m *amqp.Message) messaging.Message {
+	if m == nil {
+		log.Panic("Message cannot be nil")
+	}
+	return &Message{
+		OriginalMessage: m,
+	}
+}
+
+// NewWrapperWithRetrier wraps the message so that rejecting it schedules a delayed retry
+func NewWrapperWithRetrier(m *amqp.Message, retrier *Retrier) messaging.Message {
+	if m == nil {
+		log.Panic("Message cannot be nil")
+	}
+	return &Message{
+		OriginalMessage: m,
+		retrier:         retrier,
+	}
+}
+
+//GetAMQPMessage returns the wrapped message
+func (m *Message) GetAMQPMessage() *amqp.Message {
+	return m.OriginalMessage
+}
+
+// DeliveryCount get number of times the message has ben delivered, including any attempts
+// made before it was re-enqueued for a delayed retry
+func (m *Message) DeliveryCount() int {
+	deliveryCount := getRetryAttempts(m.OriginalMessage)
+	if m.OriginalMessage.Header != nil {
+		deliveryCount += int(m.OriginalMessage.Header.DeliveryCount)
+	}
+	return deliveryCount
+}
+
+// ID get the ID
+func (m *Message) ID() string {
+	// Todo: use reflection to identify type and do smarter stuff
+	return fmt.Sprintf("%v", m.OriginalMessage.Properties.MessageID)
+}
+
+// Body get the body
+func (m *Message) Body() []byte {
+	return m.OriginalMessage.GetData()
+}
+
+// Accept mark the message as processed successfully (don't re-queue)
+func (m *Message) Accept() error {
+	return m.OriginalMessage.Accept()
+}
+
+// Reject mark message to be requeued, after a delay if a retrier is configured
+func (m *Message) Reject() error {
+	if m.retrier != nil {
+		return m.retrier.retry(m)
+	}
+	return m.abandon()
+}
+
+// Release hands the message back without counting it as a failed delivery, used when shutting down
+func (m *Message) Release() error {
+	return m.OriginalMessage.Release()
+}
+
+// abandon makes the message available to be delivered again straight away
+func (m *Message) abandon() error {
+	return m.OriginalMessage.Modify(true, false, nil)
+}
+
+// DeadLetter mark the message as failed permanently so it isn't retried
+func (m *Message) DeadLetter(reason string) error {
+	return m.OriginalMessage.Reject(&amqp.Error{
+		Condition:   deadLetterCondition,
+		Description: reason,
+	})
+}
+
+// EventData deserialize json value to type
+func (m *Message) EventData() (common.Event, error) {
+	var event common.Event
+	data := m.OriginalMessage.GetData()
+	err := json.Unmarshal(data, &event)
+	if err != nil {
+		log.WithError(err).WithField("value", m.OriginalMessage.Data).Fatal("Unmarshal failed")
+		return event, err
+	}
+	return event, nil
+}
@@ -0,0 +1,92 @@
+package amqpmessage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/lawrencegripper/ion/internal/pkg/messaging"
+
+	log "github.com/sirupsen/logrus"
+	"pack.ag/amqp"
+)
+
+const (
+	// RetryAttemptsProperty records how many times a re-enqueued message has already been attempted
+	RetryAttemptsProperty = "ion_retry_attempts"
+	// RetrySubscriptionProperty records the subscription a re-enqueued message is for, so other
+	// subscribers to the topic can filter it out
+	RetrySubscriptionProperty = "ion_retry_subscription"
+
+	scheduledEnqueueTimeAnnotation = "x-opt-scheduled-enqueue-time"
+)
+
+// Sender sends messages to the topic a dispatcher receives from
+type Sender interface {
+	Send(ctx context.Context, msg *amqp.Message) error
+}
+
+// Retrier re-enqueues failed messages to be delivered after a delay, rather than making them
+// available again immediately
+type Retrier struct {
+	Sender           Sender
+	Policy           messaging.RetryPolicy
+	MaxRetries       int
+	SubscriptionName string
+}
+
+// retry schedules a copy of the message to be delivered again after the policy's delay then
+// accepts the original. Once the message has been retried MaxRetries times it is dead lettered
+func (r *Retrier) retry(m *Message) error {
+	retry := m.DeliveryCount() + 1
+	if retry > r.MaxRetries {
+		return m.DeadLetter(fmt.Sprintf("message failed after %d retries", r.MaxRetries))
+	}
+
+	delay := r.Policy.Delay(retry)
+	copy := newRetryMessage(m.OriginalMessage, retry, r.SubscriptionName, time.Now().Add(delay))
+	err := r.Sender.Send(context.Background(), copy)
+	if err != nil {
+		// Fall back to retrying straight away rather than losing the message
+		log.WithError(err).WithField("messageID", m.ID()).Error("failed to schedule retry, abandoning message instead")
+		return m.abandon()
+	}
+
+	log.WithField("messageID", m.ID()).WithField("retry", retry).WithField("delay", delay).Info("scheduled retry for message")
+	return m.Accept()
+}
+
+func newRetryMessage(original *amqp.Message, retry int, subscriptionName string, enqueueAt time.Time) *amqp.Message {
+	copy := &amqp.Message{
+		Data:                  original.Data,
+		Value:                 original.Value,
+		Properties:            original.Properties,
+		ApplicationProperties: map[string]interface{}{},
+		Annotations: amqp.Annotations{
+			scheduledEnqueueTimeAnnotation: enqueueAt.UTC(),
+		},
+	}
+	for key, value := range original.ApplicationProperties {
+		copy.ApplicationProperties[key] = value
+	}
+	copy.ApplicationProperties[RetryAttemptsProperty] = int64(retry)
+	copy.ApplicationProperties[RetrySubscriptionProperty] = subscriptionName
+	return copy
+}
+
+// getRetryAttempts gets how many times a message had been attempted before it was re-enqueued
+func getRetryAttempts(m *amqp.Message) int {
+	if m.ApplicationProperties == nil {
+		return 0
+	}
+	switch attempts := m.ApplicationProperties[RetryAttemptsProperty].(type) {
+	case int64:
+		return int(attempts)
+	case int32:
+		return int(attempts)
+	case int:
+		return attempts
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,51 @@
+package amqpmessage
+
+import (
+	"testing"
+	"time"
+
+	"pack.ag/amqp"
+)
+
+func TestNewRetryMessage(t *testing.T) {
+	enqueueAt := time.Date(2018, 1, 1, 12, 0, 0, 0, time.UTC)
+	original := &amqp.Message{
+		Data: [][]byte{[]byte("body")},
+		ApplicationProperties: map[string]interface{}{
+			"existing": "value",
+		},
+	}
+
+	retry := newRetryMessage(original, 2, "event_module", enqueueAt)
+
+	if string(retry.Data[0]) != "body" {
+		t.Errorf("expected body to be copied, got %s", retry.Data[0])
+	}
+	if retry.ApplicationProperties["existing"] != "value" {
+		t.Error("expected existing application properties to be copied")
+	}
+	if retry.ApplicationProperties[RetrySubscriptionProperty] != "event_module" {
+		t.Errorf("expected retry subscription to be set, got %v", retry.ApplicationProperties[RetrySubscriptionProperty])
+	}
+	if retry.Annotations[scheduledEnqueueTimeAnnotation] != enqueueAt {
+		t.Errorf("expected scheduled enqueue time %v got %v", enqueueAt, retry.Annotations[scheduledEnqueueTimeAnnotation])
+	}
+	if _, ok := original.ApplicationProperties[RetryAttemptsProperty]; ok {
+		t.Error("original message properties shouldn't be modified")
+	}
+	if attempts := getRetryAttempts(retry); attempts != 2 {
+		t.Errorf("expected 2 retry attempts got %d", attempts)
+	}
+}
+
+func TestDeliveryCountIncludesRetryAttempts(t *testing.T) {
+	m := NewWrapper(&amqp.Message{
+		Header: &amqp.MessageHeader{DeliveryCount: 1},
+		ApplicationProperties: map[string]interface{}{
+			RetryAttemptsProperty: int64(2),
+		},
+	})
+	if count := m.DeliveryCount(); count != 3 {
+		t.Errorf("expected delivery count of 3 got %d", count)
+	}
+}
@@ -52,6 +52,15 @@ const InsightDocType = "insight"
 //ModuleLogsDocType sets the document type in Context
 const ModuleLogsDocType = "modulelogs"
 
+//OutboxDocType sets the document type in Context
+const OutboxDocType = "outbox"
+
+//ProcessedEventDocType sets the document type in Context
+const ProcessedEventDocType = "processedevent"
+
+//JoinDocType sets the document type in Context
+const JoinDocType = "join"
+
 //Context carries the data for configuring the module
 type Context struct {
 	Name          string `description:"module name" bson:"name" json:"name"`
@@ -0,0 +1,10 @@
+package common
+
+//PermanentFailureExitCode is the exit code used by a module, or the handler on its behalf, to report
+//a failure which retrying won't fix such as an invalid input. The message is dead lettered rather than retried
+const PermanentFailureExitCode = 65
+
+//ModuleFailure is written to out/failure.json by a module to report a permanent failure
+type ModuleFailure struct {
+	Reason string `json:"reason"`
+}
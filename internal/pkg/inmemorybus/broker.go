@@ -0,0 +1,249 @@
+package inmemorybus
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultLockDuration matches the lock duration of Ion's servicebus subscriptions
+	DefaultLockDuration = time.Minute
+	// DefaultMaxDeliveryCount matches the max delivery count of a servicebus subscription
+	DefaultMaxDeliveryCount = 10
+
+	// maxDeliveryCountExceeded is the reason recorded for messages the broker dead letters
+	maxDeliveryCountExceeded = "MaxDeliveryCountExceeded"
+)
+
+// DeadLetter is a message which has been moved to a subscription's dead letter queue
+type DeadLetter struct {
+	ID            string
+	Body          []byte
+	DeliveryCount int
+	Reason        string
+}
+
+// Broker holds topics and subscriptions in memory so components running in the same process
+// can exchange events. Each Bus created from the broker shares its topics, like separate
+// connections to the same servicebus namespace
+type Broker struct {
+	// LockDuration is how long a received message is locked for before it's redelivered
+	LockDuration time.Duration
+	// MaxDeliveryCount is how many times a message is delivered before the broker dead letters it
+	MaxDeliveryCount int
+
+	mu     sync.Mutex
+	topics map[string]map[string]*queue
+}
+
+// NewBroker creates an empty broker using the default lock duration and max delivery count
+func NewBroker() *Broker {
+	return &Broker{
+		LockDuration:     DefaultLockDuration,
+		MaxDeliveryCount: DefaultMaxDeliveryCount,
+		topics:           map[string]map[string]*queue{},
+	}
+}
+
+// DeadLetters gets the messages dead lettered on the module's subscription to the event type
+func (b *Broker) DeadLetters(eventType, moduleName string) []DeadLetter {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q := b.topics[eventType][getSubscriptionName(eventType, moduleName)]
+	if q == nil {
+		return nil
+	}
+	return append([]DeadLetter{}, q.deadLetters...)
+}
+
+// ActiveMessageCount gets the number of messages, including locked messages, waiting on the
+// module's subscription to the event type
+func (b *Broker) ActiveMessageCount(eventType, moduleName string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q := b.topics[eventType][getSubscriptionName(eventType, moduleName)]
+	if q == nil {
+		return 0
+	}
+	return len(q.entries)
+}
+
+// subscribe creates the subscription on the topic if it doesn't exist yet
+func (b *Broker) subscribe(eventType, moduleName string) *queue {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	subscriptions, exists := b.topics[eventType]
+	if !exists {
+		subscriptions = map[string]*queue{}
+		b.topics[eventType] = subscriptions
+	}
+	name := getSubscriptionName(eventType, moduleName)
+	q, exists := subscriptions[name]
+	if !exists {
+		q = &queue{
+			name:   name,
+			notify: make(chan struct{}),
+		}
+		subscriptions[name] = q
+	}
+	return q
+}
+
+// publish adds a copy of the message to each subscription on the topic. Like servicebus,
+// messages published to a topic without subscriptions are dropped
+func (b *Broker) publish(topic, id string, body []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, q := range b.topics[topic] {
+		q.entries = append(q.entries, &entry{
+			id:   id,
+			body: body,
+		})
+		q.wake()
+	}
+}
+
+// receive locks the next available message on the queue, waiting until one is available. Returns
+// the message with the lock token and delivery count for this delivery
+func (b *Broker) receive(ctx context.Context, q *queue) (*entry, int, int, error) {
+	for {
+		b.mu.Lock()
+		e, wait := b.next(q, time.Now())
+		if e != nil {
+			token, deliveryCount := e.lockToken, e.deliveryCount
+			b.mu.Unlock()
+			return e, token, deliveryCount, nil
+		}
+		notify := q.notify
+		b.mu.Unlock()
+
+		var timer *time.Timer
+		var expired <-chan time.Time
+		if wait > 0 {
+			timer = time.NewTimer(wait)
+			expired = timer.C
+		}
+		select {
+		case <-ctx.Done():
+		case <-notify:
+		case <-expired:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			return nil, 0, 0, ctx.Err()
+		}
+	}
+}
+
+// next locks the first available message, dead lettering any which have been delivered too many times.
+// If none is available it gets how long until a locked or delayed message could become available, or 0 if
+// there aren't any
+func (b *Broker) next(q *queue, now time.Time) (*entry, time.Duration) {
+	var wait time.Duration
+	waitFor := func(t time.Time) {
+		if d := t.Sub(now); wait == 0 || d < wait {
+			wait = d
+		}
+	}
+	for i := 0; i < len(q.entries); i++ {
+		e := q.entries[i]
+		if e.locked {
+			if now.Before(e.lockedUntil) {
+				waitFor(e.lockedUntil)
+				continue
+			}
+			// The lock expired before the message was settled so it's delivered again
+			e.locked = false
+		}
+		if now.Before(e.availableAt) {
+			waitFor(e.availableAt)
+			continue
+		}
+		if e.deliveryCount >= b.MaxDeliveryCount {
+			q.remove(e)
+			q.deadLetter(e, maxDeliveryCountExceeded)
+			i--
+			continue
+		}
+		e.deliveryCount++
+		e.lockToken++
+		e.locked = true
+		e.lockedUntil = now.Add(b.LockDuration)
+		return e, 0
+	}
+	return nil, wait
+}
+
+// settle runs the settlement against the message if the receiver still holds its lock
+func (b *Broker) settle(q *queue, e *entry, token int, settlement func(now time.Time)) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	if !q.contains(e) || !e.locked || e.lockToken != token || !now.Before(e.lockedUntil) {
+		return fmt.Errorf("lock lost for message '%s' on subscription '%s'", e.id, q.name)
+	}
+	settlement(now)
+	return nil
+}
+
+// queue is a subscription's messages, in the order they were published
+type queue struct {
+	name        string
+	entries     []*entry
+	deadLetters []DeadLetter
+	// notify is closed, then replaced, when a message may have become available
+	notify chan struct{}
+}
+
+// entry is a message on a queue. Each delivery gets a new lock token so a receiver whose lock
+// expired can't settle the message once it's been delivered again
+type entry struct {
+	id            string
+	body          []byte
+	deliveryCount int
+	availableAt   time.Time
+	locked        bool
+	lockedUntil   time.Time
+	lockToken     int
+}
+
+func (q *queue) wake() {
+	close(q.notify)
+	q.notify = make(chan struct{})
+}
+
+func (q *queue) contains(e *entry) bool {
+	for _, existing := range q.entries {
+		if existing == e {
+			return true
+		}
+	}
+	return false
+}
+
+func (q *queue) remove(e *entry) {
+	for i, existing := range q.entries {
+		if existing == e {
+			q.entries = append(q.entries[:i], q.entries[i+1:]...)
+			return
+		}
+	}
+}
+
+func (q *queue) deadLetter(e *entry, reason string) {
+	q.deadLetters = append(q.deadLetters, DeadLetter{
+		ID:            e.id,
+		Body:          e.body,
+		DeliveryCount: e.deliveryCount,
+		Reason:        reason,
+	})
+}
+
+func getSubscriptionName(eventName, moduleName string) string {
+	return strings.ToLower(eventName) + "_" + strings.ToLower(moduleName)
+}
@@ -0,0 +1,189 @@
+package inmemorybus
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lawrencegripper/ion/internal/pkg/common"
+	"github.com/lawrencegripper/ion/internal/pkg/messaging"
+	"github.com/lawrencegripper/ion/internal/pkg/types"
+	"github.com/satori/go.uuid"
+)
+
+var _ messaging.MessageBus = &Bus{}
+var _ messaging.Publisher = &Publisher{}
+
+// Bus is the in-memory implementation of messaging.MessageBus, used to run Ion's components
+// together in a single process. Event types map to topics on the broker and modules to a
+// subscription on the topic named by getSubscriptionName
+type Bus struct {
+	*Publisher
+	retryPolicy messaging.RetryPolicy
+}
+
+// NewBus creates a bus using the broker. Rejected messages are retried using the retry policy
+// from the job configuration
+func NewBus(broker *Broker, config *types.Configuration) *Bus {
+	bus := &Bus{
+		Publisher: NewPublisher(broker),
+	}
+	if config != nil && config.Job != nil {
+		bus.retryPolicy = messaging.RetryPolicy{
+			InitialDelay: time.Duration(config.Job.RetryInitialDelaySecs) * time.Second,
+			Multiplier:   config.Job.RetryBackoffMultiplier,
+			MaxDelay:     time.Duration(config.Job.RetryMaxDelaySecs) * time.Second,
+		}
+	}
+	return bus
+}
+
+// Subscribe creates the module's subscription to the event type, if needed, and starts receiving from it.
+// Like a new servicebus subscription, a new subscription only receives events published after it was created
+func (b *Bus) Subscribe(ctx context.Context, eventType, moduleName string) (messaging.Subscription, error) {
+	if eventType == "" {
+		return nil, fmt.Errorf("empty event type not allowed")
+	}
+	if moduleName == "" {
+		return nil, fmt.Errorf("empty module name not allowed")
+	}
+	return &subscription{
+		broker:      b.broker,
+		queue:       b.broker.subscribe(eventType, moduleName),
+		retryPolicy: b.retryPolicy,
+		closed:      make(chan struct{}),
+	}, nil
+}
+
+// HandlerConfig returns nothing as a handler can only publish to the broker from the same process,
+// see the e2e package for running jobs in process
+func (b *Bus) HandlerConfig() ([]string, map[string]string) {
+	return nil, nil
+}
+
+// Publisher publishes events to the topics on a broker
+type Publisher struct {
+	broker *Broker
+}
+
+// NewPublisher creates a publisher for the broker
+func NewPublisher(broker *Broker) *Publisher {
+	return &Publisher{broker: broker}
+}
+
+// Publish adds the event to each subscription on the topic for its type. The event ID is used
+// as the message ID
+func (p *Publisher) Publish(ctx context.Context, event common.Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("error marshalling event %+v", err)
+	}
+	id := ""
+	if event.Context != nil {
+		id = event.Context.EventID
+	}
+	if id == "" {
+		id = uuid.Must(uuid.NewV4(), nil).String()
+	}
+	p.broker.publish(event.Type, id, body)
+	return nil
+}
+
+// Close does nothing, the broker is shared so it outlives its publishers
+func (p *Publisher) Close() error {
+	return nil
+}
+
+// subscription receives the messages on a queue of the broker
+type subscription struct {
+	broker      *Broker
+	queue       *queue
+	retryPolicy messaging.RetryPolicy
+	closeOnce   sync.Once
+	closed      chan struct{}
+}
+
+// Receive waits for the next available message and locks it
+func (s *subscription) Receive(ctx context.Context) (messaging.Message, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-s.closed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	e, token, deliveryCount, err := s.broker.receive(ctx, s.queue)
+	if err != nil {
+		select {
+		case <-s.closed:
+			return nil, fmt.Errorf("subscription '%s' is closed", s.queue.name)
+		default:
+			return nil, err
+		}
+	}
+	return &Message{
+		entry:         e,
+		lockToken:     token,
+		deliveryCount: deliveryCount,
+		subscription:  s,
+	}, nil
+}
+
+// RenewLocks extends the locks on the messages by the broker's lock duration. Fails if any lock has been lost
+func (s *subscription) RenewLocks(ctx context.Context, messages []messaging.Message) error {
+	var lost []string
+	for _, m := range messages {
+		message, ok := m.(*Message)
+		if !ok {
+			return fmt.Errorf("message '%s' wasn't received from the in-memory bus", m.ID())
+		}
+		err := s.broker.settle(s.queue, message.entry, message.lockToken, func(now time.Time) {
+			message.entry.lockedUntil = now.Add(s.broker.LockDuration)
+		})
+		if err != nil {
+			lost = append(lost, message.ID())
+		}
+	}
+	if len(lost) > 0 {
+		return fmt.Errorf("failed to renew locks for messages %v on subscription '%s'", lost, s.queue.name)
+	}
+	return nil
+}
+
+// GetQueueDepth gets the number of messages on the subscription and its dead letter queue
+func (s *subscription) GetQueueDepth() (messaging.QueueDepth, error) {
+	s.broker.mu.Lock()
+	defer s.broker.mu.Unlock()
+	return messaging.QueueDepth{
+		ActiveMessageCount:     int64(len(s.queue.entries)),
+		DeadLetterMessageCount: int64(len(s.queue.deadLetters)),
+	}, nil
+}
+
+// ReleasePending does nothing as messages are only locked when they're received
+func (s *subscription) ReleasePending() {}
+
+// Close stops any receive in progress. Messages which are locked stay locked until they're settled or their lock expires
+func (s *subscription) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+	})
+	return nil
+}
+
+// reject makes the message available again once the delay has passed
+func (s *subscription) reject(m *Message, delay time.Duration, countDelivery bool) error {
+	return s.broker.settle(s.queue, m.entry, m.lockToken, func(now time.Time) {
+		m.entry.locked = false
+		m.entry.availableAt = now.Add(delay)
+		if !countDelivery {
+			m.entry.deliveryCount--
+		}
+		s.queue.wake()
+	})
+}
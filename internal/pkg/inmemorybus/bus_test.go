@@ -0,0 +1,199 @@
+package inmemorybus
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/lawrencegripper/ion/internal/pkg/common"
+	"github.com/lawrencegripper/ion/internal/pkg/messaging"
+)
+
+func newEvent(eventID string) common.Event {
+	return common.Event{
+		Type:    "face_detected",
+		Context: &common.Context{EventID: eventID},
+	}
+}
+
+func subscribe(t *testing.T, bus *Bus, moduleName string) messaging.Subscription {
+	s, err := bus.Subscribe(context.Background(), "face_detected", moduleName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func receive(t *testing.T, s messaging.Subscription) messaging.Message {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	m, err := s.Receive(ctx)
+	if err != nil {
+		t.Fatalf("receive failed: %+v", err)
+	}
+	return m
+}
+
+func TestPublishFansOutToSubscriptions(t *testing.T) {
+	broker := NewBroker()
+	bus := NewBus(broker, nil)
+
+	// Nothing is subscribed yet so this event is dropped
+	if err := bus.Publish(context.Background(), newEvent("event0")); err != nil {
+		t.Fatal(err)
+	}
+	blur := subscribe(t, bus, "blur")
+	tag := subscribe(t, NewBus(broker, nil), "tag")
+	if err := bus.Publish(context.Background(), newEvent("event1")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []messaging.Subscription{blur, tag} {
+		m := receive(t, s)
+		if m.ID() != "event1" || m.DeliveryCount() != 1 {
+			t.Errorf("expected event1 delivered once got %s %d", m.ID(), m.DeliveryCount())
+		}
+		event, err := m.EventData()
+		if err != nil || event.Context.EventID != "event1" {
+			t.Errorf("expected event1 got %+v %+v", event, err)
+		}
+		if err := m.Accept(); err != nil {
+			t.Errorf("accept failed: %+v", err)
+		}
+	}
+	if count := broker.ActiveMessageCount("face_detected", "blur"); count != 0 {
+		t.Errorf("expected accepted message to be removed got %d", count)
+	}
+}
+
+func TestExpiredLockIsRedelivered(t *testing.T) {
+	broker := NewBroker()
+	broker.LockDuration = time.Millisecond * 50
+	bus := NewBus(broker, nil)
+	s := subscribe(t, bus, "blur")
+	if err := bus.Publish(context.Background(), newEvent("event1")); err != nil {
+		t.Fatal(err)
+	}
+
+	first := receive(t, s)
+	second := receive(t, s)
+	if second.ID() != "event1" || second.DeliveryCount() != 2 {
+		t.Errorf("expected event1 redelivered got %s %d", second.ID(), second.DeliveryCount())
+	}
+	if err := first.Accept(); err == nil {
+		t.Error("expected accept to fail once the message was redelivered")
+	}
+	if err := s.RenewLocks(context.Background(), []messaging.Message{first}); err == nil {
+		t.Error("expected renewing an expired lock to fail")
+	}
+	if err := s.RenewLocks(context.Background(), []messaging.Message{second}); err != nil {
+		t.Errorf("renew failed: %+v", err)
+	}
+}
+
+func TestRejectedMessageIsDeadLetteredAfterMaxDeliveryCount(t *testing.T) {
+	broker := NewBroker()
+	broker.MaxDeliveryCount = 2
+	bus := NewBus(broker, nil)
+	s := subscribe(t, bus, "blur")
+	if err := bus.Publish(context.Background(), newEvent("event1")); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= 2; i++ {
+		m := receive(t, s)
+		if m.DeliveryCount() != i {
+			t.Errorf("expected delivery count %d got %d", i, m.DeliveryCount())
+		}
+		if err := m.Reject(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	if m, err := s.Receive(ctx); err == nil {
+		t.Fatalf("expected no more deliveries got %s", m.ID())
+	}
+	deadLetters := broker.DeadLetters("face_detected", "blur")
+	if len(deadLetters) != 1 || deadLetters[0].Reason != maxDeliveryCountExceeded || deadLetters[0].DeliveryCount != 2 {
+		t.Errorf("expected message dead lettered after 2 deliveries got %+v", deadLetters)
+	}
+	depth, _ := s.GetQueueDepth()
+	if depth.ActiveMessageCount != 0 || depth.DeadLetterMessageCount != 1 {
+		t.Errorf("unexpected queue depth %+v", depth)
+	}
+}
+
+func TestRejectWaitsForRetryDelay(t *testing.T) {
+	bus := NewBus(NewBroker(), nil)
+	bus.retryPolicy = messaging.RetryPolicy{InitialDelay: time.Millisecond * 100}
+	s := subscribe(t, bus, "blur")
+	if err := bus.Publish(context.Background(), newEvent("event1")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := receive(t, s).Reject(); err != nil {
+		t.Fatal(err)
+	}
+	rejected := time.Now()
+	if m := receive(t, s); m.DeliveryCount() != 2 {
+		t.Errorf("expected second delivery got %d", m.DeliveryCount())
+	}
+	if waited := time.Since(rejected); waited < time.Millisecond*100 {
+		t.Errorf("expected redelivery after the retry delay, waited %v", waited)
+	}
+}
+
+func TestReleaseDoesNotCountDelivery(t *testing.T) {
+	bus := NewBus(NewBroker(), nil)
+	s := subscribe(t, bus, "blur")
+	if err := bus.Publish(context.Background(), newEvent("event1")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := receive(t, s).Release(); err != nil {
+		t.Fatal(err)
+	}
+	if m := receive(t, s); m.DeliveryCount() != 1 {
+		t.Errorf("expected released message to keep its delivery count got %d", m.DeliveryCount())
+	}
+}
+
+func TestDeadLetterRecordsReason(t *testing.T) {
+	broker := NewBroker()
+	bus := NewBus(broker, nil)
+	s := subscribe(t, bus, "blur")
+	if err := bus.Publish(context.Background(), newEvent("event1")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := receive(t, s).DeadLetter("module failed"); err != nil {
+		t.Fatal(err)
+	}
+	deadLetters := broker.DeadLetters("face_detected", "blur")
+	if len(deadLetters) != 1 || deadLetters[0].ID != "event1" || deadLetters[0].Reason != "module failed" {
+		t.Errorf("expected event1 dead lettered with reason got %+v", deadLetters)
+	}
+}
+
+func TestCloseStopsReceive(t *testing.T) {
+	s := subscribe(t, NewBus(NewBroker(), nil), "blur")
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.Receive(context.Background())
+		done <- err
+	}()
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("expected receive on a closed subscription to fail")
+		}
+	case <-time.After(time.Second * 5):
+		t.Error("receive didn't return after the subscription was closed")
+	}
+}
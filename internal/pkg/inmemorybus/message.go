@@ -0,0 +1,70 @@
+package inmemorybus
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/lawrencegripper/ion/internal/pkg/common"
+	"github.com/lawrencegripper/ion/internal/pkg/messaging"
+)
+
+var _ messaging.Message = &Message{}
+
+// Message is a delivery of a message from an in-memory subscription
+type Message struct {
+	entry         *entry
+	lockToken     int
+	deliveryCount int
+	subscription  *subscription
+}
+
+// ID gets the ID of the event in the message
+func (m *Message) ID() string {
+	return m.entry.id
+}
+
+// DeliveryCount gets the number of times the message has been delivered, including this delivery
+func (m *Message) DeliveryCount() int {
+	return m.deliveryCount
+}
+
+// Body gets the body
+func (m *Message) Body() []byte {
+	return m.entry.body
+}
+
+// Accept removes the message from the subscription
+func (m *Message) Accept() error {
+	return m.subscription.broker.settle(m.subscription.queue, m.entry, m.lockToken, func(now time.Time) {
+		m.subscription.queue.remove(m.entry)
+	})
+}
+
+// Reject makes the message available again after the delay from the retry policy
+func (m *Message) Reject() error {
+	return m.subscription.reject(m, m.subscription.retryPolicy.Delay(m.DeliveryCount()), true)
+}
+
+// Release makes the message available again straight away without counting this delivery
+func (m *Message) Release() error {
+	return m.subscription.reject(m, 0, false)
+}
+
+// DeadLetter moves the message to the subscription's dead letter queue so it isn't retried
+func (m *Message) DeadLetter(reason string) error {
+	return m.subscription.broker.settle(m.subscription.queue, m.entry, m.lockToken, func(now time.Time) {
+		m.subscription.queue.remove(m.entry)
+		m.subscription.queue.deadLetter(m.entry, reason)
+	})
+}
+
+// EventData deserialize json value to type
+func (m *Message) EventData() (common.Event, error) {
+	var event common.Event
+	err := json.Unmarshal(m.entry.body, &event)
+	if err != nil {
+		return event, fmt.Errorf("error unmarshalling event: %+v", err)
+	}
+	return event, nil
+}
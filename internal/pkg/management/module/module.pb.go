@@ -34,6 +34,15 @@ type ModuleCreateRequest struct {
 	Provider             string            `protobuf:"bytes,8,opt,name=provider,proto3" json:"provider,omitempty"`
 	Maxexecutiontimemins int32             `protobuf:"varint,9,opt,name=maxexecutiontimemins,proto3" json:"maxexecutiontimemins,omitempty"`
 	Configmap            map[string]string `protobuf:"bytes,10,rep,name=configmap,proto3" json:"configmap,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	Cpurequest           string            `protobuf:"bytes,11,opt,name=cpurequest,proto3" json:"cpurequest,omitempty"`
+	Cpulimit             string            `protobuf:"bytes,12,opt,name=cpulimit,proto3" json:"cpulimit,omitempty"`
+	Memoryrequest        string            `protobuf:"bytes,13,opt,name=memoryrequest,proto3" json:"memoryrequest,omitempty"`
+	Memorylimit          string            `protobuf:"bytes,14,opt,name=memorylimit,proto3" json:"memorylimit,omitempty"`
+	Gpucount             int32             `protobuf:"varint,15,opt,name=gpucount,proto3" json:"gpucount,omitempty"`
+	Nodeselector         []string          `protobuf:"bytes,16,rep,name=nodeselector,proto3" json:"nodeselector,omitempty"`
+	Tolerations          []string          `protobuf:"bytes,17,rep,name=tolerations,proto3" json:"tolerations,omitempty"`
+	Affinity             string            `protobuf:"bytes,18,opt,name=affinity,proto3" json:"affinity,omitempty"`
+	Serviceaccountname   string            `protobuf:"bytes,19,opt,name=serviceaccountname,proto3" json:"serviceaccountname,omitempty"`
 	XXX_NoUnkeyedLiteral struct{}          `json:"-"`
 	XXX_unrecognized     []byte            `json:"-"`
 	XXX_sizecache        int32             `json:"-"`
@@ -133,6 +142,69 @@ func (m *ModuleCreateRequest) GetConfigmap() map[string]string {
 	return nil
 }
 
+func (m *ModuleCreateRequest) GetCpurequest() string {
+	if m != nil {
+		return m.Cpurequest
+	}
+	return ""
+}
+
+func (m *ModuleCreateRequest) GetCpulimit() string {
+	if m != nil {
+		return m.Cpulimit
+	}
+	return ""
+}
+
+func (m *ModuleCreateRequest) GetMemoryrequest() string {
+	if m != nil {
+		return m.Memoryrequest
+	}
+	return ""
+}
+
+func (m *ModuleCreateRequest) GetMemorylimit() string {
+	if m != nil {
+		return m.Memorylimit
+	}
+	return ""
+}
+
+func (m *ModuleCreateRequest) GetGpucount() int32 {
+	if m != nil {
+		return m.Gpucount
+	}
+	return 0
+}
+
+func (m *ModuleCreateRequest) GetNodeselector() []string {
+	if m != nil {
+		return m.Nodeselector
+	}
+	return nil
+}
+
+func (m *ModuleCreateRequest) GetTolerations() []string {
+	if m != nil {
+		return m.Tolerations
+	}
+	return nil
+}
+
+func (m *ModuleCreateRequest) GetAffinity() string {
+	if m != nil {
+		return m.Affinity
+	}
+	return ""
+}
+
+func (m *ModuleCreateRequest) GetServiceaccountname() string {
+	if m != nil {
+		return m.Serviceaccountname
+	}
+	return ""
+}
+
 type ModuleCreateResponse struct {
 	Name                 string   `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
@@ -625,36 +697,43 @@ var _ModuleService_serviceDesc = grpc.ServiceDesc{
 func init() { proto.RegisterFile("module.proto", fileDescriptor_module_f7f16b7da2f34f61) }
 
 var fileDescriptor_module_f7f16b7da2f34f61 = []byte{
-	// 494 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x7c, 0x54, 0xc1, 0x6e, 0xd3, 0x40,
-	0x10, 0x8d, 0xeb, 0x24, 0x4d, 0xa6, 0x2d, 0x6a, 0x26, 0x01, 0x59, 0x3e, 0x20, 0x6b, 0x41, 0x28,
-	0x54, 0xc8, 0x12, 0xe1, 0x00, 0x42, 0x5c, 0xa0, 0x54, 0xbd, 0xd0, 0x4b, 0xb8, 0x71, 0xdb, 0x38,
-	0x43, 0x59, 0x61, 0xaf, 0xcd, 0xee, 0x3a, 0x6a, 0xfe, 0x97, 0x0f, 0xe0, 0x13, 0x90, 0x77, 0xe3,
-	0xd4, 0x26, 0xa6, 0xb7, 0x9d, 0x37, 0x6f, 0x66, 0x76, 0xdf, 0x1b, 0x1b, 0x4e, 0xb3, 0x7c, 0x5d,
-	0xa6, 0x14, 0x17, 0x2a, 0x37, 0x39, 0xfb, 0xe3, 0xc3, 0xf4, 0xc6, 0x02, 0x97, 0x8a, 0xb8, 0xa1,
-	0x25, 0xfd, 0x2a, 0x49, 0x1b, 0x7c, 0x0a, 0xe0, 0x78, 0x92, 0x67, 0x14, 0x78, 0x91, 0x37, 0x1f,
-	0x2f, 0x1b, 0x08, 0xc6, 0x80, 0xb4, 0x21, 0x69, 0x74, 0xb9, 0xd2, 0x89, 0x12, 0x85, 0x11, 0xb9,
-	0xd4, 0xc1, 0x91, 0xe5, 0x75, 0x64, 0xf0, 0x15, 0x4c, 0x2c, 0x5a, 0x94, 0xab, 0x54, 0x24, 0xdc,
-	0xd1, 0x7d, 0x4b, 0x3f, 0x4c, 0x60, 0x04, 0x27, 0x6e, 0x96, 0xc8, 0xf8, 0x2d, 0x05, 0x7d, 0xcb,
-	0x6b, 0x42, 0xc8, 0xe0, 0xf4, 0x07, 0x97, 0xeb, 0x94, 0x94, 0xa3, 0x0c, 0x2c, 0xa5, 0x85, 0xe1,
-	0x73, 0x38, 0x13, 0x52, 0x1b, 0x2e, 0x13, 0x4a, 0xf2, 0x52, 0x9a, 0x60, 0x18, 0x79, 0xf3, 0xc1,
-	0xb2, 0x0d, 0x56, 0x2f, 0x55, 0x64, 0xd4, 0xd6, 0x51, 0x8e, 0x2d, 0xa5, 0x81, 0x60, 0x08, 0xa3,
-	0x42, 0xe5, 0x1b, 0xb1, 0x26, 0x15, 0x8c, 0xec, 0x94, 0x7d, 0x8c, 0x0b, 0x98, 0x65, 0xfc, 0x8e,
-	0xee, 0x28, 0x29, 0xab, 0x8b, 0x1b, 0x91, 0x51, 0x26, 0xa4, 0x0e, 0xc6, 0xb6, 0x4b, 0x67, 0x0e,
-	0x3f, 0xc2, 0x38, 0xc9, 0xe5, 0x77, 0x71, 0x9b, 0xf1, 0x22, 0x80, 0xc8, 0x9f, 0x9f, 0x2c, 0x9e,
-	0xc5, 0x1d, 0x16, 0xc4, 0x97, 0x35, 0xeb, 0x4a, 0x1a, 0xb5, 0x5d, 0xde, 0x57, 0x85, 0x1f, 0xe0,
-	0x51, 0x3b, 0x89, 0xe7, 0xe0, 0xff, 0xa4, 0xed, 0xce, 0xa7, 0xea, 0x88, 0x33, 0x18, 0x6c, 0x78,
-	0x5a, 0xd2, 0xce, 0x13, 0x17, 0xbc, 0x3f, 0x7a, 0xe7, 0xb1, 0x0b, 0x98, 0xb5, 0xc7, 0xe9, 0x22,
-	0x97, 0x9a, 0x10, 0xa1, 0xdf, 0x30, 0xdb, 0x9e, 0xd9, 0xcb, 0x7a, 0x3b, 0x3e, 0x53, 0x4a, 0xf7,
-	0xdb, 0xd1, 0x45, 0xdd, 0xb7, 0xad, 0xa9, 0x0f, 0xb4, 0x7d, 0x01, 0xe7, 0x8e, 0x7b, 0x4d, 0xe6,
-	0xa1, 0x9e, 0x04, 0x93, 0x06, 0xef, 0xff, 0x0d, 0xf1, 0x09, 0x0c, 0xb5, 0xe1, 0xa6, 0xac, 0x57,
-	0x70, 0x17, 0x55, 0x2b, 0xe0, 0x4e, 0x37, 0xa4, 0x75, 0xb5, 0x27, 0x6e, 0xe5, 0xda, 0x20, 0x9b,
-	0xd6, 0x63, 0xbe, 0x08, 0x5d, 0xdf, 0x87, 0x5d, 0x00, 0x36, 0xc1, 0xdd, 0xf0, 0x19, 0x0c, 0xaa,
-	0x81, 0x3a, 0xf0, 0x22, 0xbf, 0x92, 0xd5, 0x06, 0xec, 0x18, 0x06, 0x57, 0x59, 0x61, 0xb6, 0x8b,
-	0xdf, 0x1e, 0x9c, 0xb9, 0xaa, 0xaf, 0xa4, 0x36, 0x22, 0x21, 0x7c, 0x0b, 0x43, 0xa7, 0x33, 0xce,
-	0xba, 0x5c, 0x0e, 0x1f, 0xc7, 0x5d, 0x66, 0xb0, 0x5e, 0x55, 0xe8, 0x94, 0xdc, 0x17, 0xb6, 0x3c,
-	0xd8, 0x17, 0xb6, 0xe5, 0x66, 0x3d, 0x8c, 0xc1, 0xbf, 0x26, 0x83, 0x93, 0xf8, 0x5f, 0x89, 0x43,
-	0x8c, 0x0f, 0xd4, 0x64, 0x3d, 0x7c, 0x0d, 0xfd, 0xea, 0x89, 0x58, 0x67, 0x1b, 0x22, 0x84, 0xd3,
-	0xf8, 0x50, 0x03, 0xd6, 0xfb, 0x34, 0xfa, 0x36, 0x74, 0x1f, 0xe3, 0x6a, 0x68, 0x7f, 0x23, 0x6f,
-	0xfe, 0x06, 0x00, 0x00, 0xff, 0xff, 0x0f, 0x4c, 0x40, 0xd0, 0x56, 0x04, 0x00, 0x00,
+	// 606 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x7c, 0x54, 0x4d, 0x6f, 0xd3, 0x4c,
+	0x10, 0xae, 0x9b, 0xc6, 0x6d, 0xa7, 0x1f, 0x6f, 0xb3, 0x49, 0x5f, 0xad, 0x7c, 0x40, 0x91, 0x41,
+	0xa8, 0x54, 0xc8, 0x12, 0xe5, 0x00, 0x42, 0x5c, 0xa0, 0x54, 0xbd, 0xd0, 0x4b, 0xb8, 0x71, 0xdb,
+	0x3a, 0x93, 0xb0, 0xc2, 0xde, 0x35, 0xbb, 0xeb, 0xa8, 0xfe, 0x3b, 0xfc, 0x36, 0x7e, 0x08, 0xda,
+	0x5d, 0x3b, 0xb1, 0x1b, 0xd3, 0x9b, 0xe7, 0x99, 0x67, 0x3e, 0x76, 0x9e, 0x19, 0xc3, 0x71, 0x2e,
+	0xe7, 0x65, 0x86, 0x49, 0xa1, 0xa4, 0x91, 0xf1, 0xef, 0x10, 0xc6, 0x77, 0x0e, 0xb8, 0x56, 0xc8,
+	0x0c, 0xce, 0xf0, 0x57, 0x89, 0xda, 0x90, 0x67, 0x00, 0x9e, 0x27, 0x58, 0x8e, 0x34, 0x98, 0x06,
+	0x17, 0x87, 0xb3, 0x16, 0x42, 0x12, 0x20, 0xb8, 0x42, 0x61, 0x74, 0x79, 0xaf, 0x53, 0xc5, 0x0b,
+	0xc3, 0xa5, 0xd0, 0x74, 0xd7, 0xf1, 0x7a, 0x3c, 0xe4, 0x35, 0x8c, 0x1c, 0x5a, 0x94, 0xf7, 0x19,
+	0x4f, 0x99, 0xa7, 0x0f, 0x1c, 0x7d, 0xdb, 0x41, 0xa6, 0x70, 0xe4, 0x6b, 0xf1, 0x9c, 0x2d, 0x91,
+	0xee, 0x39, 0x5e, 0x1b, 0x22, 0x31, 0x1c, 0xff, 0x60, 0x62, 0x9e, 0xa1, 0xf2, 0x94, 0xa1, 0xa3,
+	0x74, 0x30, 0xf2, 0x02, 0x4e, 0xb8, 0xd0, 0x86, 0x89, 0x14, 0x53, 0x59, 0x0a, 0x43, 0xc3, 0x69,
+	0x70, 0x31, 0x9c, 0x75, 0x41, 0xfb, 0x52, 0x85, 0x46, 0x55, 0x9e, 0xb2, 0xef, 0x28, 0x2d, 0x84,
+	0x44, 0x70, 0x50, 0x28, 0xb9, 0xe2, 0x73, 0x54, 0xf4, 0xc0, 0x55, 0x59, 0xdb, 0xe4, 0x0a, 0x26,
+	0x39, 0x7b, 0xc0, 0x07, 0x4c, 0x4b, 0xdb, 0xb8, 0xe1, 0x39, 0xe6, 0x5c, 0x68, 0x7a, 0xe8, 0xb2,
+	0xf4, 0xfa, 0xc8, 0x27, 0x38, 0x4c, 0xa5, 0x58, 0xf0, 0x65, 0xce, 0x0a, 0x0a, 0xd3, 0xc1, 0xc5,
+	0xd1, 0xd5, 0xf3, 0xa4, 0x47, 0x82, 0xe4, 0xba, 0x61, 0xdd, 0x08, 0xa3, 0xaa, 0xd9, 0x26, 0xca,
+	0xb6, 0x9c, 0x16, 0xa5, 0xf2, 0x3c, 0x7a, 0xe4, 0xc5, 0xd9, 0x20, 0xb6, 0xe5, 0xb4, 0x28, 0x33,
+	0x9e, 0x73, 0x43, 0x8f, 0x7d, 0xcb, 0x8d, 0x6d, 0x87, 0x92, 0x63, 0x2e, 0x55, 0xd5, 0x84, 0x9f,
+	0x38, 0x42, 0x17, 0x74, 0x02, 0x38, 0xc0, 0x27, 0x39, 0xad, 0x05, 0xd8, 0x40, 0xb6, 0xc6, 0xb2,
+	0x28, 0xfd, 0xd0, 0xfe, 0x73, 0xcf, 0x5d, 0xdb, 0x56, 0x1c, 0x21, 0xe7, 0xa8, 0x31, 0xc3, 0xd4,
+	0x48, 0x45, 0xcf, 0xa6, 0x03, 0x2b, 0x4e, 0x1b, 0xb3, 0x15, 0x8c, 0xcc, 0x50, 0xd5, 0xab, 0x30,
+	0x72, 0x94, 0x36, 0x64, 0x2b, 0xb0, 0xc5, 0x82, 0x0b, 0x6e, 0x2a, 0x4a, 0xfc, 0x2b, 0x1a, 0xdb,
+	0xae, 0x9f, 0x46, 0xb5, 0xe2, 0x29, 0xb2, 0xd4, 0xd5, 0x74, 0x6b, 0x3a, 0xf6, 0xeb, 0xb7, 0xed,
+	0x89, 0x3e, 0xc2, 0x69, 0x77, 0x9c, 0xe4, 0x0c, 0x06, 0x3f, 0xb1, 0xaa, 0x37, 0xdb, 0x7e, 0x92,
+	0x09, 0x0c, 0x57, 0x2c, 0x2b, 0xb1, 0xde, 0x62, 0x6f, 0x7c, 0xd8, 0x7d, 0x1f, 0xc4, 0x97, 0x30,
+	0xe9, 0x0a, 0xa4, 0x0b, 0x29, 0x34, 0x12, 0x02, 0x7b, 0xad, 0xf3, 0x70, 0xdf, 0xf1, 0xab, 0xe6,
+	0x9e, 0xbe, 0x60, 0x86, 0x9b, 0x7b, 0xea, 0xa3, 0xae, 0xd3, 0x36, 0xd4, 0x27, 0xd2, 0xbe, 0x84,
+	0x33, 0xcf, 0xbd, 0x45, 0xf3, 0x54, 0x4e, 0x84, 0x51, 0x8b, 0xf7, 0xef, 0x84, 0xe4, 0x7f, 0x08,
+	0xb5, 0x61, 0xa6, 0x6c, 0x8e, 0xb6, 0xb6, 0xec, 0x7e, 0xf8, 0xaf, 0x3b, 0xd4, 0xda, 0x5e, 0x96,
+	0x3f, 0xd2, 0x2e, 0x18, 0x8f, 0x9b, 0x32, 0x5f, 0xb9, 0x6e, 0xfa, 0x89, 0x2f, 0x81, 0xb4, 0xc1,
+	0xba, 0xf8, 0x04, 0x86, 0xb6, 0xa0, 0xa6, 0x81, 0x93, 0xd8, 0x1b, 0xf1, 0x3e, 0x0c, 0x6f, 0xf2,
+	0xc2, 0x54, 0x57, 0x7f, 0x02, 0x38, 0xf1, 0x51, 0xdf, 0xbc, 0x6c, 0xe4, 0x1d, 0x84, 0x7e, 0xce,
+	0x64, 0xd2, 0x77, 0x17, 0xd1, 0x79, 0xd2, 0x27, 0x46, 0xbc, 0x63, 0x03, 0xfd, 0x24, 0xd7, 0x81,
+	0x1d, 0x0d, 0xa2, 0xf3, 0x47, 0xe8, 0x3a, 0x30, 0x81, 0xc1, 0x2d, 0x1a, 0x32, 0x4a, 0x1e, 0x8f,
+	0x38, 0x22, 0xc9, 0xd6, 0x34, 0xe3, 0x1d, 0xf2, 0x06, 0xf6, 0xec, 0x13, 0x49, 0xe3, 0x6d, 0x0d,
+	0x21, 0x1a, 0x27, 0xdb, 0x33, 0x88, 0x77, 0x3e, 0x1f, 0x7c, 0x0f, 0xfd, 0xef, 0xeb, 0x3e, 0x74,
+	0x3f, 0xde, 0xb7, 0x7f, 0x07, 0x00, 0x45, 0xdb, 0xd6, 0x30, 0x88, 0x05, 0x00, 0x00,
 }
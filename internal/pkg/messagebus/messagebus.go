@@ -0,0 +1,43 @@
+package messagebus
+
+import (
+	"context"
+
+	"github.com/lawrencegripper/ion/internal/pkg/amqpbus"
+	"github.com/lawrencegripper/ion/internal/pkg/messaging"
+	"github.com/lawrencegripper/ion/internal/pkg/natsbus"
+	"github.com/lawrencegripper/ion/internal/pkg/redisbus"
+	"github.com/lawrencegripper/ion/internal/pkg/servicebus"
+	"github.com/lawrencegripper/ion/internal/pkg/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// New connects to the message bus enabled in the configuration, defaulting to Azure Service Bus
+func New(ctx context.Context, cfg *types.Configuration) (messaging.MessageBus, error) {
+	if cfg.AMQP != nil && cfg.AMQP.Enabled {
+		log.Info("Using AMQP message bus...")
+		bus, err := amqpbus.NewBus(ctx, cfg)
+		if err != nil {
+			return nil, err
+		}
+		return bus, nil
+	}
+	if cfg.NATS != nil && cfg.NATS.Enabled {
+		log.Info("Using NATS JetStream message bus...")
+		bus, err := natsbus.NewBus(ctx, cfg)
+		if err != nil {
+			return nil, err
+		}
+		return bus, nil
+	}
+	if cfg.Redis != nil && cfg.Redis.Enabled {
+		log.Info("Using Redis Streams message bus...")
+		bus, err := redisbus.NewBus(ctx, cfg)
+		if err != nil {
+			return nil, err
+		}
+		return bus, nil
+	}
+	log.Info("Using Azure Service Bus message bus...")
+	return servicebus.NewBus(ctx, cfg), nil
+}
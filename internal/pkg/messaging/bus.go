@@ -0,0 +1,51 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+
+	"github.com/lawrencegripper/ion/internal/pkg/common"
+)
+
+// QueueDepth is the number of messages held on a subscription
+type QueueDepth struct {
+	// ActiveMessageCount - Number of messages waiting to be received
+	ActiveMessageCount int64
+	// DeadLetterMessageCount - Number of messages that are dead lettered
+	DeadLetterMessageCount int64
+}
+
+// ErrQueueDepthUnsupported is returned by subscriptions on brokers which can't report their queue depth
+var ErrQueueDepthUnsupported = errors.New("queue depth isn't supported by this message bus")
+
+// Publisher publishes events onto the topic for their type
+type Publisher interface {
+	Publish(ctx context.Context, event common.Event) error
+	Close() error
+}
+
+// BatchPublisher is implemented by publishers which can send several events in one request
+type BatchPublisher interface {
+	PublishBatch(ctx context.Context, events []common.Event) error
+}
+
+// Subscription receives the messages for a module's subscription to an event type
+type Subscription interface {
+	Receive(ctx context.Context) (Message, error)
+	// RenewLocks extends the locks held on received messages so they aren't redelivered while being processed
+	RenewLocks(ctx context.Context, messages []Message) error
+	GetQueueDepth() (QueueDepth, error)
+	// ReleasePending hands back any messages which were prefetched but haven't been received
+	ReleasePending()
+	Close() error
+}
+
+// MessageBus is a broker which Ion's components exchange events through. Each backend maps
+// event types to its own topics and each module to its own subscription
+type MessageBus interface {
+	Publisher
+	// Subscribe creates the module's subscription to the event type, if needed, and starts receiving from it
+	Subscribe(ctx context.Context, eventType, moduleName string) (Subscription, error)
+	// HandlerConfig gets the arguments, and secrets keyed by environment variable, the handler needs to publish events on this bus
+	HandlerConfig() ([]string, map[string]string)
+}
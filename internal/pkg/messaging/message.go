@@ -1,15 +1,13 @@
 package messaging
 
 import (
-	"encoding/json"
-	"fmt"
-
 	"github.com/lawrencegripper/ion/internal/pkg/common"
-
-	log "github.com/sirupsen/logrus"
-	"pack.ag/amqp"
 )
 
+// MaxDeliveryCountExceededReason is the dead letter reason for messages delivered more times than
+// allowed, it matches the reason servicebus records
+const MaxDeliveryCountExceededReason = "MaxDeliveryCountExceeded"
+
 // Message interface for any message protocol to use
 type Message interface {
 	ID() string
@@ -17,65 +15,7 @@ type Message interface {
 	Body() []byte
 	Accept() error
 	Reject() error
+	Release() error
+	DeadLetter(reason string) error
 	EventData() (common.Event, error)
-	GetAMQPMessage() *amqp.Message
-}
-
-// AmqpMessage Wrapper for amqp
-type AmqpMessage struct {
-	// Todo: Should this be private?
-	OriginalMessage *amqp.Message
-}
-
-// NewAmqpMessageWrapper get number of times the message has ben delivered
-func NewAmqpMessageWrapper(m *amqp.Message) Message {
-	if m == nil {
-		log.Panic("Message cannot be nil")
-	}
-	return &AmqpMessage{
-		OriginalMessage: m,
-	}
-}
-
-//GetAMQPMessage returns the wrapped message
-func (m *AmqpMessage) GetAMQPMessage() *amqp.Message {
-	return m.OriginalMessage
-}
-
-// DeliveryCount get number of times the message has ben delivered
-func (m *AmqpMessage) DeliveryCount() int {
-	return int(m.OriginalMessage.Header.DeliveryCount)
-}
-
-// ID get the ID
-func (m *AmqpMessage) ID() string {
-	// Todo: use reflection to identify type and do smarter stuff
-	return fmt.Sprintf("%v", m.OriginalMessage.Properties.MessageID)
-}
-
-// Body get the body
-func (m *AmqpMessage) Body() []byte {
-	return m.OriginalMessage.GetData()
-}
-
-// Accept mark the message as processed successfully (don't re-queue)
-func (m *AmqpMessage) Accept() error {
-	return m.OriginalMessage.Accept()
-}
-
-// Reject mark message to be requeued
-func (m *AmqpMessage) Reject() error {
-	return m.OriginalMessage.Modify(true, false, nil)
-}
-
-// EventData deserialize json value to type
-func (m *AmqpMessage) EventData() (common.Event, error) {
-	var event common.Event
-	data := m.OriginalMessage.GetData()
-	err := json.Unmarshal(data, &event)
-	if err != nil {
-		log.WithError(err).WithField("value", m.OriginalMessage.Data).Fatal("Unmarshal failed")
-		return event, err
-	}
-	return event, nil
 }
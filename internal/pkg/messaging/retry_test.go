@@ -0,0 +1,38 @@
+package messaging
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := RetryPolicy{
+		InitialDelay: 10 * time.Second,
+		Multiplier:   2,
+		MaxDelay:     time.Minute,
+	}
+
+	testCases := []struct {
+		retry    int
+		expected time.Duration
+	}{
+		{1, 10 * time.Second},
+		{2, 20 * time.Second},
+		{3, 40 * time.Second},
+		{4, time.Minute},
+		{10, time.Minute},
+	}
+	for _, test := range testCases {
+		actual := policy.Delay(test.retry)
+		if actual != test.expected {
+			t.Errorf("retry %d: expected delay %v got %v", test.retry, test.expected, actual)
+		}
+	}
+}
+
+func TestRetryPolicyDelayWithoutMultiplier(t *testing.T) {
+	policy := RetryPolicy{InitialDelay: 10 * time.Second}
+	if actual := policy.Delay(5); actual != 10*time.Second {
+		t.Errorf("expected constant delay of 10s got %v", actual)
+	}
+}
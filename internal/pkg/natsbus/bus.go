@@ -0,0 +1,433 @@
+package natsbus
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lawrencegripper/ion/internal/pkg/common"
+	"github.com/lawrencegripper/ion/internal/pkg/messaging"
+	"github.com/lawrencegripper/ion/internal/pkg/types"
+	"github.com/nats-io/nats.go"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	eventSubjectPrefix      = "ion.events."
+	deadLetterSubjectPrefix = "ion.deadletter."
+	// The server publishes an advisory here, followed by the stream and consumer, when it stops
+	// delivering a message because it reached the consumer's max deliveries
+	maxDeliveriesAdvisoryPrefix = "$JS.EVENT.ADVISORY.CONSUMER.MAX_DELIVERIES."
+
+	// The handler reads its flags from the environment, with '.' replaced by '_',
+	// so the url, which can hold the server credentials, is passed using this environment variable
+	handlerURLEnv = "NATSEVENTPROVIDER_URL"
+)
+
+var (
+	// ackWait is how long a message is held for a consumer before being redelivered, the
+	// dispatcher renews its messages well within this
+	ackWait = time.Minute
+	// pullExpiry is how long a single pull request waits for a message to arrive
+	pullExpiry = time.Second * 30
+	// requestTimeout is how long JetStream API calls are given to complete
+	requestTimeout = time.Second * 10
+	dialTimeout    = time.Second * 10
+)
+
+var _ messaging.MessageBus = &Bus{}
+var _ messaging.Publisher = &Publisher{}
+
+// Bus is the NATS JetStream implementation of messaging.MessageBus. Event types map to a stream
+// each and modules to a durable pull consumer on the stream named by getSubscriptionName
+type Bus struct {
+	*Publisher
+	url         string
+	retryPolicy messaging.RetryPolicy
+	// maxDeliver is how many times a message is delivered before it's dead lettered, -1 is unlimited
+	maxDeliver int
+}
+
+// NewBus connects to the nats server in the configuration
+func NewBus(ctx context.Context, config *types.Configuration) (*Bus, error) {
+	if config.NATS == nil || config.NATS.URL == "" {
+		return nil, fmt.Errorf("nats url is required")
+	}
+	publisher, err := NewPublisher(config.NATS.URL)
+	if err != nil {
+		return nil, err
+	}
+	bus := &Bus{
+		Publisher:  publisher,
+		url:        config.NATS.URL,
+		maxDeliver: -1,
+	}
+	if config.Job != nil {
+		bus.maxDeliver = config.Job.RetryCount + 1
+		bus.retryPolicy = messaging.RetryPolicy{
+			InitialDelay: time.Duration(config.Job.RetryInitialDelaySecs) * time.Second,
+			Multiplier:   config.Job.RetryBackoffMultiplier,
+			MaxDelay:     time.Duration(config.Job.RetryMaxDelaySecs) * time.Second,
+		}
+	}
+
+	// Create the streams for the events this module publishes up front, as with servicebus topics.
+	// Like a topic without subscriptions, a stream with interest retention drops messages published
+	// before any module has subscribed, so subscribing modules need to be started first
+	if config.EventsPublished != "" {
+		for _, eventType := range strings.Split(config.EventsPublished, ",") {
+			err := publisher.ensureStream(ctx, strings.TrimSpace(eventType))
+			if err != nil {
+				_ = publisher.Close()
+				return nil, err
+			}
+		}
+	}
+	return bus, nil
+}
+
+// Subscribe creates the module's durable consumer on the event type's stream, if needed, and starts pulling from it
+func (b *Bus) Subscribe(ctx context.Context, eventType, moduleName string) (messaging.Subscription, error) {
+	if eventType == "" {
+		return nil, fmt.Errorf("empty event type not allowed")
+	}
+	if moduleName == "" {
+		return nil, fmt.Errorf("empty module name not allowed")
+	}
+
+	requestCtx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	err := b.ensureStream(requestCtx, eventType)
+	if err != nil {
+		return nil, err
+	}
+	consumer := getConsumerName(eventType, moduleName)
+	err = b.addStream(requestCtx, &nats.StreamConfig{
+		Name:      getDeadLetterStreamName(consumer),
+		Subjects:  []string{deadLetterSubjectPrefix + consumer},
+		Retention: nats.LimitsPolicy,
+		Storage:   nats.FileStorage,
+	})
+	if err != nil {
+		return nil, err
+	}
+	stream := getStreamName(eventType)
+	err = b.ensureConsumer(requestCtx, stream, &nats.ConsumerConfig{
+		Durable:       consumer,
+		DeliverPolicy: nats.DeliverAllPolicy,
+		AckPolicy:     nats.AckExplicitPolicy,
+		AckWait:       ackWait,
+		// Messages are dead lettered once they've been delivered job.retrycount + 1 times
+		MaxDeliver: b.maxDeliver,
+	})
+	if err != nil {
+		return nil, err
+	}
+	s := &subscription{
+		js:          b.js,
+		stream:      stream,
+		consumer:    consumer,
+		retryPolicy: b.retryPolicy,
+		maxDeliver:  b.maxDeliver,
+	}
+	s.sub, err = b.js.PullSubscribe(getEventSubject(eventType), consumer, nats.Bind(stream, consumer))
+	if err != nil {
+		return nil, fmt.Errorf("error subscribing to consumer '%s' on stream '%s': %+v", consumer, stream, err)
+	}
+	// Rejecting the last delivery dead letters the message, this catches messages whose last delivery
+	// wasn't settled before its ack wait passed. The module's dispatchers share a queue group so only
+	// one of them copies each message
+	s.advisories, err = b.conn.QueueSubscribe(maxDeliveriesAdvisoryPrefix+stream+"."+consumer, consumer, s.onMaxDeliveries)
+	if err != nil {
+		_ = s.sub.Unsubscribe()
+		return nil, fmt.Errorf("error subscribing to max deliveries advisories for consumer '%s': %+v", consumer, err)
+	}
+	log.WithField("stream", stream).WithField("consumer", consumer).Info("subscribed to jetstream consumer")
+	return s, nil
+}
+
+// HandlerConfig gets the arguments and secrets the handler needs to publish events to the server
+func (b *Bus) HandlerConfig() ([]string, map[string]string) {
+	args := []string{
+		"--natseventprovider.enabled=true",
+	}
+	secrets := map[string]string{
+		handlerURLEnv: b.url,
+	}
+	return args, secrets
+}
+
+// Publisher publishes events to NATS JetStream
+type Publisher struct {
+	conn    *nats.Conn
+	js      nats.JetStreamContext
+	streams map[string]bool
+	mu      sync.Mutex
+}
+
+// NewPublisher connects to the nats server at the url
+func NewPublisher(url string) (*Publisher, error) {
+	conn, err := nats.Connect(url, nats.Timeout(dialTimeout))
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to nats server: %+v", err)
+	}
+	js, err := conn.JetStream(nats.MaxWait(requestTimeout))
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error creating jetstream context: %+v", err)
+	}
+	return &Publisher{
+		conn:    conn,
+		js:      js,
+		streams: map[string]bool{},
+	}, nil
+}
+
+// Publish stores the event on the stream for its type. The event ID is used as the message ID
+// so the server drops the event if it's published again
+func (p *Publisher) Publish(ctx context.Context, event common.Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("error marshalling event %+v", err)
+	}
+	err = p.ensureStream(ctx, event.Type)
+	if err != nil {
+		return err
+	}
+	opts := []nats.PubOpt{nats.Context(ctx)}
+	if event.Context != nil && event.Context.EventID != "" {
+		opts = append(opts, nats.MsgId(event.Context.EventID))
+	}
+	_, err = p.js.PublishMsg(&nats.Msg{Subject: getEventSubject(event.Type), Data: body}, opts...)
+	if err != nil {
+		return fmt.Errorf("error publishing event to stream '%s': %+v", getStreamName(event.Type), err)
+	}
+	return nil
+}
+
+// Close closes the connection to the server
+func (p *Publisher) Close() error {
+	p.conn.Close()
+	return nil
+}
+
+// ensureStream creates the stream for the event type the first time it's used. Streams use interest
+// retention so, like a servicebus topic, messages are kept until every subscribed module has them and
+// messages published while no module is subscribed aren't kept at all
+func (p *Publisher) ensureStream(ctx context.Context, eventType string) error {
+	stream := getStreamName(eventType)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.streams[stream] {
+		return nil
+	}
+	err := p.addStream(ctx, &nats.StreamConfig{
+		Name:      stream,
+		Subjects:  []string{getEventSubject(eventType)},
+		Retention: nats.InterestPolicy,
+		Storage:   nats.FileStorage,
+	})
+	if err != nil {
+		return err
+	}
+	p.streams[stream] = true
+	return nil
+}
+
+// addStream creates the stream if it doesn't already exist
+func (p *Publisher) addStream(ctx context.Context, config *nats.StreamConfig) error {
+	_, err := p.js.StreamInfo(config.Name, nats.Context(ctx))
+	if err == nats.ErrStreamNotFound {
+		_, err = p.js.AddStream(config, nats.Context(ctx))
+	}
+	if err != nil {
+		return fmt.Errorf("error creating stream '%s': %+v", config.Name, err)
+	}
+	return nil
+}
+
+// ensureConsumer creates the durable consumer, or updates it if it already exists so config changes are applied
+func (p *Publisher) ensureConsumer(ctx context.Context, stream string, config *nats.ConsumerConfig) error {
+	_, err := p.js.ConsumerInfo(stream, config.Durable, nats.Context(ctx))
+	if err == nats.ErrConsumerNotFound {
+		_, err = p.js.AddConsumer(stream, config, nats.Context(ctx))
+	} else if err == nil {
+		_, err = p.js.UpdateConsumer(stream, config, nats.Context(ctx))
+	}
+	if err != nil {
+		return fmt.Errorf("error creating consumer '%s' on stream '%s': %+v", config.Durable, stream, err)
+	}
+	return nil
+}
+
+// subscription pulls messages for a module's durable consumer
+type subscription struct {
+	js          nats.JetStreamContext
+	sub         *nats.Subscription
+	advisories  *nats.Subscription
+	stream      string
+	consumer    string
+	retryPolicy messaging.RetryPolicy
+	maxDeliver  int
+}
+
+// Receive waits for the next message
+func (s *subscription) Receive(ctx context.Context) (messaging.Message, error) {
+	for {
+		fetchCtx, cancel := context.WithTimeout(ctx, pullExpiry)
+		messages, err := s.sub.Fetch(1, nats.Context(fetchCtx))
+		cancel()
+		if err == context.DeadlineExceeded && ctx.Err() == nil {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		message, err := newMessage(s, messages[0])
+		if err != nil {
+			log.WithError(err).Error("received message without jetstream metadata, skipping")
+			continue
+		}
+		return message, nil
+	}
+}
+
+// RenewLocks tells the server the messages are still being worked on, resetting their ack wait
+func (s *subscription) RenewLocks(ctx context.Context, messages []messaging.Message) error {
+	for _, m := range messages {
+		natsMessage, ok := m.(*Message)
+		if !ok {
+			return fmt.Errorf("message %s wasn't received from nats", m.ID())
+		}
+		err := natsMessage.original.InProgress(nats.Context(ctx))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetQueueDepth gets the messages yet to be acknowledged by the consumer and the messages dead lettered from it
+func (s *subscription) GetQueueDepth() (messaging.QueueDepth, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	consumer, err := s.js.ConsumerInfo(s.stream, s.consumer, nats.Context(ctx))
+	if err != nil {
+		return messaging.QueueDepth{}, err
+	}
+	deadLetters, err := s.js.StreamInfo(getDeadLetterStreamName(s.consumer), nats.Context(ctx))
+	if err != nil {
+		return messaging.QueueDepth{}, err
+	}
+	return messaging.QueueDepth{
+		ActiveMessageCount:     int64(consumer.NumPending) + int64(consumer.NumAckPending),
+		DeadLetterMessageCount: int64(deadLetters.State.Msgs),
+	}, nil
+}
+
+// ReleasePending does nothing, messages are only pulled when the dispatcher is ready to run them
+func (s *subscription) ReleasePending() {}
+
+// Close stops receiving from the subscription. The durable consumer is kept so no messages are missed
+// while the module isn't running, unacknowledged messages are redelivered once their ack wait passes
+func (s *subscription) Close() error {
+	err := s.advisories.Unsubscribe()
+	if err != nil {
+		return err
+	}
+	return s.sub.Unsubscribe()
+}
+
+// deadLetter stores a copy of the message on the consumer's dead letter stream then stops it being redelivered
+func (s *subscription) deadLetter(m *Message, reason string) error {
+	err := s.publishDeadLetter(m.ID(), m.original.Subject, m.original.Header, m.original.Data, reason)
+	if err != nil {
+		return err
+	}
+	return m.original.Term()
+}
+
+// onMaxDeliveries copies a message the server has stopped delivering to the consumer's dead letter stream.
+// The message stays on the event stream, as other modules may not have received it yet
+func (s *subscription) onMaxDeliveries(advisory *nats.Msg) {
+	var event struct {
+		StreamSeq uint64 `json:"stream_seq"`
+	}
+	err := json.Unmarshal(advisory.Data, &event)
+	if err != nil {
+		log.WithError(err).WithField("consumer", s.consumer).Error("failed to read max deliveries advisory")
+		return
+	}
+	contextualLogger := log.WithField("consumer", s.consumer).WithField("sequence", event.StreamSeq)
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	original, err := s.js.GetMsg(s.stream, event.StreamSeq, nats.Context(ctx))
+	if err != nil {
+		contextualLogger.WithError(err).Error("failed to get message which reached max deliveries")
+		return
+	}
+	id := original.Header.Get(nats.MsgIdHdr)
+	if id == "" {
+		id = fmt.Sprintf("%s-%d", s.stream, original.Sequence)
+	}
+	err = s.publishDeadLetter(id, original.Subject, original.Header, original.Data, messaging.MaxDeliveryCountExceededReason)
+	if err != nil {
+		contextualLogger.WithError(err).Error("failed to dead letter message which reached max deliveries")
+		return
+	}
+	contextualLogger.WithField("messageID", id).Warning("message reached max deliveries, dead lettered")
+}
+
+// publishDeadLetter publishes the message to the consumer's dead letter stream. The message ID is used as
+// the dead letter's ID so the server drops the copy if the message is dead lettered twice
+func (s *subscription) publishDeadLetter(id, subject string, header nats.Header, data []byte, reason string) error {
+	deadLetter := nats.NewMsg(deadLetterSubjectPrefix + s.consumer)
+	for key, values := range header {
+		deadLetter.Header[key] = values
+	}
+	deadLetter.Header.Set(nats.MsgIdHdr, id)
+	deadLetter.Header.Set(deadLetterReasonHeader, reason)
+	deadLetter.Header.Set(deadLetterSubjectHeader, subject)
+	deadLetter.Data = data
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	_, err := s.js.PublishMsg(deadLetter, nats.Context(ctx))
+	if err != nil {
+		return fmt.Errorf("error dead lettering message %s: %+v", id, err)
+	}
+	return nil
+}
+
+func getEventSubject(eventType string) string {
+	return eventSubjectPrefix + strings.ToLower(eventType)
+}
+
+// getStreamName gets the stream for an event type, stream names can't contain '.' so these are replaced
+func getStreamName(eventType string) string {
+	return "ion_" + sanitizeName(eventType)
+}
+
+func getDeadLetterStreamName(consumer string) string {
+	return "ion_deadletter_" + consumer
+}
+
+// getConsumerName matches the subscription names used by the servicebus bus
+func getConsumerName(eventType, moduleName string) string {
+	return sanitizeName(eventType + "_" + moduleName)
+}
+
+func sanitizeName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', '*', '>', ' ', '/', '\\':
+			return '_'
+		}
+		return r
+	}, strings.ToLower(name))
+}
@@ -0,0 +1,150 @@
+package natsbus
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/lawrencegripper/ion/internal/app/dispatcher/helpers"
+	"github.com/lawrencegripper/ion/internal/pkg/common"
+	"github.com/lawrencegripper/ion/internal/pkg/messaging"
+	"github.com/lawrencegripper/ion/internal/pkg/types"
+)
+
+// Run against a local NATS server with JetStream enabled, for example:
+// docker run -p 4222:4222 nats -js
+// NATS_URL=nats://localhost:4222 go test ./...
+func TestIntegrationNATSBus(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode...")
+	}
+	url := os.Getenv("NATS_URL")
+	if url == "" {
+		t.Fatal("env var 'NATS_URL' not set!")
+	}
+
+	// pick random names to prevent previous tests affecting this test
+	eventType := "integration_" + helpers.RandomName(8)
+	moduleName := helpers.RandomName(8)
+	config := &types.Configuration{
+		ModuleName:      moduleName,
+		EventsPublished: eventType,
+		NATS:            &types.NATSConfig{Enabled: true, URL: url},
+		Job: &types.JobConfig{
+			RetryCount:            1,
+			RetryInitialDelaySecs: 1,
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	bus, err := NewBus(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bus.Close() // nolint: errcheck
+	consumer := getConsumerName(eventType, moduleName)
+	defer bus.js.DeleteStream(getStreamName(eventType))          // nolint: errcheck
+	defer bus.js.DeleteStream(getDeadLetterStreamName(consumer)) // nolint: errcheck
+
+	sub, err := bus.Subscribe(ctx, eventType, moduleName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close() // nolint: errcheck
+
+	event := common.Event{
+		Type:    eventType,
+		Context: &common.Context{EventID: helpers.RandomName(12)},
+	}
+	// The second publish has the same event ID so should be dropped by the server
+	for i := 0; i < 2; i++ {
+		if err := bus.Publish(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	message := receive(ctx, t, sub)
+	if message.ID() != event.Context.EventID {
+		t.Errorf("expected message ID %s got %s", event.Context.EventID, message.ID())
+	}
+	if message.DeliveryCount() != 1 {
+		t.Errorf("expected first delivery got %d", message.DeliveryCount())
+	}
+	received, err := message.EventData()
+	if err != nil || received.Type != eventType {
+		t.Errorf("expected %s event got %+v %+v", eventType, received, err)
+	}
+	if err := sub.RenewLocks(ctx, []messaging.Message{message}); err != nil {
+		t.Errorf("failed to renew lock: %+v", err)
+	}
+
+	rejectedAt := time.Now()
+	if err := message.Reject(); err != nil {
+		t.Fatal(err)
+	}
+	message = receive(ctx, t, sub)
+	if delay := time.Since(rejectedAt); delay < time.Second {
+		t.Errorf("expected redelivery after the 1s retry delay got %v", delay)
+	}
+	if message.ID() != event.Context.EventID || message.DeliveryCount() != 2 {
+		t.Errorf("expected second delivery of %s got %d of %s", event.Context.EventID, message.DeliveryCount(), message.ID())
+	}
+
+	// Rejecting the last delivery allowed by the retry count dead letters the message
+	if err := message.Reject(); err != nil {
+		t.Fatal(err)
+	}
+	depth, err := sub.GetQueueDepth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if depth.ActiveMessageCount != 0 || depth.DeadLetterMessageCount != 1 {
+		t.Errorf("expected only the dead lettered message got %+v", depth)
+	}
+
+	// A message whose last delivery isn't settled before its ack wait passes is dead lettered by the advisory
+	defer func(d time.Duration) { ackWait = d }(ackWait)
+	ackWait = time.Second
+	unsettled := common.Event{
+		Type:    eventType,
+		Context: &common.Context{EventID: helpers.RandomName(12)},
+	}
+	if err := bus.Publish(ctx, unsettled); err != nil {
+		t.Fatal(err)
+	}
+	advisorySub, err := bus.Subscribe(ctx, eventType, moduleName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer advisorySub.Close() // nolint: errcheck
+	for i := 1; i <= 2; i++ {
+		message = receive(ctx, t, advisorySub)
+		if message.ID() != unsettled.Context.EventID || message.DeliveryCount() != i {
+			t.Errorf("expected delivery %d of %s got %d of %s", i, unsettled.Context.EventID, message.DeliveryCount(), message.ID())
+		}
+	}
+	deadline := time.Now().Add(time.Second * 10)
+	for depth.DeadLetterMessageCount != 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 200)
+		depth, err = advisorySub.GetQueueDepth()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if depth.DeadLetterMessageCount != 2 {
+		t.Errorf("expected unsettled message to be dead lettered got %+v", depth)
+	}
+}
+
+func receive(ctx context.Context, t *testing.T, sub messaging.Subscription) messaging.Message {
+	receiveCtx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+	message, err := sub.Receive(receiveCtx)
+	if err != nil {
+		t.Fatalf("failed to receive message: %+v", err)
+	}
+	return message
+}
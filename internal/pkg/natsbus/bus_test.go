@@ -0,0 +1,17 @@
+package natsbus
+
+import (
+	"testing"
+)
+
+func TestNames(t *testing.T) {
+	if name := getStreamName("frontapi.new_link"); name != "ion_frontapi_new_link" {
+		t.Errorf("expected ion_frontapi_new_link got %s", name)
+	}
+	if name := getConsumerName("Face_Detected", "Blur"); name != "face_detected_blur" {
+		t.Errorf("expected face_detected_blur got %s", name)
+	}
+	if subject := getEventSubject("frontapi.new_link"); subject != "ion.events.frontapi.new_link" {
+		t.Errorf("expected ion.events.frontapi.new_link got %s", subject)
+	}
+}
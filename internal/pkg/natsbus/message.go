@@ -0,0 +1,88 @@
+package natsbus
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/lawrencegripper/ion/internal/pkg/common"
+	"github.com/lawrencegripper/ion/internal/pkg/messaging"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	deadLetterReasonHeader  = "Ion-Dead-Letter-Reason"
+	deadLetterSubjectHeader = "Ion-Dead-Letter-Subject"
+)
+
+var _ messaging.Message = &Message{}
+
+// Message is a message pulled from a JetStream consumer
+type Message struct {
+	original     *nats.Msg
+	meta         *nats.MsgMetadata
+	subscription *subscription
+}
+
+func newMessage(s *subscription, m *nats.Msg) (*Message, error) {
+	meta, err := m.Metadata()
+	if err != nil {
+		return nil, err
+	}
+	return &Message{
+		original:     m,
+		meta:         meta,
+		subscription: s,
+	}, nil
+}
+
+// ID gets the message ID it was published with, or its position in the stream if it didn't have one
+func (m *Message) ID() string {
+	if id := m.original.Header.Get(nats.MsgIdHdr); id != "" {
+		return id
+	}
+	return fmt.Sprintf("%s-%d", m.meta.Stream, m.meta.Sequence.Stream)
+}
+
+// DeliveryCount gets the number of times the message has been delivered
+func (m *Message) DeliveryCount() int {
+	return int(m.meta.NumDelivered)
+}
+
+// Body gets the body
+func (m *Message) Body() []byte {
+	return m.original.Data
+}
+
+// Accept acknowledges the message so it isn't redelivered
+func (m *Message) Accept() error {
+	return m.original.Ack()
+}
+
+// Reject asks for the message to be redelivered after the delay from the retry policy, or dead letters
+// it if this was its last delivery
+func (m *Message) Reject() error {
+	if m.subscription.maxDeliver > 0 && m.DeliveryCount() >= m.subscription.maxDeliver {
+		return m.DeadLetter(messaging.MaxDeliveryCountExceededReason)
+	}
+	return m.original.NakWithDelay(m.subscription.retryPolicy.Delay(m.DeliveryCount()))
+}
+
+// Release hands the message back to be redelivered straight away. JetStream still counts this as a delivery
+func (m *Message) Release() error {
+	return m.original.Nak()
+}
+
+// DeadLetter moves the message to the consumer's dead letter stream so it isn't retried
+func (m *Message) DeadLetter(reason string) error {
+	return m.subscription.deadLetter(m, reason)
+}
+
+// EventData deserialize json value to type
+func (m *Message) EventData() (common.Event, error) {
+	var event common.Event
+	err := json.Unmarshal(m.original.Data, &event)
+	if err != nil {
+		return event, fmt.Errorf("error unmarshalling event: %+v", err)
+	}
+	return event, nil
+}
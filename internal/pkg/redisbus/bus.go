@@ -0,0 +1,472 @@
+package redisbus
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/lawrencegripper/ion/internal/pkg/common"
+	"github.com/lawrencegripper/ion/internal/pkg/messaging"
+	"github.com/lawrencegripper/ion/internal/pkg/types"
+	"github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	streamKeyPrefix     = "ion:events:"
+	retryKeyPrefix      = "ion:retry:"
+	deadLetterKeyPrefix = "ion:deadletter:"
+
+	// retryConsumer holds rejected messages in the group's pending list until their retry is due
+	retryConsumer = "ion-retry"
+
+	// Fields of a stream entry
+	eventField            = "event"
+	eventIDField          = "id"
+	deadLetterReasonField = "reason"
+	deadLetterEntryField  = "entry"
+
+	// The handler reads its flags from the environment, with '.' replaced by '_',
+	// so the url, which can hold the server password, is passed using this environment variable
+	handlerURLEnv = "REDISEVENTPROVIDER_URL"
+)
+
+var (
+	// lockDuration is how long a message can go without its lock being renewed before
+	// another consumer may claim it, the dispatcher renews its messages well within this
+	lockDuration = time.Minute
+	// pollInterval is how long a read blocks waiting for new messages before checking for
+	// retries which are due and messages whose lock has expired
+	pollInterval = time.Second * 2
+	timeout      = time.Second * 10
+)
+
+// renewScript claims each of the entries in ARGV[3:] again, which resets how long they've been idle, as
+// long as they're still held by the consumer in ARGV[2]. Checking the owner and claiming in a script is
+// atomic so an entry can't be taken back from a consumer which claimed it after its lock expired.
+// Returns the entries which were renewed
+var renewScript = redis.NewScript(`
+local renewed = {}
+for i = 3, #ARGV do
+	local pending = redis.call('XPENDING', KEYS[1], ARGV[1], ARGV[i], ARGV[i], 1)
+	if #pending > 0 and pending[1][2] == ARGV[2] then
+		redis.call('XCLAIM', KEYS[1], ARGV[1], ARGV[2], 0, ARGV[i], 'JUSTID')
+		table.insert(renewed, ARGV[i])
+	end
+end
+return renewed
+`)
+
+// claimRetryScript claims the oldest entry in the retry set KEYS[2] whose retry is due by ARGV[3] for the
+// consumer in ARGV[2], counting it as a delivery. Removing the retry and claiming the entry in a script is
+// atomic so an entry can't be left held by retryConsumer with no retry scheduled.
+// Returns the claimed entry or nil if no retry is due
+var claimRetryScript = redis.NewScript(`
+local due = redis.call('ZRANGEBYSCORE', KEYS[2], '-inf', ARGV[3], 'LIMIT', 0, 1)
+if #due == 0 then
+	return false
+end
+redis.call('ZREM', KEYS[2], due[1])
+local pending = redis.call('XPENDING', KEYS[1], ARGV[1], due[1], due[1], 1)
+if #pending == 0 then
+	return false
+end
+redis.call('XCLAIM', KEYS[1], ARGV[1], ARGV[2], 0, due[1], 'RETRYCOUNT', pending[1][4] + 1, 'JUSTID')
+return due[1]
+`)
+
+var _ messaging.MessageBus = &Bus{}
+var _ messaging.Publisher = &Publisher{}
+
+// Bus is the Redis Streams implementation of messaging.MessageBus. Event types map to a stream
+// each and modules to a consumer group on the stream named by getSubscriptionName.
+// Needs redis 6.2 or later
+type Bus struct {
+	*Publisher
+	url         string
+	consumer    string
+	retryPolicy messaging.RetryPolicy
+	// maxDeliver is how many times a message is delivered before it's dead lettered, 0 is unlimited
+	maxDeliver int
+}
+
+// NewBus connects to the redis server in the configuration
+func NewBus(ctx context.Context, config *types.Configuration) (*Bus, error) {
+	if config.Redis == nil || config.Redis.URL == "" {
+		return nil, fmt.Errorf("redis url is required")
+	}
+	publisher, err := NewPublisher(config.Redis.URL)
+	if err != nil {
+		return nil, err
+	}
+	consumer := config.Hostname
+	if consumer == "" {
+		consumer = uuid.Must(uuid.NewV4(), nil).String()
+	}
+	bus := &Bus{
+		Publisher: publisher,
+		url:       config.Redis.URL,
+		consumer:  consumer,
+	}
+	if config.Job != nil {
+		bus.maxDeliver = config.Job.RetryCount + 1
+		bus.retryPolicy = messaging.RetryPolicy{
+			InitialDelay: time.Duration(config.Job.RetryInitialDelaySecs) * time.Second,
+			Multiplier:   config.Job.RetryBackoffMultiplier,
+			MaxDelay:     time.Duration(config.Job.RetryMaxDelaySecs) * time.Second,
+		}
+	}
+	return bus, nil
+}
+
+// Subscribe creates the module's consumer group on the event type's stream, if needed, and starts reading from it.
+// Like a new servicebus subscription, a new group only receives events published after it was created
+func (b *Bus) Subscribe(ctx context.Context, eventType, moduleName string) (messaging.Subscription, error) {
+	if eventType == "" {
+		return nil, fmt.Errorf("empty event type not allowed")
+	}
+	if moduleName == "" {
+		return nil, fmt.Errorf("empty module name not allowed")
+	}
+
+	stream := getStreamKey(eventType)
+	group := getSubscriptionName(eventType, moduleName)
+	err := b.client.XGroupCreateMkStream(stream, group, "$").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return nil, fmt.Errorf("error creating consumer group '%s' on '%s': %+v", group, stream, err)
+	}
+	log.WithField("stream", stream).WithField("group", group).Info("subscribed to redis consumer group")
+	return &subscription{
+		client:      b.client,
+		stream:      stream,
+		group:       group,
+		consumer:    b.consumer,
+		retryPolicy: b.retryPolicy,
+		maxDeliver:  b.maxDeliver,
+	}, nil
+}
+
+// HandlerConfig gets the arguments and secrets the handler needs to publish events to the server
+func (b *Bus) HandlerConfig() ([]string, map[string]string) {
+	args := []string{
+		"--rediseventprovider.enabled=true",
+	}
+	secrets := map[string]string{
+		handlerURLEnv: b.url,
+	}
+	return args, secrets
+}
+
+// Publisher adds events to redis streams
+type Publisher struct {
+	client *redis.Client
+}
+
+// NewPublisher connects to the redis server at the url
+func NewPublisher(url string) (*Publisher, error) {
+	c, err := newClient(url, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to redis: %+v", err)
+	}
+	return &Publisher{client: c}, nil
+}
+
+// Publish adds the event to the stream for its type
+func (p *Publisher) Publish(ctx context.Context, event common.Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("error marshalling event %+v", err)
+	}
+	eventID := ""
+	if event.Context != nil {
+		eventID = event.Context.EventID
+	}
+	err = p.client.XAdd(&redis.XAddArgs{
+		Stream: getStreamKey(event.Type),
+		Values: map[string]interface{}{
+			eventField:   string(body),
+			eventIDField: eventID,
+		},
+	}).Err()
+	if err != nil {
+		return fmt.Errorf("error publishing event to stream '%s': %+v", getStreamKey(event.Type), err)
+	}
+	return nil
+}
+
+// Close closes the connection to the server
+func (p *Publisher) Close() error {
+	return p.client.Close()
+}
+
+// subscription reads a module's consumer group. Messages stay in the group's pending entries list
+// until they're acknowledged, rejected messages are handed to retryConsumer and claimed back once
+// their retry is due and messages whose lock has expired are claimed from the consumer which held them.
+// Messages claimed more than maxDeliver times are dead lettered rather than returned
+type subscription struct {
+	client      *redis.Client
+	stream      string
+	group       string
+	consumer    string
+	retryPolicy messaging.RetryPolicy
+	maxDeliver  int
+}
+
+// Receive waits for the next message, preferring retries which are due then messages whose lock expired
+func (s *subscription) Receive(ctx context.Context) (messaging.Message, error) {
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		m, err := s.claimDueRetry()
+		if err != nil || m != nil {
+			return m, err
+		}
+		m, err = s.claimExpired()
+		if err != nil || m != nil {
+			return m, err
+		}
+		m, err = s.readNew()
+		if err != nil || m != nil {
+			return m, err
+		}
+	}
+}
+
+// RenewLocks claims the messages again, which resets how long they've been idle. Messages which
+// this consumer no longer holds, because they were claimed by another consumer, have lost their lock
+func (s *subscription) RenewLocks(ctx context.Context, messages []messaging.Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	args := []interface{}{s.group, s.consumer}
+	for _, m := range messages {
+		redisMessage, ok := m.(*Message)
+		if !ok {
+			return fmt.Errorf("message %s wasn't received from redis", m.ID())
+		}
+		args = append(args, redisMessage.entryID)
+	}
+	reply, err := renewScript.Run(s.client, []string{s.stream}, args...).Result()
+	if err != nil {
+		return err
+	}
+	renewed := map[string]bool{}
+	entries, _ := reply.([]interface{})
+	for _, e := range entries {
+		entryID, _ := e.(string)
+		renewed[entryID] = true
+	}
+	lost := []string{}
+	for _, m := range messages {
+		if !renewed[m.(*Message).entryID] {
+			lost = append(lost, m.ID())
+		}
+	}
+	if len(lost) > 0 {
+		return fmt.Errorf("lost lock for messages %s", strings.Join(lost, ", "))
+	}
+	return nil
+}
+
+// GetQueueDepth gets the messages delivered to the group but not yet acknowledged and the messages
+// dead lettered from it
+func (s *subscription) GetQueueDepth() (messaging.QueueDepth, error) {
+	pending, err := s.client.XPending(s.stream, s.group).Result()
+	if err != nil {
+		return messaging.QueueDepth{}, err
+	}
+	deadLettered, err := s.client.XLen(getDeadLetterKey(s.group)).Result()
+	if err != nil {
+		return messaging.QueueDepth{}, err
+	}
+	return messaging.QueueDepth{
+		ActiveMessageCount:     pending.Count,
+		DeadLetterMessageCount: deadLettered,
+	}, nil
+}
+
+// ReleasePending does nothing, messages are only read when the dispatcher is ready to run them
+func (s *subscription) ReleasePending() {}
+
+// Close does nothing, the connection is shared with the bus. Unacknowledged messages are claimed by
+// another consumer once their lock expires
+func (s *subscription) Close() error {
+	return nil
+}
+
+// claimDueRetry claims the oldest rejected message whose retry is due
+func (s *subscription) claimDueRetry() (*Message, error) {
+	keys := []string{s.stream, getRetryKey(s.group)}
+	entryID, err := claimRetryScript.Run(s.client, keys, s.group, s.consumer, toMillis(time.Now())).String()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	entries, err := s.client.XRange(s.stream, entryID, entryID).Result()
+	if err != nil || len(entries) == 0 {
+		return nil, err
+	}
+	return s.delivered(entries[0])
+}
+
+// claimExpired claims a message held by another consumer which hasn't renewed its lock
+func (s *subscription) claimExpired() (*Message, error) {
+	// The client doesn't support the IDLE filter, added in redis 6.2, so the command is sent as is
+	reply, err := s.client.Do("XPENDING", s.stream, s.group, "IDLE", int64(lockDuration/time.Millisecond), "-", "+", 10).Result()
+	if err != nil {
+		return nil, err
+	}
+	entries, _ := reply.([]interface{})
+	for _, e := range entries {
+		entry, _ := e.([]interface{})
+		if len(entry) < 2 || entry[1] == retryConsumer {
+			continue
+		}
+		entryID, _ := entry[0].(string)
+		m, err := s.claim(entryID, lockDuration)
+		if err != nil || m != nil {
+			return m, err
+		}
+	}
+	return nil, nil
+}
+
+// readNew reads the next message which hasn't been delivered to the group, waiting up to pollInterval
+func (s *subscription) readNew() (*Message, error) {
+	streams, err := s.client.XReadGroup(&redis.XReadGroupArgs{
+		Group:    s.group,
+		Consumer: s.consumer,
+		Streams:  []string{s.stream, ">"},
+		Count:    1,
+		Block:    pollInterval,
+	}).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil || len(streams) == 0 || len(streams[0].Messages) == 0 {
+		return nil, err
+	}
+	return s.newMessage(streams[0].Messages[0], 1), nil
+}
+
+// claim takes the entry for this consumer, as long as it has been idle for minIdle. Returns nil
+// if the entry has since been acknowledged or claimed by another consumer, or was dead lettered
+func (s *subscription) claim(entryID string, minIdle time.Duration) (*Message, error) {
+	entries, err := s.client.XClaim(&redis.XClaimArgs{
+		Stream:   s.stream,
+		Group:    s.group,
+		Consumer: s.consumer,
+		MinIdle:  minIdle,
+		Messages: []string{entryID},
+	}).Result()
+	if err != nil || len(entries) == 0 {
+		return nil, err
+	}
+	return s.delivered(entries[0])
+}
+
+// delivered wraps an entry claimed by this consumer, dead lettering it instead if it has been
+// delivered more than maxDeliver times. Returns nil if the entry was dead lettered
+func (s *subscription) delivered(entry redis.XMessage) (*Message, error) {
+	_, deliveryCount, err := s.pendingEntry(entry.ID)
+	if err != nil {
+		return nil, err
+	}
+	m := s.newMessage(entry, deliveryCount)
+	if s.maxDeliver > 0 && deliveryCount > s.maxDeliver {
+		log.WithField("messageID", m.ID()).WithField("deliveryCount", deliveryCount).Warning("message delivered more than max deliveries, dead lettering")
+		return nil, s.deadLetter(m, messaging.MaxDeliveryCountExceededReason)
+	}
+	return m, nil
+}
+
+// pendingEntry gets the consumer holding the entry and the number of times it has been delivered
+func (s *subscription) pendingEntry(entryID string) (string, int, error) {
+	entries, err := s.client.XPendingExt(&redis.XPendingExtArgs{
+		Stream: s.stream,
+		Group:  s.group,
+		Start:  entryID,
+		End:    entryID,
+		Count:  1,
+	}).Result()
+	if err != nil || len(entries) == 0 {
+		return "", 0, err
+	}
+	return entries[0].Consumer, int(entries[0].RetryCount), nil
+}
+
+// newMessage wraps a stream entry read by the group
+func (s *subscription) newMessage(entry redis.XMessage, deliveryCount int) *Message {
+	eventID, _ := entry.Values[eventIDField].(string)
+	body, _ := entry.Values[eventField].(string)
+	return &Message{
+		entryID:       entry.ID,
+		eventID:       eventID,
+		body:          []byte(body),
+		deliveryCount: deliveryCount,
+		subscription:  s,
+	}
+}
+
+// scheduleRetry hands the entry to retryConsumer until the delay has passed
+func (s *subscription) scheduleRetry(entryID string, delay time.Duration) error {
+	retryAt := redis.Z{Score: float64(toMillis(time.Now().Add(delay))), Member: entryID}
+	err := s.client.ZAdd(getRetryKey(s.group), retryAt).Err()
+	if err != nil {
+		return err
+	}
+	return s.client.XClaimJustID(&redis.XClaimArgs{
+		Stream:   s.stream,
+		Group:    s.group,
+		Consumer: retryConsumer,
+		Messages: []string{entryID},
+	}).Err()
+}
+
+func (s *subscription) ack(entryID string) error {
+	return s.client.XAck(s.stream, s.group, entryID).Err()
+}
+
+// deadLetter copies the message to the group's dead letter stream then acknowledges it
+func (s *subscription) deadLetter(m *Message, reason string) error {
+	err := s.client.XAdd(&redis.XAddArgs{
+		Stream: getDeadLetterKey(s.group),
+		Values: map[string]interface{}{
+			eventField:            string(m.body),
+			eventIDField:          m.eventID,
+			deadLetterReasonField: reason,
+			deadLetterEntryField:  m.entryID,
+		},
+	}).Err()
+	if err != nil {
+		return fmt.Errorf("error dead lettering message %s: %+v", m.ID(), err)
+	}
+	return s.ack(m.entryID)
+}
+
+func getStreamKey(eventType string) string {
+	return streamKeyPrefix + strings.ToLower(eventType)
+}
+
+func getRetryKey(group string) string {
+	return retryKeyPrefix + group
+}
+
+func getDeadLetterKey(group string) string {
+	return deadLetterKeyPrefix + group
+}
+
+// getSubscriptionName matches the subscription names used by the servicebus bus
+func getSubscriptionName(eventName, moduleName string) string {
+	return strings.ToLower(eventName) + "_" + strings.ToLower(moduleName)
+}
+
+func toMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
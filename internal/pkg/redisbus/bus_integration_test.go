@@ -0,0 +1,175 @@
+package redisbus
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/lawrencegripper/ion/internal/app/dispatcher/helpers"
+	"github.com/lawrencegripper/ion/internal/pkg/common"
+	"github.com/lawrencegripper/ion/internal/pkg/messaging"
+	"github.com/lawrencegripper/ion/internal/pkg/types"
+)
+
+// Run against a local redis 6.2 or later, for example:
+// docker run -p 6379:6379 redis
+// REDIS_URL=redis://localhost:6379 go test ./...
+func TestIntegrationRedisBus(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode...")
+	}
+	url := os.Getenv("REDIS_URL")
+	if url == "" {
+		t.Fatal("env var 'REDIS_URL' not set!")
+	}
+
+	// Expire locks quickly so the test doesn't wait a minute for a message to be claimed
+	defer func(d time.Duration) { lockDuration = d }(lockDuration)
+	lockDuration = time.Second
+
+	// pick random names to prevent previous tests affecting this test
+	eventType := "integration_" + helpers.RandomName(8)
+	moduleName := helpers.RandomName(8)
+	config := &types.Configuration{
+		ModuleName: moduleName,
+		Hostname:   "dispatcher_a",
+		Redis:      &types.RedisConfig{Enabled: true, URL: url},
+		Job: &types.JobConfig{
+			RetryCount:            2,
+			RetryInitialDelaySecs: 1,
+		},
+	}
+	otherConfig := *config
+	otherConfig.Hostname = "dispatcher_b"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// Two dispatchers for the module share the consumer group
+	bus := newTestBus(ctx, t, config)
+	defer bus.Close() // nolint: errcheck
+	otherBus := newTestBus(ctx, t, &otherConfig)
+	defer otherBus.Close() // nolint: errcheck
+	group := getSubscriptionName(eventType, moduleName)
+	defer bus.client.Del(getStreamKey(eventType), getRetryKey(group), getDeadLetterKey(group))
+
+	sub, err := bus.Subscribe(ctx, eventType, moduleName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close() // nolint: errcheck
+	otherSub, err := otherBus.Subscribe(ctx, eventType, moduleName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer otherSub.Close() // nolint: errcheck
+
+	event := common.Event{
+		Type:    eventType,
+		Context: &common.Context{EventID: helpers.RandomName(12)},
+	}
+	if err := bus.Publish(ctx, event); err != nil {
+		t.Fatal(err)
+	}
+
+	message := receive(ctx, t, sub)
+	if message.ID() != event.Context.EventID || message.DeliveryCount() != 1 {
+		t.Errorf("expected first delivery of %s got %d of %s", event.Context.EventID, message.DeliveryCount(), message.ID())
+	}
+	received, err := message.EventData()
+	if err != nil || received.Type != eventType {
+		t.Errorf("expected %s event got %+v %+v", eventType, received, err)
+	}
+
+	// Rejecting hands the message to the retry consumer until its retry is due
+	rejectedAt := time.Now()
+	if err := message.Reject(); err != nil {
+		t.Fatal(err)
+	}
+	entryID := message.(*Message).entryID
+	if _, err := bus.client.ZScore(getRetryKey(group), entryID).Result(); err != nil {
+		t.Errorf("expected retry to be scheduled: %+v", err)
+	}
+	expectOwner(t, sub, entryID, retryConsumer)
+
+	message = receive(ctx, t, otherSub)
+	if delay := time.Since(rejectedAt); delay < time.Second {
+		t.Errorf("expected retry after the 1s delay got %v", delay)
+	}
+	if message.ID() != event.Context.EventID || message.DeliveryCount() != 2 {
+		t.Errorf("expected second delivery of %s got %d of %s", event.Context.EventID, message.DeliveryCount(), message.ID())
+	}
+	if count, _ := bus.client.ZCard(getRetryKey(group)).Result(); count != 0 {
+		t.Errorf("expected retry to be removed once claimed, %d left", count)
+	}
+	expectOwner(t, sub, entryID, otherConfig.Hostname)
+	if err := otherSub.RenewLocks(ctx, []messaging.Message{message}); err != nil {
+		t.Errorf("failed to renew lock: %+v", err)
+	}
+	// Renewing a message held by another dispatcher fails rather than taking it back
+	if err := sub.RenewLocks(ctx, []messaging.Message{message}); err == nil {
+		t.Error("expected renewing a message held by another dispatcher to fail")
+	}
+	expectOwner(t, sub, entryID, otherConfig.Hostname)
+
+	// Once its lock expires the message is claimed by the other dispatcher
+	time.Sleep(lockDuration)
+	expired := message
+	message = receive(ctx, t, sub)
+	if message.ID() != event.Context.EventID || message.DeliveryCount() != 3 {
+		t.Errorf("expected third delivery of %s got %d of %s", event.Context.EventID, message.DeliveryCount(), message.ID())
+	}
+	if err := otherSub.RenewLocks(ctx, []messaging.Message{expired}); err == nil {
+		t.Error("expected lock to be lost once the message was claimed")
+	}
+
+	// Claiming the message again would be a fourth delivery, above the retry count, so it's dead lettered
+	if err := message.Reject(); err != nil {
+		t.Fatal(err)
+	}
+	receiveCtx, cancelReceive := context.WithTimeout(ctx, time.Second*3)
+	defer cancelReceive()
+	if message, err := sub.Receive(receiveCtx); err == nil {
+		t.Errorf("expected message to be dead lettered got delivery %d", message.DeliveryCount())
+	}
+	if count, _ := bus.client.ZCard(getRetryKey(group)).Result(); count != 0 {
+		t.Errorf("expected retry to be removed once claimed, %d left", count)
+	}
+	depth, err := sub.GetQueueDepth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if depth.ActiveMessageCount != 0 || depth.DeadLetterMessageCount != 1 {
+		t.Errorf("expected only the dead lettered message got %+v", depth)
+	}
+}
+
+func newTestBus(ctx context.Context, t *testing.T, config *types.Configuration) *Bus {
+	bus, err := NewBus(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bus
+}
+
+func receive(ctx context.Context, t *testing.T, sub messaging.Subscription) messaging.Message {
+	receiveCtx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+	message, err := sub.Receive(receiveCtx)
+	if err != nil {
+		t.Fatalf("failed to receive message: %+v", err)
+	}
+	return message
+}
+
+// expectOwner checks which consumer the entry is pending for
+func expectOwner(t *testing.T, sub messaging.Subscription, entryID, expected string) {
+	owner, _, err := sub.(*subscription).pendingEntry(entryID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner != expected {
+		t.Errorf("expected %s to hold the message got %s", expected, owner)
+	}
+}
@@ -0,0 +1,45 @@
+package redisbus
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// newClient connects to the server at the url, in the form redis://[[user]:password@]host[:port][/db].
+// Use the rediss scheme for TLS. A url with a user but no password authenticates with the user as the password
+func newClient(rawURL string, timeout time.Duration) (*redis.Client, error) {
+	options, err := redis.ParseURL(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis url: %+v", err)
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis url: %+v", err)
+	}
+	if u.User != nil {
+		password, hasPassword := u.User.Password()
+		switch {
+		case !hasPassword:
+			options.Password = u.User.Username()
+		case u.User.Username() != "":
+			// The client only sends the password, so authenticate as the ACL user when connecting instead
+			options.Password = ""
+			options.OnConnect = func(conn *redis.Conn) error {
+				return conn.Process(redis.NewStatusCmd("auth", u.User.Username(), password))
+			}
+		}
+	}
+	options.DialTimeout = timeout
+	options.ReadTimeout = timeout
+	options.WriteTimeout = timeout
+
+	client := redis.NewClient(options)
+	if err := client.Ping().Err(); err != nil {
+		_ = client.Close()
+		return nil, err
+	}
+	return client, nil
+}
@@ -0,0 +1,68 @@
+package redisbus
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/lawrencegripper/ion/internal/pkg/common"
+	"github.com/lawrencegripper/ion/internal/pkg/messaging"
+)
+
+var _ messaging.Message = &Message{}
+
+// Message is an entry read from a redis stream by a consumer group
+type Message struct {
+	entryID       string
+	eventID       string
+	body          []byte
+	deliveryCount int
+	subscription  *subscription
+}
+
+// ID gets the ID of the event in the message, or the stream entry ID if it didn't have one
+func (m *Message) ID() string {
+	if m.eventID != "" {
+		return m.eventID
+	}
+	return m.entryID
+}
+
+// DeliveryCount gets the number of times the message has been delivered to the group
+func (m *Message) DeliveryCount() int {
+	return m.deliveryCount
+}
+
+// Body gets the body
+func (m *Message) Body() []byte {
+	return m.body
+}
+
+// Accept acknowledges the message so it's removed from the group's pending entries
+func (m *Message) Accept() error {
+	return m.subscription.ack(m.entryID)
+}
+
+// Reject schedules the message to be claimed again after the delay from the retry policy
+func (m *Message) Reject() error {
+	return m.subscription.scheduleRetry(m.entryID, m.subscription.retryPolicy.Delay(m.DeliveryCount()))
+}
+
+// Release hands the message back to be claimed again straight away. Redis still counts this as a delivery
+func (m *Message) Release() error {
+	return m.subscription.scheduleRetry(m.entryID, 0)
+}
+
+// DeadLetter moves the message to the group's dead letter stream so it isn't retried
+func (m *Message) DeadLetter(reason string) error {
+	return m.subscription.deadLetter(m, reason)
+}
+
+// EventData deserialize json value to type
+func (m *Message) EventData() (common.Event, error) {
+	var event common.Event
+	err := json.Unmarshal(m.body, &event)
+	if err != nil {
+		return event, fmt.Errorf("error unmarshalling event: %+v", err)
+	}
+	return event, nil
+}
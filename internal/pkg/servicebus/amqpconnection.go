@@ -8,6 +8,7 @@ import (
 	"net/url"
 	"os"
 	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -16,15 +17,22 @@ import (
 	"github.com/Azure/go-autorest/autorest/azure"
 	"github.com/Azure/go-autorest/autorest/to"
 	"github.com/lawrencegripper/ion/internal/app/dispatcher/helpers"
+	"github.com/lawrencegripper/ion/internal/pkg/amqpmessage"
+	"github.com/lawrencegripper/ion/internal/pkg/messaging"
 	"github.com/lawrencegripper/ion/internal/pkg/types"
 	"pack.ag/amqp"
 )
 
 const serviceBusRootKeyName = "RootManageSharedAccessKey"
 
+// defaultRuleName is the rule Service Bus creates on every subscription, which by default accepts all messages
+const defaultRuleName = "$Default"
+
 // AmqpConnection provides a connection to service bus and methods for creating required subscriptions and topics
 type AmqpConnection struct {
 	subsClient           *servicebus.SubscriptionsClient
+	topicsClient         *servicebus.TopicsClient
+	rulesClient          *servicebus.RulesClient
 	Endpoint             string
 	SubscriptionName     string
 	SubscriptionAmqpPath string
@@ -35,35 +43,27 @@ type AmqpConnection struct {
 	Receiver             *amqp.Receiver
 	ManagementReceiver   *amqp.Receiver
 	ManagementSender     *amqp.Sender
+	RetrySender          *amqp.Sender
 	getSubscription      func() (servicebus.SBSubscription, error)
 }
 
-// MessageCountDetails is a mirror of the SB SDK object but without pointers and things we don't need so logrus can
-// log the numbers correctly
-type MessageCountDetails struct {
-	// ActiveMessageCount - Number of active messages in the queue, topic, or subscription.
-	ActiveMessageCount int64
-	// DeadLetterMessageCount - Number of messages that are dead lettered.
-	DeadLetterMessageCount int64
-}
-
 // GetQueueDepth returns the current length of the sb queue
-func (l *AmqpConnection) GetQueueDepth() (MessageCountDetails, error) {
+func (l *AmqpConnection) GetQueueDepth() (messaging.QueueDepth, error) {
 	sub, err := l.getSubscription()
 	if err != nil || sub.MessageCount == nil {
-		return MessageCountDetails{}, err
+		return messaging.QueueDepth{}, err
 	}
 
 	details := sub.CountDetails
-	detailsPointerless := MessageCountDetails{}
+	depth := messaging.QueueDepth{}
 	if details.ActiveMessageCount != nil {
-		detailsPointerless.ActiveMessageCount = *details.ActiveMessageCount
+		depth.ActiveMessageCount = *details.ActiveMessageCount
 	}
 	if details.DeadLetterMessageCount != nil {
-		detailsPointerless.DeadLetterMessageCount = *details.DeadLetterMessageCount
+		depth.DeadLetterMessageCount = *details.DeadLetterMessageCount
 	}
 
-	return detailsPointerless, nil
+	return depth, nil
 }
 
 // Todo: Reconsider approach to error handling in this code.
@@ -80,6 +80,17 @@ func NewAmqpConnection(ctx context.Context, config *types.Configuration) *AmqpCo
 	if config.ModuleName == "" {
 		log.Panic("Empty module name not allowed")
 	}
+
+	namespace := connectNamespace(ctx, config)
+	return namespace.subscribe(ctx, config, config.SubscribesToEvent, config.ModuleName)
+}
+
+// connectNamespace opens a session with the servicebus namespace from the configuration and
+// creates the topics for the events it publishes
+func connectNamespace(ctx context.Context, config *types.Configuration) *AmqpConnection {
+	if config == nil {
+		log.Panic("Nil config not allowed")
+	}
 	if config.Job == nil {
 		log.Panic("Job config required")
 	}
@@ -92,12 +103,16 @@ func NewAmqpConnection(ctx context.Context, config *types.Configuration) *AmqpCo
 	subsClient.Authorizer = auth
 	topicsClient := servicebus.NewTopicsClient(config.SubscriptionID)
 	topicsClient.Authorizer = auth
+	rulesClient := servicebus.NewRulesClient(config.SubscriptionID)
+	rulesClient.Authorizer = auth
 	namespaceClient := servicebus.NewNamespacesClient(config.SubscriptionID)
 	namespaceClient.Authorizer = auth
 	groupsClient := resources.NewGroupsClient(config.SubscriptionID)
 	groupsClient.Authorizer = auth
 
 	listener.subsClient = &subsClient
+	listener.topicsClient = &topicsClient
+	listener.rulesClient = &rulesClient
 
 	// Check if resource group exists
 	_, err := groupsClient.Get(ctx, config.ResourceGroup)
@@ -123,23 +138,44 @@ func NewAmqpConnection(ctx context.Context, config *types.Configuration) *AmqpCo
 	listener.AccessKeys = keys
 	listener.AMQPConnectionString = getAmqpConnectionString(*keys.KeyName, *keys.SecondaryKey, *namespace.Name)
 
-	// Check Topic to listen on. Create a topic if missing
-	topic := createTopic(ctx, topicsClient, config, config.SubscribesToEvent)
-	listener.TopicName = strings.ToLower(*topic.Name)
+	if config.EventsPublished != "" {
+		eventsPublished := strings.Split(config.EventsPublished, ",")
+		for _, eventName := range eventsPublished {
+			// Check topic to publish to. Create is missing
+			createTopic(ctx, topicsClient, config, eventName)
+		}
+	}
+
+	listener.Session = createAmqpSession(&listener)
+
+	return &listener
+}
 
-	eventsPublished := strings.Split(config.EventsPublished, ",")
-	for _, eventName := range eventsPublished {
-		// Check topic to publish to. Create is missing
-		createTopic(ctx, topicsClient, config, eventName)
+// subscribe creates the module's subscription to the event type, if missing, and returns a connection
+// receiving from it which shares this connection's session
+func (l *AmqpConnection) subscribe(ctx context.Context, config *types.Configuration, eventType, moduleName string) *AmqpConnection {
+	listener := AmqpConnection{
+		subsClient:           l.subsClient,
+		topicsClient:         l.topicsClient,
+		rulesClient:          l.rulesClient,
+		Endpoint:             l.Endpoint,
+		AccessKeys:           l.AccessKeys,
+		AMQPConnectionString: l.AMQPConnectionString,
+		Session:              l.Session,
 	}
+	subsClient := *l.subsClient
+
+	// Check Topic to listen on. Create a topic if missing
+	topic := createTopic(ctx, *l.topicsClient, config, eventType)
+	listener.TopicName = strings.ToLower(*topic.Name)
 
 	// Check subscription to listen on. Create if missing
-	subName := getSubscriptionName(config.SubscribesToEvent, config.ModuleName)
+	subName := getSubscriptionName(eventType, moduleName)
 	sub, err := subsClient.Get(
 		ctx,
 		config.ResourceGroup,
 		config.ServiceBusNamespace,
-		config.SubscribesToEvent,
+		eventType,
 		subName,
 	)
 	listener.getSubscription = func() (servicebus.SBSubscription, error) {
@@ -147,7 +183,7 @@ func NewAmqpConnection(ctx context.Context, config *types.Configuration) *AmqpCo
 			ctx,
 			config.ResourceGroup,
 			config.ServiceBusNamespace,
-			config.SubscribesToEvent,
+			eventType,
 			subName,
 		)
 	}
@@ -169,7 +205,7 @@ func NewAmqpConnection(ctx context.Context, config *types.Configuration) *AmqpCo
 			ctx,
 			config.ResourceGroup,
 			config.ServiceBusNamespace,
-			config.SubscribesToEvent,
+			eventType,
 			subName,
 			subDef,
 		)
@@ -180,18 +216,63 @@ func NewAmqpConnection(ctx context.Context, config *types.Configuration) *AmqpCo
 		log.WithField("config", types.RedactConfigSecrets(config)).Panicf("Failed getting subscription: %v", err)
 	}
 	listener.SubscriptionName = *sub.Name
-	listener.SubscriptionAmqpPath = getSubscriptionAmqpPath(config.SubscribesToEvent, config.ModuleName)
+	listener.SubscriptionAmqpPath = getSubscriptionAmqpPath(eventType, moduleName)
 
-	listener.Session = createAmqpSession(&listener)
-	listener.Receiver = createAmqpListener(&listener)
-	listener.ManagementSender, listener.ManagementReceiver, err = listener.createAmqpSBManagementChannels(listener.TopicName, config.ModuleName)
+	// Retries are re-enqueued onto the topic so make sure this subscription only receives its own.
+	// This is done even when retry delays aren't enabled as other modules on the topic may have them
+	_, err = l.rulesClient.CreateOrUpdate(
+		ctx,
+		config.ResourceGroup,
+		config.ServiceBusNamespace,
+		eventType,
+		subName,
+		defaultRuleName,
+		servicebus.Rule{
+			Ruleproperties: &servicebus.Ruleproperties{
+				FilterType: servicebus.FilterTypeSQLFilter,
+				SQLFilter: &servicebus.SQLFilter{
+					SQLExpression: to.StringPtr(getRetryFilterExpression(listener.SubscriptionName)),
+				},
+			},
+		},
+	)
+	if err != nil {
+		log.WithField("config", types.RedactConfigSecrets(config)).Panicf("Failed updating subscription rule: %v", err)
+	}
+
+	listener.Receiver = createAmqpListener(&listener, config.Job.MaxConcurrent)
+	listener.ManagementSender, listener.ManagementReceiver, err = listener.createAmqpSBManagementChannels(listener.TopicName, moduleName)
 	if err != nil {
 		log.WithError(err).Error("failed to create management sender, without this renewal of message locks will fail")
 	}
+	if config.Job.RetryInitialDelaySecs > 0 {
+		listener.RetrySender, err = listener.CreateAmqpSender(listener.TopicName)
+		if err != nil {
+			log.WithError(err).Panic("failed to create retry sender")
+		}
+	}
 
 	return &listener
 }
 
+// NewRetrier creates a retrier which re-enqueues failed messages onto the topic after the configured delay.
+// Returns nil when retry delays aren't enabled, so failed messages are abandoned and redelivered immediately
+func (l *AmqpConnection) NewRetrier(config *types.JobConfig) *amqpmessage.Retrier {
+	if l.RetrySender == nil || config.RetryInitialDelaySecs < 1 {
+		return nil
+	}
+	return &amqpmessage.Retrier{
+		Sender: l.RetrySender,
+		Policy: messaging.RetryPolicy{
+			InitialDelay: time.Duration(config.RetryInitialDelaySecs) * time.Second,
+			Multiplier:   config.RetryBackoffMultiplier,
+			MaxDelay:     time.Duration(config.RetryMaxDelaySecs) * time.Second,
+		},
+		MaxRetries:       config.RetryCount,
+		SubscriptionName: l.SubscriptionName,
+	}
+}
+
 func swapIndex(indexOne, indexTwo int, array *[16]byte) {
 	v1 := array[indexOne]
 	array[indexOne] = array[indexTwo]
@@ -298,17 +379,22 @@ func (l *AmqpConnection) createAmqpSBManagementChannels(topic, eventname string)
 	return sender, reciever, nil
 }
 
-func createAmqpListener(listener *AmqpConnection) *amqp.Receiver {
+func createAmqpListener(listener *AmqpConnection, maxConcurrent int) *amqp.Receiver {
 	// Todo: how do we validate that the session is healthy?
 	if listener.Session == nil {
 		log.WithField("currentListener", listener).Panic("Cannot create amqp listener without a session already configured")
 	}
 
-	// Create a receiver
-	receiver, err := listener.Session.NewReceiver(
+	linkOptions := []amqp.LinkOption{
 		amqp.LinkSourceAddress(listener.SubscriptionAmqpPath),
-		// amqp.LinkCredit(10), // Todo: Add config value to define how many inflight tasks the dispatcher can handle
-	)
+	}
+	// Limit the messages the broker will hand us to the number of jobs we can run at once
+	if maxConcurrent > 0 {
+		linkOptions = append(linkOptions, amqp.LinkCredit(uint32(maxConcurrent)))
+	}
+
+	// Create a receiver
+	receiver, err := listener.Session.NewReceiver(linkOptions...)
 	if err != nil {
 		log.Fatal("Creating receiver:", err)
 	}
@@ -371,6 +457,11 @@ func getSubscriptionAmqpPath(eventName, moduleName string) string {
 	return "/" + strings.ToLower(eventName) + "/subscriptions/" + getSubscriptionName(eventName, moduleName)
 }
 
+// getRetryFilterExpression accepts new messages and retries re-enqueued for the given subscription
+func getRetryFilterExpression(subscriptionName string) string {
+	return fmt.Sprintf("%s IS NULL OR %s = '%s'", amqpmessage.RetrySubscriptionProperty, amqpmessage.RetrySubscriptionProperty, subscriptionName)
+}
+
 func getSubscriptionName(eventName, moduleName string) string {
 	return strings.ToLower(eventName) + "_" + strings.ToLower(moduleName)
 }
@@ -10,7 +10,7 @@ import (
 	"pack.ag/amqp"
 
 	"github.com/lawrencegripper/ion/internal/app/dispatcher/helpers"
-	"github.com/lawrencegripper/ion/internal/pkg/messaging"
+	"github.com/lawrencegripper/ion/internal/pkg/amqpmessage"
 	"github.com/lawrencegripper/ion/internal/pkg/types"
 )
 
@@ -82,7 +82,7 @@ func TestIntegrationNewListener(t *testing.T) {
 		t.Error(err)
 	}
 
-	message := messaging.NewAmqpMessageWrapper(amqpMessage)
+	message := amqpmessage.NewWrapper(amqpMessage)
 
 	// SUMMARY: Testing message lock renewal. By default SB messages's locks expire after 1min and the message is requeued
 	// 1. Starts a loop renewing the message lock
@@ -168,7 +168,7 @@ func TestIntegrationRequeueReleasedMessages(t *testing.T) {
 
 	for index := 0; index < 6; index++ {
 		amqpMessage, err := listener.Receiver.Receive(ctx)
-		message := messaging.NewAmqpMessageWrapper(amqpMessage)
+		message := amqpmessage.NewWrapper(amqpMessage)
 		if err != nil {
 			t.Error(err)
 		}
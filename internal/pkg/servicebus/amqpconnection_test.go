@@ -40,3 +40,12 @@ func TestGetSubscriptionAmqpPath(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestGetRetryFilterExpression(t *testing.T) {
+	const expected = `ion_retry_subscription IS NULL OR ion_retry_subscription = 'exampleevent_modulename'`
+	actual := getRetryFilterExpression("exampleevent_modulename")
+	if actual != expected {
+		t.Logf("Got: %s Expected: %s", actual, expected)
+		t.Fail()
+	}
+}
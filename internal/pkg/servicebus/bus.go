@@ -0,0 +1,227 @@
+package servicebus
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lawrencegripper/ion/internal/pkg/amqpmessage"
+	"github.com/lawrencegripper/ion/internal/pkg/common"
+	"github.com/lawrencegripper/ion/internal/pkg/messaging"
+	"github.com/lawrencegripper/ion/internal/pkg/types"
+	log "github.com/sirupsen/logrus"
+	"pack.ag/amqp"
+)
+
+// The handler reads its flags from the environment, with '.' replaced by '_',
+// so the key it publishes with is passed using this environment variable
+const handlerServiceBusKeyEnv = "SERVICEBUSEVENTPROVIDER_KEY"
+
+// senderMaxAge is how long a sender is used before being recreated
+// workaround for issue: https://github.com/lawrencegripper/ion/issues/128
+var senderMaxAge = time.Minute * 9
+
+var _ messaging.MessageBus = &Bus{}
+
+// Bus is the Azure Service Bus implementation of messaging.MessageBus. Event types map to topics
+// and modules to a subscription on the topic named by getSubscriptionName
+type Bus struct {
+	config     *types.Configuration
+	connection *AmqpConnection
+	senders    map[string]*topicSender
+	mu         sync.Mutex
+}
+
+type topicSender struct {
+	sender  *amqp.Sender
+	created time.Time
+}
+
+// NewBus connects to the servicebus namespace from the configuration
+func NewBus(ctx context.Context, config *types.Configuration) *Bus {
+	return &Bus{
+		config:     config,
+		connection: connectNamespace(ctx, config),
+		senders:    map[string]*topicSender{},
+	}
+}
+
+// Subscribe creates the module's subscription to the event type's topic, if needed, and starts receiving from it
+func (b *Bus) Subscribe(ctx context.Context, eventType, moduleName string) (messaging.Subscription, error) {
+	if eventType == "" {
+		return nil, fmt.Errorf("empty event type not allowed")
+	}
+	if moduleName == "" {
+		return nil, fmt.Errorf("empty module name not allowed")
+	}
+	connection := b.connection.subscribe(ctx, b.config, eventType, moduleName)
+	return &subscription{
+		connection: connection,
+		retrier:    connection.NewRetrier(b.config.Job),
+	}, nil
+}
+
+// Publish sends the event to the topic for its type
+func (b *Bus) Publish(ctx context.Context, event common.Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("error marshalling event %+v", err)
+	}
+	sender, err := b.getSender(event.Type)
+	if err != nil {
+		return err
+	}
+	err = sender.Send(ctx, amqp.NewMessage(body))
+	if err != nil {
+		return fmt.Errorf("error publishing event to topic '%s': %+v", event.Type, err)
+	}
+	return nil
+}
+
+// HandlerConfig gets the arguments and secrets the handler needs to publish events to the namespace.
+// No topic is passed as the handler publishes each event to the topic for its type
+func (b *Bus) HandlerConfig() ([]string, map[string]string) {
+	args := []string{
+		"--servicebuseventprovider.enabled=true",
+		"--servicebuseventprovider.namespace=" + b.config.ServiceBusNamespace,
+		"--servicebuseventprovider.authorizationrulename=" + *b.connection.AccessKeys.KeyName,
+	}
+	secrets := map[string]string{
+		handlerServiceBusKeyEnv: *b.connection.AccessKeys.PrimaryKey,
+	}
+	return args, secrets
+}
+
+// Close closes the senders used to publish events
+func (b *Bus) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+	for topic, s := range b.senders {
+		err := s.sender.Close(ctx)
+		if err != nil {
+			log.WithError(err).WithField("topic", topic).Error("failed to close sender")
+		}
+		delete(b.senders, topic)
+	}
+	return nil
+}
+
+// getSender gets the sender for the topic, replacing it if it has been in use longer than senderMaxAge
+func (b *Bus) getSender(topic string) (*amqp.Sender, error) {
+	topic = strings.ToLower(topic)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	existing, ok := b.senders[topic]
+	if ok && time.Since(existing.created) < senderMaxAge {
+		return existing.sender, nil
+	}
+	if ok {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+		err := existing.sender.Close(ctx)
+		cancel()
+		if err != nil {
+			log.WithError(err).Error("failed to close connection to renew link")
+		}
+		delete(b.senders, topic)
+	}
+
+	sender, err := b.connection.CreateAmqpSender(topic)
+	if err != nil {
+		return nil, err
+	}
+	b.senders[topic] = &topicSender{
+		sender:  sender,
+		created: time.Now(),
+	}
+	return sender, nil
+}
+
+// subscription receives messages from a module's servicebus subscription
+type subscription struct {
+	connection *AmqpConnection
+	retrier    *amqpmessage.Retrier
+}
+
+// Receive waits for the next message, rejected messages are retried using the configured retry policy
+func (s *subscription) Receive(ctx context.Context) (messaging.Message, error) {
+	for {
+		message, err := s.connection.Receiver.Receive(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if message == nil {
+			return nil, fmt.Errorf("nil message received")
+		}
+
+		// Messages prefetched while we were at capacity may have lost their lock, the broker
+		// will already be redelivering these so don't run them
+		if lockExpired(message, time.Now()) {
+			log.Warn("message lock expired before it could be dispatched, skipping")
+			continue
+		}
+
+		return amqpmessage.NewWrapperWithRetrier(message, s.retrier), nil
+	}
+}
+
+// RenewLocks renews the locks on messages received from this subscription
+func (s *subscription) RenewLocks(ctx context.Context, messages []messaging.Message) error {
+	messagesAMQP := make([]*amqp.Message, 0, len(messages))
+	for _, m := range messages {
+		amqpMessage, ok := m.(*amqpmessage.Message)
+		if !ok {
+			return fmt.Errorf("message %s wasn't received from servicebus", m.ID())
+		}
+		messagesAMQP = append(messagesAMQP, amqpMessage.GetAMQPMessage())
+	}
+	return s.connection.RenewLocks(ctx, messagesAMQP)
+}
+
+// GetQueueDepth gets the number of active and dead lettered messages on the subscription
+func (s *subscription) GetQueueDepth() (messaging.QueueDepth, error) {
+	return s.connection.GetQueueDepth()
+}
+
+// ReleasePending hands back messages the broker sent us that were never received
+func (s *subscription) ReleasePending() {
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+		message, err := s.connection.Receiver.Receive(ctx)
+		cancel()
+		if err != nil || message == nil {
+			return
+		}
+		err = message.Release()
+		if err != nil {
+			log.WithError(err).Error("failed to release prefetched message")
+		}
+	}
+}
+
+// Close stops receiving from the subscription. Messages which haven't been settled will be redelivered
+func (s *subscription) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	return s.connection.Receiver.Close(ctx)
+}
+
+// lockExpired checks the ServiceBus lock annotation to see if the message lock has passed
+func lockExpired(m *amqp.Message, now time.Time) bool {
+	expires, ok := m.Annotations["x-opt-locked-until"]
+	if !ok {
+		return false
+	}
+	lockedUntil, ok := expires.(time.Time)
+	if !ok {
+		return false
+	}
+	return lockedUntil.Before(now)
+}
@@ -0,0 +1,71 @@
+package servicebus
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/servicebus/mgmt/2017-04-01/servicebus"
+	"github.com/lawrencegripper/ion/internal/pkg/types"
+	"pack.ag/amqp"
+)
+
+func TestLockExpired(t *testing.T) {
+	now := time.Now()
+	testCases := []struct {
+		name     string
+		message  *amqp.Message
+		expected bool
+	}{
+		{
+			name:     "noannotation",
+			message:  &amqp.Message{},
+			expected: false,
+		},
+		{
+			name: "lockvalid",
+			message: &amqp.Message{
+				Annotations: amqp.Annotations{"x-opt-locked-until": now.Add(time.Minute)},
+			},
+			expected: false,
+		},
+		{
+			name: "lockexpired",
+			message: &amqp.Message{
+				Annotations: amqp.Annotations{"x-opt-locked-until": now.Add(-time.Minute)},
+			},
+			expected: true,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			if actual := lockExpired(test.message, now); actual != test.expected {
+				t.Errorf("lockExpired incorrect Expected: %v Got: %v", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestHandlerConfigDoesNotPassTopic(t *testing.T) {
+	keyName, key := "rule", "secret"
+	bus := &Bus{
+		config: &types.Configuration{
+			ServiceBusNamespace: "namespace",
+			SubscribesToEvent:   "page_downloaded,title_found",
+		},
+		connection: &AmqpConnection{
+			AccessKeys: servicebus.AccessKeys{KeyName: &keyName, PrimaryKey: &key},
+		},
+	}
+	args, secrets := bus.HandlerConfig()
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "--servicebuseventprovider.topic") {
+			t.Errorf("expected no topic argument as events are published to the topic for their type, got %s", arg)
+		}
+	}
+	if secrets[handlerServiceBusKeyEnv] != key {
+		t.Errorf("expected access key secret got %s", secrets[handlerServiceBusKeyEnv])
+	}
+}
@@ -0,0 +1,128 @@
+package servicebus
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lawrencegripper/ion/internal/pkg/amqpmessage"
+	"github.com/lawrencegripper/ion/internal/pkg/common"
+	"pack.ag/amqp"
+)
+
+// cSpell:ignore deadletterqueue
+
+const (
+	// Service Bus records why a message was dead lettered in these application properties
+	deadLetterReasonProperty      = "DeadLetterReason"
+	deadLetterDescriptionProperty = "DeadLetterErrorDescription"
+)
+
+// Receiver receives messages from a queue, it's satisfied by *amqp.Receiver
+type Receiver interface {
+	Receive(ctx context.Context) (*amqp.Message, error)
+}
+
+// DeadLetter is a message received from a subscription's dead letter queue
+type DeadLetter struct {
+	*amqp.Message
+}
+
+// ID gets the message ID, which is the ID of the event it holds
+func (d *DeadLetter) ID() string {
+	if d.Properties == nil || d.Properties.MessageID == nil {
+		return ""
+	}
+	return fmt.Sprintf("%v", d.Properties.MessageID)
+}
+
+// Reason gets why the message was dead lettered, along with any description given
+func (d *DeadLetter) Reason() string {
+	reason := d.applicationProperty(deadLetterReasonProperty)
+	description := d.applicationProperty(deadLetterDescriptionProperty)
+	if description == "" {
+		return reason
+	}
+	if reason == "" {
+		return description
+	}
+	return reason + ": " + description
+}
+
+// DeliveryCount gets how many times the message was delivered before being dead lettered
+func (d *DeadLetter) DeliveryCount() int {
+	return amqpmessage.NewWrapper(d.Message).DeliveryCount()
+}
+
+// Event decodes the event held in the message
+func (d *DeadLetter) Event() (common.Event, error) {
+	var event common.Event
+	if err := json.Unmarshal(d.GetData(), &event); err != nil {
+		return event, fmt.Errorf("error decoding event: %+v", err)
+	}
+	return event, nil
+}
+
+func (d *DeadLetter) applicationProperty(key string) string {
+	if d.ApplicationProperties == nil {
+		return ""
+	}
+	value, ok := d.ApplicationProperties[key]
+	if !ok || value == nil {
+		return ""
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+// GetDeadLetterAmqpPath gets the address of the dead letter queue of the module's subscription to the event
+func GetDeadLetterAmqpPath(eventName, moduleName string) string {
+	return getSubscriptionAmqpPath(eventName, moduleName) + "/$deadletterqueue"
+}
+
+// ReceiveDeadLetters receives up to max messages from a dead letter queue, or every message when max is 0.
+// Receiving stops once no message arrives for idleTimeout. The messages stay locked until the caller settles
+// them, so each one is only received once
+func ReceiveDeadLetters(ctx context.Context, receiver Receiver, max int, idleTimeout time.Duration) ([]*DeadLetter, error) {
+	var deadLetters []*DeadLetter
+	for max < 1 || len(deadLetters) < max {
+		receiveCtx, cancel := context.WithTimeout(ctx, idleTimeout)
+		message, err := receiver.Receive(receiveCtx)
+		cancel()
+		if err != nil {
+			if ctx.Err() == nil && receiveCtx.Err() == context.DeadlineExceeded {
+				break // The queue has no more messages
+			}
+			return deadLetters, fmt.Errorf("error receiving dead lettered message: %+v", err)
+		}
+		if message == nil {
+			break
+		}
+		deadLetters = append(deadLetters, &DeadLetter{Message: message})
+	}
+	return deadLetters, nil
+}
+
+// NewReplayMessage copies a dead lettered message so it can be sent to the event's topic again. The copy is only
+// delivered to the module's subscription, and is treated as having been attempted deliveryCount times already.
+// A deliveryCount below 0 keeps the attempts recorded on the message
+func NewReplayMessage(deadLetter *DeadLetter, eventName, moduleName string, deliveryCount int) *amqp.Message {
+	replay := &amqp.Message{
+		Data:                  deadLetter.Data,
+		Value:                 deadLetter.Value,
+		Properties:            deadLetter.Properties,
+		ApplicationProperties: map[string]interface{}{},
+	}
+	for key, value := range deadLetter.ApplicationProperties {
+		if strings.HasPrefix(key, "DeadLetter") {
+			continue
+		}
+		replay.ApplicationProperties[key] = value
+	}
+	replay.ApplicationProperties[amqpmessage.RetrySubscriptionProperty] = getSubscriptionName(eventName, moduleName)
+	if deliveryCount >= 0 {
+		replay.ApplicationProperties[amqpmessage.RetryAttemptsProperty] = int64(deliveryCount)
+	}
+	return replay
+}
@@ -0,0 +1,116 @@
+package servicebus
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/lawrencegripper/ion/internal/pkg/amqpmessage"
+	"pack.ag/amqp"
+)
+
+// queueReceiver returns its messages then blocks until the context is done, like an empty queue
+type queueReceiver struct {
+	messages []*amqp.Message
+}
+
+func (r *queueReceiver) Receive(ctx context.Context) (*amqp.Message, error) {
+	if len(r.messages) > 0 {
+		message := r.messages[0]
+		r.messages = r.messages[1:]
+		return message, nil
+	}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func newDeadLetterMessage(id string) *amqp.Message {
+	return &amqp.Message{
+		Data:       [][]byte{[]byte(`{"context":{"eventId":"` + id + `"},"type":"face_detected"}`)},
+		Properties: &amqp.MessageProperties{MessageID: id},
+		Header:     &amqp.MessageHeader{DeliveryCount: 2},
+		ApplicationProperties: map[string]interface{}{
+			deadLetterReasonProperty:              "ion:permanent-failure",
+			deadLetterDescriptionProperty:         "unsupported file format",
+			amqpmessage.RetryAttemptsProperty:     int64(3),
+			amqpmessage.RetrySubscriptionProperty: "face_detected_other",
+			"custom":                              "value",
+		},
+	}
+}
+
+func TestGetDeadLetterAmqpPath(t *testing.T) {
+	const expected = `/exampleevent/subscriptions/exampleevent_modulename/$deadletterqueue`
+	actual := GetDeadLetterAmqpPath("exampleEvent", "moduleName")
+	if actual != expected {
+		t.Errorf("Got: %s Expected: %s", actual, expected)
+	}
+}
+
+func TestDeadLetterDetails(t *testing.T) {
+	deadLetter := &DeadLetter{Message: newDeadLetterMessage("event1")}
+
+	if deadLetter.ID() != "event1" {
+		t.Errorf("expected ID event1 got %s", deadLetter.ID())
+	}
+	if deadLetter.Reason() != "ion:permanent-failure: unsupported file format" {
+		t.Errorf("expected reason and description got %s", deadLetter.Reason())
+	}
+	if deadLetter.DeliveryCount() != 5 {
+		t.Errorf("expected delivery count including retries of 5 got %d", deadLetter.DeliveryCount())
+	}
+	event, err := deadLetter.Event()
+	if err != nil || event.Context.EventID != "event1" {
+		t.Errorf("expected event to be decoded got %+v %+v", event, err)
+	}
+}
+
+func TestReceiveDeadLettersStopsWhenQueueIsEmpty(t *testing.T) {
+	receiver := &queueReceiver{messages: []*amqp.Message{newDeadLetterMessage("1"), newDeadLetterMessage("2")}}
+
+	deadLetters, err := ReceiveDeadLetters(context.Background(), receiver, 0, time.Millisecond*20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deadLetters) != 2 {
+		t.Errorf("expected 2 dead letters got %d", len(deadLetters))
+	}
+}
+
+func TestReceiveDeadLettersStopsAtMax(t *testing.T) {
+	receiver := &queueReceiver{messages: []*amqp.Message{newDeadLetterMessage("1"), newDeadLetterMessage("2")}}
+
+	deadLetters, err := ReceiveDeadLetters(context.Background(), receiver, 1, time.Millisecond*20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deadLetters) != 1 || len(receiver.messages) != 1 {
+		t.Errorf("expected only 1 dead letter to be received got %d", len(deadLetters))
+	}
+}
+
+func TestNewReplayMessage(t *testing.T) {
+	deadLetter := &DeadLetter{Message: newDeadLetterMessage("event1")}
+
+	replay := NewReplayMessage(deadLetter, "face_detected", "classifier", -1)
+	if replay.Properties.MessageID != "event1" || string(replay.GetData()) != string(deadLetter.GetData()) {
+		t.Errorf("expected replay to carry the original event got %+v", replay)
+	}
+	if _, exists := replay.ApplicationProperties[deadLetterReasonProperty]; exists {
+		t.Error("expected dead letter reason to be removed")
+	}
+	if replay.ApplicationProperties["custom"] != "value" {
+		t.Error("expected other properties to be kept")
+	}
+	if replay.ApplicationProperties[amqpmessage.RetrySubscriptionProperty] != "face_detected_classifier" {
+		t.Errorf("expected replay to only go to the module's subscription got %v", replay.ApplicationProperties[amqpmessage.RetrySubscriptionProperty])
+	}
+	if replay.ApplicationProperties[amqpmessage.RetryAttemptsProperty] != int64(3) {
+		t.Errorf("expected attempts to be kept got %v", replay.ApplicationProperties[amqpmessage.RetryAttemptsProperty])
+	}
+
+	replay = NewReplayMessage(deadLetter, "face_detected", "classifier", 0)
+	if replay.ApplicationProperties[amqpmessage.RetryAttemptsProperty] != int64(0) {
+		t.Errorf("expected attempts to be reset got %v", replay.ApplicationProperties[amqpmessage.RetryAttemptsProperty])
+	}
+}
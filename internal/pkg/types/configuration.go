@@ -1,5 +1,7 @@
 package types
 
+import "strings"
+
 const redacted = "****"
 
 // Configuration for the application
@@ -22,6 +24,23 @@ type Configuration struct {
 	Job                 *JobConfig        `yaml:"job"`
 	Handler             *HandlerConfig    `yaml:"handler"`
 	AzureBatch          *AzureBatchConfig `yaml:"azurebatch"`
+	Local               *LocalConfig      `yaml:"local"`
+	AMQP                *AMQPConfig       `yaml:"amqp"`
+	NATS                *NATSConfig       `yaml:"nats"`
+	Redis               *RedisConfig      `yaml:"redis"`
+}
+
+// SubscribedEvents gets the events the module subscribes to. A module subscribing to more than one
+// event is only dispatched once each of them has arrived for a correlation
+func (c *Configuration) SubscribedEvents() []string {
+	var events []string
+	for _, event := range strings.Split(c.SubscribesToEvent, ",") {
+		event = strings.TrimSpace(event)
+		if event != "" {
+			events = append(events, event)
+		}
+	}
+	return events
 }
 
 // JobConfig configures the information about the jobs which will be run
@@ -31,12 +50,27 @@ type JobConfig struct {
 	WorkerImage        string `yaml:"workerimage"`
 	HandlerImage       string `yaml:"handlerimage"`
 	PullAlways         bool   `yaml:"pullalways"`
+	MaxConcurrent      int    `yaml:"maxconcurrent"`
+	// Delay before a failed job is retried, grows by RetryBackoffMultiplier for each retry up to RetryMaxDelaySecs.
+	// A RetryInitialDelaySecs of 0 retries immediately
+	RetryInitialDelaySecs  int     `yaml:"retryinitialdelaysecs"`
+	RetryBackoffMultiplier float64 `yaml:"retrybackoffmultiplier"`
+	RetryMaxDelaySecs      int     `yaml:"retrymaxdelaysecs"`
+	// How long to wait for in-flight jobs to finish when shutting down before releasing their messages
+	DrainTimeoutSecs int `yaml:"draintimeoutsecs"`
+	// How long the handler's record of a module processing an event is used to skip the event if it's
+	// delivered again. A DedupWindowMins of 0 dispatches every delivery
+	DedupWindowMins int `yaml:"dedupwindowmins"`
+	// How long a module subscribing to several events waits for all of them to arrive for a correlation
+	// before giving up on it. A JoinTimeoutMins of 0 waits indefinitely
+	JoinTimeoutMins int `yaml:"jointimeoutmins"`
 }
 
 // HandlerConfig configures the information about the jobs which will be run
 type HandlerConfig struct {
 	ServerPort                     int              `yaml:"serverport"`
 	AzureBlobStorageProvider       *AzureBlobConfig `yaml:"azureblobprovider"`
+	S3BlobStorageProvider          *S3Config        `yaml:"s3provider"`
 	MongoDBDocumentStorageProvider *MongoDBConfig   `yaml:"mongodbdocprovider"`
 	PrintConfig                    bool             `yaml:"printconfig"`
 }
@@ -53,7 +87,18 @@ type MongoDBConfig struct {
 type AzureBlobConfig struct {
 	BlobAccountName string `yaml:"blobaccountname"`
 	BlobAccountKey  string `yaml:"blobaccountkey"`
-	UseProxy        bool   `yaml:"useproxy"`
+	// Endpoint of the account's blob service, the Azure public cloud is used when empty
+	Endpoint string `yaml:"endpoint"`
+}
+
+// S3Config is configuration required to setup an S3 compatible blob store in place of Azure Blob Storage
+type S3Config struct {
+	Endpoint        string `yaml:"endpoint"`
+	Region          string `yaml:"region"`
+	Bucket          string `yaml:"bucket"`
+	AccessKeyID     string `yaml:"accesskeyid"`
+	SecretAccessKey string `yaml:"secretaccesskey"`
+	UsePathStyle    bool   `yaml:"usepathstyle"`
 }
 
 // AzureBatchConfig - Basic azure config used to interact with ARM resources.
@@ -74,6 +119,54 @@ type AzureBatchConfig struct {
 type KubernetesConfig struct {
 	Namespace           string `yaml:"namespace"`
 	ImagePullSecretName string `yaml:"imagepullsecretname"`
+	// Worker container resources, as k8s quantities e.g. 500m or 1Gi
+	CPURequest    string `yaml:"cpurequest"`
+	CPULimit      string `yaml:"cpulimit"`
+	MemoryRequest string `yaml:"memoryrequest"`
+	MemoryLimit   string `yaml:"memorylimit"`
+	GPUCount      int    `yaml:"gpucount"`
+	// NodeSelector entries in the form key=value
+	NodeSelector []string `yaml:"nodeselector"`
+	// Tolerations in the form key[=value]:effect, as used by kubectl taint
+	Tolerations []string `yaml:"tolerations"`
+	// Affinity is a JSON encoded k8s affinity for the job's pod
+	Affinity           string `yaml:"affinity"`
+	ServiceAccountName string `yaml:"serviceaccountname"`
+}
+
+// LocalConfig - config used to run jobs as processes on the dispatcher's machine.
+type LocalConfig struct {
+	Enabled       bool     `yaml:"enabled"`
+	HandlerBinary string   `yaml:"handlerbinary"`
+	WorkerBinary  string   `yaml:"workerbinary"`
+	WorkerArgs    []string `yaml:"workerargs"`
+	BaseDir       string   `yaml:"basedir"`
+}
+
+// AMQPConfig - config used to exchange events through a generic AMQP 1.0 broker rather than Azure Service Bus.
+type AMQPConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// ConnectionString in the form amqp[s]://user:password@host:port
+	ConnectionString string `yaml:"connectionstring"`
+	// Address events are sent to, {topic} is replaced with the event type
+	TopicAddress string `yaml:"topicaddress"`
+	// Address a module receives from, {topic} and {subscription} are replaced with the
+	// event type and the module's subscription name
+	SubscriptionAddress string `yaml:"subscriptionaddress"`
+}
+
+// NATSConfig - config used to exchange events through NATS JetStream rather than Azure Service Bus.
+type NATSConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// URL in the form nats://[user:password@]host:port, the tls scheme requires TLS
+	URL string `yaml:"url"`
+}
+
+// RedisConfig - config used to exchange events through Redis Streams rather than Azure Service Bus.
+type RedisConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// URL in the form redis://[[user]:password@]host:port[/db], the rediss scheme uses TLS
+	URL string `yaml:"url"`
 }
 
 // RedactConfigSecrets strips sensitive data from the config
@@ -84,6 +177,28 @@ func RedactConfigSecrets(config *Configuration) Configuration {
 		c.ClientSecret = redacted
 		c.TenantID = redacted
 		c.SubscriptionID = redacted
+		if c.AMQP != nil {
+			amqpConfig := *c.AMQP
+			amqpConfig.ConnectionString = redacted
+			c.AMQP = &amqpConfig
+		}
+		if c.NATS != nil {
+			natsConfig := *c.NATS
+			natsConfig.URL = redacted
+			c.NATS = &natsConfig
+		}
+		if c.Redis != nil {
+			redisConfig := *c.Redis
+			redisConfig.URL = redacted
+			c.Redis = &redisConfig
+		}
+		if c.Handler != nil && c.Handler.S3BlobStorageProvider != nil {
+			handlerConfig := *c.Handler
+			s3Config := *c.Handler.S3BlobStorageProvider
+			s3Config.SecretAccessKey = redacted
+			handlerConfig.S3BlobStorageProvider = &s3Config
+			c.Handler = &handlerConfig
+		}
 	}
 	return c
 }